@@ -0,0 +1,29 @@
+package proto
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strings"
+)
+
+const (
+	// ChallengeRecordPrefix is the prefix of the TXT record name
+	// eg: _opennotr-challenge.api.example.com
+	ChallengeRecordPrefix = "_opennotr-challenge"
+)
+
+// DomainChallenge returns the token which proves the owner of key
+// controls domain. Both the client and server can compute it.
+func DomainChallenge(key, domain string) string {
+	domain = strings.TrimSuffix(strings.ToLower(domain), ".")
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write([]byte(domain))
+	return hex.EncodeToString(mac.Sum(nil))[:32]
+}
+
+// ChallengeRecord returns the TXT record name of domain
+func ChallengeRecord(domain string) string {
+	return fmt.Sprintf("%s.%s", ChallengeRecordPrefix, strings.TrimSuffix(domain, "."))
+}
@@ -19,9 +19,22 @@ type S2CHeartbeat struct {
 type C2SHeartbeat struct{}
 
 type C2SAuth struct {
-	Key     string        `json:"key" yaml:"key"`
-	Domain  string        `json:"domain" yaml:"domain"`
-	Forward []ForwardItem `json:"forwards" yaml:"forwards"` // request forwards, not real, it depends on opennotrd
+	Key    string `json:"key" yaml:"key"`
+	Domain string `json:"domain" yaml:"domain"`
+
+	// BaseDomain picks one of the server base domains
+	// empty means server default
+	BaseDomain string `json:"baseDomain" yaml:"baseDomain"`
+
+	// ClientID identifies the client of the same key
+	// it is used to generate stable domain
+	ClientID string        `json:"clientID" yaml:"clientID"`
+	Forward  []ForwardItem `json:"forwards" yaml:"forwards"` // request forwards, not real, it depends on opennotrd
+
+	// Partial accepts partial success of forwards
+	// failed forwards are replied with Error of ProxyTuple
+	// otherwise any failed forward fails the authorization
+	Partial bool `json:"partial" yaml:"partial"`
 }
 
 type ForwardItem struct {
@@ -39,19 +52,28 @@ type ForwardItem struct {
 	LocalIP string `json:"localIP" yaml:"localIP"`
 
 	// raw config pass to server
+	// it is the JSON of Options if Options is configured
 	RawConfig string `json:"rawConfig" yaml:"rawConfig"`
+
+	// Options specific per forward options of the plugin in YAML
+	// eg: auth, rewrite of http, the server validates them
+	Options interface{} `json:"-" yaml:"options"`
 }
 
 type S2CAuth struct {
 	Domain     string        `json:"domain"`     // uniq domain for opennotr
 	Vip        string        `json:"vip"`        // vip for opennotr
 	ProxyInfos []*ProxyTuple `json:"proxyInfos"` // real proxy table
+	Error      string        `json:"error,omitempty"`
 }
 
 type ProxyTuple struct {
 	Protocol string
 	FromPort string
 	ToPort   string
+
+	// Error is the reason of failed forward, only for partial success
+	Error string `json:",omitempty"`
 }
 
 type ProxyProtocol struct {
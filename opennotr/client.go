@@ -15,20 +15,26 @@ import (
 )
 
 type Client struct {
-	srv      string
-	key      string
-	domain   string
-	forwards []proto.ForwardItem
-	udppool  sync.Pool
-	tcppool  sync.Pool
+	srv        string
+	key        string
+	domain     string
+	baseDomain string
+	clientID   string
+	forwards   []proto.ForwardItem
+	partial    bool
+	udppool    sync.Pool
+	tcppool    sync.Pool
 }
 
 func NewClient(cfg *Config) *Client {
 	return &Client{
-		srv:      cfg.ServerAddr,
-		key:      cfg.Key,
-		domain:   cfg.Domain,
-		forwards: cfg.Forwards,
+		srv:        cfg.ServerAddr,
+		key:        cfg.Key,
+		domain:     cfg.Domain,
+		baseDomain: cfg.BaseDomain,
+		clientID:   cfg.ClientID,
+		forwards:   cfg.Forwards,
+		partial:    cfg.Partial,
 		tcppool: sync.Pool{
 			New: func() interface{} {
 				return make([]byte, 4096)
@@ -52,9 +58,12 @@ func (c *Client) Run() {
 		}
 
 		c2sauth := &proto.C2SAuth{
-			Key:     c.key,
-			Domain:  c.domain,
-			Forward: c.forwards,
+			Key:        c.key,
+			Domain:     c.domain,
+			BaseDomain: c.baseDomain,
+			ClientID:   c.clientID,
+			Forward:    c.forwards,
+			Partial:    c.partial,
 		}
 
 		err = proto.WriteJSON(conn, proto.CmdAuth, c2sauth)
@@ -72,6 +81,16 @@ func (c *Client) Run() {
 			continue
 		}
 
+		if len(auth.Error) > 0 {
+			log.Println("authorize fail:", auth.Error)
+			for _, item := range auth.ProxyInfos {
+				log.Printf("%s forward to 127.0.0.1:%s fail: %s\n", item.Protocol, item.ToPort, item.Error)
+			}
+			conn.Close()
+			time.Sleep(time.Second * 3)
+			continue
+		}
+
 		log.Println("connect success")
 		log.Println("vhost:", auth.Vip)
 		log.Println("domain:", auth.Domain)
@@ -80,6 +99,12 @@ func (c *Client) Run() {
 			if len(item.FromPort) == 0 {
 				fromaddr = auth.Domain
 			}
+
+			if len(item.Error) > 0 {
+				// failed forwards of partial success
+				log.Printf("%s://%s => 127.0.0.1:%s fail: %s\n", item.Protocol, fromaddr, item.ToPort, item.Error)
+				continue
+			}
 			log.Printf("%s://%s => 127.0.0.1:%s\n", item.Protocol, fromaddr, item.ToPort)
 		}
 
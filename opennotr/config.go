@@ -2,7 +2,9 @@ package main
 
 import (
 	"encoding/json"
+	"fmt"
 	"io/ioutil"
+	"os"
 
 	"github.com/ICKelin/opennotr/internal/proto"
 	"gopkg.in/yaml.v2"
@@ -12,7 +14,12 @@ type Config struct {
 	ServerAddr string              `yaml:"serverAddr"`
 	Key        string              `yaml:"key"`
 	Domain     string              `yaml:"domain"`
+	BaseDomain string              `yaml:"baseDomain"`
+	ClientID   string              `yaml:"clientID"`
 	Forwards   []proto.ForwardItem `yaml:"forwards"`
+
+	// Partial keeps the session if some forwards fail
+	Partial bool `yaml:"partial"`
 }
 
 func ParseConfig(path string) (*Config, error) {
@@ -23,7 +30,52 @@ func ParseConfig(path string) (*Config, error) {
 
 	var cfg Config
 	err = yaml.Unmarshal(cnt, &cfg)
-	return &cfg, err
+	if err != nil {
+		return nil, err
+	}
+
+	// client id is used by server to generate stable domain
+	if len(cfg.ClientID) <= 0 {
+		cfg.ClientID, _ = os.Hostname()
+	}
+
+	// options are passed to server as rawConfig
+	for i := range cfg.Forwards {
+		forward := &cfg.Forwards[i]
+		if forward.Options == nil {
+			continue
+		}
+
+		if len(forward.RawConfig) > 0 {
+			return nil, fmt.Errorf("forwards[%d]: options and rawConfig are exclusive", i)
+		}
+
+		raw, err := json.Marshal(jsonValue(forward.Options))
+		if err != nil {
+			return nil, fmt.Errorf("forwards[%d].options: %v", i, err)
+		}
+		forward.RawConfig = string(raw)
+	}
+	return &cfg, nil
+}
+
+// jsonValue converts maps decoded from YAML to JSON objects
+func jsonValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[interface{}]interface{}:
+		obj := make(map[string]interface{}, len(v))
+		for k, e := range v {
+			obj[fmt.Sprint(k)] = jsonValue(e)
+		}
+		return obj
+	case []interface{}:
+		for i, e := range v {
+			v[i] = jsonValue(e)
+		}
+		return v
+	default:
+		return v
+	}
 }
 
 func (c *Config) String() string {
@@ -2,11 +2,15 @@ package main
 
 import (
 	"flag"
+	"fmt"
 	"log"
+
+	"github.com/ICKelin/opennotr/internal/proto"
 )
 
 func main() {
 	confpath := flag.String("conf", "", "config file path")
+	challenge := flag.Bool("challenge", false, "print custom domain verification records and exit")
 	flag.Parse()
 
 	cfg, err := ParseConfig(*confpath)
@@ -15,6 +19,12 @@ func main() {
 		return
 	}
 
+	if *challenge {
+		token := proto.DomainChallenge(cfg.Key, cfg.Domain)
+		fmt.Printf("TXT record: %s %s\n", proto.ChallengeRecord(cfg.Domain), token)
+		return
+	}
+
 	cli := NewClient(cfg)
 	cli.Run()
 }
@@ -0,0 +1,123 @@
+// Package admin provides opennotrd admin api
+// modules register their handlers by Handle/HandleFunc
+package admin
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/ICKelin/opennotr/opennotrd/certs"
+	"github.com/ICKelin/opennotr/opennotrd/plugin"
+)
+
+var mux = http.NewServeMux()
+
+func init() {
+	HandleFunc("/api/v1/certs", listCerts)
+	HandleFunc("/api/v1/proxies", listProxies)
+}
+
+type Config struct {
+	// Listen specific admin api listen address
+	// eg: 127.0.0.1:10101, empty means disabled
+	Listen string `yaml:"listen"`
+
+	// Token authorizes requests by "Authorization: Bearer $token",
+	// browsers use it as the password of basic auth. The api exposes
+	// recorded requests of clients, so token is required unless
+	// listen is a loopback address
+	Token string `yaml:"token"`
+}
+
+// Check checks the api is not exposed to the network without token
+func (c Config) Check() error {
+	if len(c.Listen) <= 0 || len(c.Token) > 0 {
+		return nil
+	}
+
+	host, _, err := net.SplitHostPort(c.Listen)
+	if err != nil {
+		return err
+	}
+
+	if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+		return fmt.Errorf("token is required to listen on %s", c.Listen)
+	}
+	return nil
+}
+
+// Handle registers handler for pattern
+func Handle(pattern string, handler http.Handler) {
+	mux.Handle(pattern, handler)
+}
+
+// HandleFunc registers handler function for pattern
+func HandleFunc(pattern string, handler func(http.ResponseWriter, *http.Request)) {
+	mux.HandleFunc(pattern, handler)
+}
+
+// Handler returns the admin api handler
+func Handler() http.Handler {
+	return mux
+}
+
+func ListenAndServe(cfg Config) error {
+	err := cfg.Check()
+	if err != nil {
+		return err
+	}
+	return http.ListenAndServe(cfg.Listen, authorize(cfg.Token, mux))
+}
+
+// authorize requires token of requests, empty token allows all
+func authorize(token string, h http.Handler) http.Handler {
+	if len(token) <= 0 {
+		return h
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if _, password, ok := r.BasicAuth(); ok {
+			got = password
+		}
+
+		if subtle.ConstantTimeCompare([]byte(got), []byte(token)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Basic realm="opennotrd"`)
+			WriteError(w, http.StatusUnauthorized, fmt.Errorf("unauthorized"))
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// WriteJSON replies v as json body
+func WriteJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
+
+// WriteError replies error message as json body
+func WriteError(w http.ResponseWriter, code int, err error) {
+	WriteJSON(w, code, map[string]string{"error": err.Error()})
+}
+
+func listCerts(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	WriteJSON(w, http.StatusOK, certs.List())
+}
+
+func listProxies(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	WriteJSON(w, http.StatusOK, plugin.DefaultPluginManager().Proxies())
+}
@@ -0,0 +1,148 @@
+package admin
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/ICKelin/opennotr/opennotrd/certs"
+	"github.com/ICKelin/opennotr/opennotrd/plugin"
+)
+
+func TestListCerts(t *testing.T) {
+	srv := httptest.NewServer(Handler())
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL + "/api/v1/certs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200, got %d", resp.StatusCode)
+	}
+
+	infos := make([]certs.CertInfo, 0)
+	err = json.NewDecoder(resp.Body).Decode(&infos)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err = http.Post(srv.URL+"/api/v1/certs", "application/json", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Fatalf("expected 405, got %d", resp.StatusCode)
+	}
+}
+
+type statsPlugin struct{}
+
+func (p *statsPlugin) Setup(ctx context.Context, cfg json.RawMessage) error { return nil }
+
+func (p *statsPlugin) RunProxy(ctx context.Context, item *plugin.PluginMeta) (plugin.Proxy, error) {
+	proxy := plugin.NewProxy(&plugin.ProxyTuple{Protocol: item.Protocol, ToPort: "80"}, nil)
+	proxy.ConnOpen()
+	proxy.AddIn(10)
+	proxy.AddOut(20)
+	proxy.SetHealth(errors.New("dial fail"))
+	return proxy, nil
+}
+
+func TestListProxies(t *testing.T) {
+	plugin.RegisterV2("admin_test", &statsPlugin{})
+	err := plugin.Setup(map[string]string{"admin_test": `{}`})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	item := &plugin.PluginMeta{Protocol: "admin_test", To: "100.64.240.10:80", Domain: "a.notr.tech"}
+	mgr := plugin.DefaultPluginManager()
+	_, err = mgr.AddProxy(item)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mgr.DelProxy(item)
+
+	rec := httptest.NewRecorder()
+	Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/v1/proxies", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", rec.Code)
+	}
+
+	var list []*plugin.ProxyStatus
+	err = json.Unmarshal(rec.Body.Bytes(), &list)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(list) != 1 {
+		t.Fatalf("expected 1 proxy, got %s", rec.Body.String())
+	}
+
+	s := list[0]
+	if s.Domain != item.Domain || s.ToPort != "80" || s.Health != "dial fail" {
+		t.Errorf("unexpected status %+v", s)
+	}
+
+	if s.Stats.Conns != 1 || s.Stats.BytesIn != 10 || s.Stats.BytesOut != 20 {
+		t.Errorf("unexpected stats %+v", s.Stats)
+	}
+}
+
+func TestAuthorize(t *testing.T) {
+	srv := httptest.NewServer(authorize("secret", Handler()))
+	defer srv.Close()
+
+	get := func(set func(r *http.Request)) int {
+		req, _ := http.NewRequest(http.MethodGet, srv.URL+"/api/v1/certs", nil)
+		set(req)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	tests := []struct {
+		name   string
+		set    func(r *http.Request)
+		expect int
+	}{
+		{"no token", func(r *http.Request) {}, http.StatusUnauthorized},
+		{"wrong token", func(r *http.Request) { r.Header.Set("Authorization", "Bearer wrong") }, http.StatusUnauthorized},
+		{"bearer", func(r *http.Request) { r.Header.Set("Authorization", "Bearer secret") }, http.StatusOK},
+		{"basic", func(r *http.Request) { r.SetBasicAuth("admin", "secret") }, http.StatusOK},
+	}
+	for _, tt := range tests {
+		if code := get(tt.set); code != tt.expect {
+			t.Errorf("%s: expected %d, got %d", tt.name, tt.expect, code)
+		}
+	}
+}
+
+func TestConfigCheck(t *testing.T) {
+	tests := map[Config]bool{
+		{}:                                    true,
+		{Listen: "127.0.0.1:10101"}:           true,
+		{Listen: "[::1]:10101"}:               true,
+		{Listen: "localhost:10101"}:           true,
+		{Listen: ":10101"}:                    false,
+		{Listen: "0.0.0.0:10101"}:             false,
+		{Listen: "0.0.0.0:10101", Token: "x"}: true,
+	}
+
+	for cfg, valid := range tests {
+		err := cfg.Check()
+		if (err == nil) != valid {
+			t.Errorf("%+v: expected valid %v, got %v", cfg, valid, err)
+		}
+	}
+}
@@ -0,0 +1,592 @@
+package certs
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ICKelin/opennotr/internal/logs"
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+var (
+	// default certificate cache dir
+	defaultCacheDir = "acme"
+
+	// default renew certificates before expire(days)
+	defaultRenewBefore = 30
+
+	// default wait for dns-01 record propagation(seconds)
+	defaultDNSWait = 5
+
+	// wildcard certificates check interval
+	wildcardCheckInterval = time.Hour
+
+	// acme http-01 challenge path prefix
+	httpChallengePrefix = "/.well-known/acme-challenge/"
+)
+
+// ACMEConfig configures the acme client
+type ACMEConfig struct {
+	Enable bool `yaml:"enable"`
+
+	// DirectoryURL specific the acme server directory
+	// default is Let's Encrypt, it can be a local pebble for test
+	// eg: https://127.0.0.1:14000/dir
+	DirectoryURL string `yaml:"directoryURL"`
+
+	// Email specific the acme account contact
+	Email string `yaml:"email"`
+
+	// CacheDir specific where to store accounts and certificates
+	// default ./acme
+	CacheDir string `yaml:"cacheDir"`
+
+	// CAFile trusts the acme server with this ca
+	// eg: pebble.minica.pem
+	CAFile string `yaml:"caFile"`
+
+	// Wildcards specific wildcard certificates obtained by dns-01
+	// the dns-01 records are written by the resolver
+	// eg: *.open.notr.tech
+	Wildcards []string `yaml:"wildcards"`
+
+	// RenewBefore specific days to renew before expire, default 30
+	RenewBefore int `yaml:"renewBefore"`
+
+	// DNSWait specific seconds to wait for dns-01 record propagation
+	// default 5 seconds
+	DNSWait int `yaml:"dnsWait"`
+}
+
+// TXTWriter writes dns TXT records for dns-01 challenge
+type TXTWriter interface {
+	ApplyTXT(domain, text string) error
+	DeleteTXT(domain string) error
+}
+
+// ACME obtains and renews certificates for client domains
+// by http-01 or tls-alpn-01 challenge, and wildcard certificates
+// by dns-01 challenge.
+type ACME struct {
+	cfg         ACMEConfig
+	renewBefore time.Duration
+	dnsWait     time.Duration
+	txt         TXTWriter
+
+	// manager obtains client domain certificates
+	manager *autocert.Manager
+
+	// challenge serves http-01 challenges of manager
+	challenge http.Handler
+
+	// client obtains wildcard certificates
+	client     *acme.Client
+	registerMu sync.Mutex
+	registered bool
+
+	// wildcards stores wildcard certificates
+	// key: wildcard domain, eg: *.open.notr.tech
+	// value: certificate, nil if not obtained
+	wildcardsMu sync.RWMutex
+	wildcards   map[string]*tls.Certificate
+
+	// domains stores client domains allowed to obtain certificates
+	domainsMu sync.RWMutex
+	domains   map[string]struct{}
+}
+
+func NewACME(cfg ACMEConfig, txt TXTWriter) (*ACME, error) {
+	if len(cfg.DirectoryURL) <= 0 {
+		cfg.DirectoryURL = acme.LetsEncryptURL
+	}
+
+	if len(cfg.CacheDir) <= 0 {
+		cfg.CacheDir = defaultCacheDir
+	}
+
+	if cfg.RenewBefore <= 0 {
+		cfg.RenewBefore = defaultRenewBefore
+	}
+
+	if cfg.DNSWait <= 0 {
+		cfg.DNSWait = defaultDNSWait
+	}
+
+	if len(cfg.Wildcards) > 0 && txt == nil {
+		return nil, fmt.Errorf("wildcard certificates require resolver for dns-01")
+	}
+
+	httpClient := http.DefaultClient
+	if len(cfg.CAFile) > 0 {
+		ca, err := ioutil.ReadFile(cfg.CAFile)
+		if err != nil {
+			return nil, err
+		}
+
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(ca) {
+			return nil, fmt.Errorf("no certificate in %s", cfg.CAFile)
+		}
+
+		httpClient = &http.Client{
+			Transport: &http.Transport{
+				TLSClientConfig: &tls.Config{RootCAs: pool},
+			},
+		}
+	}
+
+	a := &ACME{
+		cfg:         cfg,
+		renewBefore: time.Duration(cfg.RenewBefore) * time.Hour * 24,
+		dnsWait:     time.Duration(cfg.DNSWait) * time.Second,
+		txt:         txt,
+		client: &acme.Client{
+			DirectoryURL: cfg.DirectoryURL,
+			HTTPClient:   httpClient,
+		},
+		wildcards: make(map[string]*tls.Certificate),
+		domains:   make(map[string]struct{}),
+	}
+
+	a.manager = &autocert.Manager{
+		Prompt:      autocert.AcceptTOS,
+		Cache:       autocert.DirCache(cfg.CacheDir),
+		HostPolicy:  a.hostPolicy,
+		RenewBefore: a.renewBefore,
+		Email:       cfg.Email,
+		Client: &acme.Client{
+			DirectoryURL: cfg.DirectoryURL,
+			HTTPClient:   httpClient,
+		},
+	}
+
+	// manager tries http-01 only after its HTTPHandler is created
+	a.challenge = a.manager.HTTPHandler(nil)
+
+	for _, w := range cfg.Wildcards {
+		a.wildcards[strings.ToLower(w)] = nil
+	}
+	return a, nil
+}
+
+// Run loads wildcard certificates from cache
+// and obtains or renews them periodically
+func (a *ACME) Run() {
+	if len(a.wildcards) == 0 {
+		return
+	}
+
+	a.loadWildcards()
+	a.renewWildcards()
+	tick := time.NewTicker(wildcardCheckInterval)
+	defer tick.Stop()
+	for range tick.C {
+		a.renewWildcards()
+	}
+}
+
+func (a *ACME) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	name := strings.TrimSuffix(strings.ToLower(hello.ServerName), ".")
+
+	// tls-alpn-01 challenge
+	for _, proto := range hello.SupportedProtos {
+		if proto == acme.ALPNProto {
+			return a.manager.GetCertificate(hello)
+		}
+	}
+
+	if cert := a.wildcard(name); cert != nil {
+		return cert, nil
+	}
+
+	if a.hostPolicy(context.Background(), name) != nil {
+		return nil, nil
+	}
+	return a.manager.GetCertificate(hello)
+}
+
+// AddDomain obtains certificate for domain in background
+// domains covered by valid wildcard certificates are skipped
+func (a *ACME) AddDomain(domain string) {
+	domain = strings.TrimSuffix(strings.ToLower(domain), ".")
+	if a.wildcard(domain) != nil {
+		return
+	}
+
+	a.domainsMu.Lock()
+	a.domains[domain] = struct{}{}
+	a.domainsMu.Unlock()
+
+	go func() {
+		hello := &tls.ClientHelloInfo{
+			ServerName:       domain,
+			CipherSuites:     []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256},
+			SignatureSchemes: []tls.SignatureScheme{tls.ECDSAWithP256AndSHA256},
+			SupportedCurves:  []tls.CurveID{tls.CurveP256},
+		}
+
+		_, err := a.manager.GetCertificate(hello)
+		if err != nil {
+			logs.Error("obtain certificate for %s fail: %v", domain, err)
+			return
+		}
+		logs.Info("obtain certificate for %s success", domain)
+	}()
+}
+
+// DelDomain stops obtaining certificate for domain
+func (a *ACME) DelDomain(domain string) {
+	domain = strings.TrimSuffix(strings.ToLower(domain), ".")
+	a.domainsMu.Lock()
+	defer a.domainsMu.Unlock()
+	delete(a.domains, domain)
+}
+
+func (a *ACME) ServeHTTPChallenge(w http.ResponseWriter, r *http.Request) bool {
+	if !strings.HasPrefix(r.URL.Path, httpChallengePrefix) {
+		return false
+	}
+
+	a.challenge.ServeHTTP(w, r)
+	return true
+}
+
+func (a *ACME) hostPolicy(ctx context.Context, host string) error {
+	a.domainsMu.RLock()
+	defer a.domainsMu.RUnlock()
+	if _, ok := a.domains[host]; !ok {
+		return fmt.Errorf("acme: host %s is not a client domain", host)
+	}
+	return nil
+}
+
+// wildcard returns the valid wildcard certificate covers name,
+// nil if it is not obtained yet or expired
+func (a *ACME) wildcard(name string) *tls.Certificate {
+	idx := strings.Index(name, ".")
+	if idx < 0 {
+		return nil
+	}
+
+	a.wildcardsMu.RLock()
+	defer a.wildcardsMu.RUnlock()
+	cert := a.wildcards["*"+name[idx:]]
+	if cert == nil || cert.Leaf == nil || time.Now().After(cert.Leaf.NotAfter) {
+		return nil
+	}
+	return cert
+}
+
+// Certificates lists obtained wildcard certificates
+// and client domain certificates in the cache
+func (a *ACME) Certificates() []CertInfo {
+	a.wildcardsMu.RLock()
+	infos := make([]CertInfo, 0, len(a.wildcards))
+	for wildcard, cert := range a.wildcards {
+		if cert == nil || cert.Leaf == nil {
+			continue
+		}
+		infos = append(infos, newCertInfo("acme", wildcard, cert.Leaf))
+	}
+	a.wildcardsMu.RUnlock()
+
+	files, err := ioutil.ReadDir(a.cfg.CacheDir)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			logs.Error("list acme cache %s fail: %v", a.cfg.CacheDir, err)
+		}
+		return infos
+	}
+
+	for _, f := range files {
+		// autocert stores certificates by domain, with +rsa suffix
+		// for rsa certificates, others are accounts and tokens
+		name := f.Name()
+		if f.IsDir() || strings.HasPrefix(name, "wildcard_") ||
+			(strings.Contains(name, "+") && !strings.HasSuffix(name, "+rsa")) {
+			continue
+		}
+
+		data, err := a.manager.Cache.Get(context.Background(), name)
+		if err != nil {
+			continue
+		}
+
+		cert, err := decodeCertificate(data)
+		if err != nil {
+			logs.Warn("decode acme certificate %s fail: %v", name, err)
+			continue
+		}
+		infos = append(infos, newCertInfo("acme", name, cert.Leaf))
+	}
+	return infos
+}
+
+func (a *ACME) loadWildcards() {
+	a.wildcardsMu.Lock()
+	defer a.wildcardsMu.Unlock()
+	for wildcard := range a.wildcards {
+		data, err := a.manager.Cache.Get(context.Background(), wildcardCacheKey(wildcard))
+		if err != nil {
+			if err != autocert.ErrCacheMiss {
+				logs.Error("load wildcard certificate %s fail: %v", wildcard, err)
+			}
+			continue
+		}
+
+		cert, err := decodeCertificate(data)
+		if err != nil {
+			logs.Error("decode wildcard certificate %s fail: %v", wildcard, err)
+			continue
+		}
+		a.wildcards[wildcard] = cert
+	}
+}
+
+func (a *ACME) renewWildcards() {
+	a.wildcardsMu.RLock()
+	renews := make([]string, 0)
+	for wildcard, cert := range a.wildcards {
+		if needRenew(cert, a.renewBefore) {
+			renews = append(renews, wildcard)
+		}
+	}
+	a.wildcardsMu.RUnlock()
+
+	for _, wildcard := range renews {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Minute*5)
+		cert, err := a.obtainWildcard(ctx, wildcard)
+		cancel()
+		if err != nil {
+			logs.Error("obtain wildcard certificate %s fail: %v", wildcard, err)
+			continue
+		}
+
+		logs.Info("obtain wildcard certificate %s success, expire at %v", wildcard, cert.Leaf.NotAfter)
+		a.wildcardsMu.Lock()
+		a.wildcards[wildcard] = cert
+		a.wildcardsMu.Unlock()
+	}
+}
+
+// obtainWildcard obtains certificate for wildcard and its apex by dns-01
+func (a *ACME) obtainWildcard(ctx context.Context, wildcard string) (*tls.Certificate, error) {
+	err := a.register(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	apex := strings.TrimPrefix(wildcard, "*.")
+	order, err := a.client.AuthorizeOrder(ctx, acme.DomainIDs(wildcard, apex))
+	if err != nil {
+		return nil, err
+	}
+
+	records := make(map[string]struct{})
+	defer func() {
+		for record := range records {
+			if err := a.txt.DeleteTXT(record); err != nil {
+				logs.Error("delete TXT record %s fail: %v", record, err)
+			}
+		}
+	}()
+
+	for _, url := range order.AuthzURLs {
+		z, err := a.client.GetAuthorization(ctx, url)
+		if err != nil {
+			return nil, err
+		}
+
+		if z.Status == acme.StatusValid {
+			continue
+		}
+
+		var chal *acme.Challenge
+		for _, c := range z.Challenges {
+			if c.Type == "dns-01" {
+				chal = c
+				break
+			}
+		}
+
+		if chal == nil {
+			return nil, fmt.Errorf("no dns-01 challenge for %s", z.Identifier.Value)
+		}
+
+		value, err := a.client.DNS01ChallengeRecord(chal.Token)
+		if err != nil {
+			return nil, err
+		}
+
+		record := "_acme-challenge." + z.Identifier.Value
+		err = a.txt.ApplyTXT(record, value)
+		if err != nil {
+			return nil, err
+		}
+		records[record] = struct{}{}
+
+		time.Sleep(a.dnsWait)
+		_, err = a.client.Accept(ctx, chal)
+		if err != nil {
+			return nil, err
+		}
+
+		_, err = a.client.WaitAuthorization(ctx, z.URI)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	order, err = a.client.WaitOrder(ctx, order.URI)
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		DNSNames: []string{wildcard, apex},
+	}, key)
+	if err != nil {
+		return nil, err
+	}
+
+	der, _, err := a.client.CreateOrderCert(ctx, order.FinalizeURL, csr, true)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := encodeCertificate(key, der)
+	if err != nil {
+		return nil, err
+	}
+
+	err = a.manager.Cache.Put(ctx, wildcardCacheKey(wildcard), data)
+	if err != nil {
+		logs.Error("store wildcard certificate %s fail: %v", wildcard, err)
+	}
+	return decodeCertificate(data)
+}
+
+// register registers the dns-01 account once
+func (a *ACME) register(ctx context.Context) error {
+	a.registerMu.Lock()
+	defer a.registerMu.Unlock()
+	if a.registered {
+		return nil
+	}
+
+	key, err := a.accountKey(ctx)
+	if err != nil {
+		return err
+	}
+	a.client.Key = key
+
+	var contact []string
+	if len(a.cfg.Email) > 0 {
+		contact = []string{"mailto:" + a.cfg.Email}
+	}
+
+	_, err = a.client.Register(ctx, &acme.Account{Contact: contact}, acme.AcceptTOS)
+	if err != nil && err != acme.ErrAccountAlreadyExists {
+		return err
+	}
+	a.registered = true
+	return nil
+}
+
+// accountKey loads the dns-01 account key from cache
+// or generates a new one
+func (a *ACME) accountKey(ctx context.Context) (crypto.Signer, error) {
+	name := "dns01_account+key"
+	data, err := a.manager.Cache.Get(ctx, name)
+	if err == nil {
+		block, _ := pem.Decode(data)
+		if block == nil {
+			return nil, fmt.Errorf("invalid account key")
+		}
+		return x509.ParseECPrivateKey(block.Bytes)
+	}
+
+	if err != autocert.ErrCacheMiss {
+		return nil, err
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+
+	data = pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der})
+	err = a.manager.Cache.Put(ctx, name, data)
+	return key, err
+}
+
+func wildcardCacheKey(wildcard string) string {
+	return "wildcard_" + strings.TrimPrefix(wildcard, "*.")
+}
+
+// needRenew checks whether cert is missing or expires in renewBefore
+func needRenew(cert *tls.Certificate, renewBefore time.Duration) bool {
+	if cert == nil || cert.Leaf == nil {
+		return true
+	}
+	return time.Now().Add(renewBefore).After(cert.Leaf.NotAfter)
+}
+
+// encodeCertificate encodes key and certificate chain to pem
+func encodeCertificate(key *ecdsa.PrivateKey, chain [][]byte) ([]byte, error) {
+	buf := &bytes.Buffer{}
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+
+	pem.Encode(buf, &pem.Block{Type: "EC PRIVATE KEY", Bytes: der})
+	for _, c := range chain {
+		pem.Encode(buf, &pem.Block{Type: "CERTIFICATE", Bytes: c})
+	}
+	return buf.Bytes(), nil
+}
+
+// decodeCertificate decodes pem encoded by encodeCertificate
+func decodeCertificate(data []byte) (*tls.Certificate, error) {
+	cert, err := tls.X509KeyPair(data, data)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(cert.Certificate) == 0 {
+		return nil, errors.New("empty certificate chain")
+	}
+
+	cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return nil, err
+	}
+	return &cert, nil
+}
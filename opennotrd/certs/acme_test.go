@@ -0,0 +1,752 @@
+package certs
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/acme"
+)
+
+type mockTXT struct {
+	mu      sync.Mutex
+	records map[string]string
+}
+
+func (m *mockTXT) ApplyTXT(domain, text string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.records == nil {
+		m.records = make(map[string]string)
+	}
+	m.records[domain] = text
+	return nil
+}
+
+func (m *mockTXT) DeleteTXT(domain string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.records, domain)
+	return nil
+}
+
+func (m *mockTXT) get(domain string) string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.records[domain]
+}
+
+func selfSigned(t *testing.T, notAfter time.Time, domains ...string) ([]byte, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: domains[0]},
+		DNSNames:     domains,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     notAfter,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return der, key
+}
+
+func newTestACME(t *testing.T, wildcards ...string) (*ACME, func()) {
+	dir, err := ioutil.TempDir("", "acme")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a, err := NewACME(ACMEConfig{
+		DirectoryURL: "https://127.0.0.1:14000/dir",
+		CacheDir:     dir,
+		Wildcards:    wildcards,
+	}, &mockTXT{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return a, func() { os.RemoveAll(dir) }
+}
+
+func TestACMEWildcardFromCache(t *testing.T) {
+	a, clean := newTestACME(t, "*.open.notr.tech")
+	defer clean()
+
+	der, key := selfSigned(t, time.Now().Add(time.Hour*24*60), "*.open.notr.tech", "open.notr.tech")
+	data, err := encodeCertificate(key, [][]byte{der})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = a.manager.Cache.Put(context.Background(), wildcardCacheKey("*.open.notr.tech"), data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a.loadWildcards()
+	cert, err := a.GetCertificate(&tls.ClientHelloInfo{ServerName: "abc.open.notr.tech"})
+	if err != nil || cert == nil {
+		t.Fatalf("expected wildcard certificate, got %v %v", cert, err)
+	}
+
+	if needRenew(cert, a.renewBefore) {
+		t.Fatal("expected no renew for certificate expires in 60 days")
+	}
+
+	// covered domain is not obtained by http-01 or tls-alpn-01
+	a.AddDomain("abc.open.notr.tech")
+	if a.hostPolicy(context.Background(), "abc.open.notr.tech") == nil {
+		t.Fatal("expected domain covered by wildcard skipped")
+	}
+
+	// not our business
+	cert, err = a.GetCertificate(&tls.ClientHelloInfo{ServerName: "a.b.example.com"})
+	if cert != nil || err != nil {
+		t.Fatalf("expected no certificate, got %v %v", cert, err)
+	}
+}
+
+func TestACMENeedRenew(t *testing.T) {
+	der, key := selfSigned(t, time.Now().Add(time.Hour*24*10), "*.open.notr.tech")
+	data, _ := encodeCertificate(key, [][]byte{der})
+	cert, err := decodeCertificate(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !needRenew(cert, time.Hour*24*30) {
+		t.Fatal("expected renew for certificate expires in 10 days")
+	}
+
+	if !needRenew(nil, time.Hour*24*30) {
+		t.Fatal("expected renew for missing certificate")
+	}
+}
+
+func TestACMEHostPolicy(t *testing.T) {
+	a, clean := newTestACME(t)
+	defer clean()
+
+	if a.hostPolicy(context.Background(), "a.open.notr.tech") == nil {
+		t.Fatal("expected unknown domain rejected")
+	}
+
+	a.domainsMu.Lock()
+	a.domains["a.open.notr.tech"] = struct{}{}
+	a.domainsMu.Unlock()
+	if err := a.hostPolicy(context.Background(), "a.open.notr.tech"); err != nil {
+		t.Fatal(err)
+	}
+
+	a.DelDomain("a.open.notr.tech")
+	if a.hostPolicy(context.Background(), "a.open.notr.tech") == nil {
+		t.Fatal("expected deleted domain rejected")
+	}
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "http://a.open.notr.tech/index.html", nil)
+	if a.ServeHTTPChallenge(w, r) {
+		t.Fatal("expected non challenge request not served")
+	}
+
+	w = httptest.NewRecorder()
+	r = httptest.NewRequest("GET", "http://a.open.notr.tech/.well-known/acme-challenge/token", nil)
+	if !a.ServeHTTPChallenge(w, r) || w.Code != http.StatusForbidden {
+		t.Fatalf("expected challenge request served, got %d", w.Code)
+	}
+}
+
+func TestNewACMEWithoutResolver(t *testing.T) {
+	_, err := NewACME(ACMEConfig{Wildcards: []string{"*.open.notr.tech"}}, nil)
+	if err == nil {
+		t.Fatal("expected wildcard without resolver error")
+	}
+}
+
+// acmeStub is an in process RFC 8555 acme server, it does not verify
+// JWS signatures. Challenges are validated by validate with the key
+// authorization of the account, certificates are signed by its own ca
+type acmeStub struct {
+	*httptest.Server
+	caKey  *ecdsa.PrivateKey
+	caCert *x509.Certificate
+
+	// validate checks the challenge of domain is fulfilled
+	validate func(typ, domain, token, keyAuth string) error
+
+	mu sync.Mutex
+
+	// challenges offered for non wildcard domains besides dns-01
+	challenges []string
+
+	// validity of issued certificates
+	validity time.Duration
+
+	// issued receives the dns names of issued certificates
+	issued chan []string
+
+	nextID   int
+	accounts map[string]*ecdsa.PublicKey
+	orders   map[string]*stubOrder
+	authzs   map[string]*stubAuthz
+	certs    map[string][]byte
+}
+
+type stubOrder struct {
+	id      string
+	account string
+	status  string
+	names   []string
+	authzs  []*stubAuthz
+	cert    string
+}
+
+type stubAuthz struct {
+	id       string
+	account  string
+	domain   string
+	wildcard bool
+	status   string
+	chals    []*stubChallenge
+}
+
+type stubChallenge struct {
+	id     string
+	typ    string
+	token  string
+	status string
+}
+
+func newACMEStub(t *testing.T, validate func(typ, domain, token, keyAuth string) error) *acmeStub {
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "acme stub ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour * 24 * 365),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caCert, _ := x509.ParseCertificate(der)
+
+	s := &acmeStub{
+		caKey:      caKey,
+		caCert:     caCert,
+		validate:   validate,
+		challenges: []string{"http-01"},
+		validity:   time.Hour * 24 * 90,
+		issued:     make(chan []string, 10),
+		accounts:   make(map[string]*ecdsa.PublicKey),
+		orders:     make(map[string]*stubOrder),
+		authzs:     make(map[string]*stubAuthz),
+		certs:      make(map[string][]byte),
+	}
+	s.Server = httptest.NewServer(s)
+	return s
+}
+
+func (s *acmeStub) set(f func()) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	f()
+}
+
+func (s *acmeStub) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Replay-Nonce", fmt.Sprintf("nonce-%d", time.Now().UnixNano()))
+	if r.URL.Path == "/dir" {
+		writeStub(w, http.StatusOK, map[string]string{
+			"newNonce":   s.URL + "/nonce",
+			"newAccount": s.URL + "/account",
+			"newOrder":   s.URL + "/order",
+			"revokeCert": s.URL + "/revoke",
+			"keyChange":  s.URL + "/key",
+		})
+		return
+	}
+
+	if r.URL.Path == "/nonce" {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	var jws struct {
+		Protected string `json:"protected"`
+		Payload   string `json:"payload"`
+	}
+	var header struct {
+		JWK json.RawMessage `json:"jwk"`
+		KID string          `json:"kid"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&jws); err != nil || decodeB64(jws.Protected, &header) != nil {
+		writeStub(w, http.StatusBadRequest, map[string]string{"type": "urn:ietf:params:acme:error:malformed"})
+		return
+	}
+	payload, _ := base64.RawURLEncoding.DecodeString(jws.Payload)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	switch {
+	case parts[0] == "account":
+		var jwk struct{ X, Y string }
+		json.Unmarshal(header.JWK, &jwk)
+		x, _ := base64.RawURLEncoding.DecodeString(jwk.X)
+		y, _ := base64.RawURLEncoding.DecodeString(jwk.Y)
+		kid := fmt.Sprintf("%s/account/%d", s.URL, s.id())
+		s.accounts[kid] = &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		w.Header().Set("Location", kid)
+		writeStub(w, http.StatusCreated, map[string]string{"status": "valid"})
+
+	case parts[0] == "order" && len(parts) == 1:
+		var req struct {
+			Identifiers []struct{ Value string } `json:"identifiers"`
+		}
+		json.Unmarshal(payload, &req)
+		o := &stubOrder{id: strconv.Itoa(s.id()), account: header.KID, status: "pending"}
+		for _, ident := range req.Identifiers {
+			o.names = append(o.names, ident.Value)
+			z := &stubAuthz{id: strconv.Itoa(s.id()), account: header.KID, status: "pending"}
+			z.domain = strings.TrimPrefix(ident.Value, "*.")
+			z.wildcard = z.domain != ident.Value
+			typs := []string{"dns-01"}
+			if !z.wildcard {
+				typs = append(typs, s.challenges...)
+			}
+			for _, typ := range typs {
+				z.chals = append(z.chals, &stubChallenge{id: strconv.Itoa(s.id()), typ: typ, token: fmt.Sprintf("token-%d", s.nextID), status: "pending"})
+			}
+			s.authzs[z.id] = z
+			o.authzs = append(o.authzs, z)
+		}
+		s.orders[o.id] = o
+		w.Header().Set("Location", s.URL+"/order/"+o.id)
+		writeStub(w, http.StatusCreated, s.order(o))
+
+	case parts[0] == "order" && len(parts) == 2 && s.orders[parts[1]] != nil:
+		o := s.orders[parts[1]]
+		w.Header().Set("Location", s.URL+"/order/"+o.id)
+		writeStub(w, http.StatusOK, s.order(o))
+
+	case parts[0] == "authz" && s.authzs[parts[1]] != nil:
+		writeStub(w, http.StatusOK, s.authz(s.authzs[parts[1]]))
+
+	case parts[0] == "chal":
+		for _, z := range s.authzs {
+			for _, c := range z.chals {
+				if c.id != parts[1] {
+					continue
+				}
+
+				keyAuth := c.token + "." + mustThumbprint(s.accounts[z.account])
+				c.status, z.status = "valid", "valid"
+				if err := s.validate(c.typ, z.domain, c.token, keyAuth); err != nil {
+					c.status, z.status = "invalid", "invalid"
+				}
+				writeStub(w, http.StatusOK, s.challenge(c))
+				return
+			}
+		}
+		http.NotFound(w, r)
+
+	case parts[0] == "finalize" && s.orders[parts[1]] != nil:
+		o := s.orders[parts[1]]
+		var req struct{ CSR string }
+		json.Unmarshal(payload, &req)
+		der, _ := base64.RawURLEncoding.DecodeString(req.CSR)
+		csr, err := x509.ParseCertificateRequest(der)
+		if err != nil || s.order(o)["status"] != "ready" {
+			writeStub(w, http.StatusForbidden, map[string]string{"type": "urn:ietf:params:acme:error:orderNotReady"})
+			return
+		}
+
+		tmpl := &x509.Certificate{
+			SerialNumber: big.NewInt(int64(s.id())),
+			Subject:      pkix.Name{CommonName: csr.DNSNames[0]},
+			DNSNames:     csr.DNSNames,
+			NotBefore:    time.Now().Add(-time.Hour),
+			NotAfter:     time.Now().Add(s.validity),
+		}
+		cert, err := x509.CreateCertificate(rand.Reader, tmpl, s.caCert, csr.PublicKey, s.caKey)
+		if err != nil {
+			writeStub(w, http.StatusInternalServerError, map[string]string{"type": "urn:ietf:params:acme:error:serverInternal"})
+			return
+		}
+
+		o.status, o.cert = "valid", strconv.Itoa(s.id())
+		s.certs[o.cert] = append(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert}),
+			pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: s.caCert.Raw})...)
+		s.issued <- csr.DNSNames
+		w.Header().Set("Location", s.URL+"/order/"+o.id)
+		writeStub(w, http.StatusOK, s.order(o))
+
+	case parts[0] == "cert" && s.certs[parts[1]] != nil:
+		w.Header().Set("Content-Type", "application/pem-certificate-chain")
+		w.Write(s.certs[parts[1]])
+
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (s *acmeStub) id() int {
+	s.nextID++
+	return s.nextID
+}
+
+func (s *acmeStub) order(o *stubOrder) map[string]interface{} {
+	status := o.status
+	if status == "pending" {
+		status = "ready"
+		for _, z := range o.authzs {
+			if z.status == "invalid" {
+				status = "invalid"
+				break
+			}
+			if z.status != "valid" {
+				status = "pending"
+			}
+		}
+	}
+
+	idents := make([]map[string]string, 0)
+	authzs := make([]string, 0)
+	for i, z := range o.authzs {
+		idents = append(idents, map[string]string{"type": "dns", "value": o.names[i]})
+		authzs = append(authzs, s.URL+"/authz/"+z.id)
+	}
+
+	res := map[string]interface{}{
+		"status":         status,
+		"identifiers":    idents,
+		"authorizations": authzs,
+		"finalize":       s.URL + "/finalize/" + o.id,
+	}
+	if len(o.cert) > 0 {
+		res["certificate"] = s.URL + "/cert/" + o.cert
+	}
+	return res
+}
+
+func (s *acmeStub) authz(z *stubAuthz) map[string]interface{} {
+	chals := make([]map[string]string, 0)
+	for _, c := range z.chals {
+		chals = append(chals, s.challenge(c))
+	}
+
+	return map[string]interface{}{
+		"status":     z.status,
+		"identifier": map[string]string{"type": "dns", "value": z.domain},
+		"wildcard":   z.wildcard,
+		"challenges": chals,
+	}
+}
+
+func (s *acmeStub) challenge(c *stubChallenge) map[string]string {
+	return map[string]string{
+		"type":   c.typ,
+		"url":    s.URL + "/chal/" + c.id,
+		"token":  c.token,
+		"status": c.status,
+	}
+}
+
+func (s *acmeStub) waitIssued(t *testing.T) []string {
+	select {
+	case names := <-s.issued:
+		return names
+	case <-time.After(time.Second * 10):
+		t.Fatal("wait certificate issued timeout")
+		return nil
+	}
+}
+
+func writeStub(w http.ResponseWriter, code int, v interface{}) {
+	ct := "application/json"
+	if code >= 400 {
+		ct = "application/problem+json"
+	}
+	w.Header().Set("Content-Type", ct)
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
+
+func decodeB64(s string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+func mustThumbprint(pub *ecdsa.PublicKey) string {
+	if pub == nil {
+		return ""
+	}
+	thumb, _ := acme.JWKThumbprint(pub)
+	return thumb
+}
+
+// ecdsaHello is the hello AddDomain obtains certificate for
+func ecdsaHello(domain string) *tls.ClientHelloInfo {
+	return &tls.ClientHelloInfo{
+		ServerName:       domain,
+		CipherSuites:     []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256},
+		SignatureSchemes: []tls.SignatureScheme{tls.ECDSAWithP256AndSHA256},
+		SupportedCurves:  []tls.CurveID{tls.CurveP256},
+	}
+}
+
+func newStubACME(t *testing.T, stub *acmeStub, txt TXTWriter, wildcards ...string) (*ACME, func()) {
+	dir, err := ioutil.TempDir("", "acme")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a, err := NewACME(ACMEConfig{
+		DirectoryURL: stub.URL + "/dir",
+		CacheDir:     dir,
+		Wildcards:    wildcards,
+	}, txt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.dnsWait = 0
+	return a, func() { os.RemoveAll(dir) }
+}
+
+func TestACMEObtainHTTP01(t *testing.T) {
+	var a *ACME
+	stub := newACMEStub(t, func(typ, domain, token, keyAuth string) error {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "http://"+domain+httpChallengePrefix+token, nil)
+		if !a.ServeHTTPChallenge(w, r) || w.Body.String() != keyAuth {
+			return fmt.Errorf("http-01 reply %d %q", w.Code, w.Body.String())
+		}
+		return nil
+	})
+	defer stub.Close()
+
+	a, clean := newStubACME(t, stub, nil)
+	defer clean()
+
+	a.AddDomain("web.open.notr.tech")
+	if names := stub.waitIssued(t); len(names) != 1 || names[0] != "web.open.notr.tech" {
+		t.Fatalf("unexpected issued names %v", names)
+	}
+
+	cert, err := a.GetCertificate(ecdsaHello("web.open.notr.tech"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	leaf, _ := x509.ParseCertificate(cert.Certificate[0])
+	if leaf.Issuer.CommonName != "acme stub ca" {
+		t.Fatalf("expected certificate issued by stub, got %s", leaf.Issuer)
+	}
+
+	// cached certificate is listed, accounts and tokens are not
+	infos := a.Certificates()
+	if len(infos) != 1 || infos[0].Name != "web.open.notr.tech" ||
+		infos[0].Issuer != "acme stub ca" || !infos[0].NotAfter.Equal(leaf.NotAfter) {
+		t.Fatalf("unexpected certificates %+v", infos)
+	}
+}
+
+func TestACMEObtainTLSALPN01(t *testing.T) {
+	var a *ACME
+	stub := newACMEStub(t, func(typ, domain, token, keyAuth string) error {
+		if typ != "tls-alpn-01" {
+			return fmt.Errorf("unexpected challenge %s", typ)
+		}
+
+		cert, err := a.GetCertificate(&tls.ClientHelloInfo{ServerName: domain, SupportedProtos: []string{acme.ALPNProto}})
+		if err != nil {
+			return err
+		}
+
+		leaf, err := x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			return err
+		}
+
+		sum := sha256.Sum256([]byte(keyAuth))
+		expect, _ := asn1.Marshal(sum[:])
+		for _, ext := range leaf.Extensions {
+			if ext.Id.Equal(asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 1, 31}) && bytes.Equal(ext.Value, expect) {
+				return nil
+			}
+		}
+		return fmt.Errorf("acme identifier not found")
+	})
+	defer stub.Close()
+	stub.set(func() { stub.challenges = []string{"tls-alpn-01"} })
+
+	a, clean := newStubACME(t, stub, nil)
+	defer clean()
+
+	a.AddDomain("api.open.notr.tech")
+	if names := stub.waitIssued(t); len(names) != 1 || names[0] != "api.open.notr.tech" {
+		t.Fatalf("unexpected issued names %v", names)
+	}
+}
+
+func TestACMERenew(t *testing.T) {
+	var a *ACME
+	stub := newACMEStub(t, func(typ, domain, token, keyAuth string) error {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "http://"+domain+httpChallengePrefix+token, nil)
+		if !a.ServeHTTPChallenge(w, r) || w.Body.String() != keyAuth {
+			return fmt.Errorf("http-01 reply %d", w.Code)
+		}
+		return nil
+	})
+	defer stub.Close()
+
+	// expires in renewBefore(30 days), renewed at once
+	stub.set(func() { stub.validity = time.Hour * 24 * 10 })
+
+	a, clean := newStubACME(t, stub, nil)
+	defer clean()
+
+	a.AddDomain("web.open.notr.tech")
+	stub.waitIssued(t)
+	stub.set(func() { stub.validity = time.Hour * 24 * 90 })
+	if names := stub.waitIssued(t); len(names) != 1 || names[0] != "web.open.notr.tech" {
+		t.Fatalf("unexpected renewed names %v", names)
+	}
+
+	// the renewed certificate is served
+	deadline := time.Now().Add(time.Second * 5)
+	for {
+		cert, err := a.GetCertificate(ecdsaHello("web.open.notr.tech"))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if cert.Leaf != nil && !needRenew(cert, a.renewBefore) {
+			break
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatal("expected renewed certificate served")
+		}
+		time.Sleep(time.Millisecond * 50)
+	}
+}
+
+func TestACMEWildcardDNS01(t *testing.T) {
+	txt := &mockTXT{}
+	stub := newACMEStub(t, func(typ, domain, token, keyAuth string) error {
+		sum := sha256.Sum256([]byte(keyAuth))
+		if typ != "dns-01" || txt.get("_acme-challenge."+domain) != base64.RawURLEncoding.EncodeToString(sum[:]) {
+			return fmt.Errorf("dns-01 record mismatch")
+		}
+		return nil
+	})
+	defer stub.Close()
+
+	a, clean := newStubACME(t, stub, txt, "*.open.notr.tech")
+	defer clean()
+
+	// cached certificate expires in 10 days is renewed
+	der, key := selfSigned(t, time.Now().Add(time.Hour*24*10), "*.open.notr.tech", "open.notr.tech")
+	data, _ := encodeCertificate(key, [][]byte{der})
+	err := a.manager.Cache.Put(context.Background(), wildcardCacheKey("*.open.notr.tech"), data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a.loadWildcards()
+	a.renewWildcards()
+	if names := stub.waitIssued(t); len(names) != 2 || names[0] != "*.open.notr.tech" || names[1] != "open.notr.tech" {
+		t.Fatalf("unexpected issued names %v", names)
+	}
+
+	cert, err := a.GetCertificate(&tls.ClientHelloInfo{ServerName: "abc.open.notr.tech"})
+	if err != nil || cert == nil {
+		t.Fatalf("expected wildcard certificate, got %v", err)
+	}
+
+	if cert.Leaf.Issuer.CommonName != "acme stub ca" || needRenew(cert, a.renewBefore) {
+		t.Fatalf("expected renewed certificate, got %s %v", cert.Leaf.Issuer, cert.Leaf.NotAfter)
+	}
+
+	if txt.get("_acme-challenge.open.notr.tech") != "" {
+		t.Fatal("expected dns-01 record deleted")
+	}
+
+	infos := a.Certificates()
+	if len(infos) != 1 || infos[0].Name != "*.open.notr.tech" || len(infos[0].Domains) != 2 {
+		t.Fatalf("unexpected certificates %+v", infos)
+	}
+
+	// renewed certificate is stored
+	a.wildcards["*.open.notr.tech"] = nil
+	a.loadWildcards()
+	if c := a.wildcard("abc.open.notr.tech"); c == nil || c.Leaf.SerialNumber.Cmp(cert.Leaf.SerialNumber) != 0 {
+		t.Fatal("expected renewed certificate cached")
+	}
+}
+
+func TestACMEWildcardPending(t *testing.T) {
+	var a *ACME
+	stub := newACMEStub(t, func(typ, domain, token, keyAuth string) error {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "http://"+domain+httpChallengePrefix+token, nil)
+		if !a.ServeHTTPChallenge(w, r) || w.Body.String() != keyAuth {
+			return fmt.Errorf("http-01 reply %d", w.Code)
+		}
+		return nil
+	})
+	defer stub.Close()
+
+	// the wildcard certificate is not obtained yet, eg: dns-01 fails
+	a, clean := newStubACME(t, stub, &mockTXT{}, "*.open.notr.tech")
+	defer clean()
+
+	a.AddDomain("web.open.notr.tech")
+	if names := stub.waitIssued(t); len(names) != 1 || names[0] != "web.open.notr.tech" {
+		t.Fatalf("unexpected issued names %v", names)
+	}
+
+	cert, err := a.GetCertificate(ecdsaHello("web.open.notr.tech"))
+	if err != nil || cert == nil {
+		t.Fatalf("expected domain certificate, got %v", err)
+	}
+}
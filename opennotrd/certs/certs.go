@@ -0,0 +1,147 @@
+// Package certs provides certificates for tls terminating plugins
+// certificates come from registered providers, eg: store, acme
+package certs
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+var (
+	mu sync.RWMutex
+
+	// providers are tried in registration order
+	providers []Provider
+)
+
+// Provider provides certificates by SNI
+// it returns nil certificate if the server name is not its business
+type Provider interface {
+	GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error)
+}
+
+// DomainWatcher is implemented by providers who obtain
+// certificates for client domains once they are registered
+type DomainWatcher interface {
+	AddDomain(domain string)
+	DelDomain(domain string)
+}
+
+// HTTPChallenger is implemented by providers who serve http challenges
+// it returns false if the request is not a challenge
+type HTTPChallenger interface {
+	ServeHTTPChallenge(w http.ResponseWriter, r *http.Request) bool
+}
+
+// Lister is implemented by providers who can list their certificates
+type Lister interface {
+	Certificates() []CertInfo
+}
+
+// CertInfo describes a certificate
+type CertInfo struct {
+	// Source is the provider of the certificate, eg: store, acme
+	Source string `json:"source"`
+
+	// Name is the certificate file, wildcard domain or acme cache key
+	Name      string    `json:"name"`
+	Domains   []string  `json:"domains"`
+	Issuer    string    `json:"issuer"`
+	NotBefore time.Time `json:"notBefore"`
+	NotAfter  time.Time `json:"notAfter"`
+}
+
+func newCertInfo(source, name string, leaf *x509.Certificate) CertInfo {
+	return CertInfo{
+		Source:    source,
+		Name:      name,
+		Domains:   leaf.DNSNames,
+		Issuer:    leaf.Issuer.CommonName,
+		NotBefore: leaf.NotBefore,
+		NotAfter:  leaf.NotAfter,
+	}
+}
+
+// Register registers a certificate provider
+func Register(p Provider) {
+	mu.Lock()
+	defer mu.Unlock()
+	providers = append(providers, p)
+}
+
+// GetCertificate returns the certificate of the first provider
+// who has certificate for hello.ServerName
+func GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	mu.RLock()
+	defer mu.RUnlock()
+
+	var lastErr error
+	for _, p := range providers {
+		cert, err := p.GetCertificate(hello)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+
+		if cert != nil {
+			return cert, nil
+		}
+	}
+
+	if lastErr != nil {
+		return nil, lastErr
+	}
+	return nil, fmt.Errorf("no certificate for %s", hello.ServerName)
+}
+
+// AddDomain notifies providers a client domain is registered
+func AddDomain(domain string) {
+	mu.RLock()
+	defer mu.RUnlock()
+	for _, p := range providers {
+		if w, ok := p.(DomainWatcher); ok {
+			w.AddDomain(domain)
+		}
+	}
+}
+
+// DelDomain notifies providers a client domain is unregistered
+func DelDomain(domain string) {
+	mu.RLock()
+	defer mu.RUnlock()
+	for _, p := range providers {
+		if w, ok := p.(DomainWatcher); ok {
+			w.DelDomain(domain)
+		}
+	}
+}
+
+// ServeHTTPChallenge serves http challenge by providers
+func ServeHTTPChallenge(w http.ResponseWriter, r *http.Request) bool {
+	mu.RLock()
+	defer mu.RUnlock()
+	for _, p := range providers {
+		if c, ok := p.(HTTPChallenger); ok && c.ServeHTTPChallenge(w, r) {
+			return true
+		}
+	}
+	return false
+}
+
+// List lists certificates of all providers
+func List() []CertInfo {
+	mu.RLock()
+	defer mu.RUnlock()
+
+	infos := make([]CertInfo, 0)
+	for _, p := range providers {
+		if l, ok := p.(Lister); ok {
+			infos = append(infos, l.Certificates()...)
+		}
+	}
+	return infos
+}
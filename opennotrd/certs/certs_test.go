@@ -0,0 +1,51 @@
+package certs
+
+import (
+	"crypto/tls"
+	"testing"
+)
+
+type mockProvider struct {
+	domain string
+	cert   *tls.Certificate
+	added  map[string]bool
+}
+
+func (p *mockProvider) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	if hello.ServerName == p.domain {
+		return p.cert, nil
+	}
+	return nil, nil
+}
+
+func (p *mockProvider) AddDomain(domain string) { p.added[domain] = true }
+func (p *mockProvider) DelDomain(domain string) { delete(p.added, domain) }
+
+func TestProviderChain(t *testing.T) {
+	defer func() { providers = nil }()
+
+	first := &mockProvider{domain: "a.open.notr.tech", cert: &tls.Certificate{}, added: map[string]bool{}}
+	second := &mockProvider{domain: "b.open.notr.tech", cert: &tls.Certificate{}, added: map[string]bool{}}
+	Register(first)
+	Register(second)
+
+	cert, err := GetCertificate(&tls.ClientHelloInfo{ServerName: "b.open.notr.tech"})
+	if err != nil || cert != second.cert {
+		t.Fatalf("expected second provider certificate, got %v %v", cert, err)
+	}
+
+	_, err = GetCertificate(&tls.ClientHelloInfo{ServerName: "c.open.notr.tech"})
+	if err == nil {
+		t.Fatal("expected no certificate error")
+	}
+
+	AddDomain("c.open.notr.tech")
+	if !first.added["c.open.notr.tech"] || !second.added["c.open.notr.tech"] {
+		t.Fatal("expected domain added to all watchers")
+	}
+
+	DelDomain("c.open.notr.tech")
+	if first.added["c.open.notr.tech"] {
+		t.Fatal("expected domain deleted")
+	}
+}
@@ -0,0 +1,280 @@
+package certs
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ICKelin/opennotr/internal/logs"
+)
+
+var (
+	// default certificate directory check interval(seconds)
+	defaultStoreReload = 10
+
+	// certificate file extensions
+	// the private key is either $name.key or in the same file
+	certExts = []string{".crt", ".pem", ".cer"}
+)
+
+// StoreConfig configures the certificate directory
+type StoreConfig struct {
+	// Dir specific the certificate directory
+	// certificates are indexed by SAN, eg:
+	// wildcard.crt + wildcard.key => *.open.notr.tech
+	// customer.pem(certificate and key) => www.customer.com
+	Dir string `yaml:"dir"`
+
+	// Reload specific seconds to check the directory for changes
+	// default 10 seconds
+	Reload int `yaml:"reload"`
+}
+
+type storeEntry struct {
+	file string
+	cert *tls.Certificate
+	leaf *x509.Certificate
+}
+
+// Store serves certificates from a directory by SNI
+// and reloads them once files in the directory changed
+type Store struct {
+	dir    string
+	reload time.Duration
+
+	mu sync.RWMutex
+
+	// names indexes certificates by SAN
+	// key: lower case SAN, eg: *.open.notr.tech
+	names map[string][]*storeEntry
+
+	// entries stores all certificates in the directory
+	entries []*storeEntry
+
+	// files stores files status of last loading
+	files map[string]string
+}
+
+func NewStore(cfg StoreConfig) (*Store, error) {
+	if cfg.Reload <= 0 {
+		cfg.Reload = defaultStoreReload
+	}
+
+	s := &Store{
+		dir:    cfg.Dir,
+		reload: time.Duration(cfg.Reload) * time.Second,
+		names:  make(map[string][]*storeEntry),
+	}
+
+	_, err := s.Load()
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Run checks the directory periodically and reloads on change
+func (s *Store) Run() {
+	tick := time.NewTicker(s.reload)
+	defer tick.Stop()
+
+	for range tick.C {
+		changed, err := s.Load()
+		if err != nil {
+			logs.Error("load certificates from %s fail: %v", s.dir, err)
+			continue
+		}
+
+		if changed {
+			logs.Info("reload certificates from %s, %d certificates", s.dir, len(s.Certificates()))
+		}
+	}
+}
+
+// Load loads certificates if files in the directory changed
+// bad certificate files are skipped and logged
+func (s *Store) Load() (bool, error) {
+	files, err := s.scan()
+	if err != nil {
+		return false, err
+	}
+
+	s.mu.RLock()
+	changed := !sameFiles(s.files, files)
+	s.mu.RUnlock()
+	if !changed {
+		return false, nil
+	}
+
+	names := make(map[string][]*storeEntry)
+	entries := make([]*storeEntry, 0)
+	for file := range files {
+		if !isCertFile(file) {
+			continue
+		}
+
+		entry, err := loadEntry(file)
+		if err != nil {
+			logs.Warn("load certificate %s fail: %v", file, err)
+			continue
+		}
+
+		entries = append(entries, entry)
+		for _, name := range entryNames(entry.leaf) {
+			names[name] = append(names[name], entry)
+		}
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].file < entries[j].file
+	})
+
+	s.mu.Lock()
+	s.names = names
+	s.entries = entries
+	s.files = files
+	s.mu.Unlock()
+	return true, nil
+}
+
+// GetCertificate returns the certificate matches the server name exactly
+// or by wildcard. If more than one certificates match, the one expires
+// latest is selected.
+func (s *Store) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	name := strings.ToLower(strings.TrimSuffix(hello.ServerName, "."))
+	if len(name) <= 0 {
+		return nil, nil
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if entry := latest(s.names[name]); entry != nil {
+		return entry.cert, nil
+	}
+
+	idx := strings.Index(name, ".")
+	if idx <= 0 {
+		return nil, nil
+	}
+
+	if entry := latest(s.names["*"+name[idx:]]); entry != nil {
+		return entry.cert, nil
+	}
+	return nil, nil
+}
+
+// Certificates lists certificates in the directory
+func (s *Store) Certificates() []CertInfo {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	infos := make([]CertInfo, 0, len(s.entries))
+	for _, entry := range s.entries {
+		infos = append(infos, newCertInfo("store", entry.file, entry.leaf))
+	}
+	return infos
+}
+
+// scan returns certificate directory files with size and modify time
+func (s *Store) scan() (map[string]string, error) {
+	infos, err := ioutil.ReadDir(s.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	files := make(map[string]string)
+	for _, info := range infos {
+		if info.IsDir() {
+			continue
+		}
+
+		file := filepath.Join(s.dir, info.Name())
+		files[file] = fmt.Sprintf("%d/%d", info.ModTime().UnixNano(), info.Size())
+	}
+	return files, nil
+}
+
+func loadEntry(file string) (*storeEntry, error) {
+	certPEM, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	keyPEM := certPEM
+	keyFile := strings.TrimSuffix(file, filepath.Ext(file)) + ".key"
+	if _, err := os.Stat(keyFile); err == nil {
+		keyPEM, err = ioutil.ReadFile(keyFile)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return nil, err
+	}
+
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return nil, err
+	}
+	cert.Leaf = leaf
+
+	return &storeEntry{file: file, cert: &cert, leaf: leaf}, nil
+}
+
+// entryNames returns lower case SANs of the certificate
+// common name is used if no SAN presents
+func entryNames(leaf *x509.Certificate) []string {
+	names := leaf.DNSNames
+	if len(names) <= 0 && len(leaf.Subject.CommonName) > 0 {
+		names = []string{leaf.Subject.CommonName}
+	}
+
+	lower := make([]string, 0, len(names))
+	for _, name := range names {
+		lower = append(lower, strings.ToLower(name))
+	}
+	return lower
+}
+
+func latest(entries []*storeEntry) *storeEntry {
+	var found *storeEntry
+	for _, entry := range entries {
+		if found == nil || entry.leaf.NotAfter.After(found.leaf.NotAfter) {
+			found = entry
+		}
+	}
+	return found
+}
+
+func isCertFile(file string) bool {
+	ext := strings.ToLower(filepath.Ext(file))
+	for _, e := range certExts {
+		if ext == e {
+			return true
+		}
+	}
+	return false
+}
+
+func sameFiles(a, b map[string]string) bool {
+	if a == nil || len(a) != len(b) {
+		return false
+	}
+
+	for file, stat := range a {
+		if b[file] != stat {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,95 @@
+package certs
+
+import (
+	"crypto/tls"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ICKelin/opennotr/opennotrd/plugin/plugintest"
+)
+
+func TestStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "certs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	plugintest.WriteCert(t, dir, "*.open.notr.tech", "open.notr.tech")
+	plugintest.WriteCert(t, dir, "www.customer.com")
+
+	// bad certificate is skipped
+	ioutil.WriteFile(filepath.Join(dir, "bad.pem"), []byte("bad"), 0644)
+
+	s, err := NewStore(StoreConfig{Dir: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		expect string
+	}{
+		{"abc.open.notr.tech", "*.open.notr.tech"},
+		{"ABC.open.notr.tech", "*.open.notr.tech"},
+		{"open.notr.tech", "*.open.notr.tech"},
+		{"www.customer.com", "www.customer.com"},
+		{"a.b.open.notr.tech", ""},
+		{"customer.com", ""},
+	}
+
+	for _, test := range tests {
+		cert, err := s.GetCertificate(&tls.ClientHelloInfo{ServerName: test.name})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(test.expect) <= 0 {
+			if cert != nil {
+				t.Errorf("%s: expected no certificate, got %s", test.name, cert.Leaf.Subject.CommonName)
+			}
+			continue
+		}
+
+		if cert == nil || cert.Leaf.Subject.CommonName != test.expect {
+			t.Errorf("%s: expected %s, got %v", test.name, test.expect, cert)
+		}
+	}
+
+	if len(s.Certificates()) != 2 {
+		t.Fatalf("expected 2 certificates, got %v", s.Certificates())
+	}
+
+	// unchanged directory is not reloaded
+	changed, err := s.Load()
+	if err != nil || changed {
+		t.Fatalf("expected no change, got %v %v", changed, err)
+	}
+
+	// the certificate expires latest is selected
+	certFile, _ := plugintest.WriteCertExpire(t, dir, time.Now().Add(time.Hour*24*90), "www.customer.com")
+	os.Rename(certFile, filepath.Join(dir, "renewed.crt"))
+	os.Rename(filepath.Join(dir, "www.customer.com.key"), filepath.Join(dir, "renewed.key"))
+	plugintest.WriteCert(t, dir, "www.customer.com")
+
+	changed, err = s.Load()
+	if err != nil || !changed {
+		t.Fatalf("expected reload, got %v %v", changed, err)
+	}
+
+	cert, _ := s.GetCertificate(&tls.ClientHelloInfo{ServerName: "www.customer.com"})
+	if cert == nil || cert.Leaf.NotAfter.Before(time.Now().Add(time.Hour*24*30)) {
+		t.Fatalf("expected renewed certificate, got %v", cert)
+	}
+
+	// removed certificate is unloaded
+	os.Remove(filepath.Join(dir, "*.open.notr.tech.crt"))
+	s.Load()
+	cert, _ = s.GetCertificate(&tls.ClientHelloInfo{ServerName: "abc.open.notr.tech"})
+	if cert != nil {
+		t.Fatal("expected removed certificate unloaded")
+	}
+}
@@ -0,0 +1,137 @@
+package core
+
+import (
+	"fmt"
+	"strings"
+)
+
+// BaseDomain defines a domain the server generates subdomains under
+// each base domain has its own plugins, resolve ip and credentials
+type BaseDomain struct {
+	Name string
+
+	// ResolveIP is written to dns for subdomains
+	// empty means server public ip
+	ResolveIP string
+
+	// plugins stores protocols allowed under this domain
+	// empty means all registered plugins
+	plugins map[string]struct{}
+
+	// credentials stores credential names allowed to use this domain
+	// empty means all credentials
+	credentials map[string]struct{}
+}
+
+func newBaseDomain(cfg BaseDomainConfig) *BaseDomain {
+	d := &BaseDomain{
+		Name:        normalizeDomain(cfg.Name),
+		ResolveIP:   cfg.ResolveIP,
+		plugins:     make(map[string]struct{}),
+		credentials: make(map[string]struct{}),
+	}
+
+	for _, p := range cfg.Plugins {
+		d.plugins[p] = struct{}{}
+	}
+
+	for _, c := range cfg.Credentials {
+		d.credentials[c] = struct{}{}
+	}
+	return d
+}
+
+// AllowProtocol checks whether the forward protocol can be used
+func (d *BaseDomain) AllowProtocol(protocol string) bool {
+	if len(d.plugins) == 0 {
+		return true
+	}
+	_, ok := d.plugins[protocol]
+	return ok
+}
+
+// AllowCredential checks whether the credential can use this domain
+func (d *BaseDomain) AllowCredential(name string) bool {
+	if len(d.credentials) == 0 {
+		return true
+	}
+	_, ok := d.credentials[name]
+	return ok
+}
+
+// Contains checks whether domain is a subdomain of this domain
+func (d *BaseDomain) Contains(domain string) bool {
+	return domain == d.Name || strings.HasSuffix(domain, "."+d.Name)
+}
+
+type baseDomains []*BaseDomain
+
+// newBaseDomains creates base domains from configuration
+// the legacy $domain is the first base domain
+func newBaseDomains(cfg ServerConfig) baseDomains {
+	bases := make(baseDomains, 0, len(cfg.Domains)+1)
+	if len(cfg.Domain) > 0 {
+		bases = append(bases, newBaseDomain(BaseDomainConfig{Name: cfg.Domain}))
+	}
+
+	for _, c := range cfg.Domains {
+		if bases.lookup(c.Name) != nil {
+			continue
+		}
+		bases = append(bases, newBaseDomain(c))
+	}
+	return bases
+}
+
+// lookup returns the base domain of name, nil if not found
+func (bs baseDomains) lookup(name string) *BaseDomain {
+	name = normalizeDomain(name)
+	for _, b := range bs {
+		if b.Name == name {
+			return b
+		}
+	}
+	return nil
+}
+
+// match returns the longest base domain contains domain
+// nil if domain is a custom domain
+func (bs baseDomains) match(domain string) *BaseDomain {
+	var matched *BaseDomain
+	for _, b := range bs {
+		if b.Contains(domain) && (matched == nil || len(b.Name) > len(matched.Name)) {
+			matched = b
+		}
+	}
+	return matched
+}
+
+// choose returns the base domain for client
+// client picks a base domain explicitly or by a domain under it
+// otherwise the first base domain the credential allowed is used
+func (bs baseDomains) choose(baseDomain, domain string, cred *Credential) (*BaseDomain, error) {
+	var base *BaseDomain
+	switch {
+	case len(baseDomain) > 0:
+		base = bs.lookup(baseDomain)
+		if base == nil {
+			return nil, fmt.Errorf("base domain %s not found", baseDomain)
+		}
+
+	case len(domain) > 0 && bs.match(domain) != nil:
+		base = bs.match(domain)
+
+	default:
+		for _, b := range bs {
+			if b.AllowCredential(cred.Name) {
+				return b, nil
+			}
+		}
+		return nil, fmt.Errorf("no base domain is allowed for credential %s", cred.Name)
+	}
+
+	if !base.AllowCredential(cred.Name) {
+		return nil, fmt.Errorf("base domain %s is not allowed", base.Name)
+	}
+	return base, nil
+}
@@ -0,0 +1,50 @@
+package core
+
+import "testing"
+
+func TestBaseDomainChoose(t *testing.T) {
+	bases := newBaseDomains(ServerConfig{
+		Domain: "dev.example.com",
+		Domains: []BaseDomainConfig{
+			{
+				Name:        "hooks.example.com",
+				Plugins:     []string{"http", "https"},
+				Credentials: []string{"hooks"},
+			},
+		},
+	})
+
+	dev := &Credential{Name: "dev"}
+	hooks := &Credential{Name: "hooks"}
+
+	base, err := bases.choose("", "", dev)
+	if err != nil || base.Name != "dev.example.com" {
+		t.Fatalf("expected default base domain, got %v %v", base, err)
+	}
+
+	base, err = bases.choose("hooks.example.com", "", hooks)
+	if err != nil || base.Name != "hooks.example.com" {
+		t.Fatalf("expected hooks base domain, got %v %v", base, err)
+	}
+
+	base, err = bases.choose("", "wechat.hooks.example.com", hooks)
+	if err != nil || base.Name != "hooks.example.com" {
+		t.Fatalf("expected hooks base domain by domain, got %v %v", base, err)
+	}
+
+	if _, err = bases.choose("hooks.example.com", "", dev); err == nil {
+		t.Fatal("expected credential not allowed error")
+	}
+
+	if _, err = bases.choose("unknown.example.com", "", dev); err == nil {
+		t.Fatal("expected base domain not found error")
+	}
+
+	if base.AllowProtocol("tcp") || !base.AllowProtocol("http") {
+		t.Fatal("unexpected protocol permission")
+	}
+
+	if bases.match("api.ourcompany.com") != nil {
+		t.Fatal("expected custom domain")
+	}
+}
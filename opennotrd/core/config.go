@@ -2,8 +2,14 @@ package core
 
 import (
 	"encoding/json"
+	"fmt"
 	"io/ioutil"
+	"net"
 
+	"github.com/ICKelin/opennotr/opennotrd/admin"
+	"github.com/ICKelin/opennotr/opennotrd/certs"
+	"github.com/ICKelin/opennotr/opennotrd/plugin"
+	"github.com/ICKelin/opennotr/opennotrd/plugin/external"
 	"gopkg.in/yaml.v2"
 )
 
@@ -13,13 +19,106 @@ type Config struct {
 	ResolverConfig   ResolverConfig    `yaml:"resolver"`
 	TCPForwardConfig TCPForwardConfig  `yaml:"tcpforward"`
 	UDPForwardConfig UDPForwardConfig  `yaml:"udpforward"`
+	ACMEConfig       certs.ACMEConfig  `yaml:"acme"`
+	CertStoreConfig  certs.StoreConfig `yaml:"certStore"`
+	AdminConfig      admin.Config      `yaml:"admin"`
+	ExternalPlugins  external.Config   `yaml:"externalPlugins"`
 	Plugins          map[string]string `yaml:"plugin"`
 }
 
 type ServerConfig struct {
-	ListenAddr string `yaml:"listen"`
-	AuthKey    string `yaml:"authKey"`
-	Domain     string `yaml:"domain"`
+	ListenAddr  string             `yaml:"listen"`
+	AuthKey     string             `yaml:"authKey"`
+	Domain      string             `yaml:"domain"`
+	Credentials []CredentialConfig `yaml:"credentials"`
+
+	// Domains specific more base domains
+	// $Domain is the first base domain if it is not empty
+	Domains []BaseDomainConfig `yaml:"domains"`
+
+	// Takeover allows a client to take over a domain held by
+	// a live session which authorized by the same credential
+	Takeover bool `yaml:"takeover"`
+
+	// PublicIP configures how to get the server public ip
+	PublicIP PublicIPConfig `yaml:"publicIP"`
+
+	// Naming configures domain generation for clients without domain
+	Naming NamingConfig `yaml:"naming"`
+
+	// CustomDomain configures domains not under $Domain
+	CustomDomain CustomDomainConfig `yaml:"customDomain"`
+}
+
+type BaseDomainConfig struct {
+	Name string `yaml:"name"`
+
+	// Plugins specific protocols clients can forward under this domain
+	// empty means all plugins
+	Plugins []string `yaml:"plugins"`
+
+	// ResolveIP specific the ip written to dns for subdomains
+	// empty means the server public ip
+	ResolveIP string `yaml:"resolveIP"`
+
+	// Credentials specific credential names allowed to use this domain
+	// empty means all credentials
+	Credentials []string `yaml:"credentials"`
+}
+
+type PublicIPConfig struct {
+	// Static specific the public ip directly
+	Static string `yaml:"static"`
+
+	// Interface specific the interface which holds the public ip
+	Interface string `yaml:"interface"`
+
+	// URLs specific discovery urls which reply the ip in body
+	// the urls are tried in order until success
+	// default is http://ipv4.icanhazip.com
+	URLs []string `yaml:"urls"`
+
+	// Refresh specific refresh interval in second, default 300
+	Refresh int `yaml:"refresh"`
+}
+
+type NamingConfig struct {
+	// Strategy specific how to generate names: random, words or hash
+	// random: random characters, default strategy
+	// words: adjective-noun, eg: swift-otter
+	// hash: hash of client identity, the name survives reconnects
+	Strategy string `yaml:"strategy"`
+
+	// Length specific the name length of random and hash strategy
+	// default 8
+	Length int `yaml:"length"`
+
+	// Prefix is prepended to generated names, letters, digits and
+	// hyphens only, prefix and name length should not exceed 63
+	Prefix string `yaml:"prefix"`
+
+	// Retries specific the max attempts if a name is in used
+	// default 8
+	Retries int `yaml:"retries"`
+}
+
+type CustomDomainConfig struct {
+	// Enable verifies custom domains before accepting them
+	// custom domains are rejected if not enabled
+	Enable bool `yaml:"enable"`
+
+	// Resolver specific dns server address used for verification
+	// eg: 8.8.8.8:53, default is the system resolver
+	Resolver string `yaml:"resolver"`
+
+	// Timeout specific verify timeout in second, default 10 seconds
+	Timeout int `yaml:"timeout"`
+}
+
+type CredentialConfig struct {
+	Name    string   `yaml:"name"`
+	Key     string   `yaml:"key"`
+	Domains []string `yaml:"domains"`
 }
 
 type TCPForwardConfig struct {
@@ -59,3 +158,45 @@ func (c *Config) String() string {
 	cnt, _ := json.Marshal(c)
 	return string(cnt)
 }
+
+// Check validates the configuration without listening any ports
+// plugin configurations are validated by schemas of plugins,
+// all invalid values are returned as *plugin.ConfigError
+func (c *Config) Check() error {
+	e := &plugin.ConfigError{}
+	add := func(path string, err error) {
+		e.Errors = append(e.Errors, path+": "+err.Error())
+	}
+
+	if _, _, err := net.SplitHostPort(c.ServerConfig.ListenAddr); err != nil {
+		add("server.listen", err)
+	}
+
+	if len(newBaseDomains(c.ServerConfig)) == 0 {
+		add("server.domain", fmt.Errorf("no base domain configured"))
+	}
+
+	if _, err := NewDomainNamer(c.ServerConfig.Naming); err != nil {
+		add("server.naming", err)
+	}
+
+	if _, _, err := getIPRange(c.DHCPConfig.Cidr); err != nil {
+		add("dhcp.cidr", err)
+	}
+
+	if err := c.AdminConfig.Check(); err != nil {
+		add("admin", err)
+	}
+
+	err := plugin.Check(c.Plugins)
+	if ce, ok := err.(*plugin.ConfigError); ok {
+		e.Errors = append(e.Errors, ce.Errors...)
+	} else if err != nil {
+		add("plugin", err)
+	}
+
+	if len(e.Errors) > 0 {
+		return e
+	}
+	return nil
+}
@@ -0,0 +1,88 @@
+package core
+
+import (
+	"crypto/subtle"
+	"path"
+	"strings"
+)
+
+// defaultCredential is the credential name of the legacy authKey
+const defaultCredential = "default"
+
+// Credential defines a client key and the domains it may claim
+type Credential struct {
+	Name string
+	Key  string
+
+	// Domains stores domain patterns this credential is allowed to claim
+	// patterns use path.Match syntax, eg: team-a-*, *.team-a.example.com
+	// a wildcard never matches across labels.
+	// empty means any domain
+	Domains []string
+}
+
+type credentials []*Credential
+
+func newCredentials(cfg ServerConfig) credentials {
+	creds := make(credentials, 0, len(cfg.Credentials)+1)
+	for _, c := range cfg.Credentials {
+		creds = append(creds, &Credential{
+			Name:    c.Name,
+			Key:     c.Key,
+			Domains: c.Domains,
+		})
+	}
+
+	// authKey is kept as an unrestricted credential
+	// for the configuration without credentials
+	if len(cfg.AuthKey) > 0 {
+		creds = append(creds, &Credential{
+			Name: defaultCredential,
+			Key:  cfg.AuthKey,
+		})
+	}
+	return creds
+}
+
+// lookup returns the credential match the key, nil if not found
+func (creds credentials) lookup(key string) *Credential {
+	for _, c := range creds {
+		if subtle.ConstantTimeCompare([]byte(c.Key), []byte(key)) == 1 {
+			return c
+		}
+	}
+	return nil
+}
+
+// AllowDomain checks whether the credential can claim domain.
+// A pattern is matched against the full domain, and against
+// the name under baseDomain if the domain is one of its subdomains.
+func (c *Credential) AllowDomain(domain, baseDomain string) bool {
+	if len(c.Domains) == 0 {
+		return true
+	}
+
+	sub := ""
+	if len(baseDomain) > 0 && strings.HasSuffix(domain, "."+baseDomain) {
+		sub = strings.TrimSuffix(domain, "."+baseDomain)
+	}
+
+	for _, pattern := range c.Domains {
+		if matchDomain(pattern, domain) {
+			return true
+		}
+
+		if len(sub) > 0 && matchDomain(pattern, sub) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchDomain matches domain with pattern label by label
+func matchDomain(pattern, domain string) bool {
+	pattern = strings.Replace(normalizeDomain(pattern), ".", "/", -1)
+	domain = strings.Replace(domain, ".", "/", -1)
+	ok, _ := path.Match(pattern, domain)
+	return ok
+}
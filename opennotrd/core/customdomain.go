@@ -0,0 +1,81 @@
+package core
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/ICKelin/opennotr/internal/logs"
+	"github.com/ICKelin/opennotr/internal/proto"
+)
+
+var (
+	// default custom domain verify timeout(seconds)
+	defaultVerifyTimeout = 10
+)
+
+// DomainVerifier verifies the client controls a custom domain
+// by a TXT record before it is accepted.
+// There is no http challenge, the domain points to opennotrd whose
+// http port can not serve a token of the client before it connects.
+type DomainVerifier struct {
+	timeout  time.Duration
+	resolver *net.Resolver
+}
+
+func NewDomainVerifier(cfg CustomDomainConfig) *DomainVerifier {
+	timeout := cfg.Timeout
+	if timeout <= 0 {
+		timeout = defaultVerifyTimeout
+	}
+
+	resolver := net.DefaultResolver
+	if len(cfg.Resolver) > 0 {
+		// all lookups go to the configured dns server
+		resolverAddr := cfg.Resolver
+		resolver = &net.Resolver{
+			PreferGo: true,
+			Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+				d := net.Dialer{}
+				return d.DialContext(ctx, network, resolverAddr)
+			},
+		}
+	}
+
+	return &DomainVerifier{
+		timeout:  time.Duration(timeout) * time.Second,
+		resolver: resolver,
+	}
+}
+
+// Verify checks the TXT record of domain is the challenge token of key
+func (v *DomainVerifier) Verify(domain, key string) error {
+	token := proto.DomainChallenge(key, domain)
+	err := v.verifyTXT(domain, token)
+	if err != nil {
+		return fmt.Errorf("verify domain %s fail, set TXT record %s to %s: %v",
+			domain, proto.ChallengeRecord(domain), token, err)
+	}
+
+	logs.Info("domain %s verified", domain)
+	return nil
+}
+
+func (v *DomainVerifier) verifyTXT(domain, token string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), v.timeout)
+	defer cancel()
+
+	records, err := v.resolver.LookupTXT(ctx, proto.ChallengeRecord(domain))
+	if err != nil {
+		return err
+	}
+
+	for _, record := range records {
+		if strings.TrimSpace(record) == token {
+			return nil
+		}
+	}
+	return fmt.Errorf("token not found in TXT records")
+}
@@ -0,0 +1,94 @@
+package core
+
+import (
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/ICKelin/opennotr/internal/proto"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// runDNS runs a local dns stand-in which replies TXT and A records
+func runDNS(t *testing.T, txt map[string]string, a map[string]string) net.PacketConn {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			nr, raddr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+
+			var req dnsmessage.Message
+			if err := req.Unpack(buf[:nr]); err != nil || len(req.Questions) == 0 {
+				continue
+			}
+
+			q := req.Questions[0]
+			name := strings.TrimSuffix(q.Name.String(), ".")
+			reply := dnsmessage.Message{
+				Header:    dnsmessage.Header{ID: req.ID, Response: true, Authoritative: true},
+				Questions: req.Questions,
+			}
+			hdr := dnsmessage.ResourceHeader{Name: q.Name, Type: q.Type, Class: q.Class, TTL: 60}
+			switch q.Type {
+			case dnsmessage.TypeTXT:
+				if v, ok := txt[name]; ok {
+					reply.Answers = append(reply.Answers, dnsmessage.Resource{
+						Header: hdr,
+						Body:   &dnsmessage.TXTResource{TXT: []string{v}},
+					})
+				}
+			case dnsmessage.TypeA:
+				if v, ok := a[name]; ok {
+					ip := [4]byte{}
+					copy(ip[:], net.ParseIP(v).To4())
+					reply.Answers = append(reply.Answers, dnsmessage.Resource{
+						Header: hdr,
+						Body:   &dnsmessage.AResource{A: ip},
+					})
+				}
+			}
+
+			if len(reply.Answers) == 0 && q.Type != dnsmessage.TypeAAAA {
+				reply.RCode = dnsmessage.RCodeNameError
+			}
+
+			out, err := reply.Pack()
+			if err != nil {
+				continue
+			}
+			conn.WriteTo(out, raddr)
+		}
+	}()
+
+	return conn
+}
+
+func TestVerifyTXT(t *testing.T) {
+	key, domain := "team a key", "api.example.com"
+	token := proto.DomainChallenge(key, domain)
+	dns := runDNS(t, map[string]string{proto.ChallengeRecord(domain): token}, nil)
+	defer dns.Close()
+
+	v := NewDomainVerifier(CustomDomainConfig{
+		Resolver: dns.LocalAddr().String(),
+	})
+
+	if err := v.Verify(domain, key); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := v.Verify(domain, "another key"); err == nil {
+		t.Fatal("expected verify fail for another key")
+	}
+
+	if err := v.Verify("web.example.com", key); err == nil {
+		t.Fatal("expected verify fail for domain without record")
+	}
+}
@@ -0,0 +1,166 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ICKelin/opennotr/internal/logs"
+)
+
+// ErrDomainInUse is returned if the domain is held by another live session
+var ErrDomainInUse = errors.New("domain is in used")
+
+var (
+	// default time to wait for the previous session release its domain
+	defaultTakeoverTimeout = time.Second * 10
+
+	// a session reads nothing in this duration is dead
+	// clients send smux keepalive frames every 10 seconds
+	defaultHeartbeatTimeout = time.Second * 20
+)
+
+// idler is implemented by connections who know how long
+// they read nothing, see activeConn
+type idler interface {
+	Idle() time.Duration
+}
+
+// domainHolder is the live session who holds a domain
+type domainHolder struct {
+	owner string
+	addr  string
+
+	// identity is the client holds a generated domain, empty if not generated
+	identity string
+
+	// closer closes the holder's connection when it is taken over
+	closer io.Closer
+
+	// done closes after the holder release the domain
+	done chan struct{}
+}
+
+// DomainLease is returned by DomainRegistry.Register
+// the holder MUST call Release when session close
+type DomainLease struct {
+	registry *DomainRegistry
+	domain   string
+	holder   *domainHolder
+}
+
+// DomainRegistry stores domains held by live sessions
+// a domain can only be held by one session at the same time
+type DomainRegistry struct {
+	mu      sync.Mutex
+	domains map[string]*domainHolder
+
+	// takeover allows a session to take over a domain
+	// held by another session of the same credential
+	takeover        bool
+	takeoverTimeout time.Duration
+
+	// heartbeatTimeout decides whether a holder is dead
+	heartbeatTimeout time.Duration
+}
+
+func NewDomainRegistry(takeover bool) *DomainRegistry {
+	return &DomainRegistry{
+		domains:          make(map[string]*domainHolder),
+		takeover:         takeover,
+		takeoverTimeout:  defaultTakeoverTimeout,
+		heartbeatTimeout: defaultHeartbeatTimeout,
+	}
+}
+
+// Register binds domain to owner.
+// It fails if the domain is held by a live session of another owner.
+// If the domain is held by the same owner, the previous session
+// is closed and replaced when takeover is enabled.
+func (r *DomainRegistry) Register(domain, owner, addr string, closer io.Closer) (*DomainLease, error) {
+	return r.RegisterIdentity(domain, owner, "", addr, closer)
+}
+
+// RegisterIdentity is Register for a domain generated from identity,
+// the same identity reconnecting replaces its dead session even if
+// takeover is disabled, so it gets the same domain instead of the next one.
+// A live session of the same identity is kept, eg: two machines of the
+// same hostname, and ErrDomainInUse is returned to try the next name.
+func (r *DomainRegistry) RegisterIdentity(domain, owner, identity, addr string, closer io.Closer) (*DomainLease, error) {
+	domain = normalizeDomain(domain)
+	for {
+		r.mu.Lock()
+		holder, ok := r.domains[domain]
+		if !ok {
+			holder = &domainHolder{
+				owner:    owner,
+				addr:     addr,
+				identity: identity,
+				closer:   closer,
+				done:     make(chan struct{}),
+			}
+			r.domains[domain] = holder
+			r.mu.Unlock()
+			return &DomainLease{registry: r, domain: domain, holder: holder}, nil
+		}
+		r.mu.Unlock()
+
+		if holder.owner != owner {
+			return nil, fmt.Errorf("%w: %s is owned by another credential", ErrDomainInUse, domain)
+		}
+
+		sameIdentity := len(identity) > 0 && holder.identity == identity
+		if !r.takeover && !(sameIdentity && holder.dead(r.heartbeatTimeout)) {
+			return nil, fmt.Errorf("%w: %s is held by %s", ErrDomainInUse, domain, holder.addr)
+		}
+
+		logs.Warn("domain %s take over from %s", domain, holder.addr)
+		holder.closer.Close()
+		select {
+		case <-holder.done:
+		case <-time.After(r.takeoverTimeout):
+			return nil, fmt.Errorf("take over domain %s timeout", domain)
+		}
+	}
+}
+
+// dead checks whether the holder's session is closed or misses heartbeats
+func (h *domainHolder) dead(timeout time.Duration) bool {
+	select {
+	case <-h.done:
+		return true
+	default:
+	}
+
+	c, ok := h.closer.(idler)
+	return ok && c.Idle() > timeout
+}
+
+// Lookup returns the owner of domain, empty if the domain is free
+func (r *DomainRegistry) Lookup(domain string) string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	holder, ok := r.domains[normalizeDomain(domain)]
+	if !ok {
+		return ""
+	}
+	return holder.owner
+}
+
+// Release releases the domain
+func (l *DomainLease) Release() {
+	r := l.registry
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.domains[l.domain] == l.holder {
+		delete(r.domains, l.domain)
+	}
+	close(l.holder.done)
+}
+
+func normalizeDomain(domain string) string {
+	return strings.TrimSuffix(strings.ToLower(domain), ".")
+}
@@ -0,0 +1,195 @@
+package core
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/ICKelin/opennotr/internal/proto"
+)
+
+type mockCloser struct {
+	closed chan struct{}
+	idle   time.Duration
+}
+
+func (c *mockCloser) Idle() time.Duration {
+	return c.idle
+}
+
+func (c *mockCloser) Close() error {
+	close(c.closed)
+	return nil
+}
+
+func TestDomainRegistryOwner(t *testing.T) {
+	r := NewDomainRegistry(false)
+	lease, err := r.Register("a.open.notr.tech", "team-a", "1.1.1.1:1", &mockCloser{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = r.Register("A.open.notr.tech.", "team-b", "2.2.2.2:2", &mockCloser{})
+	if err == nil {
+		t.Fatal("expected domain owned error")
+	}
+
+	_, err = r.Register("a.open.notr.tech", "team-a", "3.3.3.3:3", &mockCloser{})
+	if err == nil {
+		t.Fatal("expected domain in used error without takeover")
+	}
+
+	lease.Release()
+	if owner := r.Lookup("a.open.notr.tech"); owner != "" {
+		t.Fatalf("expected released domain, got owner %s", owner)
+	}
+
+	_, err = r.Register("a.open.notr.tech", "team-b", "2.2.2.2:2", &mockCloser{})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDomainRegistryTakeover(t *testing.T) {
+	r := NewDomainRegistry(true)
+	old := &mockCloser{closed: make(chan struct{})}
+	oldLease, err := r.Register("a.open.notr.tech", "team-a", "1.1.1.1:1", old)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the previous session releases its domain after connection close
+	go func() {
+		<-old.closed
+		oldLease.Release()
+	}()
+
+	_, err = r.Register("a.open.notr.tech", "team-b", "2.2.2.2:2", &mockCloser{})
+	if err == nil {
+		t.Fatal("expected domain owned error")
+	}
+
+	r.takeoverTimeout = time.Second
+	lease, err := r.Register("a.open.notr.tech", "team-a", "3.3.3.3:3", &mockCloser{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if lease.holder.addr != "3.3.3.3:3" {
+		t.Fatalf("expected new holder, got %s", lease.holder.addr)
+	}
+}
+
+func TestDomainRegistryIdentity(t *testing.T) {
+	r := NewDomainRegistry(false)
+	r.takeoverTimeout = time.Second
+	old := &mockCloser{closed: make(chan struct{})}
+	oldLease, err := r.RegisterIdentity("k3x9.open.notr.tech", "team-a", "team-a/laptop", "1.1.1.1:1", old)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go func() {
+		<-old.closed
+		oldLease.Release()
+	}()
+
+	// another client of the same credential can not take it
+	_, err = r.RegisterIdentity("k3x9.open.notr.tech", "team-a", "team-a/desktop", "2.2.2.2:2", &mockCloser{})
+	if !errors.Is(err, ErrDomainInUse) {
+		t.Fatalf("expected domain in used, got %v", err)
+	}
+
+	// the same identity can not take a live session, eg: same hostname
+	_, err = r.RegisterIdentity("k3x9.open.notr.tech", "team-a", "team-a/laptop", "3.3.3.3:3", &mockCloser{})
+	if !errors.Is(err, ErrDomainInUse) {
+		t.Fatalf("expected live session kept, got %v", err)
+	}
+
+	// the reconnecting client replaces its dead session
+	old.idle = r.heartbeatTimeout + time.Second
+	lease, err := r.RegisterIdentity("k3x9.open.notr.tech", "team-a", "team-a/laptop", "1.1.1.1:2", &mockCloser{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if lease.holder.addr != "1.1.1.1:2" {
+		t.Fatalf("expected new holder, got %s", lease.holder.addr)
+	}
+}
+
+func TestCredentialAllowDomain(t *testing.T) {
+	cred := &Credential{Name: "team-a", Domains: []string{"team-a-*"}}
+	tests := map[string]bool{
+		"team-a-api.open.notr.tech": true,
+		"team-a-web":                true,
+		"team-b-api.open.notr.tech": false,
+		"team-b-api":                false,
+		"team-a-api.example.com":    false,
+	}
+
+	for domain, expected := range tests {
+		if got := cred.AllowDomain(domain, "open.notr.tech"); got != expected {
+			t.Errorf("%s: expected %v, got %v", domain, expected, got)
+		}
+	}
+}
+
+func TestClaimDomainInvalid(t *testing.T) {
+	s := &Server{
+		bases:    newBaseDomains(ServerConfig{Domain: "open.notr.tech"}),
+		registry: NewDomainRegistry(false),
+	}
+	cred := &Credential{Name: "team-a"}
+	conn, peer := net.Pipe()
+	defer conn.Close()
+	defer peer.Close()
+
+	for _, domain := range []string{
+		"x;} server { listen 80; }.open.notr.tech",
+		"a/../../etc.open.notr.tech",
+		"a b.open.notr.tech",
+		"a\nb.open.notr.tech",
+		"-a.open.notr.tech",
+		"a..open.notr.tech",
+	} {
+		_, err := s.claimDomain(&proto.C2SAuth{Domain: domain}, cred, s.bases[0], conn)
+		if err == nil {
+			t.Errorf("%q: expected invalid domain error", domain)
+		}
+	}
+
+	// custom domains are rejected if verification is not enabled
+	_, err := s.claimDomain(&proto.C2SAuth{Domain: "api.example.com"}, cred, s.bases[0], conn)
+	if err == nil {
+		t.Error("expected domain outside base domains rejected")
+	}
+
+	lease, err := s.claimDomain(&proto.C2SAuth{Domain: "Dev-1.open.notr.tech"}, cred, s.bases[0], conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lease.Release()
+}
+
+func TestActiveConnIdle(t *testing.T) {
+	conn, peer := net.Pipe()
+	defer peer.Close()
+
+	c := newActiveConn(conn)
+	c.lastRead = time.Now().Add(-time.Minute).UnixNano()
+	go peer.Write([]byte("ping"))
+	if _, err := c.Read(make([]byte, 4)); err != nil {
+		t.Fatal(err)
+	}
+
+	if idle := c.Idle(); idle > time.Second {
+		t.Fatalf("expected active after read, got idle %s", idle)
+	}
+
+	c.Close()
+	if idle := c.Idle(); idle < defaultHeartbeatTimeout {
+		t.Fatalf("expected closed connection idle, got %s", idle)
+	}
+}
@@ -0,0 +1,175 @@
+package core
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"math/big"
+	"strings"
+
+	"github.com/ICKelin/opennotr/opennotrd/plugin"
+)
+
+var (
+	// default generated name length for random and hash strategy
+	defaultNameLength = 8
+
+	// default retry times when a generated domain is in used
+	defaultNameRetries = 8
+
+	// naming strategies
+	namingRandom = "random"
+	namingWords  = "words"
+	namingHash   = "hash"
+)
+
+const nameAlphabet = "23456789abcdefghjkmnpqrstuvwxyz"
+
+// DomainNamer generates domain names for clients without domain
+type DomainNamer interface {
+	// Name returns the name of the attempt-th try for client identity.
+	// The caller increases attempt and tries again if the
+	// domain is held by another live session.
+	Name(identity string, attempt int) string
+}
+
+// NewDomainNamer creates a domain namer base on configuration
+func NewDomainNamer(cfg NamingConfig) (DomainNamer, error) {
+	length := cfg.Length
+	if length <= 0 {
+		length = defaultNameLength
+	}
+
+	var namer DomainNamer
+	switch cfg.Strategy {
+	case "", namingRandom:
+		namer = &randomNamer{length: length}
+	case namingWords:
+		namer = &wordsNamer{}
+		length = maxWordsLength()
+	case namingHash:
+		namer = &hashNamer{length: length}
+	default:
+		return nil, fmt.Errorf("unsupported naming strategy %s", cfg.Strategy)
+	}
+
+	// generated names are a label of the base domain
+	if strings.Contains(cfg.Prefix, ".") || plugin.CheckDomain(cfg.Prefix+"x") != nil {
+		return nil, fmt.Errorf("invalid prefix %q: only letters, digits and hyphens, not starts with hyphen", cfg.Prefix)
+	}
+
+	if n := len(cfg.Prefix) + length; n > 63 {
+		return nil, fmt.Errorf("generated name length %d exceeds 63 of a label", n)
+	}
+
+	if len(cfg.Prefix) > 0 {
+		namer = &prefixNamer{prefix: cfg.Prefix, namer: namer}
+	}
+	return namer, nil
+}
+
+// randomNamer generates names from crypto random source
+type randomNamer struct {
+	length int
+}
+
+func (n *randomNamer) Name(identity string, attempt int) string {
+	buf := make([]byte, n.length)
+	for i := range buf {
+		buf[i] = nameAlphabet[randInt(len(nameAlphabet))]
+	}
+	return string(buf)
+}
+
+// wordsNamer generates adjective-noun names
+// a number suffix is appended after the first attempt
+type wordsNamer struct{}
+
+func (n *wordsNamer) Name(identity string, attempt int) string {
+	name := fmt.Sprintf("%s-%s",
+		adjectives[randInt(len(adjectives))],
+		nouns[randInt(len(nouns))])
+	if attempt > 0 {
+		name = fmt.Sprintf("%s-%d", name, randInt(100))
+	}
+	return name
+}
+
+// hashNamer generates names from the client identity
+// so the client gets the same domain after reconnect
+type hashNamer struct {
+	length int
+}
+
+func (n *hashNamer) Name(identity string, attempt int) string {
+	input := identity
+	if attempt > 0 {
+		input = fmt.Sprintf("%s#%d", identity, attempt)
+	}
+
+	sum := sha256.Sum256([]byte(input))
+	num := new(big.Int).SetBytes(sum[:])
+	base := big.NewInt(int64(len(nameAlphabet)))
+	mod := new(big.Int)
+	buf := make([]byte, n.length)
+	for i := range buf {
+		num.DivMod(num, base, mod)
+		buf[i] = nameAlphabet[mod.Int64()]
+	}
+	return string(buf)
+}
+
+type prefixNamer struct {
+	prefix string
+	namer  DomainNamer
+}
+
+func (n *prefixNamer) Name(identity string, attempt int) string {
+	return n.prefix + n.namer.Name(identity, attempt)
+}
+
+// maxWordsLength returns the max length of names of wordsNamer
+func maxWordsLength() int {
+	longest := func(words []string) int {
+		max := 0
+		for _, w := range words {
+			if len(w) > max {
+				max = len(w)
+			}
+		}
+		return max
+	}
+
+	// adjective-noun-99
+	return longest(adjectives) + longest(nouns) + len("--99")
+}
+
+func randInt(max int) int {
+	buf := make([]byte, 8)
+	_, err := rand.Read(buf)
+	if err != nil {
+		panic(err)
+	}
+	return int(binary.BigEndian.Uint64(buf) % uint64(max))
+}
+
+var adjectives = []string{
+	"amber", "ancient", "bold", "brave", "bright", "calm", "clever", "cool",
+	"crisp", "curious", "daring", "eager", "fancy", "fast", "fluffy", "gentle",
+	"giant", "golden", "happy", "hidden", "humble", "icy", "jolly", "keen",
+	"kind", "lively", "lucky", "mellow", "mighty", "misty", "noble", "odd",
+	"polite", "proud", "quick", "quiet", "rapid", "rusty", "shiny", "silent",
+	"silver", "sleepy", "smart", "snowy", "steady", "sunny", "swift", "tidy",
+	"tiny", "vivid", "warm", "wild", "wise", "witty", "young", "zesty",
+}
+
+var nouns = []string{
+	"badger", "bear", "beaver", "bison", "cat", "cheetah", "cobra", "crane",
+	"crow", "deer", "dolphin", "dove", "eagle", "falcon", "ferret", "finch",
+	"fox", "gecko", "goose", "hawk", "heron", "horse", "ibis", "jaguar",
+	"koala", "lemur", "lion", "lynx", "mole", "moose", "otter", "owl",
+	"panda", "parrot", "pelican", "puma", "rabbit", "raven", "seal", "shark",
+	"sloth", "sparrow", "swan", "tiger", "toucan", "turtle", "walrus", "whale",
+	"wolf", "wombat", "yak", "zebra",
+}
@@ -0,0 +1,74 @@
+package core
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestHashNamerStable(t *testing.T) {
+	namer, err := NewDomainNamer(NamingConfig{Strategy: namingHash, Length: 10, Prefix: "dev-"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	name := namer.Name("team-a/laptop", 0)
+	if !strings.HasPrefix(name, "dev-") || len(name) != len("dev-")+10 {
+		t.Fatalf("unexpected name %s", name)
+	}
+
+	if again := namer.Name("team-a/laptop", 0); again != name {
+		t.Fatalf("expected stable name %s, got %s", name, again)
+	}
+
+	if retry := namer.Name("team-a/laptop", 1); retry == name {
+		t.Fatalf("expected another name for retry")
+	}
+
+	if other := namer.Name("team-a/desktop", 0); other == name {
+		t.Fatalf("expected another name for another client")
+	}
+}
+
+func TestWordsNamer(t *testing.T) {
+	namer, err := NewDomainNamer(NamingConfig{Strategy: namingWords})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if sp := strings.Split(namer.Name("", 0), "-"); len(sp) != 2 {
+		t.Fatalf("expected adjective-noun, got %v", sp)
+	}
+
+	if sp := strings.Split(namer.Name("", 1), "-"); len(sp) != 3 {
+		t.Fatalf("expected adjective-noun-number, got %v", sp)
+	}
+}
+
+func TestUnknownNamer(t *testing.T) {
+	_, err := NewDomainNamer(NamingConfig{Strategy: "unknown"})
+	if err == nil {
+		t.Fatal("expected unsupported strategy error")
+	}
+}
+
+func TestNamerLabel(t *testing.T) {
+	tests := []struct {
+		cfg NamingConfig
+		ok  bool
+	}{
+		{NamingConfig{Prefix: "dev-", Length: 59}, true},
+		{NamingConfig{Prefix: "dev-", Length: 60}, false},
+		{NamingConfig{Strategy: namingHash, Length: 64}, false},
+		{NamingConfig{Strategy: namingWords, Prefix: strings.Repeat("x", 60)}, false},
+		{NamingConfig{Prefix: "a_b."}, false},
+		{NamingConfig{Prefix: "a."}, false},
+		{NamingConfig{Prefix: "-dev"}, false},
+	}
+
+	for _, test := range tests {
+		_, err := NewDomainNamer(test.cfg)
+		if test.ok != (err == nil) {
+			t.Errorf("%+v: expected ok %v, got %v", test.cfg, test.ok, err)
+		}
+	}
+}
@@ -0,0 +1,175 @@
+package core
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ICKelin/opennotr/internal/logs"
+)
+
+var (
+	// default public ip discovery urls
+	defaultPublicIPURLs = []string{"http://ipv4.icanhazip.com"}
+
+	// default public ip refresh interval(seconds)
+	defaultPublicIPRefresh = 300
+
+	// default public ip discovery timeout
+	defaultPublicIPTimeout = time.Second * 10
+)
+
+// PublicIP caches the server public ip
+// the ip is resolved from static value, interface or discovery urls
+// and refreshed periodically if it is not static
+type PublicIP struct {
+	cfg     PublicIPConfig
+	refresh time.Duration
+
+	mu sync.RWMutex
+	ip string
+}
+
+func NewPublicIP(cfg PublicIPConfig) *PublicIP {
+	if len(cfg.Static) <= 0 && len(cfg.Interface) <= 0 && len(cfg.URLs) == 0 {
+		cfg.URLs = defaultPublicIPURLs
+	}
+
+	refresh := cfg.Refresh
+	if refresh <= 0 {
+		refresh = defaultPublicIPRefresh
+	}
+
+	p := &PublicIP{
+		cfg:     cfg,
+		refresh: time.Duration(refresh) * time.Second,
+	}
+
+	// static and interface ip are resolved at once,
+	// discovery urls may block startup so they are fetched by Run
+	if len(cfg.Static) > 0 || len(cfg.Interface) > 0 {
+		p.update()
+	}
+	return p
+}
+
+// Get returns the cached public ip, empty if never resolved
+func (p *PublicIP) Get() string {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.ip
+}
+
+// Run discovers public ip by urls at first and
+// refreshes public ip periodically
+func (p *PublicIP) Run() {
+	if len(p.cfg.Static) > 0 {
+		return
+	}
+
+	if len(p.cfg.Interface) <= 0 {
+		p.update()
+	}
+
+	tick := time.NewTicker(p.refresh)
+	defer tick.Stop()
+	for range tick.C {
+		p.update()
+	}
+}
+
+// update resolves public ip and keeps the previous one on failure
+func (p *PublicIP) update() {
+	ip, err := p.resolve()
+	if err != nil {
+		logs.Error("get public ip fail: %v, keep %s", err, p.Get())
+		return
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.ip != ip {
+		logs.Info("public ip changed from %s to %s", p.ip, ip)
+		p.ip = ip
+	}
+}
+
+func (p *PublicIP) resolve() (string, error) {
+	if len(p.cfg.Static) > 0 {
+		return p.cfg.Static, nil
+	}
+
+	if len(p.cfg.Interface) > 0 {
+		return interfaceIP(p.cfg.Interface)
+	}
+
+	// try urls one by one until success
+	var lastErr error
+	for _, url := range p.cfg.URLs {
+		ip, err := discoverIP(url)
+		if err == nil {
+			return ip, nil
+		}
+		logs.Warn("discover public ip from %s fail: %v", url, err)
+		lastErr = err
+	}
+	return "", lastErr
+}
+
+// interfaceIP returns the first ipv4 address of the interface
+func interfaceIP(name string) (string, error) {
+	iface, err := net.InterfaceByName(name)
+	if err != nil {
+		return "", err
+	}
+
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return "", err
+	}
+
+	for _, addr := range addrs {
+		ipnet, ok := addr.(*net.IPNet)
+		if !ok {
+			continue
+		}
+
+		if ip := ipnet.IP.To4(); ip != nil {
+			return ip.String(), nil
+		}
+	}
+	return "", fmt.Errorf("no ipv4 address on %s", name)
+}
+
+// discoverIP gets public ip from url which replies the ip in body
+func discoverIP(url string) (string, error) {
+	cli := http.Client{
+		Timeout: defaultPublicIPTimeout,
+	}
+
+	resp, err := cli.Get(url)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("reply status %d", resp.StatusCode)
+	}
+
+	content, err := ioutil.ReadAll(io.LimitReader(resp.Body, 256))
+	if err != nil {
+		return "", err
+	}
+
+	str := strings.TrimSpace(string(content))
+	if net.ParseIP(str) == nil {
+		return "", fmt.Errorf("invalid ip %q", str)
+	}
+	return str, nil
+}
@@ -0,0 +1,60 @@
+package core
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestPublicIPFallback(t *testing.T) {
+	bad := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer bad.Close()
+
+	good := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "1.2.3.4")
+	}))
+	defer good.Close()
+
+	// urls are not fetched at startup
+	p := NewPublicIP(PublicIPConfig{URLs: []string{bad.URL, good.URL}})
+	if ip := p.Get(); ip != "" {
+		t.Fatalf("expected ip discovered by Run, got %s", ip)
+	}
+
+	p.update()
+	if ip := p.Get(); ip != "1.2.3.4" {
+		t.Fatalf("expected 1.2.3.4, got %s", ip)
+	}
+
+	// keep the cached ip if discovery fail
+	good.Close()
+	p.update()
+	if ip := p.Get(); ip != "1.2.3.4" {
+		t.Fatalf("expected cached 1.2.3.4, got %s", ip)
+	}
+}
+
+func TestPublicIPStatic(t *testing.T) {
+	p := NewPublicIP(PublicIPConfig{Static: "5.6.7.8", URLs: []string{"http://127.0.0.1:1"}})
+	if ip := p.Get(); ip != "5.6.7.8" {
+		t.Fatalf("expected 5.6.7.8, got %s", ip)
+	}
+}
+
+func TestPublicIPFail(t *testing.T) {
+	p := NewPublicIP(PublicIPConfig{URLs: []string{"http://127.0.0.1:1"}})
+	p.update()
+	if ip := p.Get(); ip != "" {
+		t.Fatalf("expected empty ip, got %s", ip)
+	}
+}
+
+func TestPublicIPInterface(t *testing.T) {
+	p := NewPublicIP(PublicIPConfig{Interface: "lo"})
+	if ip := p.Get(); ip != "127.0.0.1" {
+		t.Skipf("loopback interface without 127.0.0.1: %s", ip)
+	}
+}
@@ -2,6 +2,8 @@ package core
 
 import (
 	"context"
+	"crypto/sha1"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"strings"
@@ -11,7 +13,8 @@ import (
 )
 
 type record struct {
-	Host string `json:"host"`
+	Host string `json:"host,omitempty"`
+	Text string `json:"text,omitempty"`
 }
 
 type Resolver struct {
@@ -35,17 +38,35 @@ func NewResolve(endpoints []string) (*Resolver, error) {
 }
 
 func (r *Resolver) ApplyDomain(domain, ip string) error {
-	sp := strings.Split(domain, ".")
-	if len(sp) == 0 {
-		return fmt.Errorf("invalid domain: %s", domain)
+	key, err := skydnsKey(domain)
+	if err != nil {
+		return err
 	}
 
-	key := "/skydns"
-	for i := len(sp) - 1; i >= 0; i-- {
-		key = fmt.Sprintf("%s/%s", key, sp[i])
+	value := &record{Host: ip}
+	b, err := json.Marshal(value)
+	if err != nil {
+		return err
 	}
 
-	value := &record{Host: ip}
+	_, err = r.cli.Put(context.Background(), key, string(b))
+	return err
+}
+
+// ApplyTXT adds a TXT record to domain
+// a domain may have multiple TXT records, eg: acme dns-01 challenge
+// for both wildcard and apex domain
+func (r *Resolver) ApplyTXT(domain, text string) error {
+	key, err := skydnsKey(domain)
+	if err != nil {
+		return err
+	}
+
+	// each TXT record is stored in a sub key
+	sum := sha1.Sum([]byte(text))
+	key = fmt.Sprintf("%s/txt-%s", key, hex.EncodeToString(sum[:4]))
+
+	value := &record{Text: text}
 	b, err := json.Marshal(value)
 	if err != nil {
 		return err
@@ -54,3 +75,30 @@ func (r *Resolver) ApplyDomain(domain, ip string) error {
 	_, err = r.cli.Put(context.Background(), key, string(b))
 	return err
 }
+
+// DeleteTXT deletes all TXT records of domain
+func (r *Resolver) DeleteTXT(domain string) error {
+	key, err := skydnsKey(domain)
+	if err != nil {
+		return err
+	}
+
+	_, err = r.cli.Delete(context.Background(), key+"/txt-", clientv3.WithPrefix())
+	return err
+}
+
+// skydnsKey returns the etcd key of domain used by coredns
+// eg: a.open.notr.tech => /skydns/tech/notr/open/a
+func skydnsKey(domain string) (string, error) {
+	domain = strings.TrimSuffix(domain, ".")
+	sp := strings.Split(domain, ".")
+	if len(domain) == 0 || len(sp) == 0 {
+		return "", fmt.Errorf("invalid domain: %s", domain)
+	}
+
+	key := "/skydns"
+	for i := len(sp) - 1; i >= 0; i-- {
+		key = fmt.Sprintf("%s/%s", key, sp[i])
+	}
+	return key, nil
+}
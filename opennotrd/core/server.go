@@ -1,11 +1,9 @@
 package core
 
 import (
+	"errors"
 	"fmt"
-	"io/ioutil"
 	"net"
-	"net/http"
-	"strings"
 	"time"
 
 	"github.com/ICKelin/opennotr/internal/logs"
@@ -15,11 +13,12 @@ import (
 )
 
 type Server struct {
-	cfg      ServerConfig
-	addr     string
-	authKey  string
-	domain   string
-	publicIP string
+	cfg  ServerConfig
+	addr string
+
+	// publicIP caches server public ip
+	// it is written to dns for client domains
+	publicIP *PublicIP
 
 	// dhcp manager select/release ip for client
 	dhcp *DHCP
@@ -32,22 +31,62 @@ type Server struct {
 
 	// sess manager is the model of client session
 	sessMgr *SessionManager
+
+	// creds stores keys the client can use to authorize
+	creds credentials
+
+	// bases stores base domains clients can use
+	bases baseDomains
+
+	// registry stores domains held by live sessions
+	registry *DomainRegistry
+
+	// verifier verifies custom domains, nil if not enabled
+	verifier *DomainVerifier
+
+	// namer generates domain for client without domain
+	namer       DomainNamer
+	nameRetries int
 }
 
 func NewServer(cfg ServerConfig,
 	dhcp *DHCP,
-	resolver *Resolver) *Server {
-	return &Server{
-		cfg:       cfg,
-		addr:      cfg.ListenAddr,
-		authKey:   cfg.AuthKey,
-		domain:    cfg.Domain,
-		publicIP:  publicIP(),
-		dhcp:      dhcp,
-		pluginMgr: plugin.DefaultPluginManager(),
-		resolver:  resolver,
-		sessMgr:   GetSessionManager(),
+	resolver *Resolver) (*Server, error) {
+	var verifier *DomainVerifier
+	if cfg.CustomDomain.Enable {
+		verifier = NewDomainVerifier(cfg.CustomDomain)
+	}
+
+	namer, err := NewDomainNamer(cfg.Naming)
+	if err != nil {
+		return nil, err
 	}
+
+	bases := newBaseDomains(cfg)
+	if len(bases) == 0 {
+		return nil, fmt.Errorf("no base domain configured")
+	}
+
+	nameRetries := cfg.Naming.Retries
+	if nameRetries <= 0 {
+		nameRetries = defaultNameRetries
+	}
+
+	return &Server{
+		cfg:         cfg,
+		addr:        cfg.ListenAddr,
+		publicIP:    NewPublicIP(cfg.PublicIP),
+		dhcp:        dhcp,
+		pluginMgr:   plugin.DefaultPluginManager(),
+		resolver:    resolver,
+		sessMgr:     GetSessionManager(),
+		creds:       newCredentials(cfg),
+		bases:       bases,
+		registry:    NewDomainRegistry(cfg.Takeover),
+		verifier:    verifier,
+		namer:       namer,
+		nameRetries: nameRetries,
+	}, nil
 }
 
 func (s *Server) ListenAndServe() error {
@@ -56,6 +95,8 @@ func (s *Server) ListenAndServe() error {
 		return err
 	}
 
+	go s.publicIP.Run()
+
 	for {
 		conn, err := listener.Accept()
 		if err != nil {
@@ -66,11 +107,13 @@ func (s *Server) ListenAndServe() error {
 	}
 }
 
-func (s *Server) onConn(conn net.Conn) {
+func (s *Server) onConn(c net.Conn) {
+	// the domain registry checks heartbeats of the session by reads
+	conn := newActiveConn(c)
 	defer conn.Close()
 
 	// auth key verify
-	// currently we use auth key which configured in notrd.yaml
+	// the key should match one of the credentials configured in notrd.yaml
 	auth := proto.C2SAuth{}
 	err := proto.ReadJSON(conn, &auth)
 	if err != nil {
@@ -78,17 +121,48 @@ func (s *Server) onConn(conn net.Conn) {
 		return
 	}
 
-	if auth.Key != s.authKey {
+	cred := s.creds.lookup(auth.Key)
+	if cred == nil {
 		logs.Error("verify key fail")
+		s.replyError(conn, fmt.Errorf("verify key fail"))
 		return
 	}
 
-	// if client without domain
-	// generate random domain base on time nano
-	if len(auth.Domain) <= 0 {
-		auth.Domain = fmt.Sprintf("%s.%s", randomDomain(time.Now().UnixNano()), s.domain)
+	base, err := s.bases.choose(auth.BaseDomain, auth.Domain, cred)
+	if err != nil {
+		logs.Error("choose base domain fail: %v", err)
+		s.replyError(conn, err)
+		return
 	}
 
+	// allow checks forwards by the policy of base domain
+	allow := func(item *plugin.PluginMeta) error {
+		if !base.AllowProtocol(item.Protocol) {
+			return fmt.Errorf("protocol %s is not allowed under %s", item.Protocol, base.Name)
+		}
+		return nil
+	}
+
+	// reject before claiming domain unless partial success is accepted
+	if !auth.Partial {
+		for _, forward := range auth.Forward {
+			err := allow(&plugin.PluginMeta{Protocol: forward.Protocol})
+			if err != nil {
+				logs.Error("%v", err)
+				s.replyError(conn, err)
+				return
+			}
+		}
+	}
+
+	lease, err := s.claimDomain(&auth, cred, base, conn)
+	if err != nil {
+		logs.Error("claim domain fail: %v", err)
+		s.replyError(conn, err)
+		return
+	}
+	defer lease.Release()
+
 	// select a virtual ip for client.
 	// a virtual ip is the ip address which can be use in our system
 	// but cannot be used by other networks
@@ -100,11 +174,21 @@ func (s *Server) onConn(conn net.Conn) {
 
 	// dynamic dns, write domain=>ip map to etcd
 	// coredns will read records from etcd and reply to dns client
-	if s.resolver != nil {
-		err = s.resolver.ApplyDomain(auth.Domain, publicIP())
-		if err != nil {
-			logs.Error("resolve domain fail: %v", err)
-			return
+	// custom domains are resolved by its owner's dns server
+	if s.resolver != nil && base.Contains(auth.Domain) {
+		resolveIP := base.ResolveIP
+		if len(resolveIP) <= 0 {
+			resolveIP = s.publicIP.Get()
+		}
+
+		if len(resolveIP) > 0 {
+			err = s.resolver.ApplyDomain(auth.Domain, resolveIP)
+			if err != nil {
+				logs.Error("resolve domain fail: %v", err)
+				return
+			}
+		} else {
+			logs.Error("public ip is unknown, skip resolve domain %s", auth.Domain)
 		}
 	}
 
@@ -117,30 +201,65 @@ func (s *Server) onConn(conn net.Conn) {
 	// 2. for to address, we use $vip:$localPort
 	// the vip is the virtual lan ip address
 	// Domain is only use for restyproxy
-	proxyInfos := make([]*proto.ProxyTuple, 0)
+	// forwards are validated and added as a batch,
+	// failure of any forward fails the batch without auth.Partial
+	items := make([]*plugin.PluginMeta, 0)
 	for _, forward := range auth.Forward {
 		for publicPort, localPort := range forward.Ports {
-			item := &plugin.PluginMeta{
+			items = append(items, &plugin.PluginMeta{
 				Protocol:      forward.Protocol,
 				From:          fmt.Sprintf("0.0.0.0:%d", publicPort),
 				To:            fmt.Sprintf("%s:%s", vip, localPort),
 				Domain:        auth.Domain,
 				RecycleSignal: make(chan struct{}),
 				Ctx:           forward.RawConfig,
-			}
+				Dialer:        s.sessMgr,
+			})
+		}
+	}
 
-			p, err := s.pluginMgr.AddProxy(item)
-			if err != nil {
-				logs.Error("add proxy fail: %v", err)
-				return
+	results, err := s.pluginMgr.AddProxies(items, plugin.BatchOptions{
+		Partial: auth.Partial,
+		Allow:   allow,
+	})
+
+	// failed forwards are replied with their errors
+	proxyInfos := make([]*proto.ProxyTuple, 0, len(results))
+	failed := make([]*proto.ProxyTuple, 0)
+	for _, result := range results {
+		if result.Err != nil {
+			logs.Error("add proxy %s %s fail: %v", result.Meta.Protocol, result.Meta.From, result.Err)
+			_, fromPort, _ := net.SplitHostPort(result.Meta.From)
+			_, toPort, _ := net.SplitHostPort(result.Meta.To)
+			info := &proto.ProxyTuple{
+				Protocol: result.Meta.Protocol,
+				FromPort: fromPort,
+				ToPort:   toPort,
+				Error:    result.Err.Error(),
 			}
-			proxyInfos = append(proxyInfos, &proto.ProxyTuple{
-				Protocol: forward.Protocol,
-				FromPort: p.FromPort,
-				ToPort:   p.ToPort,
-			})
-			defer s.pluginMgr.DelProxy(item)
+			proxyInfos = append(proxyInfos, info)
+			failed = append(failed, info)
+			continue
+		}
+
+		// the batch is deleted if it fails
+		if err != nil {
+			continue
+		}
+		defer s.pluginMgr.DelProxy(result.Meta)
+
+		info := &proto.ProxyTuple{Protocol: result.Meta.Protocol}
+		if result.Tuple != nil {
+			info.FromPort = result.Tuple.FromPort
+			info.ToPort = result.Tuple.ToPort
 		}
+		proxyInfos = append(proxyInfos, info)
+	}
+
+	if err != nil {
+		logs.Error("add proxy fail: %v", err)
+		s.replyError(conn, err, failed...)
+		return
 	}
 
 	reply := &proto.S2CAuth{
@@ -175,34 +294,75 @@ func (s *Server) onConn(conn net.Conn) {
 	}
 }
 
-// randomDomain generate random domain for client
-func randomDomain(num int64) string {
-	const ALPHABET = "123456789abcdefghijklmnopqrstuvwxyz"
-	const BASE = int64(len(ALPHABET))
-	rs := ""
-	for num > 0 {
-		rs += string(ALPHABET[num%BASE])
-		num = num / BASE
+// claimDomain registers the client domain
+// the domain is bound to the credential until the session close
+// and other credentials can not use it.
+// If client without domain, a domain under base is generated by the namer
+// and another name is tried if it is held by a live session.
+func (s *Server) claimDomain(auth *proto.C2SAuth, cred *Credential, base *BaseDomain, conn net.Conn) (*DomainLease, error) {
+	addr := conn.RemoteAddr().String()
+	if len(auth.Domain) > 0 {
+		auth.Domain = normalizeDomain(auth.Domain)
+		err := plugin.CheckDomain(auth.Domain)
+		if err != nil {
+			return nil, err
+		}
+
+		if !cred.AllowDomain(auth.Domain, base.Name) {
+			return nil, fmt.Errorf("domain %s is not allowed", auth.Domain)
+		}
+
+		// custom domain should prove the client controls it
+		if s.bases.match(auth.Domain) == nil {
+			if s.verifier == nil {
+				return nil, fmt.Errorf("domain %s is not under base domains", auth.Domain)
+			}
+
+			err = s.verifier.Verify(auth.Domain, auth.Key)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		return s.registry.Register(auth.Domain, cred.Name, addr, conn)
+	}
+
+	// identity of the client is credential and client id
+	// names of clients without client id are generated from client ip,
+	// but they can not replace sessions since clients may share an ip
+	ip, _, _ := net.SplitHostPort(addr)
+	seed, identity := fmt.Sprintf("%s/%s", cred.Name, ip), ""
+	if len(auth.ClientID) > 0 {
+		identity = fmt.Sprintf("%s/%s", cred.Name, auth.ClientID)
+		seed = identity
 	}
 
-	return rs
+	for i := 0; i < s.nameRetries; i++ {
+		domain := fmt.Sprintf("%s.%s", s.namer.Name(seed, i), base.Name)
+		lease, err := s.registry.RegisterIdentity(domain, cred.Name, identity, addr, conn)
+		if err == nil {
+			auth.Domain = domain
+			return lease, nil
+		}
+
+		if !errors.Is(err, ErrDomainInUse) {
+			return nil, err
+		}
+		logs.Warn("generated domain %s is in used, retry", domain)
+	}
+	return nil, fmt.Errorf("no available domain after %d retries", s.nameRetries)
 }
 
-// get public
-func publicIP() string {
-	resp, err := http.Get("http://ipv4.icanhazip.com")
-	if err != nil {
-		logs.Error("get public ip fail: %v", err)
-		panic(err)
+// replyError replies authorization failure
+// infos are forwards failed with their errors
+func (s *Server) replyError(conn net.Conn, err error, infos ...*proto.ProxyTuple) {
+	reply := &proto.S2CAuth{
+		Error:      err.Error(),
+		ProxyInfos: infos,
 	}
 
-	defer resp.Body.Close()
-	content, err := ioutil.ReadAll(resp.Body)
+	err = proto.WriteJSON(conn, proto.CmdAuth, reply)
 	if err != nil {
-		panic(err)
+		logs.Error("write json fail: %v", err)
 	}
-
-	str := string(content)
-	idx := strings.LastIndex(str, "\n")
-	return str[:idx]
 }
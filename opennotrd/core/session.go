@@ -1,8 +1,14 @@
 package core
 
 import (
+	"fmt"
+	"math"
+	"net"
 	"sync"
+	"sync/atomic"
+	"time"
 
+	"github.com/ICKelin/opennotr/opennotrd/plugin"
 	"github.com/xtaci/smux"
 )
 
@@ -18,6 +24,40 @@ func GetSessionManager() *SessionManager {
 	return sessionMgr
 }
 
+// activeConn records when the connection reads data last time,
+// a closed connection is idle forever
+type activeConn struct {
+	// lastRead is unix nano, the first field to be 64 bit aligned
+	lastRead int64
+	closed   int32
+	net.Conn
+}
+
+func newActiveConn(conn net.Conn) *activeConn {
+	return &activeConn{lastRead: time.Now().UnixNano(), Conn: conn}
+}
+
+func (c *activeConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n > 0 {
+		atomic.StoreInt64(&c.lastRead, time.Now().UnixNano())
+	}
+	return n, err
+}
+
+func (c *activeConn) Close() error {
+	atomic.StoreInt32(&c.closed, 1)
+	return c.Conn.Close()
+}
+
+// Idle returns how long the connection reads nothing
+func (c *activeConn) Idle() time.Duration {
+	if atomic.LoadInt32(&c.closed) != 0 {
+		return time.Duration(math.MaxInt64)
+	}
+	return time.Since(time.Unix(0, atomic.LoadInt64(&c.lastRead)))
+}
+
 // Session defines each opennotr_client to opennotr_server connection
 type Session struct {
 	conn    *smux.Session
@@ -46,3 +86,40 @@ func (mgr *SessionManager) GetSession(vip string) *Session {
 func (mgr *SessionManager) DeleteSession(vip string) {
 	mgr.sessions.Delete(vip)
 }
+
+// Dial opens a stream to the session of $to's vip
+// and writes the proxy protocol, so the client forwards
+// the stream to its local port of $to
+func (mgr *SessionManager) Dial(src net.Addr, to string) (net.Conn, error) {
+	vip, dport, err := net.SplitHostPort(to)
+	if err != nil {
+		return nil, err
+	}
+
+	sess := mgr.GetSession(vip)
+	if sess == nil {
+		return nil, fmt.Errorf("%w: no route to host: %s", plugin.ErrTunnelOffline, vip)
+	}
+
+	stream, err := sess.conn.OpenStream()
+	if err != nil {
+		return nil, err
+	}
+
+	sip, sport := "", ""
+	if src != nil {
+		sip, sport, _ = net.SplitHostPort(src.String())
+	}
+
+	// todo rewrite to client configuration
+	targetIP := "127.0.0.1"
+	bytes := encodeProxyProtocol("tcp", sip, sport, targetIP, dport)
+	stream.SetWriteDeadline(time.Now().Add(time.Duration(defaultTCPTimeout) * time.Second))
+	_, err = stream.Write(bytes)
+	stream.SetWriteDeadline(time.Time{})
+	if err != nil {
+		stream.Close()
+		return nil, err
+	}
+	return stream, nil
+}
@@ -0,0 +1,190 @@
+package plugin
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+)
+
+// Validator is implemented by plugins which can check a proxy
+// before it runs, eg: whether the listen port is free.
+// AddProxies validates all proxies before running any of them.
+type Validator interface {
+	Validate(item *PluginMeta) error
+}
+
+// BatchOptions defines options of AddProxies
+type BatchOptions struct {
+	// Partial keeps proxies running if some proxies fail,
+	// otherwise any failure deletes the proxies of the batch
+	Partial bool
+
+	// Allow checks proxies by policy, nil allows all
+	Allow func(item *PluginMeta) error
+}
+
+// ProxyResult is the result of a proxy of AddProxies
+type ProxyResult struct {
+	Meta  *PluginMeta
+	Tuple *ProxyTuple
+	Err   error
+}
+
+// AddProxies adds proxies of items as a batch.
+// All items are validated first: the protocol is registered, the proxy
+// is not running or requested twice, it is allowed by opts.Allow, its
+// options match the plugin ForwardSchema and it is accepted by the plugin
+// if it is a Validator. Valid items are reserved and run then, plugins
+// are not reloaded during the batch. Proxies of other sessions are
+// added and deleted concurrently.
+//
+// Results are returned in order of items and failed ones have Err set.
+// Without opts.Partial, nothing runs if any item is invalid, the first run
+// failure deletes the proxies of the batch, and the error is returned.
+func (p *PluginManager) AddProxies(items []*PluginMeta, opts BatchOptions) ([]*ProxyResult, error) {
+	p.setupMu.RLock()
+	defer p.setupMu.RUnlock()
+
+	p.mu.Lock()
+	var firstErr error
+	results := make([]*ProxyResult, len(items))
+	seen := make(map[string]bool)
+	for i, item := range items {
+		results[i] = &ProxyResult{Meta: item}
+
+		key := item.identify()
+		err := p.validate(item, opts.Allow)
+		if err == nil && seen[key] {
+			err = fmt.Errorf("port %s is requested twice", key)
+		}
+		seen[key] = true
+
+		if err != nil {
+			results[i].Err = err
+			if firstErr == nil {
+				firstErr = fmt.Errorf("%s %s: %v", item.Protocol, item.From, err)
+			}
+		}
+	}
+
+	if firstErr != nil && !opts.Partial {
+		p.mu.Unlock()
+		return results, firstErr
+	}
+
+	for i, item := range items {
+		if results[i].Err == nil {
+			p.reserve(item)
+		}
+	}
+	p.mu.Unlock()
+
+	for i, item := range items {
+		if results[i].Err != nil {
+			continue
+		}
+
+		tuple, err := p.addProxy(item)
+		if err != nil {
+			results[i].Err = err
+			if !opts.Partial {
+				p.mu.Lock()
+				for _, rest := range items[i+1:] {
+					p.release(rest)
+				}
+				p.mu.Unlock()
+
+				for j, added := range items[:i] {
+					p.delProxy(added)
+					results[j].Tuple = nil
+				}
+				return results, fmt.Errorf("%s %s: %v", item.Protocol, item.From, err)
+			}
+			continue
+		}
+		results[i].Tuple = tuple
+	}
+
+	return results, nil
+}
+
+// validate checks item before running, the caller holds p.mu and p.setupMu
+func (p *PluginManager) validate(item *PluginMeta, allow func(*PluginMeta) error) error {
+	plug, ok := p.plugins[item.Protocol]
+	if !ok {
+		return fmt.Errorf("proxy %s not register", item.Protocol)
+	}
+
+	key := item.identify()
+	if _, ok := p.routes[key]; ok {
+		return fmt.Errorf("port %s is in used", key)
+	}
+
+	if allow != nil {
+		err := allow(item)
+		if err != nil {
+			return err
+		}
+	}
+
+	err := applyOptions(plug, item)
+	if err != nil {
+		return err
+	}
+
+	if v, ok := plug.(Validator); ok {
+		return v.Validate(item)
+	}
+	return nil
+}
+
+// applyOptions validates per forward options of item by the schema
+// the plugin declares, and replaces item.Ctx with the defaults filled
+func applyOptions(plug IPluginV2, item *PluginMeta) error {
+	c, ok := plug.(ForwardConfigurable)
+	if !ok {
+		return nil
+	}
+
+	schema := c.ForwardSchema()
+	if schema == nil {
+		return nil
+	}
+
+	raw, _ := item.Ctx.(string)
+	opts, err := schema.Apply("rawConfig", json.RawMessage(raw))
+	if err != nil {
+		return err
+	}
+
+	item.Ctx = string(opts)
+	return nil
+}
+
+// CheckListen checks whether address can be listened on network,
+// port 0 is always free. Plugins use it in Validate.
+func CheckListen(network, address string) error {
+	_, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+
+	if port == "0" {
+		return nil
+	}
+
+	switch network {
+	case "udp":
+		conn, err := net.ListenPacket(network, address)
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	default:
+		lis, err := net.Listen(network, address)
+		if err != nil {
+			return err
+		}
+		return lis.Close()
+	}
+}
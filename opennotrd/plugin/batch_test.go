@@ -0,0 +1,89 @@
+package plugin_test
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/ICKelin/opennotr/opennotrd/plugin"
+	"github.com/ICKelin/opennotr/opennotrd/plugin/plugintest"
+	_ "github.com/ICKelin/opennotr/opennotrd/plugin/tcpproxy"
+)
+
+func tcpMeta(from string) *plugin.PluginMeta {
+	return &plugin.PluginMeta{Protocol: "tcp", From: from, To: "127.0.0.1:1"}
+}
+
+func TestAddProxies(t *testing.T) {
+	err := plugin.Setup(map[string]string{"tcp": `{}`})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	busy, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer busy.Close()
+
+	free := plugintest.FreeAddr(t)
+	mgr := plugin.DefaultPluginManager()
+
+	// the busy port fails validation, the free port is not listened
+	_, err = mgr.AddProxies([]*plugin.PluginMeta{tcpMeta(free), tcpMeta(busy.Addr().String())}, plugin.BatchOptions{})
+	if err == nil {
+		t.Fatal("expect error of busy port")
+	}
+
+	if len(mgr.Routes("tcp")) != 0 {
+		t.Errorf("expect no proxy added, got %v", mgr.Routes("tcp"))
+	}
+
+	// policy rejects the batch
+	deny := func(item *plugin.PluginMeta) error {
+		if item.From == free {
+			return fmt.Errorf("denied")
+		}
+		return nil
+	}
+
+	_, err = mgr.AddProxies([]*plugin.PluginMeta{tcpMeta(free)}, plugin.BatchOptions{Allow: deny})
+	if err == nil || !strings.Contains(err.Error(), "denied") {
+		t.Errorf("expect denied error, got %v", err)
+	}
+
+	// partial success keeps the free port
+	items := []*plugin.PluginMeta{
+		tcpMeta(free),
+		tcpMeta(busy.Addr().String()),
+		{Protocol: "unknown", From: "0.0.0.0:0"},
+		tcpMeta(free),
+	}
+	results, err := mgr.AddProxies(items, plugin.BatchOptions{Partial: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mgr.DelProxy(items[0])
+
+	if len(results) != len(items) {
+		t.Fatalf("expect %d results, got %d", len(items), len(results))
+	}
+
+	if results[0].Err != nil || results[0].Tuple.FromPort != plugintest.Port(t, free) {
+		t.Errorf("unexpected result of free port %+v", results[0])
+	}
+
+	for i, want := range map[int]string{1: "in use", 2: "not register", 3: "requested twice"} {
+		if results[i].Err == nil || !strings.Contains(results[i].Err.Error(), want) {
+			t.Errorf("expect error %q of item %d, got %v", want, i, results[i].Err)
+		}
+	}
+
+	conn, err := net.Dial("tcp", free)
+	if err != nil {
+		t.Errorf("expect free port listened: %v", err)
+	} else {
+		conn.Close()
+	}
+}
@@ -0,0 +1,293 @@
+// Package caddyproxy registers reverse proxy routes to caddy
+// by caddy's JSON admin api, it is the "caddy" driver of
+// http, https and h2c plugins.
+package caddyproxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/ICKelin/opennotr/internal/logs"
+	"github.com/ICKelin/opennotr/opennotrd/plugin"
+)
+
+var (
+	defaultAdminURL = "http://localhost:2019"
+
+	// default caddy server name and listen address of each scheme
+	defaultServer = map[string]string{
+		"http":  "opennotr_http",
+		"h2c":   "opennotr_http",
+		"https": "opennotr_https",
+	}
+
+	defaultListen = map[string]string{
+		"http":  ":80",
+		"h2c":   ":80",
+		"https": ":443",
+	}
+)
+
+func init() {
+	plugin.RegisterDriverV2("http", "caddy", &CaddyProxy{scheme: "http"})
+	plugin.RegisterDriverV2("https", "caddy", &CaddyProxy{scheme: "https"})
+	plugin.RegisterDriverV2("h2c", "caddy", &CaddyProxy{scheme: "h2c"})
+}
+
+type config struct {
+	// AdminURL specific caddy admin api, default http://localhost:2019
+	AdminURL string `json:"adminUrl"`
+
+	// Server specific the caddy server routes are added to
+	// it is created if not exist, default opennotr_http for
+	// http and h2c, opennotr_https for https
+	Server string `json:"server"`
+
+	// Listen specific listen address of the server if it is created
+	// default :80 for http and h2c, :443 for https
+	Listen string `json:"listen"`
+
+	// Issuers specific tls automation issuers of https domains
+	// in caddy JSON format, empty means caddy default issuers
+	// eg: [{"module": "acme", "email": "admin@notr.tech"}]
+	Issuers json.RawMessage `json:"issuers"`
+}
+
+// CaddyProxy adds a route of each domain to caddy
+// the route proxies to $vip:$port which is routed to the
+// client by tproxy
+type CaddyProxy struct {
+	scheme string
+	cfg    config
+	cli    *http.Client
+}
+
+func (p *CaddyProxy) Schema() *plugin.Schema {
+	return plugin.SchemaOf(config{
+		AdminURL: defaultAdminURL,
+		Server:   defaultServer[p.scheme],
+		Listen:   defaultListen[p.scheme],
+	})
+}
+
+func (p *CaddyProxy) Setup(ctx context.Context, rawMessage json.RawMessage) error {
+	var cfg config
+	err := json.Unmarshal(rawMessage, &cfg)
+	if err != nil {
+		return err
+	}
+
+	if len(cfg.AdminURL) <= 0 {
+		cfg.AdminURL = defaultAdminURL
+	}
+	cfg.AdminURL = strings.TrimSuffix(cfg.AdminURL, "/")
+
+	if len(cfg.Server) <= 0 {
+		cfg.Server = defaultServer[p.scheme]
+	}
+
+	if len(cfg.Listen) <= 0 {
+		cfg.Listen = defaultListen[p.scheme]
+	}
+
+	p.cfg = cfg
+	p.cli = &http.Client{Timeout: time.Second * 10}
+	return nil
+}
+
+// ForwardSchema declares forwards accept no options
+func (p *CaddyProxy) ForwardSchema() *plugin.Schema {
+	return plugin.SchemaOf(struct{}{})
+}
+
+func (p *CaddyProxy) RunProxy(ctx context.Context, item *plugin.PluginMeta) (plugin.Proxy, error) {
+	if len(item.Domain) <= 0 {
+		return nil, fmt.Errorf("domain is required for %s", p.scheme)
+	}
+
+	// domain is a part of config ids in urls
+	err := plugin.CheckDomain(item.Domain)
+	if err != nil {
+		return nil, err
+	}
+
+	_, toPort, err := net.SplitHostPort(item.To)
+	if err != nil {
+		return nil, err
+	}
+
+	// the route of last session may be left, eg: opennotrd restarted
+	p.delete(routeID(p.scheme, item.Domain))
+
+	serverPath := "/config/apps/http/servers/" + p.cfg.Server
+	err = p.insert(serverPath+"/routes", p.route(item), map[string]interface{}{
+		serverPath: map[string]interface{}{"listen": []string{p.cfg.Listen}},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("add caddy route %s://%s fail: %v", p.scheme, item.Domain, err)
+	}
+
+	if p.scheme == "https" {
+		p.delete(policyID(item.Domain))
+		err = p.insert("/config/apps/tls/automation/policies", p.policy(item.Domain), nil)
+		if err != nil {
+			p.delete(routeID(p.scheme, item.Domain))
+			return nil, fmt.Errorf("add caddy tls policy %s fail: %v", item.Domain, err)
+		}
+	}
+
+	logs.Info("add caddy route %s://%s => %s", p.scheme, item.Domain, item.To)
+	return plugin.NewProxy(&plugin.ProxyTuple{
+		Protocol: item.Protocol,
+		ToPort:   toPort,
+	}, func() error {
+		return p.stopProxy(item)
+	}), nil
+}
+
+// stopProxy deletes route and tls policy of domain
+func (p *CaddyProxy) stopProxy(item *plugin.PluginMeta) error {
+	err := p.delete(routeID(p.scheme, item.Domain))
+	if err != nil {
+		err = fmt.Errorf("delete caddy route %s://%s fail: %v", p.scheme, item.Domain, err)
+	}
+
+	if p.scheme == "https" {
+		if e := p.delete(policyID(item.Domain)); e != nil && err == nil {
+			err = fmt.Errorf("delete caddy tls policy %s fail: %v", item.Domain, e)
+		}
+	}
+	return err
+}
+
+// route returns caddy route proxies domain to $To
+func (p *CaddyProxy) route(item *plugin.PluginMeta) map[string]interface{} {
+	proxy := map[string]interface{}{
+		"handler":   "reverse_proxy",
+		"upstreams": []map[string]string{{"dial": item.To}},
+	}
+
+	if p.scheme == "h2c" {
+		proxy["transport"] = map[string]interface{}{
+			"protocol": "http",
+			"versions": []string{"h2c", "2"},
+		}
+	}
+
+	return map[string]interface{}{
+		"@id":      routeID(p.scheme, item.Domain),
+		"match":    []map[string][]string{{"host": {item.Domain}}},
+		"handle":   []interface{}{proxy},
+		"terminal": true,
+	}
+}
+
+// policy returns tls automation policy of domain
+func (p *CaddyProxy) policy(domain string) map[string]interface{} {
+	policy := map[string]interface{}{
+		"@id":      policyID(domain),
+		"subjects": []string{domain},
+	}
+
+	if len(p.cfg.Issuers) > 0 {
+		policy["issuers"] = p.cfg.Issuers
+	}
+	return policy
+}
+
+// insert inserts item at the beginning of array of path.
+// If the array or its parents do not exist, they are created from
+// the deepest existing one. objects specific extra fields of the
+// created objects, eg: listen of server.
+func (p *CaddyProxy) insert(path string, item interface{}, objects map[string]interface{}) error {
+	err := p.request("PUT", path+"/0", item)
+	if _, ok := err.(*statusError); !ok {
+		return err
+	}
+
+	var value interface{} = []interface{}{item}
+	for strings.Count(path, "/") > 1 {
+		err = p.request("PUT", path, value)
+		if err == nil {
+			return nil
+		}
+
+		idx := strings.LastIndex(path, "/")
+		parent, key := path[:idx], path[idx+1:]
+
+		obj := map[string]interface{}{}
+		if extra, ok := objects[parent].(map[string]interface{}); ok {
+			for k, v := range extra {
+				obj[k] = v
+			}
+		}
+		obj[key] = value
+		value, path = obj, parent
+	}
+	return err
+}
+
+// delete deletes config of id, not exist is not an error
+func (p *CaddyProxy) delete(id string) error {
+	err := p.request("DELETE", "/id/"+url.PathEscape(id), nil)
+	if e, ok := err.(*statusError); ok && e.status == http.StatusNotFound {
+		return nil
+	}
+	return err
+}
+
+type statusError struct {
+	status int
+	msg    string
+}
+
+func (e *statusError) Error() string {
+	return fmt.Sprintf("caddy reply %d: %s", e.status, e.msg)
+}
+
+func (p *CaddyProxy) request(method, path string, body interface{}) error {
+	var reader *bytes.Reader
+	if body != nil {
+		buf, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(buf)
+	} else {
+		reader = bytes.NewReader(nil)
+	}
+
+	req, err := http.NewRequest(method, p.cfg.AdminURL+path, reader)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := p.cli.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		cnt, _ := ioutil.ReadAll(resp.Body)
+		return &statusError{status: resp.StatusCode, msg: strings.TrimSpace(string(cnt))}
+	}
+	return nil
+}
+
+func routeID(scheme, domain string) string {
+	return "opennotr_" + scheme + "_" + domain
+}
+
+func policyID(domain string) string {
+	return "opennotr_tls_" + domain
+}
@@ -0,0 +1,263 @@
+package caddyproxy
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/ICKelin/opennotr/opennotrd/plugin"
+)
+
+// caddyStub implements PUT and DELETE /id/ of caddy admin api
+// on an in memory JSON tree
+type caddyStub struct {
+	mu   sync.Mutex
+	root map[string]interface{}
+}
+
+func (s *caddyStub) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if r.Method == "DELETE" && strings.HasPrefix(r.URL.Path, "/id/") {
+		if !deleteID(s.root, strings.TrimPrefix(r.URL.Path, "/id/")) {
+			http.Error(w, "unknown object ID", http.StatusNotFound)
+		}
+		return
+	}
+
+	if r.Method != "PUT" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	var value interface{}
+	json.NewDecoder(r.Body).Decode(&value)
+
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	var parent interface{} = s.root
+	for _, part := range parts[:len(parts)-1] {
+		parent = child(parent, part)
+		if parent == nil {
+			http.Error(w, "invalid traversal path at "+part, http.StatusBadRequest)
+			return
+		}
+	}
+
+	last := parts[len(parts)-1]
+	switch node := parent.(type) {
+	case map[string]interface{}:
+		if _, ok := node[last]; ok {
+			http.Error(w, "key already exists: "+last, http.StatusConflict)
+			return
+		}
+		node[last] = value
+
+	case []interface{}:
+		// arrays are stored in their parents, insert by replacing
+		idx, err := strconv.Atoi(last)
+		if err != nil || idx > len(node) {
+			http.Error(w, "invalid index", http.StatusBadRequest)
+			return
+		}
+		arr := append(node[:idx:idx], append([]interface{}{value}, node[idx:]...)...)
+		setChild(s.root, parts[:len(parts)-1], arr)
+
+	default:
+		http.Error(w, "invalid traversal path", http.StatusBadRequest)
+	}
+}
+
+func (s *caddyStub) routes(server string) []interface{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	arr, _ := child(child(child(child(child(s.root, "config"), "apps"), "http"), "servers"), server).(map[string]interface{})["routes"].([]interface{})
+	return arr
+}
+
+func (s *caddyStub) policies() []interface{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	arr, _ := child(child(child(child(s.root, "config"), "apps"), "tls"), "automation").(map[string]interface{})["policies"].([]interface{})
+	return arr
+}
+
+func child(node interface{}, key string) interface{} {
+	switch n := node.(type) {
+	case map[string]interface{}:
+		return n[key]
+	case []interface{}:
+		idx, err := strconv.Atoi(key)
+		if err != nil || idx >= len(n) {
+			return nil
+		}
+		return n[idx]
+	}
+	return nil
+}
+
+func setChild(root map[string]interface{}, path []string, value interface{}) {
+	var node interface{} = root
+	for _, part := range path[:len(path)-1] {
+		node = child(node, part)
+	}
+	node.(map[string]interface{})[path[len(path)-1]] = value
+}
+
+func deleteID(node interface{}, id string) bool {
+	switch n := node.(type) {
+	case map[string]interface{}:
+		for k, v := range n {
+			if arr, ok := v.([]interface{}); ok {
+				for i, item := range arr {
+					if m, ok := item.(map[string]interface{}); ok && m["@id"] == id {
+						n[k] = append(arr[:i:i], arr[i+1:]...)
+						return true
+					}
+				}
+			}
+			if deleteID(v, id) {
+				return true
+			}
+		}
+	case []interface{}:
+		for _, v := range n {
+			if deleteID(v, id) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func TestCaddyProxy(t *testing.T) {
+	stub := &caddyStub{root: map[string]interface{}{"config": map[string]interface{}{}}}
+	srv := httptest.NewServer(stub)
+	defer srv.Close()
+
+	p := &CaddyProxy{scheme: "https"}
+	err := p.Setup(context.Background(), json.RawMessage(`{"adminUrl": "`+srv.URL+`", "issuers": [{"module": "internal"}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	item := &plugin.PluginMeta{
+		Protocol: "https",
+		To:       "100.64.240.10:8443",
+		Domain:   "a.open.notr.tech",
+	}
+
+	// server, http app and tls app are created at the first time
+	proxy, err := p.RunProxy(context.Background(), item)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tuple := proxy.Tuple()
+
+	if tuple.ToPort != "8443" {
+		t.Fatalf("unexpected tuple %v", tuple)
+	}
+
+	routes := stub.routes("opennotr_https")
+	if len(routes) != 1 {
+		t.Fatalf("expected 1 route, got %v", routes)
+	}
+
+	route, _ := json.Marshal(routes[0])
+	expected := `{"@id":"opennotr_https_a.open.notr.tech","handle":[{"handler":"reverse_proxy","upstreams":[{"dial":"100.64.240.10:8443"}]}],"match":[{"host":["a.open.notr.tech"]}],"terminal":true}`
+	if string(route) != expected {
+		t.Fatalf("expected route %s, got %s", expected, route)
+	}
+
+	listen, _ := json.Marshal(child(child(child(child(child(stub.root, "config"), "apps"), "http"), "servers"), "opennotr_https").(map[string]interface{})["listen"])
+	if string(listen) != `[":443"]` {
+		t.Fatalf("expected server listen :443, got %s", listen)
+	}
+
+	policies := stub.policies()
+	policy, _ := json.Marshal(policies)
+	if string(policy) != `[{"@id":"opennotr_tls_a.open.notr.tech","issuers":[{"module":"internal"}],"subjects":["a.open.notr.tech"]}]` {
+		t.Fatalf("unexpected tls policies %s", policy)
+	}
+
+	// routes are prepended, left route of the same domain is replaced
+	other := &plugin.PluginMeta{Protocol: "https", To: "100.64.240.11:443", Domain: "b.open.notr.tech"}
+	if _, err := p.RunProxy(context.Background(), other); err != nil {
+		t.Fatal(err)
+	}
+
+	again, err := p.RunProxy(context.Background(), item)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	routes = stub.routes("opennotr_https")
+	if len(routes) != 2 || routes[0].(map[string]interface{})["@id"] != "opennotr_https_a.open.notr.tech" {
+		t.Fatalf("unexpected routes %v", routes)
+	}
+
+	again.Close()
+	routes = stub.routes("opennotr_https")
+	if len(routes) != 1 || routes[0].(map[string]interface{})["@id"] != "opennotr_https_b.open.notr.tech" {
+		t.Fatalf("unexpected routes after stop %v", routes)
+	}
+
+	if len(stub.policies()) != 1 {
+		t.Fatalf("expected tls policy deleted, got %v", stub.policies())
+	}
+
+	// stop twice is fine
+	proxy.Close()
+}
+
+func TestCaddyH2CRoute(t *testing.T) {
+	p := &CaddyProxy{scheme: "h2c"}
+	route, _ := json.Marshal(p.route(&plugin.PluginMeta{To: "100.64.240.10:50052", Domain: "g.open.notr.tech"}))
+	if !strings.Contains(string(route), `"transport":{"protocol":"http","versions":["h2c","2"]}`) {
+		t.Fatalf("expected h2c transport, got %s", route)
+	}
+}
+
+func TestCaddyInvalidDomain(t *testing.T) {
+	mu := sync.Mutex{}
+	paths := make([]string, 0)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		paths = append(paths, r.URL.EscapedPath())
+	}))
+	defer srv.Close()
+
+	p := &CaddyProxy{scheme: "https"}
+	err := p.Setup(context.Background(), json.RawMessage(`{"adminUrl": "`+srv.URL+`"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, domain := range []string{"a/../../config", "a?b.open.notr.tech", "a#b.open.notr.tech"} {
+		_, err := p.RunProxy(context.Background(), &plugin.PluginMeta{
+			Protocol: "https",
+			To:       "100.64.240.10:8443",
+			Domain:   domain,
+		})
+		if err == nil {
+			t.Errorf("%q: expected invalid domain error", domain)
+		}
+	}
+
+	// ids are escaped as a path segment
+	if err := p.delete("a/../b?c"); err != nil {
+		t.Fatal(err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(paths) != 1 || paths[0] != "/id/a%2F..%2Fb%3Fc" {
+		t.Fatalf("unexpected admin api requests %v", paths)
+	}
+}
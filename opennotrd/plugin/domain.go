@@ -0,0 +1,33 @@
+package plugin
+
+import (
+	"fmt"
+	"strings"
+)
+
+// CheckDomain checks whether domain is a RFC 1123 hostname, labels are
+// letters, digits and hyphens of at most 63 characters, 253 in total.
+// Domains are rendered into configurations and commands of drivers,
+// such as nginx and haproxy, drivers check domains before using them.
+func CheckDomain(domain string) error {
+	if len(domain) <= 0 || len(domain) > 253 {
+		return fmt.Errorf("invalid domain %q: length should be 1 to 253", domain)
+	}
+
+	for _, label := range strings.Split(domain, ".") {
+		if len(label) <= 0 || len(label) > 63 {
+			return fmt.Errorf("invalid domain %q: label length should be 1 to 63", domain)
+		}
+
+		if label[0] == '-' || label[len(label)-1] == '-' {
+			return fmt.Errorf("invalid domain %q: label starts or ends with hyphen", domain)
+		}
+
+		for _, c := range label {
+			if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-') {
+				return fmt.Errorf("invalid domain %q: unexpected character %q", domain, c)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,34 @@
+package plugin
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCheckDomain(t *testing.T) {
+	tests := map[string]bool{
+		"dev.open.notr.tech":               true,
+		"Dev-1.open.notr.tech":             true,
+		"localhost":                        true,
+		strings.Repeat("a", 63) + ".notr":  true,
+		strings.Repeat("a", 64) + ".notr":  false,
+		strings.Repeat("a.", 127) + "notr": false,
+		"":                                 false,
+		"a..notr.tech":                     false,
+		"-a.notr.tech":                     false,
+		"a-.notr.tech":                     false,
+		"a_b.notr.tech":                    false,
+		"*.notr.tech":                      false,
+		"a/../b.notr.tech":                 false,
+		"x;}server{.notr.tech":             false,
+		"a b.notr.tech":                    false,
+		"a\nb.notr.tech":                   false,
+	}
+
+	for domain, valid := range tests {
+		err := CheckDomain(domain)
+		if (err == nil) != valid {
+			t.Errorf("%q: expect valid %v, got %v", domain, valid, err)
+		}
+	}
+}
@@ -1,6 +1,7 @@
 package dummy
 
 import (
+	"context"
 	"encoding/json"
 
 	"github.com/ICKelin/opennotr/internal/logs"
@@ -8,18 +9,21 @@ import (
 )
 
 func init() {
-	plugin.Register("dummy", &DummyPlugin{})
+	plugin.RegisterV2("dummy", &DummyPlugin{})
 }
 
+// DummyPlugin is the minimal example of plugin
 type DummyPlugin struct{}
 
-func (d *DummyPlugin) Setup(cfg json.RawMessage) error {
+func (d *DummyPlugin) Schema() *plugin.Schema {
+	return plugin.SchemaOf(struct{}{})
+}
+
+func (d *DummyPlugin) Setup(ctx context.Context, cfg json.RawMessage) error {
 	return nil
 }
 
-func (d *DummyPlugin) RunProxy(meta *plugin.PluginMeta) (*plugin.ProxyTuple, error) {
+func (d *DummyPlugin) RunProxy(ctx context.Context, meta *plugin.PluginMeta) (plugin.Proxy, error) {
 	logs.Info("dummy plugin client config: %v", meta.Ctx)
-	return &plugin.ProxyTuple{}, nil
+	return plugin.NewProxy(&plugin.ProxyTuple{}, nil), nil
 }
-
-func (d *DummyPlugin) StopProxy(meta *plugin.PluginMeta) {}
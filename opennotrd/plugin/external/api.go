@@ -0,0 +1,51 @@
+package external
+
+import (
+	"net/http"
+	"sort"
+
+	"github.com/ICKelin/opennotr/opennotrd/admin"
+)
+
+func init() {
+	admin.HandleFunc("/api/v1/plugins", listPlugins)
+}
+
+// status is the reply of GET /api/v1/plugins
+type status struct {
+	Name      string   `json:"name"`
+	Path      string   `json:"path"`
+	Protocols []string `json:"protocols"`
+	Pid       int      `json:"pid"`
+	Running   bool     `json:"running"`
+	Restarts  int      `json:"restarts"`
+}
+
+func listPlugins(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	processesMu.Lock()
+	list := make([]*status, 0, len(processes))
+	for _, p := range processes {
+		p.mu.Lock()
+		s := &status{
+			Name:      p.name,
+			Path:      p.path,
+			Protocols: p.protocols,
+			Running:   p.client != nil,
+			Restarts:  p.restarts,
+		}
+		if p.cmd != nil && p.cmd.Process != nil {
+			s.Pid = p.cmd.Process.Pid
+		}
+		p.mu.Unlock()
+		list = append(list, s)
+	}
+	processesMu.Unlock()
+
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	admin.WriteJSON(w, http.StatusOK, list)
+}
@@ -0,0 +1,386 @@
+package external
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ICKelin/opennotr/opennotrd/admin"
+	"github.com/ICKelin/opennotr/opennotrd/plugin"
+)
+
+// the test binary serves fakePlugin if EXTERNAL_TEST_PLUGIN is set
+// EXTERNAL_TEST_PLUGIN specific the transport, stdio or unix
+// EXTERNAL_TEST_LOG specific the file calls are appended to
+func TestMain(m *testing.M) {
+	transport := os.Getenv("EXTERNAL_TEST_PLUGIN")
+	if len(transport) <= 0 {
+		os.Exit(m.Run())
+	}
+
+	protocol := "ext_" + transport
+	plugins := map[string]plugin.IPluginV2{protocol: &fakePlugin{log: os.Getenv("EXTERNAL_TEST_LOG")}}
+
+	var err error
+	if transport == "unix" {
+		err = ServeUnix(os.Getenv("EXTERNAL_TEST_LOG")+".sock", plugins)
+	} else {
+		err = Serve(plugins)
+	}
+
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	os.Exit(0)
+}
+
+type fakePlugin struct {
+	log string
+}
+
+func (p *fakePlugin) record(format string, args ...interface{}) {
+	f, err := os.OpenFile(p.log, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	fmt.Fprintf(f, format+"\n", args...)
+}
+
+func (p *fakePlugin) Setup(ctx context.Context, cfg json.RawMessage) error {
+	p.record("setup %s", cfg)
+	return nil
+}
+
+func (p *fakePlugin) RunProxy(ctx context.Context, item *plugin.PluginMeta) (plugin.Proxy, error) {
+	if item.Domain == "fail.notr.tech" {
+		return nil, fmt.Errorf("rejected %s", item.Domain)
+	}
+
+	p.record("run %s %s %v", item.Domain, item.To, item.Ctx)
+	return plugin.NewProxy(&plugin.ProxyTuple{Protocol: item.Protocol, ToPort: "9000"}, func() error {
+		p.record("stop %s", item.Domain)
+		return nil
+	}), nil
+}
+
+// readLog waits until log has n lines
+func readLog(t *testing.T, log string, n int) []string {
+	deadline := time.Now().Add(time.Second * 5)
+	for {
+		cnt, _ := ioutil.ReadFile(log)
+		lines := strings.Split(strings.TrimSpace(string(cnt)), "\n")
+		if len(cnt) > 0 && len(lines) >= n {
+			return lines
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatalf("expect %d lines, got %q", n, cnt)
+		}
+		time.Sleep(time.Millisecond * 20)
+	}
+}
+
+func TestExternalPlugin(t *testing.T) {
+	for _, transport := range []string{"stdio", "unix"} {
+		t.Run(transport, func(t *testing.T) {
+			testExternalPlugin(t, transport)
+		})
+	}
+}
+
+func testExternalPlugin(t *testing.T, transport string) {
+	restartBackoff = time.Millisecond * 50
+
+	dir, err := ioutil.TempDir("", "external")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	self, err := filepath.Abs(os.Args[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	name := "fake_" + transport
+	log := filepath.Join(dir, "calls")
+	script := fmt.Sprintf("#!/bin/sh\nEXTERNAL_TEST_PLUGIN=%s EXTERNAL_TEST_LOG=%s exec %s\n", transport, log, self)
+	err = ioutil.WriteFile(filepath.Join(dir, name), []byte(script), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// not executable, skipped
+	ioutil.WriteFile(filepath.Join(dir, "README"), []byte("plugins"), 0644)
+
+	err = Load(Config{Dir: dir, Health: 1, Timeout: 5})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	protocol := "ext_" + transport
+	if !plugin.Registered(protocol) {
+		t.Fatalf("protocol %s is not registered", protocol)
+	}
+
+	err = plugin.Setup(map[string]string{protocol: `{"driver":"` + name + `"}`})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	item := &plugin.PluginMeta{
+		Protocol: protocol,
+		From:     "0.0.0.0:2222",
+		To:       "100.64.240.10:22",
+		Domain:   "a.notr.tech",
+		Ctx:      "ctx",
+	}
+
+	mgr := plugin.DefaultPluginManager()
+	tuple, err := mgr.AddProxy(item)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if tuple.Protocol != protocol || tuple.ToPort != "9000" {
+		t.Errorf("unexpected tuple %+v", tuple)
+	}
+
+	_, err = mgr.AddProxy(&plugin.PluginMeta{Protocol: protocol, Domain: "fail.notr.tech", To: "100.64.240.11:22"})
+	if err == nil || !strings.Contains(err.Error(), "rejected") {
+		t.Errorf("expect rejected error, got %v", err)
+	}
+
+	lines := readLog(t, log, 2)
+	if lines[0] != `setup {"driver":"`+name+`"}` || lines[1] != "run a.notr.tech 100.64.240.10:22 ctx" {
+		t.Errorf("unexpected calls %q", lines)
+	}
+
+	// the restarted plugin is setup and runs the proxy again
+	processesMu.Lock()
+	p := processes[name]
+	processesMu.Unlock()
+
+	p.mu.Lock()
+	p.cmd.Process.Kill()
+	p.mu.Unlock()
+
+	lines = readLog(t, log, 4)
+	if lines[2] != lines[0] || lines[3] != lines[1] {
+		t.Errorf("unexpected calls after restart %q", lines)
+	}
+
+	mgr.DelProxy(item)
+	lines = readLog(t, log, 5)
+	if lines[4] != "stop a.notr.tech" {
+		t.Errorf("unexpected calls %q", lines)
+	}
+
+	rec := httptest.NewRecorder()
+	admin.Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/v1/plugins", nil))
+
+	var list []*status
+	json.Unmarshal(rec.Body.Bytes(), &list)
+	found := false
+	for _, s := range list {
+		if s.Name == name {
+			found = true
+			if !s.Running || s.Restarts != 1 || s.Pid <= 0 {
+				t.Errorf("unexpected status %+v", s)
+			}
+		}
+	}
+
+	if !found {
+		t.Errorf("plugin %s not listed: %s", name, rec.Body.String())
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	dir, err := ioutil.TempDir("", "external")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	self, err := filepath.Abs(os.Args[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	log := filepath.Join(dir, "calls")
+	script := fmt.Sprintf("#!/bin/sh\nEXTERNAL_TEST_PLUGIN=stdio EXTERNAL_TEST_LOG=%s exec %s\n", log, self)
+	err = ioutil.WriteFile(filepath.Join(dir, "fake_shutdown"), []byte(script), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = Load(Config{Dir: dir, Health: 1, Timeout: 5})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	processesMu.Lock()
+	p := processes["fake_shutdown"]
+	processesMu.Unlock()
+
+	Shutdown()
+
+	// the plugin exits by stdin closed and is not restarted
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.cmd.ProcessState == nil || !p.cmd.ProcessState.Success() || p.restarts != 0 {
+		t.Fatalf("expected plugin exited without restarts, got %v %d", p.cmd.ProcessState, p.restarts)
+	}
+
+	processesMu.Lock()
+	defer processesMu.Unlock()
+	if len(processes) != 0 {
+		t.Fatalf("expected plugins unloaded, got %d", len(processes))
+	}
+}
+
+func TestNextBackoff(t *testing.T) {
+	tests := []struct {
+		backoff time.Duration
+		uptime  time.Duration
+		expect  time.Duration
+	}{
+		{restartBackoff, 0, restartBackoff * 2},
+		{restartBackoff * 2, time.Second * 5, restartBackoff * 4},
+		{maxRestartBackoff, 0, maxRestartBackoff},
+		{maxRestartBackoff, restartReset, restartBackoff},
+	}
+
+	for _, test := range tests {
+		if got := nextBackoff(test.backoff, test.uptime); got != test.expect {
+			t.Errorf("backoff %s uptime %s: expected %s, got %s", test.backoff, test.uptime, test.expect, got)
+		}
+	}
+}
+
+func TestRestoreSelectedDriver(t *testing.T) {
+	restartBackoff = time.Millisecond * 50
+
+	dir, err := ioutil.TempDir("", "external")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	self, err := filepath.Abs(os.Args[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{"fake_selected", "fake_unselected"} {
+		script := fmt.Sprintf("#!/bin/sh\nEXTERNAL_TEST_PLUGIN=stdio EXTERNAL_TEST_LOG=%s exec %s\n", filepath.Join(dir, name+".log"), self)
+		err = ioutil.WriteFile(filepath.Join(dir, name), []byte(script), 0755)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err = Load(Config{Dir: dir, Health: 1, Timeout: 5})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer Shutdown()
+
+	err = plugin.Setup(map[string]string{"ext_stdio": `{"driver":"fake_selected"}`})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	item := &plugin.PluginMeta{Protocol: "ext_stdio", To: "100.64.240.10:22", Domain: "b.notr.tech"}
+	mgr := plugin.DefaultPluginManager()
+	if _, err := mgr.AddProxy(item); err != nil {
+		t.Fatal(err)
+	}
+	defer mgr.DelProxy(item)
+
+	processesMu.Lock()
+	selected, unselected := processes["fake_selected"], processes["fake_unselected"]
+	processesMu.Unlock()
+
+	// the unselected plugin was setup, eg: by a previous configuration
+	err = unselected.remotes["ext_stdio"].Setup(context.Background(), json.RawMessage(`{}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	unselectedLog := filepath.Join(dir, "fake_unselected.log")
+	readLog(t, unselectedLog, 1)
+
+	for _, p := range []*process{selected, unselected} {
+		p.mu.Lock()
+		p.cmd.Process.Kill()
+		p.mu.Unlock()
+	}
+
+	lines := readLog(t, filepath.Join(dir, "fake_selected.log"), 4)
+	if lines[3] != "run b.notr.tech 100.64.240.10:22 <nil>" {
+		t.Errorf("unexpected calls of selected plugin %q", lines)
+	}
+
+	deadline := time.Now().Add(time.Second * 5)
+	for {
+		unselected.mu.Lock()
+		restarts := unselected.restarts
+		unselected.mu.Unlock()
+		if restarts > 0 {
+			break
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatal("expected unselected plugin restarted")
+		}
+		time.Sleep(time.Millisecond * 20)
+	}
+
+	time.Sleep(time.Millisecond * 100)
+	if lines := readLog(t, unselectedLog, 1); len(lines) != 1 {
+		t.Errorf("expected unselected plugin not restored, got %q", lines)
+	}
+}
+
+func TestRunProxyReplace(t *testing.T) {
+	dir, err := ioutil.TempDir("", "external")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	log := filepath.Join(dir, "replace.log")
+	s := &service{
+		plugins: map[string]plugin.IPluginV2{"ext_fake": &fakePlugin{log: log}},
+		proxies: make(map[string]plugin.Proxy),
+	}
+
+	// the same proxy runs again, eg: restored after opennotrd restarts
+	args := Meta{Protocol: "ext_fake", To: "100.64.240.10:22", Domain: "r.notr.tech"}
+	for i := 0; i < 2; i++ {
+		if err := s.RunProxy(args, &Tuple{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := s.StopProxy(args, &Empty{}); err != nil {
+		t.Fatal(err)
+	}
+
+	lines := readLog(t, log, 4)
+	expect := []string{"run r.notr.tech 100.64.240.10:22 <nil>", "stop r.notr.tech", "run r.notr.tech 100.64.240.10:22 <nil>", "stop r.notr.tech"}
+	if strings.Join(lines, "\n") != strings.Join(expect, "\n") {
+		t.Fatalf("expected previous proxy closed, got %q", lines)
+	}
+}
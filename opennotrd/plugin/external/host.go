@@ -0,0 +1,508 @@
+package external
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/rpc"
+	"net/rpc/jsonrpc"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ICKelin/opennotr/internal/logs"
+	"github.com/ICKelin/opennotr/opennotrd/plugin"
+)
+
+var (
+	// default health check interval(seconds)
+	defaultHealth = 10
+
+	// default rpc timeout(seconds)
+	defaultTimeout = 10
+
+	// restart backoff base, doubled each restart up to maxRestartBackoff
+	restartBackoff    = time.Second
+	maxRestartBackoff = time.Second * 30
+
+	// restart backoff is reset after the plugin runs this long
+	restartReset = time.Minute
+
+	processesMu sync.Mutex
+
+	// processes stores loaded plugins
+	// key: plugin name
+	processes = make(map[string]*process)
+)
+
+type Config struct {
+	// Dir specific the plugin dir, each executable is a plugin
+	// empty means disabled
+	Dir string `yaml:"dir"`
+
+	// Health specific health check interval in seconds, default 10
+	Health int `yaml:"health"`
+
+	// Timeout specific rpc timeout in seconds, default 10
+	Timeout int `yaml:"timeout"`
+}
+
+// Load starts plugins of dir and registers their protocols.
+// A plugin is registered as the "$name" driver of its protocols,
+// and as the protocol plugin if the protocol is not builtin.
+// It should be called before plugin.Setup.
+func Load(cfg Config) error {
+	if cfg.Health <= 0 {
+		cfg.Health = defaultHealth
+	}
+
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = defaultTimeout
+	}
+
+	entries, err := ioutil.ReadDir(cfg.Dir)
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		if !entry.Mode().IsRegular() || entry.Mode()&0111 == 0 {
+			continue
+		}
+
+		p := &process{
+			name:    entry.Name(),
+			path:    filepath.Join(cfg.Dir, entry.Name()),
+			health:  time.Duration(cfg.Health) * time.Second,
+			timeout: time.Duration(cfg.Timeout) * time.Second,
+			configs: make(map[string]json.RawMessage),
+			remotes: make(map[string]*remote),
+			done:    make(chan struct{}),
+		}
+
+		err := p.start()
+		if err != nil {
+			return fmt.Errorf("start plugin %s fail: %v", p.name, err)
+		}
+
+		for _, protocol := range p.protocols {
+			r := &remote{proc: p, protocol: protocol}
+			p.remotes[protocol] = r
+			plugin.RegisterDriverV2(protocol, p.name, r)
+			if !plugin.Registered(protocol) {
+				plugin.RegisterV2(protocol, r)
+			}
+		}
+
+		processesMu.Lock()
+		processes[p.name] = p
+		processesMu.Unlock()
+
+		logs.Info("load plugin %s with protocols %v", p.name, p.protocols)
+		go p.supervise()
+	}
+	return nil
+}
+
+// Shutdown stops loaded plugins, they are not restarted anymore.
+// Plugins are killed if they do not exit in the rpc timeout
+// after their stdin is closed.
+func Shutdown() {
+	processesMu.Lock()
+	procs := make([]*process, 0, len(processes))
+	for name, p := range processes {
+		procs = append(procs, p)
+		delete(processes, name)
+	}
+	processesMu.Unlock()
+
+	for _, p := range procs {
+		p.stop()
+	}
+}
+
+// process is a running plugin executable
+type process struct {
+	name    string
+	path    string
+	health  time.Duration
+	timeout time.Duration
+
+	mu        sync.Mutex
+	cmd       *exec.Cmd
+	stdin     io.Closer
+	client    *rpc.Client
+	protocols []string
+	restarts  int
+
+	// configs stores setup configs for restarts
+	// key: protocol
+	configs map[string]json.RawMessage
+
+	// remotes stores plugins of protocols registered to plugin manager
+	// key: protocol
+	remotes map[string]*remote
+
+	// stopping stops supervise, done closes after it returns
+	stopping bool
+	done     chan struct{}
+}
+
+// stop closes stdin of the plugin and waits supervise returns
+func (p *process) stop() {
+	p.mu.Lock()
+	p.stopping = true
+	if p.stdin != nil {
+		p.stdin.Close()
+	}
+	p.mu.Unlock()
+
+	select {
+	case <-p.done:
+		return
+	case <-time.After(p.timeout):
+	}
+
+	logs.Warn("plugin %s does not exit, kill it", p.name)
+	p.mu.Lock()
+	p.cmd.Process.Kill()
+	p.mu.Unlock()
+	<-p.done
+}
+
+func (p *process) isStopping() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.stopping
+}
+
+// start starts the executable, reads the handshake line and
+// connects to its rpc service
+func (p *process) start() error {
+	stdinR, stdinW, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+
+	stdoutR, stdoutW, err := os.Pipe()
+	if err != nil {
+		stdinR.Close()
+		stdinW.Close()
+		return err
+	}
+
+	cmd := exec.Command(p.path)
+	cmd.Env = append(os.Environ(), versionEnv+"="+strconv.Itoa(Version))
+	cmd.Stdin = stdinR
+	cmd.Stdout = stdoutW
+	cmd.Stderr = &logWriter{name: p.name}
+
+	err = cmd.Start()
+	stdinR.Close()
+	stdoutW.Close()
+	if err != nil {
+		stdinW.Close()
+		stdoutR.Close()
+		return err
+	}
+
+	fail := func(err error) error {
+		cmd.Process.Kill()
+		stdinW.Close()
+		stdoutR.Close()
+		cmd.Wait()
+		return err
+	}
+
+	stdout := bufio.NewReader(stdoutR)
+	stdoutR.SetReadDeadline(time.Now().Add(p.timeout))
+	line, err := stdout.ReadString('\n')
+	if err != nil {
+		return fail(fmt.Errorf("read handshake fail: %v", err))
+	}
+	stdoutR.SetReadDeadline(time.Time{})
+
+	fields := strings.Split(strings.TrimSpace(line), "|")
+	if len(fields) < 3 || fields[0] != magic {
+		return fail(fmt.Errorf("invalid handshake %q", line))
+	}
+
+	if fields[1] != strconv.Itoa(Version) {
+		return fail(fmt.Errorf("plugin speaks protocol %s, expect %d", fields[1], Version))
+	}
+
+	var conn io.ReadWriteCloser
+	switch {
+	case fields[2] == "stdio":
+		conn = &stdio{Reader: stdout, WriteCloser: stdinW}
+
+	case fields[2] == "unix" && len(fields) == 4:
+		c, err := net.DialTimeout("unix", fields[3], p.timeout)
+		if err != nil {
+			return fail(err)
+		}
+		conn = c
+		go io.Copy(&logWriter{name: p.name}, stdout)
+
+	default:
+		return fail(fmt.Errorf("invalid handshake %q", line))
+	}
+
+	client := rpc.NewClientWithCodec(jsonrpc.NewClientCodec(conn))
+	var hs HandshakeReply
+	err = callTimeout(client, p.timeout, "Handshake", Empty{}, &hs)
+	if err != nil {
+		client.Close()
+		return fail(fmt.Errorf("handshake fail: %v", err))
+	}
+
+	p.mu.Lock()
+	p.cmd = cmd
+	p.stdin = stdinW
+	p.client = client
+	if p.protocols == nil {
+		sort.Strings(hs.Protocols)
+		p.protocols = hs.Protocols
+	}
+	p.mu.Unlock()
+	return nil
+}
+
+// supervise restarts the plugin if it exits or fails health checks,
+// setups and runs proxies of the plugin again after restarts
+func (p *process) supervise() {
+	defer close(p.done)
+
+	backoff := restartBackoff
+	for {
+		p.mu.Lock()
+		cmd := p.cmd
+		p.mu.Unlock()
+		started := time.Now()
+
+		exited := make(chan error, 1)
+		go func() {
+			exited <- cmd.Wait()
+		}()
+
+		err := p.watch(exited)
+
+		p.mu.Lock()
+		p.client.Close()
+		p.stdin.Close()
+		p.client = nil
+		p.mu.Unlock()
+
+		if p.isStopping() {
+			logs.Info("plugin %s stopped: %v", p.name, err)
+			return
+		}
+
+		backoff = nextBackoff(backoff, time.Since(started))
+		logs.Warn("plugin %s exit: %v, restart in %s", p.name, err, backoff)
+
+		for {
+			time.Sleep(backoff)
+			if p.isStopping() {
+				return
+			}
+
+			err := p.start()
+			if err == nil {
+				break
+			}
+
+			backoff = nextBackoff(backoff, 0)
+			logs.Error("restart plugin %s fail: %v, retry in %s", p.name, err, backoff)
+		}
+
+		p.mu.Lock()
+		p.restarts++
+		p.mu.Unlock()
+
+		p.restore()
+	}
+}
+
+// nextBackoff returns the backoff of the next restart of a plugin which
+// ran uptime. The backoff grows while the plugin keeps crashing, and is
+// reset to restartBackoff once the plugin ran restartReset.
+func nextBackoff(backoff, uptime time.Duration) time.Duration {
+	if uptime >= restartReset {
+		return restartBackoff
+	}
+
+	backoff *= 2
+	if backoff > maxRestartBackoff {
+		backoff = maxRestartBackoff
+	}
+	return backoff
+}
+
+// watch returns when the plugin exits or fails health checks
+func (p *process) watch(exited chan error) error {
+	tick := time.NewTicker(p.health)
+	defer tick.Stop()
+
+	for {
+		select {
+		case err := <-exited:
+			return err
+
+		case <-tick.C:
+			// stopping plugin is waited to exit by stop
+			if p.isStopping() {
+				continue
+			}
+
+			err := p.call("Health", Empty{}, &Empty{})
+			if err != nil {
+				logs.Warn("plugin %s health check fail: %v, kill it", p.name, err)
+				p.mu.Lock()
+				p.cmd.Process.Kill()
+				p.mu.Unlock()
+				return <-exited
+			}
+		}
+	}
+}
+
+// restore setups protocols and runs proxies again,
+// protocols whose driver is not the plugin are skipped
+func (p *process) restore() {
+	p.mu.Lock()
+	configs := make(map[string]json.RawMessage)
+	for protocol, cfg := range p.configs {
+		configs[protocol] = cfg
+	}
+	p.mu.Unlock()
+
+	mgr := plugin.DefaultPluginManager()
+	for protocol, cfg := range configs {
+		if r := p.remotes[protocol]; r == nil || mgr.Plugin(protocol) != plugin.IPluginV2(r) {
+			continue
+		}
+
+		err := p.call("Setup", &SetupArgs{Protocol: protocol, Config: cfg}, &Empty{})
+		if err != nil {
+			logs.Error("setup protocol %s of plugin %s fail: %v", protocol, p.name, err)
+			continue
+		}
+
+		for _, item := range mgr.Routes(protocol) {
+			err := p.call("RunProxy", metaOf(item), &Tuple{})
+			if err != nil {
+				logs.Error("run proxy %s %s of plugin %s fail: %v", protocol, item.To, p.name, err)
+			}
+		}
+	}
+}
+
+func (p *process) call(method string, args, reply interface{}) error {
+	p.mu.Lock()
+	client := p.client
+	p.mu.Unlock()
+
+	if client == nil {
+		return fmt.Errorf("plugin %s is not running", p.name)
+	}
+	return callTimeout(client, p.timeout, method, args, reply)
+}
+
+func callTimeout(client *rpc.Client, timeout time.Duration, method string, args, reply interface{}) error {
+	call := client.Go(serviceName+"."+method, args, reply, make(chan *rpc.Call, 1))
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case <-call.Done:
+		return call.Error
+	case <-timer.C:
+		return fmt.Errorf("%s timeout", method)
+	}
+}
+
+// remote is the IPluginV2 of a protocol served by a plugin process
+type remote struct {
+	proc     *process
+	protocol string
+}
+
+func (r *remote) Setup(ctx context.Context, rawMessage json.RawMessage) error {
+	r.proc.mu.Lock()
+	r.proc.configs[r.protocol] = rawMessage
+	r.proc.mu.Unlock()
+
+	return r.proc.call("Setup", &SetupArgs{Protocol: r.protocol, Config: rawMessage}, &Empty{})
+}
+
+func (r *remote) RunProxy(ctx context.Context, item *plugin.PluginMeta) (plugin.Proxy, error) {
+	var tuple Tuple
+	err := r.proc.call("RunProxy", metaOf(item), &tuple)
+	if err != nil {
+		return nil, err
+	}
+
+	return &remoteProxy{
+		BasicProxy: plugin.NewProxy(&plugin.ProxyTuple{
+			Protocol: tuple.Protocol,
+			FromPort: tuple.FromPort,
+			ToPort:   tuple.ToPort,
+		}, func() error {
+			err := r.proc.call("StopProxy", metaOf(item), &Empty{})
+			if err != nil {
+				return fmt.Errorf("stop proxy %s %s of plugin %s fail: %v", item.Protocol, item.To, r.proc.name, err)
+			}
+			return nil
+		}),
+		proc: r.proc,
+	}, nil
+}
+
+// remoteProxy is a proxy served by a plugin process
+// it is unhealthy while the process is restarting
+type remoteProxy struct {
+	*plugin.BasicProxy
+	proc *process
+}
+
+func (p *remoteProxy) Health() error {
+	p.proc.mu.Lock()
+	defer p.proc.mu.Unlock()
+	if p.proc.client == nil {
+		return fmt.Errorf("plugin %s is not running", p.proc.name)
+	}
+	return nil
+}
+
+func metaOf(item *plugin.PluginMeta) *Meta {
+	return &Meta{
+		Protocol: item.Protocol,
+		From:     item.From,
+		To:       item.To,
+		Domain:   item.Domain,
+		Ctx:      item.Ctx,
+	}
+}
+
+// logWriter writes plugin output to logs
+type logWriter struct {
+	name string
+}
+
+func (w *logWriter) Write(b []byte) (int, error) {
+	for _, line := range strings.Split(strings.TrimSpace(string(b)), "\n") {
+		logs.Info("plugin %s: %s", w.name, line)
+	}
+	return len(b), nil
+}
@@ -0,0 +1,67 @@
+// Package external runs plugins as separate executables.
+//
+// opennotrd starts every executable of the plugin dir with env
+// OPENNOTR_PLUGIN_VERSION=$Version. The plugin writes a handshake
+// line to stdout and serves JSON-RPC(net/rpc/jsonrpc) with the
+// service name "Plugin":
+//
+//	opennotr-plugin|1|stdio             rpc over stdin and stdout
+//	opennotr-plugin|1|unix|$socket      rpc over unix socket
+//
+// The methods are Handshake, Setup, RunProxy, StopProxy and Health.
+// Plugins exit when their stdin is closed. Plugins written in go
+// can use Serve and ServeUnix.
+package external
+
+import "encoding/json"
+
+const (
+	// Version is the version of rpc protocol
+	// it is increased on incompatible changes
+	Version = 1
+
+	magic = "opennotr-plugin"
+
+	versionEnv = "OPENNOTR_PLUGIN_VERSION"
+
+	// rpc service name
+	serviceName = "Plugin"
+)
+
+// HandshakeReply is the reply of Plugin.Handshake
+type HandshakeReply struct {
+	Version int `json:"version"`
+
+	// Protocols specific protocols the plugin serves
+	Protocols []string `json:"protocols"`
+}
+
+// SetupArgs is the args of Plugin.Setup
+type SetupArgs struct {
+	Protocol string          `json:"protocol"`
+	Config   json.RawMessage `json:"config"`
+}
+
+// Meta is the args of Plugin.RunProxy and Plugin.StopProxy,
+// it is PluginMeta without RecycleSignal and Dialer
+type Meta struct {
+	Protocol string      `json:"protocol"`
+	From     string      `json:"from"`
+	To       string      `json:"to"`
+	Domain   string      `json:"domain"`
+	Ctx      interface{} `json:"ctx"`
+}
+
+// Tuple is the reply of Plugin.RunProxy
+type Tuple struct {
+	Protocol string `json:"protocol"`
+	FromPort string `json:"fromPort"`
+	ToPort   string `json:"toPort"`
+}
+
+// Empty is the args or reply of methods without data
+type Empty struct{}
+
+func (m *Meta) key() string {
+	return m.Protocol + "|" + m.From + "|" + m.Domain + "|" + m.To
+}
@@ -0,0 +1,162 @@
+package external
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/rpc"
+	"net/rpc/jsonrpc"
+	"os"
+	"strconv"
+	"sync"
+
+	"github.com/ICKelin/opennotr/opennotrd/plugin"
+)
+
+// Serve serves plugins over stdin and stdout until stdin is closed
+// key: protocol, value: plugin implement
+// plugins must not write to stdout, use stderr for logs instead
+func Serve(plugins map[string]plugin.IPluginV2) error {
+	srv, err := newServer(plugins)
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(os.Stdout, "%s|%d|stdio\n", magic, Version)
+	srv.ServeCodec(jsonrpc.NewServerCodec(&stdio{Reader: os.Stdin, WriteCloser: os.Stdout}))
+	return nil
+}
+
+// ServeUnix serves plugins over unix socket path until stdin is closed
+func ServeUnix(path string, plugins map[string]plugin.IPluginV2) error {
+	srv, err := newServer(plugins)
+	if err != nil {
+		return err
+	}
+
+	os.Remove(path)
+	lis, err := net.Listen("unix", path)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(path)
+	defer lis.Close()
+
+	go func() {
+		for {
+			conn, err := lis.Accept()
+			if err != nil {
+				return
+			}
+			go srv.ServeCodec(jsonrpc.NewServerCodec(conn))
+		}
+	}()
+
+	fmt.Fprintf(os.Stdout, "%s|%d|unix|%s\n", magic, Version, path)
+	io.Copy(ioutil.Discard, os.Stdin)
+	return nil
+}
+
+func newServer(plugins map[string]plugin.IPluginV2) (*rpc.Server, error) {
+	if v := os.Getenv(versionEnv); len(v) > 0 && v != strconv.Itoa(Version) {
+		return nil, fmt.Errorf("opennotrd speaks plugin protocol %s, expect %d", v, Version)
+	}
+
+	srv := rpc.NewServer()
+	err := srv.RegisterName(serviceName, &service{
+		plugins: plugins,
+		proxies: make(map[string]plugin.Proxy),
+	})
+	return srv, err
+}
+
+// service is the rpc service of plugin side
+type service struct {
+	plugins map[string]plugin.IPluginV2
+
+	mu sync.Mutex
+
+	// proxies stores running proxies, closed by StopProxy
+	// key: Meta.key()
+	proxies map[string]plugin.Proxy
+}
+
+func (s *service) Handshake(args Empty, reply *HandshakeReply) error {
+	reply.Version = Version
+	for protocol := range s.plugins {
+		reply.Protocols = append(reply.Protocols, protocol)
+	}
+	return nil
+}
+
+func (s *service) Setup(args SetupArgs, reply *Empty) error {
+	p, ok := s.plugins[args.Protocol]
+	if !ok {
+		return fmt.Errorf("protocol %s not register", args.Protocol)
+	}
+	return p.Setup(context.Background(), args.Config)
+}
+
+// RunProxy runs the proxy of args, the running proxy of the same key
+// is closed first, eg: opennotrd restores proxies after it restarts
+func (s *service) RunProxy(args Meta, reply *Tuple) error {
+	p, ok := s.plugins[args.Protocol]
+	if !ok {
+		return fmt.Errorf("protocol %s not register", args.Protocol)
+	}
+
+	s.mu.Lock()
+	old, ok := s.proxies[args.key()]
+	delete(s.proxies, args.key())
+	s.mu.Unlock()
+
+	if ok {
+		old.Close()
+	}
+
+	item := &plugin.PluginMeta{
+		Protocol: args.Protocol,
+		From:     args.From,
+		To:       args.To,
+		Domain:   args.Domain,
+		Ctx:      args.Ctx,
+	}
+
+	proxy, err := p.RunProxy(context.Background(), item)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	s.proxies[args.key()] = proxy
+	s.mu.Unlock()
+
+	if tuple := proxy.Tuple(); tuple != nil {
+		*reply = Tuple{Protocol: tuple.Protocol, FromPort: tuple.FromPort, ToPort: tuple.ToPort}
+	}
+	return nil
+}
+
+func (s *service) StopProxy(args Meta, reply *Empty) error {
+	s.mu.Lock()
+	proxy, ok := s.proxies[args.key()]
+	delete(s.proxies, args.key())
+	s.mu.Unlock()
+
+	if !ok {
+		return nil
+	}
+	return proxy.Close()
+}
+
+func (s *service) Health(args Empty, reply *Empty) error {
+	return nil
+}
+
+// stdio joins stdin and stdout as a connection
+type stdio struct {
+	io.Reader
+	io.WriteCloser
+}
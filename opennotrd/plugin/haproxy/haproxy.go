@@ -0,0 +1,264 @@
+// Package haproxy maps client domains onto haproxy by its runtime api,
+// it is the "haproxy" driver of http, https and h2c plugins.
+//
+// Each domain gets a server $vip:$port in the backend and a map entry
+// $domain => $server, the haproxy configuration selects the server of
+// request Host by the map. Schemes use separate maps since the same
+// domain may be forwarded by http and h2c.
+package haproxy
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ICKelin/opennotr/internal/logs"
+	"github.com/ICKelin/opennotr/opennotrd/plugin"
+)
+
+var (
+	defaultSocket = "/var/run/haproxy.sock"
+
+	// default map file is /etc/haproxy/opennotr_$scheme.map
+	defaultMapFormat = "/etc/haproxy/opennotr_%s.map"
+
+	// default runtime api command timeout(seconds)
+	defaultTimeout = 5
+
+	mapsMu sync.Mutex
+
+	// maps stores map files used by schemes
+	// key: map file, value: scheme
+	maps = make(map[string]string)
+)
+
+func init() {
+	plugin.RegisterDriverV2("http", "haproxy", &HAProxy{scheme: "http"})
+	plugin.RegisterDriverV2("https", "haproxy", &HAProxy{scheme: "https"})
+	plugin.RegisterDriverV2("h2c", "haproxy", &HAProxy{scheme: "h2c"})
+}
+
+type config struct {
+	// Socket specific the runtime api unix socket
+	// default /var/run/haproxy.sock
+	Socket string `json:"socket"`
+
+	// Backend specific the backend servers are added to
+	// default opennotr_$scheme
+	Backend string `json:"backend"`
+
+	// Map specific the map file of host => server, it can not be
+	// shared by schemes. default /etc/haproxy/opennotr_$scheme.map
+	Map string `json:"map"`
+
+	// ServerOptions are appended to "add server", eg: "check proto h2"
+	ServerOptions string `json:"serverOptions"`
+
+	// Timeout specific runtime api command timeout in second, default 5
+	Timeout int `json:"timeout" min:"0"`
+}
+
+// HAProxy adds servers and map entries by haproxy runtime api
+type HAProxy struct {
+	scheme  string
+	cfg     config
+	timeout time.Duration
+}
+
+func (p *HAProxy) Schema() *plugin.Schema {
+	return plugin.SchemaOf(config{
+		Socket:  defaultSocket,
+		Backend: "opennotr_" + p.scheme,
+		Map:     fmt.Sprintf(defaultMapFormat, p.scheme),
+		Timeout: defaultTimeout,
+	})
+}
+
+func (p *HAProxy) Setup(ctx context.Context, rawMessage json.RawMessage) error {
+	var cfg config
+	err := json.Unmarshal(rawMessage, &cfg)
+	if err != nil {
+		return err
+	}
+
+	if len(cfg.Socket) <= 0 {
+		cfg.Socket = defaultSocket
+	}
+
+	if len(cfg.Backend) <= 0 {
+		cfg.Backend = "opennotr_" + p.scheme
+	}
+
+	if len(cfg.Map) <= 0 {
+		cfg.Map = fmt.Sprintf(defaultMapFormat, p.scheme)
+	}
+
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = defaultTimeout
+	}
+
+	// entries of a map are keyed by domain only
+	mapsMu.Lock()
+	defer mapsMu.Unlock()
+	if scheme, ok := maps[cfg.Map]; ok && scheme != p.scheme {
+		return fmt.Errorf("haproxy map %s is used by %s", cfg.Map, scheme)
+	}
+
+	if p.cfg.Map != cfg.Map {
+		delete(maps, p.cfg.Map)
+	}
+	maps[cfg.Map] = p.scheme
+
+	p.cfg = cfg
+	p.timeout = time.Duration(cfg.Timeout) * time.Second
+	return nil
+}
+
+// ForwardSchema declares forwards accept no options
+func (p *HAProxy) ForwardSchema() *plugin.Schema {
+	return plugin.SchemaOf(struct{}{})
+}
+
+func (p *HAProxy) RunProxy(ctx context.Context, item *plugin.PluginMeta) (plugin.Proxy, error) {
+	if len(item.Domain) <= 0 {
+		return nil, fmt.Errorf("domain is required for %s", p.scheme)
+	}
+
+	err := plugin.CheckDomain(item.Domain)
+	if err != nil {
+		return nil, err
+	}
+
+	_, toPort, err := net.SplitHostPort(item.To)
+	if err != nil {
+		return nil, err
+	}
+
+	domain := strings.ToLower(item.Domain)
+	server := p.serverName(domain)
+
+	// the server of last session may be left, eg: opennotrd restarted
+	p.delServer(server)
+
+	addCmd := []string{"add", "server", p.cfg.Backend + "/" + server, item.To}
+	addCmd = append(addCmd, strings.Fields(p.cfg.ServerOptions)...)
+	err = p.expect(addCmd, "New server registered")
+	if err != nil {
+		return nil, err
+	}
+
+	// dynamic servers start in maintenance
+	err = p.expect([]string{"enable", "server", p.cfg.Backend + "/" + server}, "")
+	if err != nil {
+		p.delServer(server)
+		return nil, err
+	}
+
+	p.command([]string{"del", "map", p.cfg.Map, domain})
+	err = p.expect([]string{"add", "map", p.cfg.Map, domain, server}, "")
+	if err != nil {
+		p.delServer(server)
+		return nil, err
+	}
+
+	logs.Info("add haproxy server %s/%s => %s", p.cfg.Backend, server, item.To)
+	return plugin.NewProxy(&plugin.ProxyTuple{
+		Protocol: item.Protocol,
+		ToPort:   toPort,
+	}, func() error {
+		return p.stopProxy(domain)
+	}), nil
+}
+
+// stopProxy deletes map entry and server of domain
+func (p *HAProxy) stopProxy(domain string) error {
+	err := p.expect([]string{"del", "map", p.cfg.Map, domain}, "")
+	if err != nil {
+		err = fmt.Errorf("delete haproxy map %s fail: %v", domain, err)
+	}
+
+	if e := p.delServer(p.serverName(domain)); e != nil && err == nil {
+		err = fmt.Errorf("delete haproxy server %s fail: %v", domain, e)
+	}
+	return err
+}
+
+// delServer puts server into maintenance and deletes it
+func (p *HAProxy) delServer(server string) error {
+	name := p.cfg.Backend + "/" + server
+	p.command([]string{"set", "server", name, "state", "maint"})
+	p.command([]string{"shutdown", "sessions", "server", name})
+	return p.expect([]string{"del", "server", name}, "Server deleted")
+}
+
+func (p *HAProxy) serverName(domain string) string {
+	return p.scheme + "_" + domain
+}
+
+// expect runs cmd and checks the reply has prefix
+// empty prefix means the reply should be empty
+func (p *HAProxy) expect(args []string, prefix string) error {
+	reply, err := p.command(args)
+	if err != nil {
+		return err
+	}
+
+	if (len(prefix) <= 0 && len(reply) > 0) || !strings.HasPrefix(reply, prefix) {
+		return fmt.Errorf("haproxy %q: %s", strings.Join(args, " "), reply)
+	}
+	return nil
+}
+
+// command runs a runtime api command of args
+// haproxy replies and closes the connection in non-interactive mode
+func (p *HAProxy) command(args []string) (string, error) {
+	cmd, err := commandLine(args)
+	if err != nil {
+		return "", err
+	}
+
+	conn, err := net.DialTimeout("unix", p.cfg.Socket, p.timeout)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(p.timeout))
+	_, err = conn.Write([]byte(cmd + "\n"))
+	if err != nil {
+		return "", err
+	}
+
+	reply, err := ioutil.ReadAll(conn)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(reply)), nil
+}
+
+// commandLine joins args as a runtime api command line, spaces,
+// semicolons and backslashes of args are escaped so an argument
+// is never split or taken as another command
+func commandLine(args []string) (string, error) {
+	escaped := make([]string, 0, len(args))
+	for _, arg := range args {
+		if len(arg) <= 0 || strings.ContainsAny(arg, "\r\n") {
+			return "", fmt.Errorf("invalid haproxy argument %q", arg)
+		}
+
+		b := &strings.Builder{}
+		for _, c := range arg {
+			if c == ' ' || c == '\t' || c == ';' || c == '\\' {
+				b.WriteByte('\\')
+			}
+			b.WriteRune(c)
+		}
+		escaped = append(escaped, b.String())
+	}
+	return strings.Join(escaped, " "), nil
+}
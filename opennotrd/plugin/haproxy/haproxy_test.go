@@ -0,0 +1,355 @@
+package haproxy
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/ICKelin/opennotr/opennotrd/plugin"
+)
+
+// fakeHAProxy speaks the runtime api line protocol on unix socket
+type fakeHAProxy struct {
+	lis net.Listener
+
+	mu       sync.Mutex
+	servers  map[string]string // backend/server => addr
+	enabled  map[string]bool
+	maps     map[string][]string // file => "key value" entries
+	commands []string
+}
+
+func newFakeHAProxy(t *testing.T, sock string) *fakeHAProxy {
+	lis, err := net.Listen("unix", sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f := &fakeHAProxy{
+		lis:     lis,
+		servers: map[string]string{"opennotr_http/static": "127.0.0.1:80"},
+		enabled: make(map[string]bool),
+		maps:    make(map[string][]string),
+	}
+
+	go func() {
+		for {
+			conn, err := lis.Accept()
+			if err != nil {
+				return
+			}
+
+			line, _ := bufio.NewReader(conn).ReadString('\n')
+			for _, args := range parseLine(strings.TrimSpace(line)) {
+				fmt.Fprintf(conn, "%s\n", f.handle(args))
+			}
+			conn.Close()
+		}
+	}()
+	return f
+}
+
+// parseLine splits line to commands by semicolons and commands
+// to arguments by spaces as haproxy does, backslash escapes a character
+func parseLine(line string) [][]string {
+	cmds := make([][]string, 0)
+	args := make([]string, 0)
+	arg := &strings.Builder{}
+	escaped := false
+	flush := func() {
+		if arg.Len() > 0 {
+			args = append(args, arg.String())
+			arg.Reset()
+		}
+	}
+
+	for _, c := range line {
+		switch {
+		case escaped:
+			arg.WriteRune(c)
+			escaped = false
+		case c == '\\':
+			escaped = true
+		case c == ' ' || c == '\t':
+			flush()
+		case c == ';':
+			flush()
+			cmds = append(cmds, args)
+			args = make([]string, 0)
+		default:
+			arg.WriteRune(c)
+		}
+	}
+	flush()
+	return append(cmds, args)
+}
+
+func (f *fakeHAProxy) handle(args []string) string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.commands = append(f.commands, strings.Join(args, " "))
+
+	if len(args) < 2 {
+		return "Unknown command."
+	}
+
+	cmd := strings.Join(args[:2], " ")
+	switch {
+	case cmd == "add server" && len(args) >= 4:
+		if !strings.HasPrefix(args[2], "opennotr_") {
+			return "No such backend."
+		}
+		if _, ok := f.servers[args[2]]; ok {
+			return "Already exists a server with the same name in backend."
+		}
+		f.servers[args[2]] = args[3]
+		return "New server registered."
+
+	case cmd == "enable server":
+		if _, ok := f.servers[args[2]]; !ok {
+			return "No such server."
+		}
+		f.enabled[args[2]] = true
+		return ""
+
+	case cmd == "set server", cmd == "shutdown sessions":
+		name := args[len(args)-1]
+		if cmd == "set server" {
+			name = args[2]
+		}
+		if _, ok := f.servers[name]; !ok {
+			return "No such server."
+		}
+		f.enabled[name] = false
+		return ""
+
+	case cmd == "del server":
+		if _, ok := f.servers[args[2]]; !ok {
+			return "No such server."
+		}
+		if f.enabled[args[2]] {
+			return "Only servers in maintenance mode can be deleted."
+		}
+		delete(f.servers, args[2])
+		return "Server deleted."
+
+	case cmd == "add map" && len(args) == 5:
+		f.maps[args[2]] = append(f.maps[args[2]], args[3]+" "+args[4])
+		return ""
+
+	case cmd == "del map" && len(args) == 4:
+		entries := f.maps[args[2]]
+		for i, e := range entries {
+			if strings.HasPrefix(e, args[3]+" ") {
+				f.maps[args[2]] = append(entries[:i:i], entries[i+1:]...)
+				return ""
+			}
+		}
+		return "Key not found."
+	}
+	return "Unknown command."
+}
+
+func (f *fakeHAProxy) state() (map[string]string, []string) {
+	return f.stateOf("/etc/haproxy/opennotr_http.map")
+}
+
+func (f *fakeHAProxy) stateOf(mapFile string) (map[string]string, []string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	servers := make(map[string]string)
+	for k, v := range f.servers {
+		servers[k] = v
+	}
+	return servers, append([]string{}, f.maps[mapFile]...)
+}
+
+func TestHAProxy(t *testing.T) {
+	dir, err := ioutil.TempDir("", "haproxy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	sock := filepath.Join(dir, "haproxy.sock")
+	fake := newFakeHAProxy(t, sock)
+	defer fake.lis.Close()
+
+	p := &HAProxy{scheme: "http"}
+	err = p.Setup(context.Background(), json.RawMessage(fmt.Sprintf(`{"socket": "%s", "serverOptions": "check"}`, sock)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	item := &plugin.PluginMeta{
+		Protocol: "http",
+		To:       "100.64.240.10:8080",
+		Domain:   "A.open.notr.tech",
+	}
+
+	proxy, err := p.RunProxy(context.Background(), item)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tuple := proxy.Tuple()
+
+	if tuple.ToPort != "8080" {
+		t.Fatalf("unexpected tuple %v", tuple)
+	}
+
+	servers, entries := fake.state()
+	if servers["opennotr_http/http_a.open.notr.tech"] != "100.64.240.10:8080" ||
+		!fake.enabled["opennotr_http/http_a.open.notr.tech"] {
+		t.Fatalf("expected server added and enabled, got %v", servers)
+	}
+
+	if len(entries) != 1 || entries[0] != "a.open.notr.tech http_a.open.notr.tech" {
+		t.Fatalf("unexpected map entries %v", entries)
+	}
+
+	// reconnect replaces the left server and map entry
+	item.To = "100.64.240.11:8080"
+	again, err := p.RunProxy(context.Background(), item)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	servers, entries = fake.state()
+	if servers["opennotr_http/http_a.open.notr.tech"] != "100.64.240.11:8080" || len(entries) != 1 {
+		t.Fatalf("expected server replaced, got %v %v", servers, entries)
+	}
+
+	again.Close()
+	servers, entries = fake.state()
+	if len(servers) != 1 || len(entries) != 0 {
+		t.Fatalf("expected server and map entry deleted, got %v %v", servers, entries)
+	}
+
+	// errors of runtime api are returned
+	bad := &HAProxy{scheme: "http"}
+	bad.Setup(context.Background(), json.RawMessage(fmt.Sprintf(`{"socket": "%s", "backend": "missing"}`, sock)))
+	if _, err := bad.RunProxy(context.Background(), item); err == nil || !strings.Contains(err.Error(), "No such backend") {
+		t.Fatalf("expected no such backend error, got %v", err)
+	}
+
+	fake.mu.Lock()
+	last := fake.commands[len(fake.commands)-1]
+	fake.mu.Unlock()
+	if !strings.HasPrefix(last, "add server missing/http_a.open.notr.tech 100.64.240.11:8080") {
+		t.Fatalf("unexpected last command %q", last)
+	}
+}
+
+func TestHAProxySocketUnavailable(t *testing.T) {
+	p := &HAProxy{scheme: "http"}
+	p.Setup(context.Background(), json.RawMessage(`{"socket": "/nonexistent/haproxy.sock"}`))
+	_, err := p.RunProxy(context.Background(), &plugin.PluginMeta{Protocol: "http", To: "100.64.240.10:80", Domain: "a.open.notr.tech"})
+	if err == nil {
+		t.Fatal("expected socket error")
+	}
+}
+
+func TestHAProxyEscape(t *testing.T) {
+	dir, err := ioutil.TempDir("", "haproxy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	sock := filepath.Join(dir, "haproxy.sock")
+	fake := newFakeHAProxy(t, sock)
+	defer fake.lis.Close()
+
+	// semicolons of configuration are escaped as arguments
+	p := &HAProxy{scheme: "http"}
+	err = p.Setup(context.Background(), json.RawMessage(fmt.Sprintf(`{"socket": "%s", "serverOptions": "check;del server opennotr_http/static"}`, sock)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	proxy, err := p.RunProxy(context.Background(), &plugin.PluginMeta{Protocol: "http", To: "100.64.240.10:80", Domain: "a.open.notr.tech"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer proxy.Close()
+
+	servers, _ := fake.state()
+	if _, ok := servers["opennotr_http/static"]; !ok {
+		t.Fatalf("expected static server kept, got %v", servers)
+	}
+
+	for _, domain := range []string{"a.open.notr.tech;disable frontend www", "a b.open.notr.tech"} {
+		_, err := p.RunProxy(context.Background(), &plugin.PluginMeta{Protocol: "http", To: "100.64.240.10:80", Domain: domain})
+		if err == nil {
+			t.Errorf("%q: expected invalid domain error", domain)
+		}
+	}
+
+	line, _ := commandLine([]string{"add", "map", "a b", `c;d\`})
+	if line != `add map a\ b c\;d\\` {
+		t.Errorf("unexpected command line %s", line)
+	}
+
+	if _, err := commandLine([]string{"add", "map", "a\nshow"}); err == nil {
+		t.Error("expected newline rejected")
+	}
+}
+
+func TestHAProxySchemes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "haproxy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	sock := filepath.Join(dir, "haproxy.sock")
+	fake := newFakeHAProxy(t, sock)
+	defer fake.lis.Close()
+
+	cfg := json.RawMessage(fmt.Sprintf(`{"socket": "%s"}`, sock))
+	http := &HAProxy{scheme: "http"}
+	h2c := &HAProxy{scheme: "h2c"}
+	if err := http.Setup(context.Background(), cfg); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := h2c.Setup(context.Background(), json.RawMessage(fmt.Sprintf(`{"socket": "%s", "map": "/etc/haproxy/opennotr_http.map"}`, sock))); err == nil {
+		t.Fatal("expected map shared by schemes error")
+	}
+
+	if err := h2c.Setup(context.Background(), cfg); err != nil {
+		t.Fatal(err)
+	}
+
+	item := &plugin.PluginMeta{To: "100.64.240.10:80", Domain: "a.open.notr.tech"}
+	httpProxy, err := http.RunProxy(context.Background(), item)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	h2cProxy, err := h2c.RunProxy(context.Background(), item)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h2cProxy.Close()
+
+	// stopping http keeps the h2c entry
+	httpProxy.Close()
+	_, entries := fake.stateOf("/etc/haproxy/opennotr_h2c.map")
+	if len(entries) != 1 || entries[0] != "a.open.notr.tech h2c_a.open.notr.tech" {
+		t.Fatalf("unexpected h2c map entries %v", entries)
+	}
+
+	if _, entries := fake.state(); len(entries) != 0 {
+		t.Fatalf("unexpected http map entries %v", entries)
+	}
+}
@@ -0,0 +1,220 @@
+// Package hook runs a command or calls a webhook when proxies
+// start and stop, it integrates firewalls, load balancers or
+// billing without writing plugins in go.
+//
+// It registers protocol "hook" and the "hook" driver of the
+// builtin protocols.
+package hook
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/ICKelin/opennotr/opennotrd/plugin"
+)
+
+var (
+	// default timeout of command and webhook(seconds)
+	defaultTimeout = 10
+
+	// protocols the hook driver is registered
+	protocols = []string{"tcp", "udp", "http", "https", "h2c", "tls", "ssh"}
+)
+
+func init() {
+	plugin.RegisterV2("hook", &Hook{})
+	for _, protocol := range protocols {
+		plugin.RegisterDriverV2(protocol, "hook", &Hook{})
+	}
+}
+
+type config struct {
+	// Exec specific the command and its arguments
+	// the event is written to stdin as JSON
+	Exec []string `json:"exec"`
+
+	// URL specific the webhook the event is posted to
+	URL string `json:"url"`
+
+	// Headers specific extra headers of webhook requests
+	// eg: {"Authorization": "Bearer xxx"}
+	Headers map[string]string `json:"headers"`
+
+	// Timeout specific timeout of command and webhook in seconds
+	// default 10
+	Timeout int `json:"timeout" min:"0"`
+}
+
+// Event is passed to the hook as JSON
+type Event struct {
+	// Event is "run" or "stop"
+	Event    string      `json:"event"`
+	Protocol string      `json:"protocol"`
+	From     string      `json:"from"`
+	To       string      `json:"to"`
+	Domain   string      `json:"domain"`
+	Ctx      interface{} `json:"ctx"`
+}
+
+// Reply is the optional JSON reply of the hook for "run" event
+// empty fields are filled from the PluginMeta
+type Reply struct {
+	Protocol string `json:"protocol"`
+	FromPort string `json:"fromPort"`
+	ToPort   string `json:"toPort"`
+}
+
+// Hook runs the command or calls the webhook when proxies start and stop.
+// The command succeeds if it exits 0, the webhook succeeds if it
+// replies 2xx, otherwise RunProxy fails with the output of the hook.
+type Hook struct {
+	cfg     config
+	timeout time.Duration
+	cli     *http.Client
+}
+
+func (h *Hook) Schema() *plugin.Schema {
+	return plugin.SchemaOf(config{Timeout: defaultTimeout})
+}
+
+func (h *Hook) Setup(ctx context.Context, rawMessage json.RawMessage) error {
+	var cfg config
+	err := json.Unmarshal(rawMessage, &cfg)
+	if err != nil {
+		return err
+	}
+
+	if (len(cfg.Exec) > 0) == (len(cfg.URL) > 0) {
+		return fmt.Errorf("hook requires one of exec and url")
+	}
+
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = defaultTimeout
+	}
+
+	h.cfg = cfg
+	h.timeout = time.Duration(cfg.Timeout) * time.Second
+	h.cli = &http.Client{Timeout: h.timeout}
+	return nil
+}
+
+func (h *Hook) RunProxy(ctx context.Context, item *plugin.PluginMeta) (plugin.Proxy, error) {
+	out, err := h.call(eventOf("run", item))
+	if err != nil {
+		return nil, err
+	}
+
+	var reply Reply
+	if len(bytes.TrimSpace(out)) > 0 {
+		err = json.Unmarshal(out, &reply)
+		if err != nil {
+			return nil, fmt.Errorf("invalid hook reply %q: %v", out, err)
+		}
+	}
+
+	if len(reply.Protocol) <= 0 {
+		reply.Protocol = item.Protocol
+	}
+
+	if len(reply.FromPort) <= 0 {
+		_, reply.FromPort, _ = net.SplitHostPort(item.From)
+	}
+
+	if len(reply.ToPort) <= 0 {
+		_, reply.ToPort, _ = net.SplitHostPort(item.To)
+	}
+
+	return plugin.NewProxy(&plugin.ProxyTuple{
+		Protocol: reply.Protocol,
+		FromPort: reply.FromPort,
+		ToPort:   reply.ToPort,
+	}, func() error {
+		_, err := h.call(eventOf("stop", item))
+		if err != nil {
+			return fmt.Errorf("stop hook of %s %s fail: %v", item.Protocol, item.To, err)
+		}
+		return nil
+	}), nil
+}
+
+func (h *Hook) call(event *Event) ([]byte, error) {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(h.cfg.Exec) > 0 {
+		return h.exec(body)
+	}
+	return h.post(body)
+}
+
+// exec runs the command with body as stdin and returns its stdout
+func (h *Hook) exec(body []byte) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), h.timeout)
+	defer cancel()
+
+	stdout, stderr := &bytes.Buffer{}, &bytes.Buffer{}
+	cmd := exec.CommandContext(ctx, h.cfg.Exec[0], h.cfg.Exec[1:]...)
+	cmd.Stdin = bytes.NewReader(body)
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+
+	err := cmd.Run()
+	if err != nil {
+		msg := strings.TrimSpace(stderr.String())
+		if len(msg) <= 0 {
+			msg = strings.TrimSpace(stdout.String())
+		}
+		return nil, fmt.Errorf("hook %s: %v: %s", h.cfg.Exec[0], err, msg)
+	}
+	return stdout.Bytes(), nil
+}
+
+// post posts body to the webhook and returns the reply
+func (h *Hook) post(body []byte) ([]byte, error) {
+	req, err := http.NewRequest("POST", h.cfg.URL, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range h.cfg.Headers {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := h.cli.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	cnt, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return nil, fmt.Errorf("hook reply %s: %s", resp.Status, strings.TrimSpace(string(cnt)))
+	}
+	return cnt, nil
+}
+
+func eventOf(event string, item *plugin.PluginMeta) *Event {
+	return &Event{
+		Event:    event,
+		Protocol: item.Protocol,
+		From:     item.From,
+		To:       item.To,
+		Domain:   item.Domain,
+		Ctx:      item.Ctx,
+	}
+}
@@ -0,0 +1,136 @@
+package hook
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/ICKelin/opennotr/opennotrd/plugin"
+)
+
+func setup(t *testing.T, cfg interface{}) *Hook {
+	raw, _ := json.Marshal(cfg)
+	h := &Hook{}
+	err := h.Setup(context.Background(), raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return h
+}
+
+func TestHookExec(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hook")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	events := filepath.Join(dir, "events")
+	script := `cat >> ` + events + `; echo >> ` + events + `
+if grep -q deny ` + events + `; then echo denied >&2; exit 1; fi
+echo '{"toPort": "9000"}'`
+
+	h := setup(t, map[string]interface{}{"exec": []string{"sh", "-c", script}})
+	item := &plugin.PluginMeta{
+		Protocol: "tcp",
+		From:     "0.0.0.0:2222",
+		To:       "100.64.240.10:22",
+		Ctx:      `{"port": 22}`,
+	}
+
+	proxy, err := h.RunProxy(context.Background(), item)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tuple := proxy.Tuple()
+
+	if tuple.Protocol != "tcp" || tuple.FromPort != "2222" || tuple.ToPort != "9000" {
+		t.Errorf("unexpected tuple %+v", tuple)
+	}
+
+	proxy.Close()
+
+	cnt, _ := ioutil.ReadFile(events)
+	lines := strings.Split(strings.TrimSpace(string(cnt)), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("expect 2 events, got %q", cnt)
+	}
+
+	for i, name := range []string{"run", "stop"} {
+		var event Event
+		err := json.Unmarshal([]byte(lines[i]), &event)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if event.Event != name || event.To != item.To || event.Ctx != item.Ctx {
+			t.Errorf("unexpected event %+v", event)
+		}
+	}
+
+	_, err = h.RunProxy(context.Background(), &plugin.PluginMeta{Protocol: "tcp", Domain: "deny", To: "100.64.240.10:22"})
+	if err == nil || !strings.Contains(err.Error(), "denied") {
+		t.Errorf("expect denied error, got %v", err)
+	}
+}
+
+func TestHookWebhook(t *testing.T) {
+	var events []*Event
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer token" {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		var event Event
+		json.NewDecoder(r.Body).Decode(&event)
+		events = append(events, &event)
+
+		if event.Domain == "deny.notr.tech" {
+			http.Error(w, "quota exceeded", http.StatusForbidden)
+		}
+	}))
+	defer srv.Close()
+
+	h := setup(t, map[string]interface{}{
+		"url":     srv.URL,
+		"headers": map[string]string{"Authorization": "Bearer token"},
+	})
+
+	item := &plugin.PluginMeta{Protocol: "http", Domain: "a.notr.tech", To: "100.64.240.10:80"}
+	proxy, err := h.RunProxy(context.Background(), item)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tuple := proxy.Tuple()
+
+	if tuple.Protocol != "http" || tuple.ToPort != "80" {
+		t.Errorf("unexpected tuple %+v", tuple)
+	}
+
+	proxy.Close()
+
+	_, err = h.RunProxy(context.Background(), &plugin.PluginMeta{Protocol: "http", Domain: "deny.notr.tech", To: "100.64.240.10:80"})
+	if err == nil || !strings.Contains(err.Error(), "quota exceeded") {
+		t.Errorf("expect quota error, got %v", err)
+	}
+
+	if len(events) != 3 || events[0].Event != "run" || events[1].Event != "stop" {
+		t.Errorf("unexpected events %+v", events)
+	}
+}
+
+func TestHookSetup(t *testing.T) {
+	for _, cfg := range []string{`{}`, `{"exec": ["true"], "url": "http://127.0.0.1"}`} {
+		h := &Hook{}
+		if err := h.Setup(context.Background(), json.RawMessage(cfg)); err == nil {
+			t.Errorf("expect error of %s", cfg)
+		}
+	}
+}
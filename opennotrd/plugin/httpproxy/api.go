@@ -0,0 +1,175 @@
+package httpproxy
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"html/template"
+	"net/http"
+	"strings"
+
+	"github.com/ICKelin/opennotr/opennotrd/admin"
+)
+
+// inspect api prefix, the routes are:
+// GET    /api/v1/inspect/$domain/records             list records
+// DELETE /api/v1/inspect/$domain/records             clear records
+// GET    /api/v1/inspect/$domain/records/$id         get record
+// POST   /api/v1/inspect/$domain/records/$id/replay  replay record
+// GET    /api/v1/inspect/$domain/har                 export as HAR
+// GET    /api/v1/inspect/$domain/ui                  browse records
+var inspectAPIPrefix = "/api/v1/inspect/"
+
+// inspectUI lists records of a domain with their details,
+// records are replayed by the forms and redirected back,
+// the forms carry the csrf token of the domain
+var inspectUI = template.Must(template.New("inspect").Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>{{.Domain}} - opennotr inspect</title></head>
+<body style="font-family: sans-serif;">
+<h2>{{.Domain}}</h2>
+<p><a href="har">export HAR</a></p>
+{{range .Records}}
+<details>
+<summary>#{{.ID}} {{.Started.Format "15:04:05"}} {{.Request.Method}} {{.Request.URL}} &rarr; {{.Response.Status}} ({{.Duration}}){{if .Replay}} replay of #{{.Replay}}{{end}}</summary>
+<form method="post" action="records/{{.ID}}/replay"><input type="hidden" name="csrf" value="{{$.CSRF}}"><button{{if .Request.Truncated}} disabled{{end}}>replay</button></form>
+<h4>Request</h4>
+<pre>{{range $k, $v := .Request.Header}}{{$k}}: {{range $v}}{{.}} {{end}}
+{{end}}
+{{printf "%s" .Request.Body}}{{if .Request.Truncated}}... ({{.Request.BodySize}} bytes){{end}}</pre>
+<h4>Response</h4>
+<pre>{{range $k, $v := .Response.Header}}{{$k}}: {{range $v}}{{.}} {{end}}
+{{end}}
+{{printf "%s" .Response.Body}}{{if .Response.Truncated}}... ({{.Response.BodySize}} bytes){{end}}</pre>
+</details>
+{{else}}
+<p>no records</p>
+{{end}}
+</body>
+</html>
+`))
+
+func init() {
+	admin.HandleFunc(inspectAPIPrefix, serveInspectAPI)
+}
+
+func serveInspectAPI(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, inspectAPIPrefix), "/"), "/")
+	if len(parts) < 2 {
+		http.NotFound(w, r)
+		return
+	}
+
+	ins := getInspector(parts[0])
+	if ins == nil {
+		admin.WriteError(w, http.StatusNotFound, fmt.Errorf("domain %s is not inspected", parts[0]))
+		return
+	}
+
+	switch {
+	case len(parts) == 2 && parts[1] == "ui" && r.Method == http.MethodGet:
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		inspectUI.Execute(w, map[string]interface{}{
+			"Domain":  ins.domain,
+			"Records": ins.list(),
+			"CSRF":    inspectCSRF(ins.domain),
+		})
+
+	case len(parts) == 2 && parts[1] == "har" && r.Method == http.MethodGet:
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", ins.domain+".har"))
+		admin.WriteJSON(w, http.StatusOK, toHAR(ins.list()))
+
+	case len(parts) == 2 && parts[1] == "records" && r.Method == http.MethodGet:
+		records := ins.list()
+		summaries := make([]summary, 0, len(records))
+		for _, rec := range records {
+			summaries = append(summaries, rec.summary())
+		}
+		admin.WriteJSON(w, http.StatusOK, summaries)
+
+	case len(parts) == 2 && parts[1] == "records" && r.Method == http.MethodDelete:
+		ins.clear()
+		w.WriteHeader(http.StatusNoContent)
+
+	case len(parts) == 3 && parts[1] == "records" && r.Method == http.MethodGet:
+		rec := ins.get(parts[2])
+		if rec == nil {
+			admin.WriteError(w, http.StatusNotFound, fmt.Errorf("record %s not found", parts[2]))
+			return
+		}
+		admin.WriteJSON(w, http.StatusOK, rec)
+
+	case len(parts) == 4 && parts[1] == "records" && parts[3] == "replay" && r.Method == http.MethodPost:
+		if !replayAllowed(r, ins.domain) {
+			admin.WriteError(w, http.StatusForbidden, fmt.Errorf("bearer token or csrf token is required"))
+			return
+		}
+
+		rec := ins.get(parts[2])
+		if rec == nil {
+			admin.WriteError(w, http.StatusNotFound, fmt.Errorf("record %s not found", parts[2]))
+			return
+		}
+
+		replayed, err := replay(ins, rec)
+		if err != nil {
+			admin.WriteError(w, http.StatusBadRequest, err)
+			return
+		}
+
+		// form of the ui
+		if strings.Contains(r.Header.Get("Accept"), "text/html") {
+			http.Redirect(w, r, "../../ui", http.StatusSeeOther)
+			return
+		}
+		admin.WriteJSON(w, http.StatusOK, replayed)
+
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// inspectCSRF returns the csrf token of replay forms of domain,
+// other sites can not read the ui, so they can not forge the form
+func inspectCSRF(domain string) string {
+	mac := hmac.New(sha256.New, sessionKey)
+	mac.Write([]byte("inspect:" + domain))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// replayAllowed checks the replay is not forged by other sites.
+// Browsers send basic auth of the admin api automatically,
+// so forms of the ui carry the csrf token and api clients
+// send Bearer token which browsers never send by themselves
+func replayAllowed(r *http.Request, domain string) bool {
+	if strings.HasPrefix(r.Header.Get("Authorization"), "Bearer ") {
+		return true
+	}
+
+	got := r.PostFormValue("csrf")
+	return subtle.ConstantTimeCompare([]byte(got), []byte(inspectCSRF(domain))) == 1
+}
+
+// replay sends the recorded request to the client again
+// the replayed request/response pair is recorded as a new record
+func replay(ins *inspector, rec *record) (*record, error) {
+	if rec.Request.Truncated {
+		return nil, fmt.Errorf("record %s body is truncated", rec.ID)
+	}
+
+	r := findRoute(ins.domain)
+	if r == nil {
+		return nil, fmt.Errorf("no route for %s", ins.domain)
+	}
+
+	req, err := http.NewRequest(rec.Request.Method, rec.Request.URL, bytes.NewReader(rec.Request.Body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header = rec.Request.Header.Clone()
+
+	return ins.serve(&discardWriter{header: make(http.Header)}, req, r.proxy, rec.ID), nil
+}
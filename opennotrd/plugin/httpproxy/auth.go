@@ -0,0 +1,163 @@
+package httpproxy
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+)
+
+var (
+	// sessionKey signs login sessions and oidc states
+	// sessions are invalid after opennotrd restarts
+	sessionKey = make([]byte, 32)
+
+	// sessionCookie stores the login session
+	sessionCookie = "_opennotr_session"
+
+	// default login session lifetime
+	defaultSessionTTL = 12 * time.Hour
+
+	errBadSignature = errors.New("bad signature")
+)
+
+func init() {
+	rand.Read(sessionKey)
+}
+
+// authenticator enforces authOptions of a route
+type authenticator struct {
+	domain string
+	opts   *authOptions
+	oidc   *oidcProvider
+}
+
+func newAuthenticator(domain string, opts *authOptions) *authenticator {
+	a := &authenticator{domain: domain, opts: opts}
+	if opts.OIDC != nil {
+		a.oidc = newOIDCProvider(domain, opts.OIDC)
+	}
+	return a
+}
+
+// serve passes authenticated requests to h
+// the credential consumed by us is removed from the request and
+// the authenticated user is passed by X-Forwarded-User
+func (a *authenticator) serve(w http.ResponseWriter, req *http.Request, h http.Handler) {
+	if a.oidc != nil && req.URL.Path == oidcCallbackPath {
+		a.oidc.callback(w, req)
+		return
+	}
+
+	user, ok := a.authenticate(req)
+	if !ok {
+		a.challenge(w, req)
+		return
+	}
+
+	req.Header.Set("X-Forwarded-User", user)
+	h.ServeHTTP(w, req)
+}
+
+func (a *authenticator) authenticate(req *http.Request) (string, bool) {
+	if user, pass, ok := req.BasicAuth(); ok && len(a.opts.Basic) > 0 {
+		expected, exist := a.opts.Basic[user]
+		if exist && subtle.ConstantTimeCompare([]byte(pass), []byte(expected)) == 1 {
+			req.Header.Del("Authorization")
+			return user, true
+		}
+	}
+
+	auth := req.Header.Get("Authorization")
+	if strings.HasPrefix(auth, "Bearer ") && len(a.opts.Bearer) > 0 {
+		token := []byte(strings.TrimPrefix(auth, "Bearer "))
+		for _, expected := range a.opts.Bearer {
+			if subtle.ConstantTimeCompare(token, []byte(expected)) == 1 {
+				req.Header.Del("Authorization")
+				return "bearer", true
+			}
+		}
+	}
+
+	if a.oidc != nil {
+		if email, ok := a.oidc.session(req); ok {
+			removeCookie(req, sessionCookie)
+			return email, true
+		}
+	}
+	return "", false
+}
+
+// challenge redirects browsers to oidc login
+// and replies 401 for others
+func (a *authenticator) challenge(w http.ResponseWriter, req *http.Request) {
+	if a.oidc != nil && req.Method == http.MethodGet &&
+		strings.Contains(req.Header.Get("Accept"), "text/html") {
+		a.oidc.login(w, req)
+		return
+	}
+
+	if len(a.opts.Basic) > 0 {
+		w.Header().Add("WWW-Authenticate", `Basic realm="`+a.domain+`"`)
+	}
+
+	if len(a.opts.Bearer) > 0 || a.oidc != nil {
+		w.Header().Add("WWW-Authenticate", `Bearer realm="`+a.domain+`"`)
+	}
+	http.Error(w, "unauthorized", http.StatusUnauthorized)
+}
+
+// removeCookie removes cookie of name from request
+func removeCookie(req *http.Request, name string) {
+	cookies := req.Cookies()
+	req.Header.Del("Cookie")
+	for _, c := range cookies {
+		if c.Name != name {
+			req.AddCookie(c)
+		}
+	}
+}
+
+// sign encodes v as base64(json).base64(hmac)
+func sign(v interface{}) (string, error) {
+	payload, err := json.Marshal(v)
+	if err != nil {
+		return "", err
+	}
+
+	mac := hmac.New(sha256.New, sessionKey)
+	mac.Write(payload)
+	return base64.RawURLEncoding.EncodeToString(payload) + "." +
+		base64.RawURLEncoding.EncodeToString(mac.Sum(nil)), nil
+}
+
+// verify decodes value encoded by sign to v
+func verify(value string, v interface{}) error {
+	parts := strings.Split(value, ".")
+	if len(parts) != 2 {
+		return errBadSignature
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return errBadSignature
+	}
+
+	sig, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return errBadSignature
+	}
+
+	mac := hmac.New(sha256.New, sessionKey)
+	mac.Write(payload)
+	if !hmac.Equal(sig, mac.Sum(nil)) {
+		return errBadSignature
+	}
+	return json.Unmarshal(payload, v)
+}
@@ -0,0 +1,377 @@
+package httpproxy
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ICKelin/opennotr/opennotrd/plugin"
+	"github.com/ICKelin/opennotr/opennotrd/plugin/plugintest"
+)
+
+// oidcStub is a local openid connect provider
+// it logs in $email without asking and issues RS256 id tokens
+type oidcStub struct {
+	*httptest.Server
+	key    *rsa.PrivateKey
+	email  string
+	mu     sync.Mutex
+	nonces map[string]string
+}
+
+func newOIDCStub(t *testing.T, email string) *oidcStub {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := &oidcStub{key: key, email: email, nonces: make(map[string]string)}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 s.URL,
+			"authorization_endpoint": s.URL + "/authorize",
+			"token_endpoint":         s.URL + "/token",
+			"jwks_uri":               s.URL + "/jwks",
+		})
+	})
+
+	mux.HandleFunc("/authorize", func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		code := randomHex(8)
+		s.mu.Lock()
+		s.nonces[code] = q.Get("nonce")
+		s.mu.Unlock()
+		http.Redirect(w, r, q.Get("redirect_uri")+"?code="+code+"&state="+url.QueryEscape(q.Get("state")), http.StatusFound)
+	})
+
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		s.mu.Lock()
+		nonce, ok := s.nonces[r.Form.Get("code")]
+		s.mu.Unlock()
+		if !ok || r.Form.Get("client_secret") != "secret" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		json.NewEncoder(w).Encode(map[string]string{
+			"id_token": s.sign(map[string]interface{}{
+				"iss":   s.URL,
+				"aud":   r.Form.Get("client_id"),
+				"sub":   "10001",
+				"exp":   time.Now().Add(time.Minute).Unix(),
+				"nonce": nonce,
+				"email": s.email,
+			}),
+		})
+	})
+
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"keys": []map[string]string{{
+				"kty": "RSA",
+				"kid": "k1",
+				"n":   base64.RawURLEncoding.EncodeToString(s.key.N.Bytes()),
+				"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(s.key.E)).Bytes()),
+			}},
+		})
+	})
+
+	s.Server = httptest.NewServer(mux)
+	return s
+}
+
+func (s *oidcStub) sign(claims map[string]interface{}) string {
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "kid": "k1"})
+	payload, _ := json.Marshal(claims)
+	signing := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	hashed := sha256.Sum256([]byte(signing))
+	sig, _ := rsa.SignPKCS1v15(rand.Reader, s.key, crypto.SHA256, hashed[:])
+	return signing + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+// runAuthProxy runs a forward of domain, issuers are allowed oidc issuers
+func runAuthProxy(t *testing.T, domain, rawConfig string, issuers ...string) (string, func()) {
+	tun := plugintest.NewTunnel(t)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "%s|%s|%s", r.Header.Get("X-Forwarded-User"),
+			r.Header.Get("Authorization"), r.Header.Get("Cookie"))
+	}))
+
+	addr := plugintest.FreeAddr(t)
+	cfg, _ := json.Marshal(map[string]interface{}{
+		"listen": addr,
+		"oidc":   map[string]interface{}{"issuers": issuers},
+	})
+	p := setup(t, "http", string(cfg))
+	item := &plugin.PluginMeta{
+		Protocol: "http",
+		To:       "100.64.240.10:" + plugintest.Port(t, backend.URL),
+		Domain:   domain,
+		Dialer:   tun,
+		Ctx:      rawConfig,
+	}
+
+	proxy, err := runProxy(p, item)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return addr, func() {
+		proxy.Close()
+		backend.Close()
+		tun.Close()
+	}
+}
+
+func TestBasicAndBearerAuth(t *testing.T) {
+	addr, stop := runAuthProxy(t, "dash.open.notr.tech",
+		`{"auth": {"basic": {"admin": "pass"}, "bearer": ["token"]}}`)
+	defer stop()
+
+	tests := []struct {
+		auth   string
+		code   int
+		expect string
+	}{
+		{"", http.StatusUnauthorized, ""},
+		{"Basic " + base64.StdEncoding.EncodeToString([]byte("admin:bad")), http.StatusUnauthorized, ""},
+		{"Basic " + base64.StdEncoding.EncodeToString([]byte("admin:pass")), http.StatusOK, "admin||"},
+		{"Bearer bad", http.StatusUnauthorized, ""},
+		{"Bearer token", http.StatusOK, "bearer||"},
+	}
+
+	for _, test := range tests {
+		req, _ := http.NewRequest("GET", "http://"+addr+"/", nil)
+		req.Host = "dash.open.notr.tech"
+		if len(test.auth) > 0 {
+			req.Header.Set("Authorization", test.auth)
+		}
+		req.Header.Set("X-Forwarded-User", "spoofed")
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+
+		if resp.StatusCode != test.code {
+			t.Errorf("%q: expected %d, got %d", test.auth, test.code, resp.StatusCode)
+			continue
+		}
+
+		if test.code == http.StatusUnauthorized {
+			if len(resp.Header["Www-Authenticate"]) != 2 {
+				t.Errorf("%q: expected basic and bearer challenges, got %v", test.auth, resp.Header["Www-Authenticate"])
+			}
+			continue
+		}
+
+		if string(body) != test.expect {
+			t.Errorf("%q: expected %q, got %q", test.auth, test.expect, body)
+		}
+	}
+}
+
+func TestOIDCAuth(t *testing.T) {
+	idp := newOIDCStub(t, "dev@notr.tech")
+	defer idp.Close()
+
+	addr, stop := runAuthProxy(t, "dash.open.notr.tech", fmt.Sprintf(
+		`{"auth": {"oidc": {"issuer": "%s", "clientID": "opennotr", "clientSecret": "secret", "emailDomains": ["notr.tech"]}}}`, idp.URL), idp.URL)
+	defer stop()
+
+	// browser reaches dash.open.notr.tech via the proxy
+	jar, _ := cookiejar.New(nil)
+	browser := &http.Client{
+		Jar: jar,
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, network, a string) (net.Conn, error) {
+				if strings.HasPrefix(a, "dash.open.notr.tech:") {
+					a = addr
+				}
+				return (&net.Dialer{}).DialContext(ctx, network, a)
+			},
+		},
+	}
+
+	_, port, _ := net.SplitHostPort(addr)
+	site := "http://dash.open.notr.tech:" + port
+
+	// api clients get 401 instead of login redirect
+	resp, err := browser.Get(site + "/dashboard")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("expected 401 for api client, got %d", resp.StatusCode)
+	}
+
+	req, _ := http.NewRequest("GET", site+"/dashboard?tab=1", nil)
+	req.Header.Set("Accept", "text/html")
+	resp, err = browser.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK || resp.Request.URL.RequestURI() != "/dashboard?tab=1" {
+		t.Fatalf("expected login and back to dashboard, got %d %s", resp.StatusCode, resp.Request.URL)
+	}
+
+	// session cookie is not passed to the local service
+	if string(body) != "dev@notr.tech||" {
+		t.Fatalf("unexpected backend view %q", body)
+	}
+
+	// forged callback without browser state is rejected
+	req, _ = http.NewRequest("GET", fmt.Sprintf("http://%s%s?code=x&state=y", addr, oidcCallbackPath), nil)
+	req.Host = "dash.open.notr.tech"
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("expected forged callback rejected, got %d", resp.StatusCode)
+	}
+}
+
+func TestOIDCAuthForbidden(t *testing.T) {
+	idp := newOIDCStub(t, "someone@example.com")
+	defer idp.Close()
+
+	addr, stop := runAuthProxy(t, "dash2.open.notr.tech", fmt.Sprintf(
+		`{"auth": {"oidc": {"issuer": "%s", "clientID": "opennotr", "clientSecret": "secret", "emails": ["dev@notr.tech"]}}}`, idp.URL), idp.URL)
+	defer stop()
+
+	jar, _ := cookiejar.New(nil)
+	browser := &http.Client{
+		Jar: jar,
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, network, a string) (net.Conn, error) {
+				if strings.HasPrefix(a, "dash2.open.notr.tech:") {
+					a = addr
+				}
+				return (&net.Dialer{}).DialContext(ctx, network, a)
+			},
+		},
+	}
+
+	_, port, _ := net.SplitHostPort(addr)
+	req, _ := http.NewRequest("GET", "http://dash2.open.notr.tech:"+port+"/", nil)
+	req.Header.Set("Accept", "text/html")
+	resp, err := browser.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("expected 403 for not allowed email, got %d", resp.StatusCode)
+	}
+}
+
+func TestOIDCSessionBinding(t *testing.T) {
+	opts := &oidcOptions{Issuer: "https://idp.notr.tech", ClientID: "opennotr", EmailDomains: []string{"notr.tech"}}
+	p := newOIDCProvider("dash.open.notr.tech", opts)
+	value, err := p.newSession("dev@notr.tech", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sessionOf := func(p *oidcProvider) (string, bool) {
+		req, _ := http.NewRequest("GET", "http://dash.open.notr.tech/", nil)
+		req.AddCookie(&http.Cookie{Name: sessionCookie, Value: value})
+		return p.session(req)
+	}
+
+	if user, ok := sessionOf(p); !ok || user != "dev@notr.tech" {
+		t.Fatalf("expected session of dev@notr.tech, got %q %v", user, ok)
+	}
+
+	tests := map[string]*oidcProvider{
+		"domain":   newOIDCProvider("other.open.notr.tech", opts),
+		"issuer":   newOIDCProvider("dash.open.notr.tech", &oidcOptions{Issuer: "https://other.notr.tech", ClientID: "opennotr", EmailDomains: []string{"notr.tech"}}),
+		"clientID": newOIDCProvider("dash.open.notr.tech", &oidcOptions{Issuer: "https://idp.notr.tech", ClientID: "other", EmailDomains: []string{"notr.tech"}}),
+		"options":  newOIDCProvider("dash.open.notr.tech", &oidcOptions{Issuer: "https://idp.notr.tech", ClientID: "opennotr", EmailDomains: []string{"notr.tech"}, SessionTTL: 60}),
+	}
+	for name, other := range tests {
+		if _, ok := sessionOf(other); ok {
+			t.Errorf("expected session rejected for other %s", name)
+		}
+	}
+
+	// emails are authorized on every request
+	p.opts.EmailDomains = []string{"example.com"}
+	if _, ok := sessionOf(p); ok {
+		t.Error("expected session rejected after email domains changed")
+	}
+}
+
+func TestOIDCProviderRestrictions(t *testing.T) {
+	p := setup(t, "http", fmt.Sprintf(`{"listen": "%s", "oidc": {"issuers": ["https://idp.notr.tech/"]}}`, plugintest.FreeAddr(t)))
+	for issuer, allowed := range map[string]bool{
+		"https://idp.notr.tech":    true,
+		"http://169.254.169.254":   false,
+		"https://idp.notr.tech.io": false,
+	} {
+		err := p.Validate(&plugin.PluginMeta{Ctx: fmt.Sprintf(`{"auth": {"oidc": {"issuer": "%s", "clientID": "opennotr"}}}`, issuer)})
+		if allowed != (err == nil) {
+			t.Errorf("issuer %s: expected allowed %v, got %v", issuer, allowed, err)
+		}
+	}
+
+	// endpoints of discovery document must be served by the issuer
+	var jwksHits int
+	var idp *httptest.Server
+	idp = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/.well-known/openid-configuration":
+			json.NewEncoder(w).Encode(map[string]string{
+				"issuer":         idp.URL,
+				"token_endpoint": idp.URL + "/token",
+				"jwks_uri":       "http://169.254.169.254/jwks",
+			})
+		case "/jwks":
+			jwksHits++
+			fmt.Fprint(w, `{"keys": []}`)
+		}
+	}))
+	defer idp.Close()
+
+	provider := newOIDCProvider("dash.open.notr.tech", &oidcOptions{Issuer: idp.URL, ClientID: "opennotr"})
+	if _, err := provider.discover(); err == nil {
+		t.Error("expected jwks endpoint of other host rejected")
+	}
+
+	// unknown kid does not refetch keys on every request
+	cfg := &oidcConfig{Issuer: idp.URL, JWKSURI: idp.URL + "/jwks"}
+	for i := 0; i < 3; i++ {
+		if _, err := provider.key(cfg, "unknown"); err == nil {
+			t.Fatal("expected unknown kid rejected")
+		}
+	}
+	if jwksHits != 1 {
+		t.Errorf("expected keys fetched once, got %d", jwksHits)
+	}
+}
@@ -0,0 +1,182 @@
+package httpproxy
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"html/template"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/ICKelin/opennotr/opennotrd/plugin"
+)
+
+var (
+	// default Retry-After of error pages(seconds)
+	defaultRetryAfter = 30
+
+	defaultErrorPage = template.Must(template.New("error").Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>{{.Status}} {{.Title}}</title></head>
+<body style="font-family: sans-serif; text-align: center; padding-top: 10%;">
+<h1>{{.Title}}</h1>
+<p>{{.Message}}</p>
+<p style="color: #888;">{{.Domain}} &middot; request id {{.RequestID}}</p>
+</body>
+</html>
+`))
+)
+
+// errorKind is the reason of a failed request
+type errorKind struct {
+	name    string
+	status  int
+	title   string
+	message string
+}
+
+var (
+	errorOffline = &errorKind{
+		name:    "offline",
+		status:  http.StatusServiceUnavailable,
+		title:   "Tunnel Offline",
+		message: "The tunnel of this domain is not connected, please try again later.",
+	}
+
+	errorUnreachable = &errorKind{
+		name:    "unreachable",
+		status:  http.StatusBadGateway,
+		title:   "Local Service Unreachable",
+		message: "The tunnel is connected but the local service is not responding.",
+	}
+
+	errorTimeout = &errorKind{
+		name:    "timeout",
+		status:  http.StatusGatewayTimeout,
+		title:   "Timeout",
+		message: "The local service did not respond in time.",
+	}
+)
+
+type errorPagesConfig struct {
+	// Offline, Unreachable and Timeout specific html template files
+	// the template data is errorPageData
+	// empty means the builtin page
+	Offline     string `json:"offline"`
+	Unreachable string `json:"unreachable"`
+	Timeout     string `json:"timeout"`
+
+	// RetryAfter specific Retry-After header in second, default 30
+	RetryAfter int `json:"retryAfter" min:"0"`
+}
+
+// errorPageData is the data of error page templates
+type errorPageData struct {
+	Status     int    `json:"status"`
+	Error      string `json:"error"`
+	Title      string `json:"title"`
+	Message    string `json:"message"`
+	Domain     string `json:"domain"`
+	RequestID  string `json:"requestID"`
+	RetryAfter int    `json:"retryAfter"`
+}
+
+// errorPages replies html or json error pages
+type errorPages struct {
+	retryAfter int
+
+	// templates stores templates of error kind name
+	templates map[string]*template.Template
+}
+
+func loadErrorPages(cfg errorPagesConfig) (*errorPages, error) {
+	if cfg.RetryAfter <= 0 {
+		cfg.RetryAfter = defaultRetryAfter
+	}
+
+	pages := &errorPages{
+		retryAfter: cfg.RetryAfter,
+		templates:  make(map[string]*template.Template),
+	}
+
+	files := map[string]string{
+		errorOffline.name:     cfg.Offline,
+		errorUnreachable.name: cfg.Unreachable,
+		errorTimeout.name:     cfg.Timeout,
+	}
+
+	for name, file := range files {
+		if len(file) <= 0 {
+			pages.templates[name] = defaultErrorPage
+			continue
+		}
+
+		content, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+
+		tmpl, err := template.New(name).Parse(string(content))
+		if err != nil {
+			return nil, err
+		}
+		pages.templates[name] = tmpl
+	}
+	return pages, nil
+}
+
+// write replies error page of kind
+// json is replied if the visitor accepts json but not html
+func (p *errorPages) write(w http.ResponseWriter, req *http.Request, kind *errorKind) {
+	host := req.Header.Get("X-Forwarded-Host")
+	if len(host) <= 0 {
+		host = req.Host
+	}
+
+	data := &errorPageData{
+		Status:     kind.status,
+		Error:      kind.name,
+		Title:      kind.title,
+		Message:    kind.message,
+		Domain:     host,
+		RequestID:  req.Header.Get("X-Request-ID"),
+		RetryAfter: p.retryAfter,
+	}
+
+	h := w.Header()
+	h.Set("X-Request-ID", data.RequestID)
+	h.Set("Retry-After", strconv.Itoa(p.retryAfter))
+	h.Set("Cache-Control", "no-store")
+
+	accept := req.Header.Get("Accept")
+	if strings.Contains(accept, "application/json") && !strings.Contains(accept, "text/html") {
+		h.Set("Content-Type", "application/json")
+		w.WriteHeader(kind.status)
+		json.NewEncoder(w).Encode(data)
+		return
+	}
+
+	h.Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(kind.status)
+	p.templates[kind.name].Execute(w, data)
+}
+
+// classifyError returns the error kind of proxy error
+func classifyError(err error) *errorKind {
+	if errors.Is(err, plugin.ErrTunnelOffline) {
+		return errorOffline
+	}
+
+	if errors.Is(err, context.DeadlineExceeded) {
+		return errorTimeout
+	}
+
+	var ne net.Error
+	if errors.As(err, &ne) && ne.Timeout() {
+		return errorTimeout
+	}
+	return errorUnreachable
+}
@@ -0,0 +1,117 @@
+package httpproxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ICKelin/opennotr/opennotrd/plugin"
+	"github.com/ICKelin/opennotr/opennotrd/plugin/plugintest"
+)
+
+func TestErrorPages(t *testing.T) {
+	dir, err := ioutil.TempDir("", "errpage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	offline := filepath.Join(dir, "offline.html")
+	ioutil.WriteFile(offline, []byte(`<h1>{{.Domain}} is sleeping</h1>{{.RequestID}}`), 0644)
+
+	tun := plugintest.NewTunnel(t)
+	defer tun.Close()
+
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			time.Sleep(time.Millisecond * 1500)
+		}
+		fmt.Fprint(w, r.Header.Get("X-Request-ID"))
+	}))
+	defer backend.Close()
+
+	// closed port
+	down := httptest.NewServer(http.NotFoundHandler())
+	down.Close()
+
+	addr := plugintest.FreeAddr(t)
+	p := setup(t, "http", fmt.Sprintf(`{"listen": "%s", "timeout": 1,
+		"errorPages": {"offline": "%s", "retryAfter": 10}}`, addr, offline))
+
+	items := []*plugin.PluginMeta{
+		{
+			Protocol: "http",
+			To:       "100.64.240.10:" + plugintest.Port(t, backend.URL),
+			Domain:   "up.open.notr.tech",
+			Dialer:   tun,
+		},
+		{
+			Protocol: "http",
+			To:       "100.64.240.10:" + plugintest.Port(t, down.URL),
+			Domain:   "down.open.notr.tech",
+			Dialer:   tun,
+		},
+	}
+	for _, item := range items {
+		proxy, err := runProxy(p, item)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer proxy.Close()
+	}
+
+	do := func(path, host, accept string) (*http.Response, string) {
+		req, _ := http.NewRequest("GET", "http://"+addr+path, nil)
+		req.Host = host
+		req.Header.Set("Accept", accept)
+		req.Header.Set("X-Request-ID", "req-1")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, _ := ioutil.ReadAll(resp.Body)
+		return resp, string(body)
+	}
+
+	// request id is passed to the local service
+	resp, body := do("/", "up.open.notr.tech", "")
+	if resp.StatusCode != http.StatusOK || body != "req-1" {
+		t.Fatalf("unexpected response %d %q", resp.StatusCode, body)
+	}
+
+	resp, body = do("/", "unknown.open.notr.tech", "text/html")
+	if resp.StatusCode != http.StatusServiceUnavailable || body != "<h1>unknown.open.notr.tech is sleeping</h1>req-1" {
+		t.Fatalf("unexpected offline page %d %q", resp.StatusCode, body)
+	}
+
+	if resp.Header.Get("Retry-After") != "10" || resp.Header.Get("X-Request-ID") != "req-1" {
+		t.Fatalf("unexpected offline headers %v", resp.Header)
+	}
+
+	resp, body = do("/", "down.open.notr.tech", "application/json")
+	data := &errorPageData{}
+	json.Unmarshal([]byte(body), data)
+	if resp.StatusCode != http.StatusBadGateway || data.Error != "unreachable" || data.RequestID != "req-1" {
+		t.Fatalf("unexpected unreachable page %d %q", resp.StatusCode, body)
+	}
+
+	resp, body = do("/slow", "up.open.notr.tech", "text/html")
+	if resp.StatusCode != http.StatusGatewayTimeout || !strings.Contains(body, "Timeout") {
+		t.Fatalf("unexpected timeout page %d %q", resp.StatusCode, body)
+	}
+
+	// the route is kept until the proxy is closed but the tunnel is gone
+	tun.Close()
+	resp, _ = do("/", "up.open.notr.tech", "text/html")
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("expected offline page for closed tunnel, got %d", resp.StatusCode)
+	}
+}
@@ -0,0 +1,178 @@
+package httpproxy
+
+import (
+	"encoding/base64"
+	"net/http"
+	"net/url"
+	"time"
+	"unicode/utf8"
+)
+
+// HAR 1.2 format, only the fields we have are filled
+// http://www.softwareishard.com/blog/har-12-spec/
+type har struct {
+	Log harLog `json:"log"`
+}
+
+type harLog struct {
+	Version string     `json:"version"`
+	Creator harCreator `json:"creator"`
+	Entries []harEntry `json:"entries"`
+}
+
+type harCreator struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+}
+
+type harEntry struct {
+	StartedDateTime string      `json:"startedDateTime"`
+	Time            float64     `json:"time"`
+	Request         harRequest  `json:"request"`
+	Response        harResponse `json:"response"`
+	Cache           struct{}    `json:"cache"`
+	Timings         harTimings  `json:"timings"`
+	Comment         string      `json:"comment,omitempty"`
+}
+
+type harRequest struct {
+	Method      string         `json:"method"`
+	URL         string         `json:"url"`
+	HTTPVersion string         `json:"httpVersion"`
+	Cookies     []harNameValue `json:"cookies"`
+	Headers     []harNameValue `json:"headers"`
+	QueryString []harNameValue `json:"queryString"`
+	PostData    *harPostData   `json:"postData,omitempty"`
+	HeadersSize int            `json:"headersSize"`
+	BodySize    int64          `json:"bodySize"`
+}
+
+type harResponse struct {
+	Status      int            `json:"status"`
+	StatusText  string         `json:"statusText"`
+	HTTPVersion string         `json:"httpVersion"`
+	Cookies     []harNameValue `json:"cookies"`
+	Headers     []harNameValue `json:"headers"`
+	Content     harContent     `json:"content"`
+	RedirectURL string         `json:"redirectURL"`
+	HeadersSize int            `json:"headersSize"`
+	BodySize    int64          `json:"bodySize"`
+}
+
+type harNameValue struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type harPostData struct {
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text"`
+}
+
+type harContent struct {
+	Size     int64  `json:"size"`
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text,omitempty"`
+	Encoding string `json:"encoding,omitempty"`
+}
+
+type harTimings struct {
+	Send    float64 `json:"send"`
+	Wait    float64 `json:"wait"`
+	Receive float64 `json:"receive"`
+}
+
+// toHAR exports records in chronological order
+func toHAR(records []*record) *har {
+	entries := make([]harEntry, 0, len(records))
+	for i := len(records) - 1; i >= 0; i-- {
+		entries = append(entries, harEntryOf(records[i]))
+	}
+
+	return &har{
+		Log: harLog{
+			Version: "1.2",
+			Creator: harCreator{Name: "opennotr", Version: "1.0"},
+			Entries: entries,
+		},
+	}
+}
+
+func harEntryOf(rec *record) harEntry {
+	req := harRequest{
+		Method:      rec.Request.Method,
+		URL:         rec.Request.URL,
+		HTTPVersion: rec.Request.Proto,
+		Cookies:     []harNameValue{},
+		Headers:     harHeaders(rec.Request.Header),
+		QueryString: []harNameValue{},
+		HeadersSize: -1,
+		BodySize:    rec.Request.BodySize,
+	}
+
+	if u, err := url.Parse(rec.Request.URL); err == nil {
+		for name, values := range u.Query() {
+			for _, value := range values {
+				req.QueryString = append(req.QueryString, harNameValue{name, value})
+			}
+		}
+	}
+
+	if len(rec.Request.Body) > 0 {
+		req.PostData = &harPostData{
+			MimeType: rec.Request.Header.Get("Content-Type"),
+			Text:     string(rec.Request.Body),
+		}
+	}
+
+	content := harContent{
+		Size:     rec.Response.BodySize,
+		MimeType: rec.Response.Header.Get("Content-Type"),
+	}
+	if utf8.Valid(rec.Response.Body) {
+		content.Text = string(rec.Response.Body)
+	} else {
+		content.Text = base64.StdEncoding.EncodeToString(rec.Response.Body)
+		content.Encoding = "base64"
+	}
+
+	entry := harEntry{
+		StartedDateTime: rec.Started.Format(time.RFC3339Nano),
+		Time:            millis(rec.Duration),
+		Request:         req,
+		Response: harResponse{
+			Status:      rec.Response.Status,
+			StatusText:  http.StatusText(rec.Response.Status),
+			HTTPVersion: rec.Request.Proto,
+			Cookies:     []harNameValue{},
+			Headers:     harHeaders(rec.Response.Header),
+			Content:     content,
+			RedirectURL: rec.Response.Header.Get("Location"),
+			HeadersSize: -1,
+			BodySize:    rec.Response.BodySize,
+		},
+		Timings: harTimings{
+			Wait:    millis(rec.Wait),
+			Receive: millis(rec.Duration - rec.Wait),
+		},
+	}
+
+	if len(rec.Replay) > 0 {
+		entry.Comment = "replay of " + rec.Replay
+	}
+	return entry
+}
+
+func harHeaders(header http.Header) []harNameValue {
+	headers := make([]harNameValue, 0, len(header))
+	for name, values := range header {
+		for _, value := range values {
+			headers = append(headers, harNameValue{name, value})
+		}
+	}
+	return headers
+}
+
+func millis(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
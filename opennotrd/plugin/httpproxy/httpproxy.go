@@ -0,0 +1,258 @@
+package httpproxy
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/ICKelin/opennotr/opennotrd/certs"
+	"github.com/ICKelin/opennotr/opennotrd/plugin"
+)
+
+var (
+	// default upstream dial and response header timeout(seconds)
+	defaultTimeout = 30
+
+	// default listen address of each scheme
+	defaultListen = map[string]string{
+		"http":  ":80",
+		"h2c":   ":80",
+		"https": ":443",
+	}
+)
+
+func init() {
+	plugin.RegisterDriverV2("http", "native", &HTTPProxy{scheme: "http"})
+	plugin.RegisterDriverV2("https", "native", &HTTPProxy{scheme: "https"})
+	plugin.RegisterDriverV2("h2c", "native", &HTTPProxy{scheme: "h2c"})
+}
+
+type config struct {
+	// Listen specific the listen address
+	// default :80 for http and h2c, :443 for https
+	// http and h2c share the listener if they use the same address
+	Listen string `json:"listen"`
+
+	// CertFile and KeyFile specific the default certificate of https
+	// certificates of certs providers are preferred, eg: acme
+	CertFile string `json:"certFile"`
+	KeyFile  string `json:"keyFile"`
+
+	// Timeout specific upstream response header timeout in second
+	// default 30 seconds
+	Timeout int `json:"timeout" min:"0"`
+
+	// ErrorPages configures pages replied when the tunnel is offline,
+	// the local service is unreachable or timeout
+	ErrorPages errorPagesConfig `json:"errorPages"`
+
+	// Inspect limits inspect options of forwards
+	Inspect inspectLimits `json:"inspect"`
+
+	// OIDC limits oidc login options of forwards
+	OIDC oidcLimits `json:"oidc"`
+}
+
+// inspectLimits limits memory used by request inspection,
+// forwards request more than the limits are rejected
+type inspectLimits struct {
+	// MaxCapacity specific max records kept of a domain, default 1000
+	MaxCapacity int `json:"maxCapacity" min:"0"`
+
+	// MaxBody specific max body bytes kept of each request
+	// and response, default 1MB
+	MaxBody int `json:"maxBody" min:"0"`
+
+	// MaxMemory specific max bytes kept of a domain, the oldest
+	// records are dropped once exceeded, default 32MB
+	MaxMemory int `json:"maxMemory" min:"0"`
+}
+
+// oidcLimits limits providers opennotrd fetches for oidc login,
+// issuers are specific by clients so they must be allowed here
+type oidcLimits struct {
+	// Issuers specific allowed issuers, eg: https://accounts.google.com
+	// forwards with oidc login are rejected if empty
+	Issuers []string `json:"issuers"`
+}
+
+func (l oidcLimits) allow(issuer string) bool {
+	issuer = strings.TrimSuffix(issuer, "/")
+	for _, i := range l.Issuers {
+		if strings.TrimSuffix(i, "/") == issuer {
+			return true
+		}
+	}
+	return false
+}
+
+// HTTPProxy is a http reverse proxy in go
+// it routes requests by Host header or SNI to the client
+// and opens streams to the client directly
+type HTTPProxy struct {
+	scheme  string
+	cfg     config
+	timeout time.Duration
+	srv     *server
+
+	// pages is the *errorPages of routes, swapped by Setup
+	pages atomic.Value
+}
+
+func (p *HTTPProxy) Schema() *plugin.Schema {
+	return plugin.SchemaOf(config{
+		Listen:     defaultListen[p.scheme],
+		Timeout:    defaultTimeout,
+		ErrorPages: errorPagesConfig{RetryAfter: defaultRetryAfter},
+		Inspect: inspectLimits{
+			MaxCapacity: defaultInspectMaxCapacity,
+			MaxBody:     defaultInspectLimitBody,
+			MaxMemory:   defaultInspectMaxMemory,
+		},
+	})
+}
+
+// Setup listens the address, listeners are shared by address and
+// kept on reload, the listen address can not be changed by reload.
+// Error pages and the certificate are replaced on reload,
+// routes added after reload use the new configuration
+func (p *HTTPProxy) Setup(ctx context.Context, rawMessage json.RawMessage) error {
+	var cfg config
+	err := json.Unmarshal(rawMessage, &cfg)
+	if err != nil {
+		return err
+	}
+
+	if len(cfg.Listen) <= 0 {
+		cfg.Listen = defaultListen[p.scheme]
+	}
+
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = defaultTimeout
+	}
+
+	if cfg.Inspect.MaxCapacity <= 0 {
+		cfg.Inspect.MaxCapacity = defaultInspectMaxCapacity
+	}
+
+	if cfg.Inspect.MaxBody <= 0 {
+		cfg.Inspect.MaxBody = defaultInspectLimitBody
+	}
+
+	if cfg.Inspect.MaxMemory <= 0 {
+		cfg.Inspect.MaxMemory = defaultInspectMaxMemory
+	}
+
+	if p.srv != nil && cfg.Listen != p.srv.addr {
+		return fmt.Errorf("%s listen %s can not be changed to %s by reload", p.scheme, p.srv.addr, cfg.Listen)
+	}
+
+	pages, err := loadErrorPages(cfg.ErrorPages)
+	if err != nil {
+		return err
+	}
+
+	srv, err := listen(p.scheme, cfg, pages)
+	if err != nil {
+		return err
+	}
+
+	p.cfg = cfg
+	p.pages.Store(pages)
+	p.timeout = time.Duration(cfg.Timeout) * time.Second
+	p.srv = srv
+	return nil
+}
+
+// ForwardSchema declares options of forwards, see options
+func (p *HTTPProxy) ForwardSchema() *plugin.Schema {
+	return plugin.SchemaOf(options{
+		Inspect: &inspectOptions{
+			Capacity: defaultInspectCapacity,
+			MaxBody:  defaultInspectMaxBody,
+		},
+	})
+}
+
+// Validate checks options of the forward before it runs
+func (p *HTTPProxy) Validate(item *plugin.PluginMeta) error {
+	_, err := p.options(item)
+	return err
+}
+
+// options parses options of the forward and checks them by limits
+func (p *HTTPProxy) options(item *plugin.PluginMeta) (*options, error) {
+	opts, err := parseOptions(item.Ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if ins, limits := opts.Inspect, p.cfg.Inspect; ins != nil {
+		if ins.Capacity > limits.MaxCapacity {
+			return nil, fmt.Errorf("inspect capacity %d exceeds the max %d", ins.Capacity, limits.MaxCapacity)
+		}
+
+		if ins.MaxBody > limits.MaxBody {
+			return nil, fmt.Errorf("inspect maxBody %d exceeds the max %d", ins.MaxBody, limits.MaxBody)
+		}
+	}
+
+	if auth := opts.Auth; auth != nil && auth.OIDC != nil && !p.cfg.OIDC.allow(auth.OIDC.Issuer) {
+		return nil, fmt.Errorf("oidc issuer %s is not allowed", auth.OIDC.Issuer)
+	}
+	return opts, nil
+}
+
+func (p *HTTPProxy) RunProxy(ctx context.Context, item *plugin.PluginMeta) (plugin.Proxy, error) {
+	if item.Dialer == nil {
+		return nil, fmt.Errorf("no dialer for %s", item.Domain)
+	}
+
+	if len(item.Domain) <= 0 {
+		return nil, fmt.Errorf("domain is required for %s", p.scheme)
+	}
+
+	opts, err := p.options(item)
+	if err != nil {
+		return nil, err
+	}
+
+	// the default port is omitted
+	_, fromPort, _ := net.SplitHostPort(p.cfg.Listen)
+	if p.cfg.Listen == defaultListen[p.scheme] {
+		fromPort = ""
+	}
+	_, toPort, _ := net.SplitHostPort(item.To)
+
+	// the route is deleted from the server it is added to
+	// the server may be changed by reload
+	srv, scheme := p.srv, p.scheme
+	proxy := plugin.NewProxy(&plugin.ProxyTuple{
+		Protocol: item.Protocol,
+		FromPort: fromPort,
+		ToPort:   toPort,
+	}, func() error {
+		srv.delRoute(item.Domain, scheme, item)
+		if scheme == "https" {
+			certs.DelDomain(item.Domain)
+		}
+		return nil
+	})
+
+	r := newRoute(p.scheme, item, p.timeout, opts, &p.pages, p.cfg.Inspect)
+	r.stats = proxy
+	err = srv.addRoute(item.Domain, r)
+	if err != nil {
+		r.close()
+		return nil, err
+	}
+
+	if p.scheme == "https" {
+		certs.AddDomain(item.Domain)
+	}
+	return proxy, nil
+}
@@ -0,0 +1,351 @@
+package httpproxy
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ICKelin/opennotr/opennotrd/plugin"
+	"github.com/ICKelin/opennotr/opennotrd/plugin/plugintest"
+	"github.com/gorilla/websocket"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+func setup(t *testing.T, scheme, cfg string) *HTTPProxy {
+	p := &HTTPProxy{scheme: scheme}
+	err := p.Setup(context.Background(), json.RawMessage(cfg))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func runProxy(p *HTTPProxy, item *plugin.PluginMeta) (plugin.Proxy, error) {
+	return p.RunProxy(context.Background(), item)
+}
+
+func echoHandler(w http.ResponseWriter, r *http.Request) {
+	fmt.Fprintf(w, "%s %s %s %s %s", r.Proto, r.Host, r.URL.Path,
+		r.Header.Get("X-Forwarded-Host"), r.Header.Get("X-Forwarded-Proto"))
+}
+
+func get(t *testing.T, cli *http.Client, url, host string) (int, string) {
+	req, _ := http.NewRequest("GET", url, nil)
+	req.Host = host
+	resp, err := cli.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(resp.Body)
+	return resp.StatusCode, string(body)
+}
+
+func TestHTTPProxy(t *testing.T) {
+	tun := plugintest.NewTunnel(t)
+	defer tun.Close()
+	backend := httptest.NewServer(http.HandlerFunc(echoHandler))
+	defer backend.Close()
+
+	addr := plugintest.FreeAddr(t)
+	p := setup(t, "http", fmt.Sprintf(`{"listen": "%s"}`, addr))
+
+	item := &plugin.PluginMeta{
+		Protocol: "http",
+		To:       "100.64.240.10:" + plugintest.Port(t, backend.URL),
+		Domain:   "a.open.notr.tech",
+		Dialer:   tun,
+	}
+	proxy, err := runProxy(p, item)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = runProxy(p, item)
+	if err == nil {
+		t.Fatal("expected domain in used error")
+	}
+
+	code, body := get(t, http.DefaultClient, "http://"+addr+"/hello", "a.open.notr.tech")
+	expected := "HTTP/1.1 a.open.notr.tech /hello a.open.notr.tech http"
+	if code != http.StatusOK || body != expected {
+		t.Fatalf("expected %q, got %d %q", expected, code, body)
+	}
+
+	code, _ = get(t, http.DefaultClient, "http://"+addr+"/hello", "b.open.notr.tech")
+	if code != http.StatusServiceUnavailable {
+		t.Fatalf("expected 503 for unknown domain, got %d", code)
+	}
+
+	stats := proxy.Stats()
+	if stats.TotalConns != 1 || stats.Conns != 0 || stats.BytesOut != int64(len(expected)) {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+
+	if err := proxy.Health(); err != nil {
+		t.Errorf("unexpected health %v", err)
+	}
+
+	proxy.Close()
+	code, _ = get(t, http.DefaultClient, "http://"+addr+"/hello", "a.open.notr.tech")
+	if code != http.StatusServiceUnavailable {
+		t.Fatalf("expected 503 after stop, got %d", code)
+	}
+}
+
+func TestWebsocketProxy(t *testing.T) {
+	tun := plugintest.NewTunnel(t)
+	defer tun.Close()
+	upgrader := websocket.Upgrader{}
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		for {
+			mt, msg, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			conn.WriteMessage(mt, msg)
+		}
+	}))
+	defer backend.Close()
+
+	addr := plugintest.FreeAddr(t)
+	p := setup(t, "http", fmt.Sprintf(`{"listen": "%s"}`, addr))
+	item := &plugin.PluginMeta{
+		Protocol: "http",
+		To:       "100.64.240.10:" + plugintest.Port(t, backend.URL),
+		Domain:   "ws.open.notr.tech",
+		Dialer:   tun,
+	}
+	proxy, err := runProxy(p, item)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer proxy.Close()
+
+	dialer := websocket.Dialer{
+		NetDial: func(network, _ string) (net.Conn, error) {
+			return net.Dial(network, addr)
+		},
+	}
+	conn, _, err := dialer.Dial("ws://ws.open.notr.tech/ws", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	conn.WriteMessage(websocket.TextMessage, []byte("ping"))
+	_, msg, err := conn.ReadMessage()
+	if err != nil || string(msg) != "ping" {
+		t.Fatalf("expected ping, got %s %v", msg, err)
+	}
+}
+
+func TestH2CProxy(t *testing.T) {
+	tun := plugintest.NewTunnel(t)
+	defer tun.Close()
+	backend := httptest.NewServer(h2c.NewHandler(http.HandlerFunc(echoHandler), &http2.Server{}))
+	defer backend.Close()
+
+	addr := plugintest.FreeAddr(t)
+	setup(t, "http", fmt.Sprintf(`{"listen": "%s"}`, addr))
+	p := setup(t, "h2c", fmt.Sprintf(`{"listen": "%s"}`, addr))
+	item := &plugin.PluginMeta{
+		Protocol: "h2c",
+		To:       "100.64.240.10:" + plugintest.Port(t, backend.URL),
+		Domain:   "grpc.open.notr.tech",
+		Dialer:   tun,
+	}
+	proxy, err := runProxy(p, item)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer proxy.Close()
+
+	cli := &http.Client{
+		Transport: &http2.Transport{
+			AllowHTTP: true,
+			DialTLS: func(network, _ string, _ *tls.Config) (net.Conn, error) {
+				return net.Dial(network, addr)
+			},
+		},
+	}
+
+	code, body := get(t, cli, "http://grpc.open.notr.tech/h2c", "grpc.open.notr.tech")
+	expected := "HTTP/2.0 grpc.open.notr.tech /h2c grpc.open.notr.tech http"
+	if code != http.StatusOK || body != expected {
+		t.Fatalf("expected %q, got %d %q", expected, code, body)
+	}
+}
+
+func TestHTTPSProxy(t *testing.T) {
+	tun := plugintest.NewTunnel(t)
+	defer tun.Close()
+	backend := httptest.NewServer(http.HandlerFunc(echoHandler))
+	defer backend.Close()
+
+	dir, err := ioutil.TempDir("", "httpproxy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	certFile, keyFile := plugintest.WriteCert(t, dir, "s.open.notr.tech")
+
+	addr := plugintest.FreeAddr(t)
+	p := setup(t, "https", fmt.Sprintf(`{"listen": "%s", "certFile": "%s", "keyFile": "%s"}`, addr, certFile, keyFile))
+	item := &plugin.PluginMeta{
+		Protocol: "https",
+		To:       "100.64.240.10:" + plugintest.Port(t, backend.URL),
+		Domain:   "s.open.notr.tech",
+		Dialer:   tun,
+	}
+	proxy, err := runProxy(p, item)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer proxy.Close()
+
+	cli := &http.Client{
+		Transport: &http.Transport{
+			TLSClientConfig:   &tls.Config{InsecureSkipVerify: true, ServerName: "s.open.notr.tech"},
+			ForceAttemptHTTP2: true,
+			DialContext:       (&net.Dialer{}).DialContext,
+		},
+	}
+	code, body := get(t, cli, "https://"+addr+"/tls", "s.open.notr.tech")
+	expected := "HTTP/1.1 s.open.notr.tech /tls s.open.notr.tech https"
+	if code != http.StatusOK || body != expected {
+		t.Fatalf("expected %q, got %d %q", expected, code, body)
+	}
+
+	_, err = runProxy(p, &plugin.PluginMeta{Protocol: "https", Domain: "x.open.notr.tech"})
+	if err == nil {
+		t.Fatal("expected no dialer error")
+	}
+
+	_, err = listen("http", config{Listen: addr}, nil)
+	if err == nil {
+		t.Fatal("expected share tls listener error")
+	}
+}
+
+func TestForwardSchema(t *testing.T) {
+	p := &HTTPProxy{scheme: "http"}
+	raw, err := p.ForwardSchema().Apply("rawConfig", json.RawMessage(`{"inspect": {}, "paths": [{"prefix": "/api", "port": 8080}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	opts, err := parseOptions(string(raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if opts.Inspect.Capacity != defaultInspectCapacity || opts.Inspect.MaxBody != defaultInspectMaxBody {
+		t.Errorf("expect inspect defaults, got %+v", opts.Inspect)
+	}
+
+	_, err = p.ForwardSchema().Apply("rawConfig", json.RawMessage(`{"paths": [{"port": 70000}], "auth": {"oidc": {"issuer": "x"}}, "inspector": {}}`))
+	expect := "rawConfig.auth.oidc.clientID: is required; rawConfig.paths[0].prefix: is required; " +
+		"rawConfig.paths[0].port: expect <= 65535, got 70000; rawConfig.inspector: unknown field"
+	if err == nil || err.Error() != expect {
+		t.Errorf("expect %s, got %v", expect, err)
+	}
+
+	err = p.Validate(&plugin.PluginMeta{Ctx: `{"paths": [{"prefix": "api", "port": 8080}]}`})
+	if err == nil {
+		t.Error("expect error of path prefix without /")
+	}
+}
+
+func TestReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "httpproxy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	tun := plugintest.NewTunnel(t)
+	defer tun.Close()
+
+	// closed port
+	down := httptest.NewServer(http.NotFoundHandler())
+	down.Close()
+
+	pages := filepath.Join(dir, "page.html")
+	ioutil.WriteFile(pages, []byte(`before`), 0644)
+	addr := plugintest.FreeAddr(t)
+	cfg := fmt.Sprintf(`{"listen": "%s", "errorPages": {"offline": "%s", "unreachable": "%s"}}`, addr, pages, pages)
+	p := setup(t, "http", cfg)
+
+	proxy, err := runProxy(p, &plugin.PluginMeta{
+		Protocol: "http",
+		To:       "100.64.240.10:" + plugintest.Port(t, down.URL),
+		Domain:   "down.open.notr.tech",
+		Dialer:   tun,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer proxy.Close()
+
+	// pages of the server and running routes are replaced
+	ioutil.WriteFile(pages, []byte(`after`), 0644)
+	err = p.Setup(context.Background(), json.RawMessage(cfg))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, host := range []string{"offline.open.notr.tech", "down.open.notr.tech"} {
+		if _, body := get(t, http.DefaultClient, "http://"+addr+"/", host); body != "after" {
+			t.Errorf("%s: expected reloaded page, got %q", host, body)
+		}
+	}
+
+	err = p.Setup(context.Background(), json.RawMessage(fmt.Sprintf(`{"listen": "%s"}`, plugintest.FreeAddr(t))))
+	if err == nil {
+		t.Error("expected listen change rejected")
+	}
+
+	// the default certificate is replaced
+	tlsAddr := plugintest.FreeAddr(t)
+	servedCert := func() string {
+		conn, err := tls.Dial("tcp", tlsAddr, &tls.Config{InsecureSkipVerify: true, ServerName: "any.open.notr.tech"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		return conn.ConnectionState().PeerCertificates[0].DNSNames[0]
+	}
+
+	sub1, sub2 := filepath.Join(dir, "1"), filepath.Join(dir, "2")
+	os.Mkdir(sub1, 0755)
+	os.Mkdir(sub2, 0755)
+	certFile, keyFile := plugintest.WriteCert(t, sub1, "before.open.notr.tech")
+	tp := setup(t, "https", fmt.Sprintf(`{"listen": "%s", "certFile": "%s", "keyFile": "%s"}`, tlsAddr, certFile, keyFile))
+	if name := servedCert(); name != "before.open.notr.tech" {
+		t.Fatalf("unexpected certificate %s", name)
+	}
+
+	certFile, keyFile = plugintest.WriteCert(t, sub2, "after.open.notr.tech")
+	err = tp.Setup(context.Background(), json.RawMessage(fmt.Sprintf(`{"listen": "%s", "certFile": "%s", "keyFile": "%s"}`, tlsAddr, certFile, keyFile)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if name := servedCert(); name != "after.open.notr.tech" {
+		t.Errorf("expected reloaded certificate, got %s", name)
+	}
+}
@@ -0,0 +1,370 @@
+package httpproxy
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	// default max records kept of each domain
+	defaultInspectCapacity = 100
+
+	// default max body bytes kept of each request and response
+	defaultInspectMaxBody = 64 * 1024
+
+	// default max records a forward can request
+	defaultInspectMaxCapacity = 1000
+
+	// default max body bytes a forward can request
+	defaultInspectLimitBody = 1024 * 1024
+
+	// default max bytes kept of each domain
+	defaultInspectMaxMemory = 32 * 1024 * 1024
+
+	inspectorsMu sync.Mutex
+
+	// inspectors stores inspectors of domains
+	// http, h2c and https routes of the same domain share the inspector
+	// key: domain
+	inspectors = make(map[string]*inspector)
+)
+
+// record is a captured request/response pair
+type record struct {
+	ID     string `json:"id"`
+	Domain string `json:"domain"`
+
+	// Replay is the id of the record replayed from
+	Replay string `json:"replay,omitempty"`
+
+	Started time.Time `json:"started"`
+
+	// Wait is the duration until response header is written
+	Wait time.Duration `json:"wait"`
+
+	// Duration is the duration until response is finished
+	Duration time.Duration `json:"duration"`
+
+	Request  capturedRequest  `json:"request"`
+	Response capturedResponse `json:"response"`
+}
+
+type capturedRequest struct {
+	Method     string      `json:"method"`
+	URL        string      `json:"url"`
+	Proto      string      `json:"proto"`
+	RemoteAddr string      `json:"remoteAddr"`
+	Header     http.Header `json:"header"`
+	Body       []byte      `json:"body"`
+	BodySize   int64       `json:"bodySize"`
+	Truncated  bool        `json:"truncated"`
+}
+
+type capturedResponse struct {
+	Status    int         `json:"status"`
+	Header    http.Header `json:"header"`
+	Body      []byte      `json:"body"`
+	BodySize  int64       `json:"bodySize"`
+	Truncated bool        `json:"truncated"`
+}
+
+// summary is the record without bodies for listing
+type summary struct {
+	ID       string        `json:"id"`
+	Replay   string        `json:"replay,omitempty"`
+	Started  time.Time     `json:"started"`
+	Duration time.Duration `json:"duration"`
+	Method   string        `json:"method"`
+	URL      string        `json:"url"`
+	Status   int           `json:"status"`
+}
+
+func (r *record) summary() summary {
+	return summary{
+		ID:       r.ID,
+		Replay:   r.Replay,
+		Started:  r.Started,
+		Duration: r.Duration,
+		Method:   r.Request.Method,
+		URL:      r.Request.URL,
+		Status:   r.Response.Status,
+	}
+}
+
+// size returns approximate bytes the record keeps
+func (r *record) size() int {
+	n := len(r.Request.URL) + len(r.Request.Body) + len(r.Response.Body)
+	for _, h := range []http.Header{r.Request.Header, r.Response.Header} {
+		for k, values := range h {
+			for _, v := range values {
+				n += len(k) + len(v)
+			}
+		}
+	}
+	return n
+}
+
+// inspector keeps the latest records of a domain, the oldest records
+// are dropped once there are more than capacity records or they keep
+// more than maxMemory bytes
+type inspector struct {
+	domain    string
+	maxBody   int
+	capacity  int
+	maxMemory int
+	refs      int
+
+	mu     sync.RWMutex
+	seq    uint64
+	memory int
+
+	// records are ordered from the oldest to the newest
+	records []*record
+}
+
+// acquireInspector returns the inspector of domain
+// it creates the inspector at the first call
+func acquireInspector(domain string, opts *inspectOptions, maxMemory int) *inspector {
+	inspectorsMu.Lock()
+	defer inspectorsMu.Unlock()
+
+	if ins, ok := inspectors[domain]; ok {
+		ins.refs++
+		return ins
+	}
+
+	capacity := opts.Capacity
+	if capacity <= 0 {
+		capacity = defaultInspectCapacity
+	}
+
+	maxBody := opts.MaxBody
+	if maxBody <= 0 {
+		maxBody = defaultInspectMaxBody
+	}
+
+	if maxMemory <= 0 {
+		maxMemory = defaultInspectMaxMemory
+	}
+
+	ins := &inspector{
+		domain:    domain,
+		maxBody:   maxBody,
+		capacity:  capacity,
+		maxMemory: maxMemory,
+		refs:      1,
+	}
+	inspectors[domain] = ins
+	return ins
+}
+
+// releaseInspector removes the inspector once no route uses it
+func releaseInspector(ins *inspector) {
+	inspectorsMu.Lock()
+	defer inspectorsMu.Unlock()
+
+	ins.refs--
+	if ins.refs <= 0 && inspectors[ins.domain] == ins {
+		delete(inspectors, ins.domain)
+	}
+}
+
+func getInspector(domain string) *inspector {
+	inspectorsMu.Lock()
+	defer inspectorsMu.Unlock()
+	return inspectors[strings.ToLower(domain)]
+}
+
+// serve proxies req by h and records the request/response pair
+func (ins *inspector) serve(w http.ResponseWriter, req *http.Request, h http.Handler, replay string) *record {
+	rec := &record{
+		Domain:  ins.domain,
+		Replay:  replay,
+		Started: time.Now(),
+		Request: capturedRequest{
+			Method:     req.Method,
+			URL:        requestURL(req),
+			Proto:      req.Proto,
+			RemoteAddr: req.RemoteAddr,
+			Header:     req.Header.Clone(),
+		},
+	}
+
+	var body *captureBody
+	if req.Body != nil && req.Body != http.NoBody {
+		body = &captureBody{ReadCloser: req.Body, max: ins.maxBody}
+		req.Body = body
+	}
+
+	cw := &captureWriter{ResponseWriter: w, max: ins.maxBody, started: rec.Started}
+	h.ServeHTTP(cw, req)
+
+	rec.Duration = time.Since(rec.Started)
+	rec.Wait = cw.wait
+	if body != nil {
+		rec.Request.Body = body.buf.Bytes()
+		rec.Request.BodySize = body.size
+		rec.Request.Truncated = body.size > int64(body.buf.Len())
+	}
+
+	status := cw.status
+	if status == 0 && cw.hijacked {
+		status = http.StatusSwitchingProtocols
+	}
+
+	rec.Response = capturedResponse{
+		Status:    status,
+		Header:    w.Header().Clone(),
+		Body:      cw.buf.Bytes(),
+		BodySize:  cw.size,
+		Truncated: cw.size > int64(cw.buf.Len()),
+	}
+
+	ins.add(rec)
+	return rec
+}
+
+func (ins *inspector) add(rec *record) {
+	ins.mu.Lock()
+	defer ins.mu.Unlock()
+
+	ins.seq++
+	rec.ID = strconv.FormatUint(ins.seq, 10)
+	ins.records = append(ins.records, rec)
+	ins.memory += rec.size()
+	for len(ins.records) > ins.capacity || (ins.memory > ins.maxMemory && len(ins.records) > 1) {
+		ins.memory -= ins.records[0].size()
+		ins.records[0] = nil
+		ins.records = ins.records[1:]
+	}
+}
+
+// list returns records from the newest to the oldest
+func (ins *inspector) list() []*record {
+	ins.mu.RLock()
+	defer ins.mu.RUnlock()
+
+	records := make([]*record, 0, len(ins.records))
+	for i := len(ins.records) - 1; i >= 0; i-- {
+		records = append(records, ins.records[i])
+	}
+	return records
+}
+
+func (ins *inspector) get(id string) *record {
+	for _, rec := range ins.list() {
+		if rec.ID == id {
+			return rec
+		}
+	}
+	return nil
+}
+
+func (ins *inspector) clear() {
+	ins.mu.Lock()
+	defer ins.mu.Unlock()
+	ins.records = nil
+	ins.memory = 0
+}
+
+func requestURL(req *http.Request) string {
+	scheme := "http"
+	if req.TLS != nil {
+		scheme = "https"
+	}
+	return scheme + "://" + req.Host + req.URL.RequestURI()
+}
+
+// captureBody keeps the first max bytes read from request body
+type captureBody struct {
+	io.ReadCloser
+	max  int
+	buf  bytes.Buffer
+	size int64
+}
+
+func (b *captureBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.size += int64(n)
+	if remain := b.max - b.buf.Len(); remain > 0 {
+		if remain > n {
+			remain = n
+		}
+		b.buf.Write(p[:remain])
+	}
+	return n, err
+}
+
+// captureWriter keeps status and the first max bytes of response body
+type captureWriter struct {
+	http.ResponseWriter
+	max      int
+	started  time.Time
+	wait     time.Duration
+	status   int
+	buf      bytes.Buffer
+	size     int64
+	hijacked bool
+}
+
+func (w *captureWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+		w.wait = time.Since(w.started)
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *captureWriter) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.WriteHeader(http.StatusOK)
+	}
+
+	n, err := w.ResponseWriter.Write(p)
+	w.size += int64(n)
+	if remain := w.max - w.buf.Len(); remain > 0 {
+		if remain > n {
+			remain = n
+		}
+		w.buf.Write(p[:remain])
+	}
+	return n, err
+}
+
+func (w *captureWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Hijack is used by websocket upgrade
+func (w *captureWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, http.ErrNotSupported
+	}
+	w.hijacked = true
+	return h.Hijack()
+}
+
+// discardWriter is the response writer of replay
+type discardWriter struct {
+	header http.Header
+}
+
+func (w *discardWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *discardWriter) Write(p []byte) (int, error) {
+	return len(p), nil
+}
+
+func (w *discardWriter) WriteHeader(status int) {}
@@ -0,0 +1,234 @@
+package httpproxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/ICKelin/opennotr/opennotrd/admin"
+	"github.com/ICKelin/opennotr/opennotrd/plugin"
+	"github.com/ICKelin/opennotr/opennotrd/plugin/plugintest"
+)
+
+func decodeJSON(t *testing.T, resp *http.Response, v interface{}) {
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(resp.Body)
+		t.Fatalf("expected 200, got %d %s", resp.StatusCode, body)
+	}
+
+	err := json.NewDecoder(resp.Body).Decode(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestInspector(t *testing.T) {
+	tun := plugintest.NewTunnel(t)
+	defer tun.Close()
+
+	delivered := make(chan string, 10)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		delivered <- string(body)
+		w.Header().Set("Content-Type", "text/plain")
+		fmt.Fprintf(w, "ack %s", body)
+	}))
+	defer backend.Close()
+
+	api := httptest.NewServer(admin.Handler())
+	defer api.Close()
+
+	addr := plugintest.FreeAddr(t)
+	p := setup(t, "http", fmt.Sprintf(`{"listen": "%s"}`, addr))
+
+	item := &plugin.PluginMeta{
+		Protocol: "http",
+		To:       "100.64.240.10:" + plugintest.Port(t, backend.URL),
+		Domain:   "hook.open.notr.tech",
+		Dialer:   tun,
+		Ctx:      `{"inspect": {"capacity": 2, "maxBody": 16}}`,
+	}
+	proxy, err := runProxy(p, item)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer proxy.Close()
+
+	post := func(body string) {
+		req, _ := http.NewRequest("POST", "http://"+addr+"/webhook?event=push", strings.NewReader(body))
+		req.Host = "hook.open.notr.tech"
+		req.Header.Set("Content-Type", "application/json")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		<-delivered
+	}
+
+	post(`{"id":1}`)
+	post(`{"id":2}`)
+	post(`{"id":3, "padding": "truncated"}`)
+
+	// ring buffer keeps the latest 2 records
+	summaries := make([]summary, 0)
+	resp, err := http.Get(api.URL + "/api/v1/inspect/hook.open.notr.tech/records")
+	if err != nil {
+		t.Fatal(err)
+	}
+	decodeJSON(t, resp, &summaries)
+	if len(summaries) != 2 || summaries[0].ID != "3" || summaries[1].ID != "2" {
+		t.Fatalf("expected records 3 and 2, got %v", summaries)
+	}
+
+	if summaries[1].Method != "POST" || summaries[1].Status != http.StatusOK ||
+		summaries[1].URL != "http://hook.open.notr.tech/webhook?event=push" {
+		t.Fatalf("unexpected summary %+v", summaries[1])
+	}
+
+	rec := &record{}
+	resp, err = http.Get(api.URL + "/api/v1/inspect/hook.open.notr.tech/records/3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	decodeJSON(t, resp, rec)
+	if !rec.Request.Truncated || len(rec.Request.Body) != 16 || rec.Request.BodySize != 32 {
+		t.Fatalf("expected truncated request body, got %+v", rec.Request)
+	}
+
+	replayOf := func(id string) *http.Response {
+		req, _ := http.NewRequest("POST", api.URL+"/api/v1/inspect/hook.open.notr.tech/records/"+id+"/replay", nil)
+		req.Header.Set("Authorization", "Bearer token")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+
+	// truncated record can not be replayed
+	resp = replayOf("3")
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("expected 400 for truncated record, got %d", resp.StatusCode)
+	}
+
+	// forged form of other sites without csrf token
+	resp, err = http.PostForm(api.URL+"/api/v1/inspect/hook.open.notr.tech/records/2/replay", url.Values{"csrf": {"forged"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("expected 403 for forged replay, got %d", resp.StatusCode)
+	}
+
+	resp = replayOf("2")
+	decodeJSON(t, resp, rec)
+	if body := <-delivered; body != `{"id":2}` {
+		t.Fatalf("expected replayed body, got %q", body)
+	}
+
+	if rec.Replay != "2" || rec.ID != "4" || string(rec.Response.Body) != `ack {"id":2}` {
+		t.Fatalf("unexpected replay record %+v", rec)
+	}
+
+	h := &har{}
+	resp, err = http.Get(api.URL + "/api/v1/inspect/hook.open.notr.tech/har")
+	if err != nil {
+		t.Fatal(err)
+	}
+	decodeJSON(t, resp, h)
+	if len(h.Log.Entries) != 2 {
+		t.Fatalf("expected 2 har entries, got %d", len(h.Log.Entries))
+	}
+
+	entry := h.Log.Entries[1]
+	if entry.Request.PostData == nil || entry.Request.PostData.Text != `{"id":2}` ||
+		entry.Response.Content.Text != `ack {"id":2}` || entry.Comment != "replay of 2" {
+		t.Fatalf("unexpected har entry %+v", entry)
+	}
+
+	if len(entry.Request.QueryString) != 1 || entry.Request.QueryString[0].Value != "push" {
+		t.Fatalf("unexpected har query string %+v", entry.Request.QueryString)
+	}
+
+	// replayed by the form of ui is redirected back to the ui
+	form := url.Values{"csrf": {inspectCSRF("hook.open.notr.tech")}}
+	req, _ := http.NewRequest("POST", api.URL+"/api/v1/inspect/hook.open.notr.tech/records/4/replay", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "text/html")
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body := <-delivered; body != `{"id":2}` {
+		t.Fatalf("expected replayed body, got %q", body)
+	}
+	page, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.Request.URL.Path != "/api/v1/inspect/hook.open.notr.tech/ui" ||
+		!strings.Contains(string(page), "replay of #4") || !strings.Contains(string(page), "ack {&#34;id&#34;:2}") ||
+		!strings.Contains(string(page), form.Get("csrf")) {
+		t.Fatalf("unexpected ui %s %s", resp.Request.URL, page)
+	}
+
+	req, _ = http.NewRequest("DELETE", api.URL+"/api/v1/inspect/hook.open.notr.tech/records", nil)
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if len(getInspector("hook.open.notr.tech").list()) != 0 {
+		t.Fatal("expected records cleared")
+	}
+
+	proxy.Close()
+	if getInspector("hook.open.notr.tech") != nil {
+		t.Fatal("expected inspector released")
+	}
+
+	resp, err = http.Get(api.URL + "/api/v1/inspect/hook.open.notr.tech/records")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("expected 404 for stopped domain, got %d", resp.StatusCode)
+	}
+}
+
+func TestInspectLimits(t *testing.T) {
+	addr := plugintest.FreeAddr(t)
+	p := setup(t, "http", fmt.Sprintf(`{"listen": "%s", "inspect": {"maxCapacity": 10, "maxBody": 1024}}`, addr))
+
+	for ctx, valid := range map[string]bool{
+		`{"inspect": {"capacity": 10, "maxBody": 1024}}`:  true,
+		`{"inspect": {"capacity": 2000000000}}`:           false,
+		`{"inspect": {"capacity": 10, "maxBody": 10240}}`: false,
+	} {
+		err := p.Validate(&plugin.PluginMeta{Protocol: "http", Domain: "limit.open.notr.tech", Ctx: ctx})
+		if (err == nil) != valid {
+			t.Errorf("%s: expect valid %v, got %v", ctx, valid, err)
+		}
+	}
+
+	// the oldest records are dropped once memory exceeds
+	ins := acquireInspector("memory.open.notr.tech", &inspectOptions{Capacity: 10}, 250)
+	defer releaseInspector(ins)
+	for i := 0; i < 5; i++ {
+		ins.add(&record{Request: capturedRequest{Body: make([]byte, 100)}})
+	}
+
+	records := ins.list()
+	if len(records) != 2 || records[0].ID != "5" || records[1].ID != "4" || ins.memory != 200 {
+		t.Fatalf("expect records 5 and 4 kept, got %d records of %d bytes", len(records), ins.memory)
+	}
+}
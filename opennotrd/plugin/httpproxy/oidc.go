@@ -0,0 +1,540 @@
+package httpproxy
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ICKelin/opennotr/internal/logs"
+)
+
+var (
+	// oidcCallbackPath is handled by us on each protected domain
+	// it should be registered as redirect uri in the provider, eg:
+	// https://xyz.open.notr.tech/.opennotr/oidc/callback
+	oidcCallbackPath = "/.opennotr/oidc/callback"
+
+	// oidcStateCookie binds the login state to the browser
+	oidcStateCookie = "_opennotr_oidc"
+
+	// login must be finished in this duration
+	oidcLoginTimeout = 10 * time.Minute
+
+	oidcClient = &http.Client{Timeout: time.Second * 10}
+
+	// oidcMaxBody limits bytes read of each provider response
+	oidcMaxBody int64 = 1 << 20
+
+	// keys are refetched for unknown kid at most once per interval
+	oidcKeysInterval = time.Minute
+)
+
+// oidcConfig is the provider discovery document
+type oidcConfig struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+// oidcState is carried by the state parameter
+type oidcState struct {
+	Nonce   string `json:"nonce"`
+	Return  string `json:"return"`
+	Expires int64  `json:"exp"`
+}
+
+// oidcSession is stored in the session cookie
+// it is bound to the provider and options of the forward,
+// so it is invalid for other forwards or after options changed
+type oidcSession struct {
+	Domain   string `json:"domain"`
+	Issuer   string `json:"iss"`
+	ClientID string `json:"aud"`
+	Options  string `json:"opts"`
+	Email    string `json:"email"`
+	Verified *bool  `json:"email_verified,omitempty"`
+	Expires  int64  `json:"exp"`
+}
+
+type oidcClaims struct {
+	Issuer        string          `json:"iss"`
+	Audience      json.RawMessage `json:"aud"`
+	Expires       int64           `json:"exp"`
+	Nonce         string          `json:"nonce"`
+	Subject       string          `json:"sub"`
+	Email         string          `json:"email"`
+	EmailVerified *bool           `json:"email_verified"`
+}
+
+// oidcProvider logs in visitors by authorization code flow
+type oidcProvider struct {
+	domain string
+	opts   *oidcOptions
+	ttl    time.Duration
+
+	// digest is the hash of opts sessions are bound to
+	digest string
+
+	// config and keys are fetched at the first login
+	mu      sync.Mutex
+	config  *oidcConfig
+	keys    map[string]*rsa.PublicKey
+	fetched time.Time
+}
+
+func newOIDCProvider(domain string, opts *oidcOptions) *oidcProvider {
+	ttl := defaultSessionTTL
+	if opts.SessionTTL > 0 {
+		ttl = time.Duration(opts.SessionTTL) * time.Second
+	}
+
+	buf, _ := json.Marshal(opts)
+	digest := sha256.Sum256(buf)
+
+	return &oidcProvider{
+		domain: domain,
+		opts:   opts,
+		ttl:    ttl,
+		digest: hex.EncodeToString(digest[:16]),
+	}
+}
+
+// session returns the logged in user of request
+// the user is authorized again in case emails are changed
+func (p *oidcProvider) session(req *http.Request) (string, bool) {
+	c, err := req.Cookie(sessionCookie)
+	if err != nil {
+		return "", false
+	}
+
+	var sess oidcSession
+	if err := verify(c.Value, &sess); err != nil {
+		return "", false
+	}
+
+	if sess.Domain != p.domain || sess.Issuer != p.opts.Issuer ||
+		sess.ClientID != p.opts.ClientID || sess.Options != p.digest ||
+		time.Now().Unix() > sess.Expires {
+		return "", false
+	}
+
+	if !p.allow(&oidcClaims{Email: sess.Email, EmailVerified: sess.Verified}) {
+		return "", false
+	}
+	return sess.Email, true
+}
+
+// newSession returns the signed session of user
+func (p *oidcProvider) newSession(user string, verified *bool) (string, error) {
+	return sign(&oidcSession{
+		Domain:   p.domain,
+		Issuer:   p.opts.Issuer,
+		ClientID: p.opts.ClientID,
+		Options:  p.digest,
+		Email:    user,
+		Verified: verified,
+		Expires:  time.Now().Add(p.ttl).Unix(),
+	})
+}
+
+// login redirects to the provider authorization endpoint
+func (p *oidcProvider) login(w http.ResponseWriter, req *http.Request) {
+	cfg, err := p.discover()
+	if err != nil {
+		logs.Error("oidc discover %s fail: %v", p.opts.Issuer, err)
+		http.Error(w, "login unavailable", http.StatusBadGateway)
+		return
+	}
+
+	nonce := randomHex(16)
+	state, err := sign(&oidcState{
+		Nonce:   nonce,
+		Return:  req.URL.RequestURI(),
+		Expires: time.Now().Add(oidcLoginTimeout).Unix(),
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     oidcStateCookie,
+		Value:    nonce,
+		Path:     oidcCallbackPath,
+		MaxAge:   int(oidcLoginTimeout / time.Second),
+		HttpOnly: true,
+		Secure:   req.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	scopes := p.opts.Scopes
+	if len(scopes) <= 0 {
+		scopes = []string{"openid", "email"}
+	}
+
+	query := url.Values{}
+	query.Set("response_type", "code")
+	query.Set("client_id", p.opts.ClientID)
+	query.Set("redirect_uri", redirectURI(req))
+	query.Set("scope", strings.Join(scopes, " "))
+	query.Set("state", state)
+	query.Set("nonce", nonce)
+
+	sep := "?"
+	if strings.Contains(cfg.AuthorizationEndpoint, "?") {
+		sep = "&"
+	}
+	http.Redirect(w, req, cfg.AuthorizationEndpoint+sep+query.Encode(), http.StatusFound)
+}
+
+// callback exchanges the code for id token and starts the session
+func (p *oidcProvider) callback(w http.ResponseWriter, req *http.Request) {
+	query := req.URL.Query()
+	if e := query.Get("error"); len(e) > 0 {
+		http.Error(w, "login fail: "+e, http.StatusUnauthorized)
+		return
+	}
+
+	var state oidcState
+	if err := verify(query.Get("state"), &state); err != nil || time.Now().Unix() > state.Expires {
+		http.Error(w, "invalid login state", http.StatusBadRequest)
+		return
+	}
+
+	c, err := req.Cookie(oidcStateCookie)
+	if err != nil || c.Value != state.Nonce {
+		http.Error(w, "invalid login state", http.StatusBadRequest)
+		return
+	}
+
+	claims, err := p.exchange(query.Get("code"), redirectURI(req))
+	if err != nil {
+		logs.Warn("oidc login %s fail: %v", p.domain, err)
+		http.Error(w, "login fail", http.StatusUnauthorized)
+		return
+	}
+
+	if claims.Nonce != state.Nonce {
+		http.Error(w, "invalid login nonce", http.StatusUnauthorized)
+		return
+	}
+
+	if !p.allow(claims) {
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	}
+
+	user := claims.Email
+	if len(user) <= 0 {
+		user = claims.Subject
+	}
+
+	value, err := p.newSession(user, claims.EmailVerified)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     oidcStateCookie,
+		Path:     oidcCallbackPath,
+		MaxAge:   -1,
+		HttpOnly: true,
+	})
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookie,
+		Value:    value,
+		Path:     "/",
+		MaxAge:   int(p.ttl / time.Second),
+		HttpOnly: true,
+		Secure:   req.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	// only local path is allowed to avoid open redirect
+	ret := state.Return
+	if !strings.HasPrefix(ret, "/") || strings.HasPrefix(ret, "//") {
+		ret = "/"
+	}
+	http.Redirect(w, req, ret, http.StatusFound)
+}
+
+func (p *oidcProvider) allow(claims *oidcClaims) bool {
+	if len(p.opts.Emails) <= 0 && len(p.opts.EmailDomains) <= 0 {
+		return true
+	}
+
+	if len(claims.Email) <= 0 || (claims.EmailVerified != nil && !*claims.EmailVerified) {
+		return false
+	}
+
+	email := strings.ToLower(claims.Email)
+	for _, e := range p.opts.Emails {
+		if strings.ToLower(e) == email {
+			return true
+		}
+	}
+
+	for _, d := range p.opts.EmailDomains {
+		if strings.HasSuffix(email, "@"+strings.ToLower(d)) {
+			return true
+		}
+	}
+	return false
+}
+
+// exchange exchanges code for id token and verifies it
+func (p *oidcProvider) exchange(code, redirect string) (*oidcClaims, error) {
+	cfg, err := p.discover()
+	if err != nil {
+		return nil, err
+	}
+
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", code)
+	form.Set("redirect_uri", redirect)
+	form.Set("client_id", p.opts.ClientID)
+	form.Set("client_secret", p.opts.ClientSecret)
+
+	resp, err := oidcClient.PostForm(cfg.TokenEndpoint, form)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("token endpoint reply %s", resp.Status)
+	}
+
+	var token struct {
+		IDToken string `json:"id_token"`
+	}
+	err = json.NewDecoder(io.LimitReader(resp.Body, oidcMaxBody)).Decode(&token)
+	if err != nil {
+		return nil, err
+	}
+	return p.verifyIDToken(cfg, token.IDToken)
+}
+
+// verifyIDToken verifies RS256 signed id token
+func (p *oidcProvider) verifyIDToken(cfg *oidcConfig, token string) (*oidcClaims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("malformed id token")
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, err
+	}
+
+	if header.Alg != "RS256" {
+		return nil, fmt.Errorf("unsupported id token alg %s", header.Alg)
+	}
+
+	key, err := p.key(cfg, header.Kid)
+	if err != nil {
+		return nil, err
+	}
+
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, err
+	}
+
+	hashed := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	err = rsa.VerifyPKCS1v15(key, crypto.SHA256, hashed[:], sig)
+	if err != nil {
+		return nil, fmt.Errorf("id token signature: %v", err)
+	}
+
+	claims := &oidcClaims{}
+	if err := decodeSegment(parts[1], claims); err != nil {
+		return nil, err
+	}
+
+	if claims.Issuer != cfg.Issuer {
+		return nil, fmt.Errorf("unexpected id token issuer %s", claims.Issuer)
+	}
+
+	if !audienceContains(claims.Audience, p.opts.ClientID) {
+		return nil, fmt.Errorf("id token is not issued to %s", p.opts.ClientID)
+	}
+
+	if time.Now().Unix() > claims.Expires {
+		return nil, fmt.Errorf("id token expired")
+	}
+	return claims, nil
+}
+
+// discover fetches provider configuration once
+func (p *oidcProvider) discover() (*oidcConfig, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.config != nil {
+		return p.config, nil
+	}
+
+	cfg := &oidcConfig{}
+	err := getJSON(strings.TrimSuffix(p.opts.Issuer, "/")+"/.well-known/openid-configuration", cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	if cfg.Issuer != strings.TrimSuffix(p.opts.Issuer, "/") && cfg.Issuer != p.opts.Issuer {
+		return nil, fmt.Errorf("issuer mismatch: %s", cfg.Issuer)
+	}
+
+	// endpoints are fetched by us, so they must be served by the
+	// issuer instead of any address the discovery document points to
+	for _, endpoint := range []string{cfg.TokenEndpoint, cfg.JWKSURI} {
+		if !sameOrigin(p.opts.Issuer, endpoint) {
+			return nil, fmt.Errorf("endpoint %s is not served by issuer %s", endpoint, p.opts.Issuer)
+		}
+	}
+
+	p.config = cfg
+	return cfg, nil
+}
+
+// key returns the signing key of kid
+// keys are refetched for unknown kid, eg: key rotation,
+// at most once per oidcKeysInterval
+func (p *oidcProvider) key(cfg *oidcConfig, kid string) (*rsa.PublicKey, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if key, ok := p.keys[kid]; ok {
+		return key, nil
+	}
+
+	if time.Since(p.fetched) < oidcKeysInterval {
+		return nil, fmt.Errorf("unknown id token key %s", kid)
+	}
+	p.fetched = time.Now()
+
+	var jwks struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Kid string `json:"kid"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+		} `json:"keys"`
+	}
+	err := getJSON(cfg.JWKSURI, &jwks)
+	if err != nil {
+		return nil, err
+	}
+
+	keys := make(map[string]*rsa.PublicKey)
+	for _, k := range jwks.Keys {
+		if k.Kty != "RSA" {
+			continue
+		}
+
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			continue
+		}
+
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil {
+			continue
+		}
+
+		keys[k.Kid] = &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64()),
+		}
+	}
+	p.keys = keys
+
+	key, ok := keys[kid]
+	if !ok {
+		return nil, fmt.Errorf("unknown id token key %s", kid)
+	}
+	return key, nil
+}
+
+func redirectURI(req *http.Request) string {
+	scheme := "http"
+	if req.TLS != nil {
+		scheme = "https"
+	}
+	return scheme + "://" + req.Host + oidcCallbackPath
+}
+
+// sameOrigin checks whether u has the scheme and host of issuer
+func sameOrigin(issuer, u string) bool {
+	iu, err := url.Parse(issuer)
+	if err != nil {
+		return false
+	}
+
+	eu, err := url.Parse(u)
+	if err != nil {
+		return false
+	}
+	return eu.Scheme == iu.Scheme && strings.EqualFold(eu.Host, iu.Host)
+}
+
+func audienceContains(aud json.RawMessage, clientID string) bool {
+	var single string
+	if err := json.Unmarshal(aud, &single); err == nil {
+		return single == clientID
+	}
+
+	var multi []string
+	if err := json.Unmarshal(aud, &multi); err == nil {
+		for _, a := range multi {
+			if a == clientID {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func decodeSegment(seg string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(seg)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+func getJSON(u string, v interface{}) error {
+	resp, err := oidcClient.Get(u)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("get %s reply %s", u, resp.Status)
+	}
+	return json.NewDecoder(io.LimitReader(resp.Body, oidcMaxBody)).Decode(v)
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,151 @@
+package httpproxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// options specific per forward options
+// they are passed by client forward rawConfig, eg:
+// rawConfig: '{"inspect": {"capacity": 100, "maxBody": 65536}}'
+type options struct {
+	// Inspect records requests and responses of the domain
+	// nil means disabled
+	Inspect *inspectOptions `json:"inspect"`
+
+	// Auth authenticates visitors before traffic enters the tunnel
+	// nil means disabled
+	Auth *authOptions `json:"auth"`
+
+	// Rewrite rewrites requests and responses
+	// nil means disabled
+	Rewrite *rewriteOptions `json:"rewrite"`
+
+	// Paths routes requests to other local ports by path prefix
+	// unmatched requests go to the forward port
+	Paths []pathOptions `json:"paths"`
+}
+
+type pathOptions struct {
+	// Prefix matches the path and its sub paths, eg:
+	// /api matches /api and /api/users but not /apis
+	Prefix string `json:"prefix" required:"true"`
+
+	// Port specific the local port of the same client
+	Port int `json:"port" required:"true" min:"1" max:"65535"`
+
+	// Strip removes the prefix before forwarding
+	// the prefix is passed by X-Forwarded-Prefix
+	Strip bool `json:"strip"`
+}
+
+type inspectOptions struct {
+	// Capacity specific max records kept, default 100
+	Capacity int `json:"capacity" min:"0"`
+
+	// MaxBody specific max body bytes kept of each request
+	// and response, default 64KB
+	MaxBody int `json:"maxBody" min:"0"`
+}
+
+// authOptions specific accepted credentials
+// a request is accepted if any of them matches
+type authOptions struct {
+	// Basic specific http basic auth users, user => password
+	Basic map[string]string `json:"basic"`
+
+	// Bearer specific static bearer tokens
+	Bearer []string `json:"bearer"`
+
+	// OIDC specific openid connect login for browsers
+	OIDC *oidcOptions `json:"oidc"`
+}
+
+type oidcOptions struct {
+	// Issuer specific the provider, its configuration is discovered
+	// from $issuer/.well-known/openid-configuration
+	Issuer       string   `json:"issuer" required:"true"`
+	ClientID     string   `json:"clientID" required:"true"`
+	ClientSecret string   `json:"clientSecret"`
+	Scopes       []string `json:"scopes"`
+
+	// Emails and EmailDomains restrict logged in users
+	// empty means any user of the provider
+	Emails       []string `json:"emails"`
+	EmailDomains []string `json:"emailDomains"`
+
+	// SessionTTL specific login session lifetime in seconds
+	// default 12 hours
+	SessionTTL int `json:"sessionTTL" min:"0"`
+}
+
+type rewriteOptions struct {
+	// Host overrides Host header sent to the local service, eg: localhost:5173
+	// the public host is kept in X-Forwarded-Host
+	Host string `json:"host"`
+
+	// RequestHeaders and ResponseHeaders modify headers
+	RequestHeaders  *headerRules `json:"requestHeaders"`
+	ResponseHeaders *headerRules `json:"responseHeaders"`
+
+	// Location rewrites Location header points to the local service
+	// back to the public domain
+	Location bool `json:"location"`
+
+	// CORS injects CORS headers and answers preflight requests
+	CORS *corsOptions `json:"cors"`
+}
+
+// headerRules are applied in order: remove, set, add
+type headerRules struct {
+	Remove []string          `json:"remove"`
+	Set    map[string]string `json:"set"`
+	Add    map[string]string `json:"add"`
+}
+
+type corsOptions struct {
+	// Origins specific allowed origins, "*" allows any origin
+	Origins []string `json:"origins"`
+
+	// Methods specific allowed methods
+	// default GET, POST, PUT, PATCH, DELETE, OPTIONS
+	Methods []string `json:"methods"`
+
+	// Headers specific allowed request headers
+	// default is the requested headers
+	Headers []string `json:"headers"`
+
+	Credentials bool `json:"credentials"`
+
+	// MaxAge specific preflight cache seconds
+	MaxAge int `json:"maxAge" min:"0"`
+}
+
+// parseOptions parses options from PluginMeta.Ctx
+func parseOptions(ctx interface{}) (*options, error) {
+	opts := &options{}
+	raw, _ := ctx.(string)
+	if len(raw) <= 0 {
+		return opts, nil
+	}
+
+	err := json.Unmarshal([]byte(raw), opts)
+	if err != nil {
+		return nil, fmt.Errorf("parse forward options: %v", err)
+	}
+
+	for _, p := range opts.Paths {
+		if !strings.HasPrefix(p.Prefix, "/") || p.Port <= 0 || p.Port > 65535 {
+			return nil, fmt.Errorf("invalid path route %s => %d", p.Prefix, p.Port)
+		}
+	}
+
+	if opts.Auth != nil && opts.Auth.OIDC != nil {
+		oidc := opts.Auth.OIDC
+		if len(oidc.Issuer) <= 0 || len(oidc.ClientID) <= 0 {
+			return nil, fmt.Errorf("oidc issuer and clientID are required")
+		}
+	}
+	return opts, nil
+}
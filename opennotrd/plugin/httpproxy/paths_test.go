@@ -0,0 +1,78 @@
+package httpproxy
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/ICKelin/opennotr/opennotrd/plugin"
+	"github.com/ICKelin/opennotr/opennotrd/plugin/plugintest"
+)
+
+func TestPathRoutes(t *testing.T) {
+	tun := plugintest.NewTunnel(t)
+	defer tun.Close()
+
+	newBackend := func(name string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprintf(w, "%s %s %s", name, r.URL.RequestURI(), r.Header.Get("X-Forwarded-Prefix"))
+		}))
+	}
+
+	frontend := newBackend("frontend")
+	defer frontend.Close()
+	api := newBackend("api")
+	defer api.Close()
+	admin := newBackend("admin")
+	defer admin.Close()
+
+	addr := plugintest.FreeAddr(t)
+	p := setup(t, "http", fmt.Sprintf(`{"listen": "%s"}`, addr))
+	item := &plugin.PluginMeta{
+		Protocol: "http",
+		To:       "100.64.240.10:" + plugintest.Port(t, frontend.URL),
+		Domain:   "app.open.notr.tech",
+		Dialer:   tun,
+		Ctx: fmt.Sprintf(`{"paths": [
+			{"prefix": "/api", "port": %s},
+			{"prefix": "/api/admin/", "port": %s, "strip": true}
+		]}`, plugintest.Port(t, api.URL), plugintest.Port(t, admin.URL)),
+	}
+	proxy, err := runProxy(p, item)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer proxy.Close()
+
+	tests := []struct {
+		path   string
+		expect string
+	}{
+		{"/", "frontend / "},
+		{"/apis", "frontend /apis "},
+		{"/api", "api /api "},
+		{"/api/users?id=1", "api /api/users?id=1 "},
+		{"/api/admin", "admin / /api/admin"},
+		{"/api/admin/stats", "admin /stats /api/admin"},
+	}
+
+	for _, test := range tests {
+		code, body := get(t, http.DefaultClient, "http://"+addr+test.path, "app.open.notr.tech")
+		if code != http.StatusOK || body != test.expect {
+			t.Errorf("%s: expected %q, got %d %q", test.path, test.expect, code, body)
+		}
+	}
+}
+
+func TestParsePathOptions(t *testing.T) {
+	for _, raw := range []string{
+		`{"paths": [{"prefix": "api", "port": 8080}]}`,
+		`{"paths": [{"prefix": "/api", "port": 0}]}`,
+		`{"paths": [{"prefix": "/api", "port": 65536}]}`,
+	} {
+		if _, err := parseOptions(raw); err == nil {
+			t.Errorf("%s: expected error", raw)
+		}
+	}
+}
@@ -0,0 +1,161 @@
+package httpproxy
+
+import (
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+var defaultCORSMethods = []string{"GET", "POST", "PUT", "PATCH", "DELETE", "OPTIONS"}
+
+// rewriter applies rewriteOptions of a route
+type rewriter struct {
+	opts *rewriteOptions
+
+	// to is the vip:port of the local service
+	to string
+}
+
+func newRewriter(opts *rewriteOptions, to string) *rewriter {
+	return &rewriter{opts: opts, to: to}
+}
+
+// rewriteRequest is called by director after X-Forwarded-* headers set
+func (rw *rewriter) rewriteRequest(req *http.Request) {
+	if len(rw.opts.Host) > 0 {
+		req.Host = rw.opts.Host
+	}
+
+	if rw.opts.RequestHeaders != nil {
+		rw.opts.RequestHeaders.apply(req.Header)
+	}
+}
+
+// rewriteResponse is called before response is written to visitor
+func (rw *rewriter) rewriteResponse(resp *http.Response) error {
+	if rw.opts.ResponseHeaders != nil {
+		rw.opts.ResponseHeaders.apply(resp.Header)
+	}
+
+	if rw.opts.Location {
+		rw.rewriteLocation(resp)
+	}
+
+	if rw.opts.CORS != nil {
+		origin := resp.Request.Header.Get("Origin")
+		if len(origin) > 0 && rw.allowOrigin(origin) {
+			rw.corsHeaders(resp.Header, origin)
+		}
+	}
+	return nil
+}
+
+// rewriteLocation rewrites absolute Location points to the local service
+// eg: http://localhost:5173/login => https://abc.open.notr.tech/login
+func (rw *rewriter) rewriteLocation(resp *http.Response) {
+	location := resp.Header.Get("Location")
+	if len(location) <= 0 {
+		return
+	}
+
+	u, err := url.Parse(location)
+	if err != nil || !u.IsAbs() {
+		return
+	}
+
+	host := u.Hostname()
+	if u.Host != rw.opts.Host && u.Host != rw.to &&
+		host != "localhost" && host != "127.0.0.1" && host != "::1" {
+		return
+	}
+
+	public := resp.Request.Header.Get("X-Forwarded-Host")
+	if len(public) <= 0 {
+		return
+	}
+
+	u.Scheme = resp.Request.Header.Get("X-Forwarded-Proto")
+	u.Host = public
+	resp.Header.Set("Location", u.String())
+}
+
+// preflight answers CORS preflight request
+// it returns false if the request is not a preflight
+func (rw *rewriter) preflight(w http.ResponseWriter, req *http.Request) bool {
+	if rw.opts.CORS == nil || req.Method != http.MethodOptions ||
+		len(req.Header.Get("Access-Control-Request-Method")) <= 0 {
+		return false
+	}
+
+	origin := req.Header.Get("Origin")
+	if len(origin) <= 0 || !rw.allowOrigin(origin) {
+		w.WriteHeader(http.StatusForbidden)
+		return true
+	}
+
+	cors := rw.opts.CORS
+	methods := cors.Methods
+	if len(methods) <= 0 {
+		methods = defaultCORSMethods
+	}
+
+	headers := strings.Join(cors.Headers, ", ")
+	if len(cors.Headers) <= 0 {
+		headers = req.Header.Get("Access-Control-Request-Headers")
+	}
+
+	h := w.Header()
+	rw.corsHeaders(h, origin)
+	h.Set("Access-Control-Allow-Methods", strings.Join(methods, ", "))
+	if len(headers) > 0 {
+		h.Set("Access-Control-Allow-Headers", headers)
+	}
+
+	if cors.MaxAge > 0 {
+		h.Set("Access-Control-Max-Age", strconv.Itoa(cors.MaxAge))
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return true
+}
+
+func (rw *rewriter) allowOrigin(origin string) bool {
+	for _, o := range rw.opts.CORS.Origins {
+		if o == "*" || strings.EqualFold(o, origin) {
+			return true
+		}
+	}
+	return false
+}
+
+// corsHeaders sets allowed origin
+// the origin is echoed instead of "*" when credentials are allowed
+func (rw *rewriter) corsHeaders(h http.Header, origin string) {
+	allow := origin
+	if !rw.opts.CORS.Credentials && len(rw.opts.CORS.Origins) == 1 && rw.opts.CORS.Origins[0] == "*" {
+		allow = "*"
+	}
+
+	h.Set("Access-Control-Allow-Origin", allow)
+	if allow != "*" {
+		h.Add("Vary", "Origin")
+	}
+
+	if rw.opts.CORS.Credentials {
+		h.Set("Access-Control-Allow-Credentials", "true")
+	}
+}
+
+func (rules *headerRules) apply(h http.Header) {
+	for _, name := range rules.Remove {
+		h.Del(name)
+	}
+
+	for name, value := range rules.Set {
+		h.Set(name, value)
+	}
+
+	for name, value := range rules.Add {
+		h.Add(name, value)
+	}
+}
@@ -0,0 +1,119 @@
+package httpproxy
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/ICKelin/opennotr/opennotrd/plugin"
+	"github.com/ICKelin/opennotr/opennotrd/plugin/plugintest"
+)
+
+func TestRewrite(t *testing.T) {
+	tun := plugintest.NewTunnel(t)
+	defer tun.Close()
+
+	// vite like dev server only accepts localhost
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Host != "localhost:5173" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+
+		if r.URL.Path == "/login" {
+			http.Redirect(w, r, "http://localhost:5173/home", http.StatusFound)
+			return
+		}
+
+		w.Header().Set("Server", "vite")
+		w.Header().Set("X-Powered-By", "node")
+		fmt.Fprintf(w, "%s|%s|%s", r.Header.Get("X-Env"), r.Header.Get("Cookie"), r.Header.Get("X-Forwarded-Host"))
+	}))
+	defer backend.Close()
+
+	addr := plugintest.FreeAddr(t)
+	p := setup(t, "http", fmt.Sprintf(`{"listen": "%s"}`, addr))
+	item := &plugin.PluginMeta{
+		Protocol: "http",
+		To:       "100.64.240.10:" + plugintest.Port(t, backend.URL),
+		Domain:   "vite.open.notr.tech",
+		Dialer:   tun,
+		Ctx: `{"rewrite": {
+			"host": "localhost:5173",
+			"location": true,
+			"requestHeaders": {"remove": ["Cookie"], "set": {"X-Env": "tunnel"}},
+			"responseHeaders": {"remove": ["X-Powered-By"], "add": {"X-Tunnel": "opennotr"}},
+			"cors": {"origins": ["https://app.notr.tech"], "credentials": true, "maxAge": 600}
+		}}`,
+	}
+	proxy, err := runProxy(p, item)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer proxy.Close()
+
+	do := func(method, path string, header map[string]string) *http.Response {
+		req, _ := http.NewRequest(method, "http://"+addr+path, nil)
+		req.Host = "vite.open.notr.tech"
+		for k, v := range header {
+			req.Header.Set(k, v)
+		}
+
+		resp, err := http.DefaultTransport.RoundTrip(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+
+	resp := do("GET", "/", map[string]string{"Cookie": "a=b", "Origin": "https://app.notr.tech"})
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || string(body) != "tunnel||vite.open.notr.tech" {
+		t.Fatalf("unexpected response %d %q", resp.StatusCode, body)
+	}
+
+	if resp.Header.Get("X-Powered-By") != "" || resp.Header.Get("X-Tunnel") != "opennotr" ||
+		resp.Header.Get("Server") != "vite" {
+		t.Fatalf("unexpected response headers %v", resp.Header)
+	}
+
+	if resp.Header.Get("Access-Control-Allow-Origin") != "https://app.notr.tech" ||
+		resp.Header.Get("Access-Control-Allow-Credentials") != "true" {
+		t.Fatalf("expected cors headers, got %v", resp.Header)
+	}
+
+	resp = do("GET", "/login", nil)
+	resp.Body.Close()
+	if resp.Header.Get("Location") != "http://vite.open.notr.tech/home" {
+		t.Fatalf("expected location rewritten, got %q", resp.Header.Get("Location"))
+	}
+
+	resp = do("GET", "/", map[string]string{"Origin": "https://evil.com"})
+	resp.Body.Close()
+	if resp.Header.Get("Access-Control-Allow-Origin") != "" {
+		t.Fatal("expected no cors headers for not allowed origin")
+	}
+
+	preflight := map[string]string{
+		"Origin":                         "https://app.notr.tech",
+		"Access-Control-Request-Method":  "PUT",
+		"Access-Control-Request-Headers": "Content-Type",
+	}
+	resp = do("OPTIONS", "/api", preflight)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent ||
+		resp.Header.Get("Access-Control-Allow-Headers") != "Content-Type" ||
+		resp.Header.Get("Access-Control-Max-Age") != "600" {
+		t.Fatalf("unexpected preflight response %d %v", resp.StatusCode, resp.Header)
+	}
+
+	preflight["Origin"] = "https://evil.com"
+	resp = do("OPTIONS", "/api", preflight)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("expected preflight of not allowed origin rejected, got %d", resp.StatusCode)
+	}
+}
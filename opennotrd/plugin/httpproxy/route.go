@@ -0,0 +1,257 @@
+package httpproxy
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/ICKelin/opennotr/internal/logs"
+	"github.com/ICKelin/opennotr/opennotrd/plugin"
+	"golang.org/x/net/http2"
+)
+
+// route proxies requests of a domain to the client
+type route struct {
+	scheme    string
+	meta      *plugin.PluginMeta
+	transport http.RoundTripper
+	proxy     *httputil.ReverseProxy
+
+	// inspector records requests of the route if enabled
+	inspector *inspector
+
+	// auth authenticates visitors if enabled
+	auth *authenticator
+
+	// rewriter rewrites requests and responses if enabled
+	rewriter *rewriter
+
+	// pages is the *errorPages of the proxy, swapped on reload
+	pages *atomic.Value
+
+	// paths routes requests to other local ports by path prefix
+	// sorted by prefix length, the longest is matched first
+	paths []*pathRoute
+
+	// stats counts requests and reports health of the proxy
+	// it is nil for routes not created by RunProxy
+	stats *plugin.BasicProxy
+}
+
+type pathRoute struct {
+	prefix string
+	to     string
+	strip  bool
+}
+
+func newRoute(scheme string, meta *plugin.PluginMeta, timeout time.Duration, opts *options, pages *atomic.Value, limits inspectLimits) *route {
+	r := &route{
+		scheme: scheme,
+		meta:   meta,
+		pages:  pages,
+	}
+
+	if opts.Inspect != nil {
+		r.inspector = acquireInspector(strings.ToLower(meta.Domain), opts.Inspect, limits.MaxMemory)
+	}
+
+	if opts.Auth != nil {
+		r.auth = newAuthenticator(strings.ToLower(meta.Domain), opts.Auth)
+	}
+
+	if opts.Rewrite != nil {
+		r.rewriter = newRewriter(opts.Rewrite, meta.To)
+	}
+
+	vip, _, _ := net.SplitHostPort(meta.To)
+	for _, p := range opts.Paths {
+		r.paths = append(r.paths, &pathRoute{
+			prefix: strings.TrimSuffix(p.Prefix, "/"),
+			to:     net.JoinHostPort(vip, strconv.Itoa(p.Port)),
+			strip:  p.Strip,
+		})
+	}
+	sort.SliceStable(r.paths, func(i, j int) bool {
+		return len(r.paths[i].prefix) > len(r.paths[j].prefix)
+	})
+
+	// the dialed address is the $vip:$port selected by director
+	if scheme == "h2c" {
+		// the local service speaks http2 without tls
+		r.transport = &http2.Transport{
+			AllowHTTP: true,
+			DialTLS: func(network, addr string, cfg *tls.Config) (net.Conn, error) {
+				return meta.Dialer.Dial(nil, addr)
+			},
+		}
+	} else {
+		r.transport = &http.Transport{
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				src, _ := ctx.Value(srcAddrKey).(net.Addr)
+				return meta.Dialer.Dial(src, addr)
+			},
+			MaxIdleConnsPerHost:   16,
+			IdleConnTimeout:       time.Second * 90,
+			ResponseHeaderTimeout: timeout,
+		}
+	}
+
+	r.proxy = &httputil.ReverseProxy{
+		Director:      r.director,
+		Transport:     r.transport,
+		FlushInterval: time.Millisecond * 100,
+		ErrorHandler:  r.errorHandler,
+	}
+
+	r.proxy.ModifyResponse = r.modifyResponse
+	return r
+}
+
+// ServeHTTP authenticates request before it enters the tunnel
+// CORS preflight is answered without authentication
+func (r *route) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if r.stats != nil {
+		r.stats.ConnOpen()
+		defer r.stats.ConnClose()
+		req.Body = &countReader{ReadCloser: req.Body, add: r.stats.AddIn}
+	}
+
+	if r.rewriter != nil && r.rewriter.preflight(w, req) {
+		return
+	}
+
+	if r.auth != nil {
+		r.auth.serve(w, req, http.HandlerFunc(r.forward))
+		return
+	}
+	r.forward(w, req)
+}
+
+func (r *route) forward(w http.ResponseWriter, req *http.Request) {
+	if r.inspector != nil {
+		r.inspector.serve(w, req, r.proxy, "")
+		return
+	}
+	r.proxy.ServeHTTP(w, req)
+}
+
+// director rewrites request to the client
+// Host header is kept and X-Forwarded-* headers are set
+// X-Forwarded-For is appended by httputil.ReverseProxy
+func (r *route) director(req *http.Request) {
+	proto := "http"
+	if req.TLS != nil {
+		proto = "https"
+	}
+
+	req.URL.Scheme = "http"
+	req.URL.Host = r.meta.To
+	if p := r.matchPath(req.URL.Path); p != nil {
+		req.URL.Host = p.to
+		if p.strip {
+			stripPrefix(req.URL, p.prefix)
+			req.Header.Set("X-Forwarded-Prefix", p.prefix)
+		}
+	}
+	req.Header.Set("X-Forwarded-Host", req.Host)
+	req.Header.Set("X-Forwarded-Proto", proto)
+	if ip, _, err := net.SplitHostPort(req.RemoteAddr); err == nil {
+		req.Header.Set("X-Real-IP", ip)
+	}
+
+	if r.rewriter != nil {
+		r.rewriter.rewriteRequest(req)
+	}
+
+	// avoid default User-Agent
+	if _, ok := req.Header["User-Agent"]; !ok {
+		req.Header.Set("User-Agent", "")
+	}
+}
+
+func (r *route) matchPath(path string) *pathRoute {
+	for _, p := range r.paths {
+		if path == p.prefix || strings.HasPrefix(path, p.prefix+"/") {
+			return p
+		}
+	}
+	return nil
+}
+
+// stripPrefix removes prefix from url path
+// eg: /api/users => /users, /api => /
+func stripPrefix(u *url.URL, prefix string) {
+	u.Path = strings.TrimPrefix(u.Path, prefix)
+	if !strings.HasPrefix(u.Path, "/") {
+		u.Path = "/" + u.Path
+	}
+
+	if len(u.RawPath) > 0 {
+		u.RawPath = strings.TrimPrefix(u.RawPath, prefix)
+		if !strings.HasPrefix(u.RawPath, "/") {
+			u.RawPath = "/" + u.RawPath
+		}
+	}
+}
+
+// modifyResponse counts response body and rewrites response
+func (r *route) modifyResponse(resp *http.Response) error {
+	if r.stats != nil {
+		r.stats.SetHealth(nil)
+
+		// the body of upgrade response is the raw connection
+		if resp.StatusCode != http.StatusSwitchingProtocols {
+			resp.Body = &countReader{ReadCloser: resp.Body, add: r.stats.AddOut}
+		}
+	}
+
+	if r.rewriter != nil {
+		return r.rewriter.rewriteResponse(resp)
+	}
+	return nil
+}
+
+func (r *route) errorHandler(w http.ResponseWriter, req *http.Request, err error) {
+	// the visitor is gone
+	if req.Context().Err() == context.Canceled {
+		w.WriteHeader(http.StatusBadGateway)
+		return
+	}
+
+	logs.Error("proxy %s%s to %s fail: %v", req.Host, req.URL.Path, req.URL.Host, err)
+	if r.stats != nil {
+		r.stats.SetHealth(err)
+	}
+	r.pages.Load().(*errorPages).write(w, req, classifyError(err))
+}
+
+// countReader counts bytes read by add
+type countReader struct {
+	io.ReadCloser
+	add func(int64)
+}
+
+func (c *countReader) Read(b []byte) (int, error) {
+	n, err := c.ReadCloser.Read(b)
+	c.add(int64(n))
+	return n, err
+}
+
+func (r *route) close() {
+	if r.inspector != nil {
+		releaseInspector(r.inspector)
+	}
+
+	if c, ok := r.transport.(interface{ CloseIdleConnections() }); ok {
+		c.CloseIdleConnections()
+	}
+}
@@ -0,0 +1,256 @@
+package httpproxy
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/ICKelin/opennotr/internal/logs"
+	"github.com/ICKelin/opennotr/opennotrd/certs"
+	"github.com/ICKelin/opennotr/opennotrd/plugin"
+	"golang.org/x/crypto/acme"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+var (
+	serversMu sync.Mutex
+
+	// servers stores listening servers
+	// key: listen address
+	// value: server
+	servers = make(map[string]*server)
+)
+
+type contextKey struct{}
+
+// srcAddrKey stores the visitor address in request context
+var srcAddrKey = contextKey{}
+
+// server is a listener shared by schemes of the same address
+type server struct {
+	addr  string
+	isTLS bool
+
+	// pages replies offline page for domains without route
+	// it is the *errorPages of the scheme setup last
+	pages atomic.Value
+
+	// cert is the configured *tls.Certificate of https,
+	// it is swapped by Setup on reload
+	cert atomic.Value
+
+	mu sync.RWMutex
+
+	// routes stores routes of domains
+	// key: domain
+	// value: scheme => route
+	routes map[string]map[string]*route
+}
+
+// listen returns the server of cfg.Listen
+// it creates and runs the server at the first call,
+// the pages and certificate of the server are replaced by later calls
+func listen(scheme string, cfg config, pages *errorPages) (*server, error) {
+	serversMu.Lock()
+	defer serversMu.Unlock()
+
+	isTLS := scheme == "https"
+	srv, ok := servers[cfg.Listen]
+	if ok && srv.isTLS != isTLS {
+		return nil, fmt.Errorf("%s can not share listener %s", scheme, cfg.Listen)
+	}
+
+	var cert *tls.Certificate
+	if isTLS && (len(cfg.CertFile) > 0 || len(cfg.KeyFile) > 0) {
+		c, err := tls.LoadX509KeyPair(cfg.CertFile, cfg.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		cert = &c
+	}
+
+	if ok {
+		srv.pages.Store(pages)
+		srv.cert.Store(cert)
+		return srv, nil
+	}
+
+	srv = &server{
+		addr:   cfg.Listen,
+		isTLS:  isTLS,
+		routes: make(map[string]map[string]*route),
+	}
+	srv.pages.Store(pages)
+	srv.cert.Store(cert)
+
+	hs := &http.Server{
+		Handler:           srv,
+		ReadHeaderTimeout: time.Second * 30,
+	}
+
+	if isTLS {
+		hs.TLSConfig = srv.tlsConfig()
+	} else {
+		// h2c handler serves both http/1.1 and h2c prior knowledge
+		hs.Handler = h2c.NewHandler(srv, &http2.Server{})
+	}
+
+	lis, err := net.Listen("tcp", cfg.Listen)
+	if err != nil {
+		return nil, err
+	}
+
+	go func() {
+		defer lis.Close()
+		var err error
+		if isTLS {
+			err = hs.ServeTLS(lis, "", "")
+		} else {
+			err = hs.Serve(lis)
+		}
+		logs.Error("http server %s exit: %v", cfg.Listen, err)
+	}()
+
+	servers[cfg.Listen] = srv
+	return srv, nil
+}
+
+// tlsConfig creates tls config which selects certificate by SNI
+// certificates of certs providers are preferred and the
+// configured certificate is the default one
+func (s *server) tlsConfig() *tls.Config {
+	return &tls.Config{
+		GetCertificate: func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+			cert, err := certs.GetCertificate(hello)
+			if err == nil {
+				return cert, nil
+			}
+
+			if defaultCert := s.cert.Load().(*tls.Certificate); defaultCert != nil {
+				return defaultCert, nil
+			}
+			return nil, err
+		},
+		NextProtos: []string{"h2", "http/1.1", acme.ALPNProto},
+	}
+}
+
+func (s *server) addRoute(domain string, r *route) error {
+	domain = strings.ToLower(domain)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	schemes, ok := s.routes[domain]
+	if !ok {
+		schemes = make(map[string]*route)
+		s.routes[domain] = schemes
+	}
+
+	if _, ok := schemes[r.scheme]; ok {
+		return fmt.Errorf("%s://%s is in used", r.scheme, domain)
+	}
+	schemes[r.scheme] = r
+	return nil
+}
+
+// delRoute deletes route of domain if it is added by meta
+func (s *server) delRoute(domain, scheme string, meta *plugin.PluginMeta) {
+	domain = strings.ToLower(domain)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	schemes := s.routes[domain]
+	r, ok := schemes[scheme]
+	if !ok || r.meta != meta {
+		return
+	}
+
+	delete(schemes, scheme)
+	if len(schemes) == 0 {
+		delete(s.routes, domain)
+	}
+	r.close()
+}
+
+// lookup returns route for request
+// h2c route is preferred for http2 request and http route for others
+func (s *server) lookup(req *http.Request) *route {
+	host := req.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	schemes := s.routes[host]
+	if len(schemes) == 0 {
+		return nil
+	}
+
+	prefers := []string{"http", "h2c"}
+	if s.isTLS {
+		prefers = []string{"https"}
+	} else if req.ProtoMajor == 2 {
+		prefers = []string{"h2c", "http"}
+	}
+
+	for _, scheme := range prefers {
+		if r, ok := schemes[scheme]; ok {
+			return r
+		}
+	}
+	return nil
+}
+
+func (s *server) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if !s.isTLS && certs.ServeHTTPChallenge(w, req) {
+		return
+	}
+
+	// request id is passed to the local service and error pages
+	if len(req.Header.Get("X-Request-ID")) <= 0 {
+		req.Header.Set("X-Request-ID", randomHex(8))
+	}
+
+	r := s.lookup(req)
+	if r == nil {
+		logs.Warn("no route for %s%s", req.Host, req.URL.Path)
+		s.pages.Load().(*errorPages).write(w, req, errorOffline)
+		return
+	}
+
+	// visitor address is passed to the client when open stream
+	if addr, err := net.ResolveTCPAddr("tcp", req.RemoteAddr); err == nil {
+		req = req.WithContext(context.WithValue(req.Context(), srcAddrKey, addr))
+	}
+	r.ServeHTTP(w, req)
+}
+
+// findRoute returns a route of domain in all servers
+// http route is preferred, then h2c and https
+func findRoute(domain string) *route {
+	domain = strings.ToLower(domain)
+	serversMu.Lock()
+	defer serversMu.Unlock()
+
+	var found *route
+	for _, scheme := range []string{"http", "h2c", "https"} {
+		for _, srv := range servers {
+			srv.mu.RLock()
+			found = srv.routes[domain][scheme]
+			srv.mu.RUnlock()
+			if found != nil {
+				return found
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,251 @@
+// Package nginxproxy renders a nginx server block of each domain into
+// a conf dir and reloads nginx, it is the "nginx" driver of
+// http, https and h2c plugins.
+package nginxproxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/ICKelin/opennotr/internal/logs"
+	"github.com/ICKelin/opennotr/opennotrd/plugin"
+)
+
+var (
+	defaultDir = "/etc/nginx/conf.d"
+
+	// default debounce of reloads(milliseconds)
+	defaultDebounce = 500
+
+	defaultTest   = []string{"nginx", "-t"}
+	defaultReload = []string{"nginx", "-s", "reload"}
+
+	defaultListen = map[string]string{
+		"http":  "80",
+		"h2c":   "80 http2",
+		"https": "443 ssl http2",
+	}
+
+	defaultTemplate = template.Must(template.New("server").Parse(`# generated by opennotrd, do not edit
+server {
+    listen {{.Listen}};
+    server_name {{.Domain}};
+{{- if eq .Scheme "https"}}
+    ssl_certificate {{.CertFile}};
+    ssl_certificate_key {{.KeyFile}};
+{{- end}}
+
+    location / {
+{{- if eq .Scheme "h2c"}}
+        grpc_pass grpc://{{.To}};
+{{- else}}
+        proxy_pass http://{{.To}};
+        proxy_http_version 1.1;
+        proxy_set_header Host $host;
+        proxy_set_header X-Real-IP $remote_addr;
+        proxy_set_header X-Forwarded-For $proxy_add_x_forwarded_for;
+        proxy_set_header X-Forwarded-Proto $scheme;
+        proxy_set_header Upgrade $http_upgrade;
+        proxy_set_header Connection $http_connection;
+{{- end}}
+    }
+}
+`))
+)
+
+func init() {
+	plugin.RegisterDriverV2("http", "nginx", &NginxProxy{scheme: "http"})
+	plugin.RegisterDriverV2("https", "nginx", &NginxProxy{scheme: "https"})
+	plugin.RegisterDriverV2("h2c", "nginx", &NginxProxy{scheme: "h2c"})
+}
+
+type config struct {
+	// Dir specific where conf files are written
+	// default /etc/nginx/conf.d
+	Dir string `json:"dir"`
+
+	// Template specific the server block template file
+	// the template data is serverData, empty means the builtin one
+	Template string `json:"template"`
+
+	// Listen specific the listen directive parameters
+	// default "80" for http, "80 http2" for h2c, "443 ssl http2" for https
+	Listen string `json:"listen"`
+
+	// CertFile and KeyFile specific the certificate of https
+	CertFile string `json:"certFile"`
+	KeyFile  string `json:"keyFile"`
+
+	// Test and Reload specific the commands to validate and reload
+	// default "nginx -t" and "nginx -s reload"
+	Test   []string `json:"test"`
+	Reload []string `json:"reload"`
+
+	// Debounce specific milliseconds to collect changes for one reload
+	// default 500ms
+	Debounce int `json:"debounce" min:"0"`
+}
+
+// serverData is the data of server block template
+type serverData struct {
+	Scheme   string
+	Domain   string
+	To       string
+	Listen   string
+	CertFile string
+	KeyFile  string
+}
+
+// NginxProxy writes a conf file of each domain and reloads nginx
+// the server block proxies to $vip:$port which is routed to the
+// client by tproxy
+type NginxProxy struct {
+	scheme   string
+	cfg      config
+	tmpl     *template.Template
+	reloader *reloader
+}
+
+func (p *NginxProxy) Schema() *plugin.Schema {
+	return plugin.SchemaOf(config{
+		Dir:      defaultDir,
+		Listen:   defaultListen[p.scheme],
+		Test:     defaultTest,
+		Reload:   defaultReload,
+		Debounce: defaultDebounce,
+	})
+}
+
+func (p *NginxProxy) Setup(ctx context.Context, rawMessage json.RawMessage) error {
+	var cfg config
+	err := json.Unmarshal(rawMessage, &cfg)
+	if err != nil {
+		return err
+	}
+
+	if len(cfg.Dir) <= 0 {
+		cfg.Dir = defaultDir
+	}
+
+	if len(cfg.Listen) <= 0 {
+		cfg.Listen = defaultListen[p.scheme]
+	}
+
+	if len(cfg.Test) <= 0 {
+		cfg.Test = defaultTest
+	}
+
+	if len(cfg.Reload) <= 0 {
+		cfg.Reload = defaultReload
+	}
+
+	if cfg.Debounce <= 0 {
+		cfg.Debounce = defaultDebounce
+	}
+
+	if p.scheme == "https" && (len(cfg.CertFile) <= 0 || len(cfg.KeyFile) <= 0) {
+		return fmt.Errorf("certFile and keyFile are required for https")
+	}
+
+	tmpl := defaultTemplate
+	if len(cfg.Template) > 0 {
+		content, err := ioutil.ReadFile(cfg.Template)
+		if err != nil {
+			return err
+		}
+
+		tmpl, err = template.New("server").Parse(string(content))
+		if err != nil {
+			return err
+		}
+	}
+
+	err = os.MkdirAll(cfg.Dir, 0755)
+	if err != nil {
+		return err
+	}
+
+	p.cfg = cfg
+	p.tmpl = tmpl
+	p.reloader = getReloader(cfg.Dir, cfg.Test, cfg.Reload, time.Duration(cfg.Debounce)*time.Millisecond)
+	return nil
+}
+
+// ForwardSchema declares forwards accept no options
+func (p *NginxProxy) ForwardSchema() *plugin.Schema {
+	return plugin.SchemaOf(struct{}{})
+}
+
+func (p *NginxProxy) RunProxy(ctx context.Context, item *plugin.PluginMeta) (plugin.Proxy, error) {
+	if len(item.Domain) <= 0 {
+		return nil, fmt.Errorf("domain is required for %s", p.scheme)
+	}
+
+	// the domain is written to the server block and the file name
+	err := plugin.CheckDomain(item.Domain)
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := p.confFile(item.Domain)
+	if err != nil {
+		return nil, err
+	}
+
+	_, toPort, err := net.SplitHostPort(item.To)
+	if err != nil {
+		return nil, err
+	}
+
+	buf := &bytes.Buffer{}
+	err = p.tmpl.Execute(buf, &serverData{
+		Scheme:   p.scheme,
+		Domain:   strings.ToLower(item.Domain),
+		To:       item.To,
+		Listen:   p.cfg.Listen,
+		CertFile: p.cfg.CertFile,
+		KeyFile:  p.cfg.KeyFile,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// the conf file is deleted by the reloader it is written by
+	// the dir may be changed by reload
+	reloader := p.reloader
+	err = reloader.submit(file, buf.Bytes())
+	if err != nil {
+		return nil, err
+	}
+
+	logs.Info("add nginx server %s://%s => %s", p.scheme, item.Domain, item.To)
+	return plugin.NewProxy(&plugin.ProxyTuple{
+		Protocol: item.Protocol,
+		ToPort:   toPort,
+	}, func() error {
+		err := reloader.submit(file, nil)
+		if err != nil {
+			return fmt.Errorf("delete nginx conf of %s://%s fail: %v", p.scheme, item.Domain, err)
+		}
+		return nil
+	}), nil
+}
+
+// confFile returns the conf file of domain in the conf dir
+func (p *NginxProxy) confFile(domain string) (string, error) {
+	name := fmt.Sprintf("opennotr_%s_%s.conf", p.scheme, strings.ToLower(domain))
+	file := filepath.Join(p.cfg.Dir, name)
+	if filepath.Dir(file) != filepath.Clean(p.cfg.Dir) {
+		return "", fmt.Errorf("conf file of %s is out of %s", domain, p.cfg.Dir)
+	}
+	return file, nil
+}
@@ -0,0 +1,234 @@
+package nginxproxy
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/ICKelin/opennotr/opennotrd/plugin"
+)
+
+// newProxy returns http proxy writes to a temp dir,
+// "nginx -t" fails if any conf contains "invalid",
+// "nginx -s reload" appends a line to the reloads file
+func newProxy(t *testing.T) (*NginxProxy, string, func() int) {
+	root, err := ioutil.TempDir("", "nginxproxy")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := filepath.Join(root, "conf.d")
+	reloads := filepath.Join(root, "reloads")
+	tmpl := filepath.Join(root, "server.tmpl")
+	err = ioutil.WriteFile(tmpl, []byte(`server_name {{.Domain}}; proxy_pass http://{{.To}};{{if eq .To "100.64.240.99:80"}} invalid{{end}}`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg, _ := json.Marshal(map[string]interface{}{
+		"dir":      dir,
+		"template": tmpl,
+		"test":     []string{"sh", "-c", "! grep -rq invalid " + dir},
+		"reload":   []string{"sh", "-c", "echo reload >> " + reloads},
+		"debounce": 50,
+	})
+
+	p := &NginxProxy{scheme: "http"}
+	err = p.Setup(context.Background(), cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	count := func() int {
+		cnt, _ := ioutil.ReadFile(reloads)
+		return strings.Count(string(cnt), "reload")
+	}
+	return p, dir, count
+}
+
+func meta(domain, to string) *plugin.PluginMeta {
+	return &plugin.PluginMeta{Protocol: "http", Domain: domain, To: to}
+}
+
+func confFile(t *testing.T, p *NginxProxy, domain string) string {
+	file, err := p.confFile(domain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+// TestNginxProxyBurst connects sessions concurrently through the plugin
+// manager, the burst is applied by one reload
+func TestNginxProxyBurst(t *testing.T) {
+	p, dir, reloads := newProxy(t)
+	defer os.RemoveAll(filepath.Dir(dir))
+	plugin.RegisterV2("nginx_burst_test", p)
+
+	items := []*plugin.PluginMeta{
+		meta("a.notr.tech", "100.64.240.10:80"),
+		meta("b.notr.tech", "100.64.240.11:80"),
+		meta("bad.notr.tech", "100.64.240.99:80"),
+		meta("c.notr.tech", "100.64.240.12:80"),
+	}
+
+	mgr := plugin.DefaultPluginManager()
+	errs := make([]error, len(items))
+	wg := sync.WaitGroup{}
+	for i, item := range items {
+		item.Protocol = "nginx_burst_test"
+		wg.Add(1)
+		go func(i int, item *plugin.PluginMeta) {
+			defer wg.Done()
+			_, errs[i] = mgr.AddProxies([]*plugin.PluginMeta{item}, plugin.BatchOptions{})
+		}(i, item)
+	}
+	wg.Wait()
+
+	for i, item := range items {
+		_, statErr := os.Stat(confFile(t, p, item.Domain))
+		if item.Domain == "bad.notr.tech" {
+			if errs[i] == nil || !strings.Contains(errs[i].Error(), "validate") {
+				t.Errorf("expect validate error of bad domain, got %v", errs[i])
+			}
+			if !os.IsNotExist(statErr) {
+				t.Errorf("expect conf of bad domain rolled back, got %v", statErr)
+			}
+			continue
+		}
+
+		if errs[i] != nil {
+			t.Errorf("add proxy %s: %v", item.Domain, errs[i])
+		}
+		if statErr != nil {
+			t.Errorf("conf of %s: %v", item.Domain, statErr)
+		}
+	}
+
+	if n := reloads(); n != 1 {
+		t.Errorf("expect 1 reload of the burst, got %d", n)
+	}
+
+	// sessions close concurrently too
+	for _, item := range items {
+		wg.Add(1)
+		go func(item *plugin.PluginMeta) {
+			defer wg.Done()
+			mgr.DelProxy(item)
+		}(item)
+	}
+	wg.Wait()
+
+	if n := reloads(); n != 2 {
+		t.Errorf("expect 1 reload of closing sessions, got %d", n-1)
+	}
+}
+
+func TestNginxProxyInvalidDomain(t *testing.T) {
+	p, dir, reloads := newProxy(t)
+	defer os.RemoveAll(filepath.Dir(dir))
+
+	for _, domain := range []string{"x;} server { listen 80; } #.notr.tech", "a/../../b.notr.tech"} {
+		_, err := p.RunProxy(context.Background(), meta(domain, "100.64.240.10:80"))
+		if err == nil {
+			t.Errorf("%q: expect invalid domain error", domain)
+		}
+	}
+
+	if _, err := p.confFile("../b.notr.tech"); err == nil {
+		t.Error("expect conf file out of dir error")
+	}
+
+	files, _ := ioutil.ReadDir(filepath.Dir(dir))
+	for _, f := range files {
+		if f.Name() != "conf.d" && f.Name() != "server.tmpl" {
+			t.Errorf("unexpected file %s", f.Name())
+		}
+	}
+
+	if n := reloads(); n != 0 {
+		t.Errorf("expect no reload, got %d", n)
+	}
+}
+
+func TestNginxProxyRollback(t *testing.T) {
+	p, dir, reloads := newProxy(t)
+	defer os.RemoveAll(filepath.Dir(dir))
+
+	proxy, err := p.RunProxy(context.Background(), meta("a.notr.tech", "100.64.240.10:80"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tuple := proxy.Tuple()
+
+	if tuple.ToPort != "80" {
+		t.Errorf("expect to port 80, got %s", tuple.ToPort)
+	}
+
+	file := confFile(t, p, "a.notr.tech")
+	prev, _ := ioutil.ReadFile(file)
+
+	_, err = p.RunProxy(context.Background(), meta("a.notr.tech", "100.64.240.99:80"))
+	if err == nil {
+		t.Fatal("expect validate error")
+	}
+
+	cur, _ := ioutil.ReadFile(file)
+	if string(cur) != string(prev) {
+		t.Errorf("expect previous conf restored, got %s", cur)
+	}
+
+	proxy.Close()
+	if _, err := os.Stat(file); !os.IsNotExist(err) {
+		t.Errorf("expect conf deleted, got %v", err)
+	}
+
+	if n := reloads(); n != 2 {
+		t.Errorf("expect 2 reloads, got %d", n)
+	}
+}
+
+func TestNginxProxyDefaultTemplate(t *testing.T) {
+	p := &NginxProxy{scheme: "https"}
+	err := p.Setup(context.Background(), json.RawMessage(`{}`))
+	if err == nil {
+		t.Error("expect error without certificate for https")
+	}
+
+	for _, scheme := range []string{"http", "https", "h2c"} {
+		buf := &strings.Builder{}
+		err := defaultTemplate.Execute(buf, &serverData{
+			Scheme:   scheme,
+			Domain:   "a.notr.tech",
+			To:       "100.64.240.10:80",
+			Listen:   defaultListen[scheme],
+			CertFile: "/etc/opennotr/a.crt",
+			KeyFile:  "/etc/opennotr/a.key",
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		conf := buf.String()
+		if !strings.Contains(conf, "server_name a.notr.tech;") {
+			t.Errorf("%s: missing server_name: %s", scheme, conf)
+		}
+
+		pass := "proxy_pass http://100.64.240.10:80;"
+		if scheme == "h2c" {
+			pass = "grpc_pass grpc://100.64.240.10:80;"
+		}
+		if !strings.Contains(conf, pass) {
+			t.Errorf("%s: missing %s: %s", scheme, pass, conf)
+		}
+
+		if hasCert := strings.Contains(conf, "ssl_certificate /etc/opennotr/a.crt;"); hasCert != (scheme == "https") {
+			t.Errorf("%s: unexpected ssl_certificate: %s", scheme, conf)
+		}
+	}
+}
@@ -0,0 +1,204 @@
+package nginxproxy
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ICKelin/opennotr/internal/logs"
+)
+
+var (
+	reloadersMu sync.Mutex
+
+	// reloaders stores reloaders of conf dirs
+	// http, https and h2c share the reloader of the same dir
+	// key: conf dir
+	reloaders = make(map[string]*reloader)
+)
+
+// change writes or deletes a conf file
+type change struct {
+	file string
+
+	// content is nil for deleting
+	content []byte
+
+	// prev stores the file before change for rollback
+	// existed is false if the file did not exist
+	prev    []byte
+	existed bool
+
+	done chan error
+}
+
+func (c *change) apply() error {
+	prev, err := ioutil.ReadFile(c.file)
+	c.existed = err == nil
+	c.prev = prev
+
+	if c.content == nil {
+		if !c.existed {
+			return nil
+		}
+		return os.Remove(c.file)
+	}
+	return ioutil.WriteFile(c.file, c.content, 0644)
+}
+
+func (c *change) rollback() {
+	var err error
+	if c.existed {
+		err = ioutil.WriteFile(c.file, c.prev, 0644)
+	} else {
+		err = os.Remove(c.file)
+		if os.IsNotExist(err) {
+			err = nil
+		}
+	}
+
+	if err != nil {
+		logs.Error("rollback %s fail: %v", c.file, err)
+	}
+}
+
+// reloader applies changes in batch, validates and reloads nginx once
+// for changes submitted in the debounce duration
+type reloader struct {
+	mu       sync.Mutex
+	test     []string
+	reload   []string
+	debounce time.Duration
+	pending  []*change
+	armed    bool
+
+	// flushMu serializes batches
+	flushMu sync.Mutex
+}
+
+// getReloader returns the reloader of dir
+// it creates the reloader at the first call and updates
+// commands of the reloader at later calls
+func getReloader(dir string, test, reload []string, debounce time.Duration) *reloader {
+	reloadersMu.Lock()
+	defer reloadersMu.Unlock()
+
+	if r, ok := reloaders[dir]; ok {
+		r.mu.Lock()
+		r.test, r.reload, r.debounce = test, reload, debounce
+		r.mu.Unlock()
+		return r
+	}
+
+	r := &reloader{
+		test:     test,
+		reload:   reload,
+		debounce: debounce,
+	}
+	reloaders[dir] = r
+	return r
+}
+
+// submit submits change and waits until nginx is reloaded
+// the change is rolled back if it fails validation
+func (r *reloader) submit(file string, content []byte) error {
+	c := &change{
+		file:    file,
+		content: content,
+		done:    make(chan error, 1),
+	}
+
+	r.mu.Lock()
+	r.pending = append(r.pending, c)
+	if !r.armed {
+		r.armed = true
+		time.AfterFunc(r.debounce, r.flush)
+	}
+	r.mu.Unlock()
+
+	return <-c.done
+}
+
+func (r *reloader) flush() {
+	r.flushMu.Lock()
+	defer r.flushMu.Unlock()
+
+	r.mu.Lock()
+	batch := r.pending
+	test, reload := r.test, r.reload
+	r.pending = nil
+	r.armed = false
+	r.mu.Unlock()
+
+	applied := make([]*change, 0, len(batch))
+	for _, c := range batch {
+		if err := c.apply(); err != nil {
+			c.done <- err
+			continue
+		}
+		applied = append(applied, c)
+	}
+
+	if len(applied) == 0 {
+		return
+	}
+
+	err := run(test)
+	if err != nil {
+		logs.Warn("nginx validate %d changes fail: %v, validate one by one", len(applied), err)
+		applied = validateEach(test, applied)
+		if len(applied) == 0 {
+			return
+		}
+	}
+
+	err = run(reload)
+	if err != nil {
+		err = fmt.Errorf("nginx reload fail: %v", err)
+		for i := len(applied) - 1; i >= 0; i-- {
+			applied[i].rollback()
+		}
+	}
+
+	for _, c := range applied {
+		c.done <- err
+	}
+}
+
+// validateEach rolls back all changes and applies them one by one,
+// changes fail validation are rolled back and replied with the error
+// it returns changes passed validation
+func validateEach(test []string, changes []*change) []*change {
+	for i := len(changes) - 1; i >= 0; i-- {
+		changes[i].rollback()
+	}
+
+	passed := make([]*change, 0, len(changes))
+	for _, c := range changes {
+		if err := c.apply(); err != nil {
+			c.done <- err
+			continue
+		}
+
+		if err := run(test); err != nil {
+			c.rollback()
+			c.done <- fmt.Errorf("nginx validate %s fail: %v", c.file, err)
+			continue
+		}
+		passed = append(passed, c)
+	}
+	return passed
+}
+
+// run runs command and returns its output as error on failure
+func run(command []string) error {
+	out, err := exec.Command(command[0], command[1:]...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%v: %s", err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
@@ -1,16 +1,22 @@
 package plugin
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"net"
+	"sort"
 	"sync"
 
 	"github.com/ICKelin/opennotr/internal/logs"
 )
 
 var pluginMgr = &PluginManager{
-	routes:  make(map[string]*PluginMeta),
-	plugins: make(map[string]IPlugin),
+	routes:  make(map[string]*route),
+	plugins: make(map[string]IPluginV2),
+	drivers: make(map[string]map[string]IPluginV2),
+	configs: make(map[string]string),
 }
 
 // ProxyTuple defineds plugins real proxy address
@@ -46,16 +52,34 @@ type PluginMeta struct {
 
 	// Data you want to passto plugin
 	// Reserve
-	Ctx           interface{}
+	Ctx interface{}
+
+	// RecycleSignal is used by v1 plugins to stop proxies
+	// v2 plugins use the context of RunProxy instead
 	RecycleSignal chan struct{}
+
+	// Dialer opens stream to our VPN peer node directly
+	// plugins can use it instead of dialing $To via tproxy
+	Dialer Dialer
+}
+
+// ErrTunnelOffline is returned by Dialer if the VPN peer node
+// of the vip is not connected
+var ErrTunnelOffline = errors.New("tunnel offline")
+
+// Dialer opens a connection to the VPN peer node who owns the vip of $to
+// src is the address of the visitor, it will be passed to the peer
+// src may be nil if the visitor is unknown
+type Dialer interface {
+	Dial(src net.Addr, to string) (net.Conn, error)
 }
 
 func (item *PluginMeta) identify() string {
 	return fmt.Sprintf("%s:%s:%s", item.Protocol, item.From, item.Domain)
 }
 
-// IPlugin defines plugin interface
-// Plugin should implements the IPlugin
+// IPlugin defines v1 plugin interface
+// new plugins should implement IPluginV2
 type IPlugin interface {
 	// Setup calls at the begin of plugin system initialize
 	// plugin system will pass the raw message to plugin's Setup function
@@ -68,41 +92,123 @@ type IPlugin interface {
 	RunProxy(item *PluginMeta) (*ProxyTuple, error)
 }
 
+// route is a running proxy, proxy is nil while
+// the proxy is starting or closing
+type route struct {
+	meta   *PluginMeta
+	proxy  Proxy
+	cancel context.CancelFunc
+}
+
 type PluginManager struct {
+	// setupMu is held for writing while plugins are setup, and for
+	// reading while proxies run or close. Plugins are called without
+	// mu held, so proxies of sessions run and close concurrently
+	setupMu sync.RWMutex
+
 	mu sync.Mutex
 
 	// routes stores proxier of localAddress
 	// key: pluginMeta.identify()
-	// value: pluginMeta
-	routes map[string]*PluginMeta
+	// value: running proxy
+	routes map[string]*route
 
 	// plugins store plugin information
 	// by call plugin.Register function.
 	// key: protocol, eg: tcp, udp
 	// value: plugin implement
-	plugins map[string]IPlugin
+	plugins map[string]IPluginV2
+
+	// drivers store alternative plugins of protocols
+	// by call plugin.RegisterDriver function.
+	// key: protocol, eg: http
+	// value: driver name => plugin implement
+	drivers map[string]map[string]IPluginV2
+
+	// configs stores configuration of setup protocols
+	// key: protocol
+	configs map[string]string
 }
 
 func DefaultPluginManager() *PluginManager {
 	return pluginMgr
 }
 
+// Register registers v1 plugin of protocol
 func Register(protocol string, p IPlugin) {
+	RegisterV2(protocol, FromV1(p))
+}
+
+// RegisterV2 registers plugin of protocol
+func RegisterV2(protocol string, p IPluginV2) {
 	pluginMgr.plugins[protocol] = p
 }
 
+// RegisterDriver registers an alternative v1 plugin for protocol
+// it replaces the plugin registered by Register if the
+// "driver" field of protocol configuration is driver
+func RegisterDriver(protocol, driver string, p IPlugin) {
+	RegisterDriverV2(protocol, driver, FromV1(p))
+}
+
+// RegisterDriverV2 registers an alternative plugin for protocol
+func RegisterDriverV2(protocol, driver string, p IPluginV2) {
+	drivers, ok := pluginMgr.drivers[protocol]
+	if !ok {
+		drivers = make(map[string]IPluginV2)
+		pluginMgr.drivers[protocol] = drivers
+	}
+	drivers[driver] = p
+}
+
+// Registered returns whether protocol has a plugin
+// registered by Register
+func Registered(protocol string) bool {
+	_, ok := pluginMgr.plugins[protocol]
+	return ok
+}
+
+// driverConfig is the common field of plugin configuration
+type driverConfig struct {
+	Driver string `json:"driver"`
+}
+
 func Setup(plugins map[string]string) error {
 	for protocol, cfg := range plugins {
-		logs.Info("setup for %s with configuration:\n%s", protocol, cfg)
-		plug, ok := pluginMgr.plugins[protocol]
-		if !ok {
-			logs.Error("protocol %s not register", protocol)
-			return fmt.Errorf("protocol %s not register", protocol)
+		pluginMgr.setupMu.Lock()
+		err := pluginMgr.setup(protocol, cfg)
+		pluginMgr.setupMu.Unlock()
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Reload setups plugins whose configuration changed again,
+// running proxies keep running. Drivers can not be changed by reload.
+func Reload(plugins map[string]string) error {
+	pluginMgr.setupMu.Lock()
+	defer pluginMgr.setupMu.Unlock()
+
+	for protocol, cfg := range plugins {
+		old, ok := pluginMgr.configs[protocol]
+		if ok && old == cfg {
+			continue
+		}
+
+		if ok {
+			var oldDriver, newDriver driverConfig
+			json.Unmarshal([]byte(old), &oldDriver)
+			json.Unmarshal([]byte(cfg), &newDriver)
+			if oldDriver.Driver != newDriver.Driver {
+				return fmt.Errorf("driver of protocol %s can not be changed by reload", protocol)
+			}
 		}
 
-		err := plug.Setup([]byte(cfg))
+		err := pluginMgr.setup(protocol, cfg)
 		if err != nil {
-			logs.Error("setup protocol %s fail: %v", protocol, err)
 			return err
 		}
 	}
@@ -110,37 +216,294 @@ func Setup(plugins map[string]string) error {
 	return nil
 }
 
+// setup setups plugin of protocol, the caller holds p.setupMu
+// proxies are not added or deleted while plugins are setup
+func (p *PluginManager) setup(protocol, cfg string) error {
+	logs.Info("setup for %s with configuration:\n%s", protocol, cfg)
+	plug, err := p.lookup(protocol, cfg)
+	if err != nil {
+		logs.Error("%v", err)
+		return err
+	}
+
+	raw, err := configOf(protocol, plug, cfg)
+	if err != nil {
+		logs.Error("invalid configuration of protocol %s: %v", protocol, err)
+		return err
+	}
+
+	err = plug.Setup(context.Background(), raw)
+	if err != nil {
+		logs.Error("setup protocol %s fail: %v", protocol, err)
+		return err
+	}
+
+	p.mu.Lock()
+	p.plugins[protocol] = plug
+	p.configs[protocol] = cfg
+	p.mu.Unlock()
+	return nil
+}
+
+// lookup returns plugin of protocol selected by the "driver" field of cfg
+func (p *PluginManager) lookup(protocol, cfg string) (IPluginV2, error) {
+	var dc driverConfig
+	json.Unmarshal([]byte(cfg), &dc)
+	if len(dc.Driver) > 0 {
+		plug, ok := p.drivers[protocol][dc.Driver]
+		if !ok {
+			return nil, fmt.Errorf("driver %s of protocol %s not register", dc.Driver, protocol)
+		}
+		return plug, nil
+	}
+
+	plug, ok := p.plugins[protocol]
+	if !ok {
+		return nil, fmt.Errorf("protocol %s not register", protocol)
+	}
+	return plug, nil
+}
+
+// configOf validates cfg by the schema of plug and fills the defaults
+// cfg is returned as it is if plug does not declare a schema
+func configOf(protocol string, plug IPluginV2, cfg string) (json.RawMessage, error) {
+	c, ok := plug.(Configurable)
+	if !ok {
+		return json.RawMessage(cfg), nil
+	}
+
+	schema := c.Schema()
+	if schema == nil {
+		return json.RawMessage(cfg), nil
+	}
+
+	// driver is the common field of plugin configuration
+	fields := append([]*Field{{Name: "driver", Schema: &Schema{Type: "string"}}}, schema.Fields...)
+	schema = &Schema{Type: schema.Type, Fields: fields}
+	return schema.Apply("plugin."+protocol, json.RawMessage(cfg))
+}
+
+// Check validates plugin configurations by schemas of plugins,
+// plugins are not setup and no ports are listened.
+// All invalid values are returned as *ConfigError
+func Check(plugins map[string]string) error {
+	pluginMgr.setupMu.RLock()
+	defer pluginMgr.setupMu.RUnlock()
+
+	protocols := make([]string, 0, len(plugins))
+	for protocol := range plugins {
+		protocols = append(protocols, protocol)
+	}
+	sort.Strings(protocols)
+
+	e := &ConfigError{}
+	for _, protocol := range protocols {
+		plug, err := pluginMgr.lookup(protocol, plugins[protocol])
+		if err != nil {
+			e.add("plugin."+protocol, "%v", err)
+			continue
+		}
+
+		_, err = configOf(protocol, plug, plugins[protocol])
+		if ce, ok := err.(*ConfigError); ok {
+			e.Errors = append(e.Errors, ce.Errors...)
+		} else if err != nil {
+			e.add("plugin."+protocol, "%v", err)
+		}
+	}
+
+	if len(e.Errors) > 0 {
+		return e
+	}
+	return nil
+}
+
 func (p *PluginManager) AddProxy(item *PluginMeta) (*ProxyTuple, error) {
+	p.setupMu.RLock()
+	defer p.setupMu.RUnlock()
+
 	p.mu.Lock()
-	defer p.mu.Unlock()
+	err := p.validate(item, nil)
+	if err == nil {
+		p.reserve(item)
+	}
+	p.mu.Unlock()
+
+	if err != nil {
+		return nil, err
+	}
+	return p.addProxy(item)
+}
+
+// reserve reserves the route of a valid item before it runs,
+// so it can not be added by others, the caller holds p.mu
+func (p *PluginManager) reserve(item *PluginMeta) {
+	p.routes[item.identify()] = &route{meta: item}
+}
+
+// release releases the reservation of item, the caller holds p.mu
+func (p *PluginManager) release(item *PluginMeta) {
 	key := item.identify()
-	if _, ok := p.routes[key]; ok {
-		return nil, fmt.Errorf("port %s is in used", key)
+	if r, ok := p.routes[key]; ok && r.proxy == nil {
+		delete(p.routes, key)
 	}
+}
 
+// addProxy runs proxy of the reserved item, the reservation is released
+// if it fails, the caller holds p.setupMu for reading
+func (p *PluginManager) addProxy(item *PluginMeta) (*ProxyTuple, error) {
+	p.mu.Lock()
 	plug, ok := p.plugins[item.Protocol]
+	p.mu.Unlock()
 	if !ok {
+		p.mu.Lock()
+		p.release(item)
+		p.mu.Unlock()
 		return nil, fmt.Errorf("proxy %s not register", item.Protocol)
 	}
 
-	tuple, err := plug.RunProxy(item)
+	ctx, cancel := context.WithCancel(context.Background())
+	proxy, err := plug.RunProxy(ctx, item)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
 	if err != nil {
+		cancel()
+		p.release(item)
 		logs.Error("run proxy fail: %v", err)
 		return nil, err
 	}
-	p.routes[key] = item
-	return tuple, nil
+
+	p.routes[item.identify()] = &route{
+		meta:   item,
+		proxy:  proxy,
+		cancel: cancel,
+	}
+	return proxy.Tuple(), nil
 }
 
 func (p *PluginManager) DelProxy(item *PluginMeta) {
+	p.setupMu.RLock()
+	defer p.setupMu.RUnlock()
+	p.delProxy(item)
+}
+
+// delProxy closes proxy of item, the caller holds p.setupMu for reading.
+// The route is kept reserved until the proxy is closed, so the same
+// proxy added again does not run before the old one is closed
+func (p *PluginManager) delProxy(item *PluginMeta) {
+	key := item.identify()
+
+	p.mu.Lock()
+	r, ok := p.routes[key]
+	if !ok || r.proxy == nil {
+		p.mu.Unlock()
+		return
+	}
+	p.routes[key] = &route{meta: r.meta}
+	p.mu.Unlock()
+
+	r.cancel()
+	err := r.proxy.Close()
+	if err != nil {
+		logs.Error("close proxy %s fail: %v", key, err)
+	}
+
+	p.mu.Lock()
+	p.release(item)
+	p.mu.Unlock()
+}
+
+// Plugin returns the plugin protocol is setup with, nil if not setup
+func (p *PluginManager) Plugin(protocol string) IPluginV2 {
 	p.mu.Lock()
 	defer p.mu.Unlock()
-	key := item.identify()
+	if _, ok := p.configs[protocol]; !ok {
+		return nil
+	}
+	return p.plugins[protocol]
+}
 
-	plug, ok := p.plugins[item.Protocol]
-	if ok {
-		plug.StopProxy(item)
+// Reserved returns proxies of protocol which are starting,
+// eg: their RunProxy is in progress
+func (p *PluginManager) Reserved(protocol string) []*PluginMeta {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	routes := make([]*PluginMeta, 0)
+	for _, r := range p.routes {
+		if r.proxy == nil && r.meta.Protocol == protocol {
+			routes = append(routes, r.meta)
+		}
+	}
+	return routes
+}
+
+// Routes returns running proxies of protocol
+func (p *PluginManager) Routes(protocol string) []*PluginMeta {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	routes := make([]*PluginMeta, 0)
+	for _, r := range p.routes {
+		if r.proxy != nil && r.meta.Protocol == protocol {
+			routes = append(routes, r.meta)
+		}
+	}
+	return routes
+}
+
+// ProxyStatus is the status of a running proxy
+type ProxyStatus struct {
+	Protocol string `json:"protocol"`
+	From     string `json:"from"`
+	To       string `json:"to"`
+	Domain   string `json:"domain"`
+	FromPort string `json:"fromPort"`
+	ToPort   string `json:"toPort"`
+	Stats    Stats  `json:"stats"`
+
+	// Health is the health error, empty means healthy
+	Health string `json:"health"`
+}
+
+// Proxies returns status of running proxies ordered by protocol and to
+func (p *PluginManager) Proxies() []*ProxyStatus {
+	p.mu.Lock()
+	routes := make([]*route, 0, len(p.routes))
+	for _, r := range p.routes {
+		if r.proxy != nil {
+			routes = append(routes, r)
+		}
 	}
+	p.mu.Unlock()
 
-	delete(p.routes, key)
+	list := make([]*ProxyStatus, 0, len(routes))
+	for _, r := range routes {
+		s := &ProxyStatus{
+			Protocol: r.meta.Protocol,
+			From:     r.meta.From,
+			To:       r.meta.To,
+			Domain:   r.meta.Domain,
+			Stats:    r.proxy.Stats(),
+		}
+
+		if tuple := r.proxy.Tuple(); tuple != nil {
+			s.FromPort = tuple.FromPort
+			s.ToPort = tuple.ToPort
+		}
+
+		if err := r.proxy.Health(); err != nil {
+			s.Health = err.Error()
+		}
+		list = append(list, s)
+	}
+
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Protocol != list[j].Protocol {
+			return list[i].Protocol < list[j].Protocol
+		}
+		return list[i].To < list[j].To
+	})
+	return list
 }
@@ -0,0 +1,147 @@
+// Package plugintest provides helpers for plugin tests
+package plugintest
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/ICKelin/opennotr/internal/proto"
+	"github.com/ICKelin/opennotr/opennotrd/plugin"
+	"github.com/xtaci/smux"
+)
+
+// Tunnel is a opennotr server and client connected by smux.
+// The server side opens streams as core.SessionManager does,
+// the client side forwards streams to local ports as opennotr client does.
+// Tunnel implements plugin.Dialer, it returns plugin.ErrTunnelOffline
+// once closed.
+type Tunnel struct {
+	sess *smux.Session
+}
+
+func NewTunnel(t *testing.T) *Tunnel {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lis.Close()
+
+	go func() {
+		conn, err := net.Dial("tcp", lis.Addr().String())
+		if err != nil {
+			return
+		}
+
+		cli, err := smux.Client(conn, nil)
+		if err != nil {
+			return
+		}
+
+		for {
+			stream, err := cli.AcceptStream()
+			if err != nil {
+				return
+			}
+			go forwardLocal(stream)
+		}
+	}()
+
+	conn, err := lis.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sess, err := smux.Server(conn, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &Tunnel{sess: sess}
+}
+
+// Close closes the tunnel, streams opened before are closed too
+func (t *Tunnel) Close() error {
+	return t.sess.Close()
+}
+
+func (t *Tunnel) Dial(src net.Addr, to string) (net.Conn, error) {
+	_, dport, err := net.SplitHostPort(to)
+	if err != nil {
+		return nil, err
+	}
+
+	if t.sess.IsClosed() {
+		return nil, fmt.Errorf("%w: tunnel closed", plugin.ErrTunnelOffline)
+	}
+
+	stream, err := t.sess.OpenStream()
+	if err != nil {
+		return nil, err
+	}
+
+	body, _ := json.Marshal(&proto.ProxyProtocol{
+		Protocol: "tcp",
+		DstIP:    "127.0.0.1",
+		DstPort:  dport,
+	})
+	hdr := make([]byte, 2)
+	binary.BigEndian.PutUint16(hdr, uint16(len(body)))
+	_, err = stream.Write(append(hdr, body...))
+	return stream, err
+}
+
+func forwardLocal(stream *smux.Stream) {
+	defer stream.Close()
+	hdr := make([]byte, 2)
+	if _, err := io.ReadFull(stream, hdr); err != nil {
+		return
+	}
+
+	body := make([]byte, binary.BigEndian.Uint16(hdr))
+	if _, err := io.ReadFull(stream, body); err != nil {
+		return
+	}
+
+	var p proto.ProxyProtocol
+	if err := json.Unmarshal(body, &p); err != nil {
+		return
+	}
+
+	conn, err := net.Dial("tcp", net.JoinHostPort(p.DstIP, p.DstPort))
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	go func() {
+		defer conn.Close()
+		defer stream.Close()
+		io.Copy(conn, stream)
+	}()
+	io.Copy(stream, conn)
+}
+
+// FreeAddr returns a free local tcp address
+func FreeAddr(t *testing.T) string {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lis.Close()
+	return lis.Addr().String()
+}
+
+// Port returns the port of addr, addr may be an url
+func Port(t *testing.T, addr string) string {
+	addr = strings.TrimPrefix(addr, "http://")
+	addr = strings.TrimPrefix(addr, "https://")
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return port
+}
@@ -2,23 +2,38 @@ package restyproxy
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"net"
 	"net/http"
+	"net/url"
+	"sync"
 	"time"
 
 	"github.com/ICKelin/opennotr/internal/logs"
 	"github.com/ICKelin/opennotr/opennotrd/plugin"
 )
 
-var restyAdminUrl string
+var (
+	// default retries of admin api requests
+	defaultRetries = 3
+
+	// default reconcile interval(seconds)
+	defaultReconcile = 30
+
+	// default timeout of an admin api operation including retries(seconds)
+	defaultTimeout = 10
+
+	// retry backoff base, doubled each retry
+	retryBackoff = time.Millisecond * 200
+)
 
 func init() {
-	plugin.Register("http", &RestyProxy{})
-	plugin.Register("https", &RestyProxy{})
-	plugin.Register("h2c", &RestyProxy{})
+	plugin.RegisterV2("http", &RestyProxy{scheme: "http"})
+	plugin.RegisterV2("https", &RestyProxy{scheme: "https"})
+	plugin.RegisterV2("h2c", &RestyProxy{scheme: "h2c"})
 }
 
 type AddUpstreamBody struct {
@@ -29,101 +44,296 @@ type AddUpstreamBody struct {
 }
 
 type RestyConfig struct {
-	RestyAdminUrl string `json:"adminUrl"`
+	RestyAdminUrl string `json:"adminUrl" required:"true"`
+
+	// Retries specific retries after the first attempt of admin api
+	// requests, default 3, 0 disables retries
+	Retries int `json:"retries" min:"0"`
+
+	// Reconcile specific interval in seconds to compare upstreams of
+	// openresty with running proxies and repair the difference.
+	// default 30 seconds, negative disables reconciliation
+	Reconcile int `json:"reconcile"`
+
+	// Timeout specific seconds an admin api operation takes at most,
+	// retries included, default 10
+	Timeout int `json:"timeout" min:"0"`
 }
 
 type RestyProxy struct {
-	cfg RestyConfig
+	scheme string
+	cfg    RestyConfig
+	cli    *http.Client
+
+	// stop stops the reconcile loop of previous Setup
+	mu   sync.Mutex
+	stop chan struct{}
 }
 
-func (p *RestyProxy) Setup(config json.RawMessage) error {
-	var cfg = RestyConfig{}
+func (p *RestyProxy) Schema() *plugin.Schema {
+	return plugin.SchemaOf(RestyConfig{Retries: defaultRetries, Reconcile: defaultReconcile, Timeout: defaultTimeout})
+}
+
+func (p *RestyProxy) Setup(ctx context.Context, config json.RawMessage) error {
+	// retries is defaulted only if absent, 0 is valid
+	var cfg = RestyConfig{Retries: defaultRetries}
 	err := json.Unmarshal([]byte(config), &cfg)
 	if err != nil {
 		return err
 	}
+
+	if cfg.Reconcile == 0 {
+		cfg.Reconcile = defaultReconcile
+	}
+
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = defaultTimeout
+	}
+
 	p.cfg = cfg
+	p.cli = &http.Client{
+		Timeout: time.Second * 5,
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.stop != nil {
+		close(p.stop)
+		p.stop = nil
+	}
+
+	if cfg.Reconcile > 0 {
+		p.stop = make(chan struct{})
+		go p.runReconcile(time.Duration(cfg.Reconcile)*time.Second, p.stop)
+	}
 	return nil
 }
 
-func (p *RestyProxy) StopProxy(item *plugin.PluginMeta) {
-	p.sendDeleteReq(item.Domain, item.Protocol)
+// ForwardSchema declares forwards accept no options
+func (p *RestyProxy) ForwardSchema() *plugin.Schema {
+	return plugin.SchemaOf(struct{}{})
 }
 
-func (p *RestyProxy) RunProxy(item *plugin.PluginMeta) (*plugin.ProxyTuple, error) {
-	vip, port, err := net.SplitHostPort(item.To)
+// RunProxy registers upstream to openresty
+// the error is returned after retries, timeout or ctx is done
+// the upstream is deleted when the proxy is closed
+func (p *RestyProxy) RunProxy(ctx context.Context, item *plugin.PluginMeta) (plugin.Proxy, error) {
+	body, err := upstreamOf(item)
 	if err != nil {
 		return nil, err
 	}
 
-	req := &AddUpstreamBody{
-		Scheme: item.Protocol,
-		Host:   item.Domain,
-		IP:     vip,
-		Port:   port,
+	err = p.setUpstream(ctx, body)
+	if err != nil {
+		return nil, fmt.Errorf("set upstream %s://%s fail: %v", body.Scheme, body.Host, err)
 	}
 
-	go p.sendPostReq(req)
-
-	_, toPort, _ := net.SplitHostPort(item.To)
-	return &plugin.ProxyTuple{
+	return plugin.NewProxy(&plugin.ProxyTuple{
 		Protocol: item.Protocol,
-		ToPort:   toPort,
-	}, nil
+		ToPort:   body.Port,
+	}, func() error {
+		err := p.deleteUpstream(context.Background(), item.Domain, item.Protocol)
+		if err != nil {
+			return fmt.Errorf("delete upstream %s://%s fail: %v", item.Protocol, item.Domain, err)
+		}
+		return nil
+	}), nil
 }
 
-func (p *RestyProxy) sendPostReq(body interface{}) {
-	cli := http.Client{
-		Timeout: time.Second * 10,
+func (p *RestyProxy) runReconcile(interval time.Duration, stop chan struct{}) {
+	tick := time.NewTicker(interval)
+	defer tick.Stop()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		<-stop
+		cancel()
+	}()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-tick.C:
+			p.reconcile(ctx)
+		}
 	}
+}
 
-	buf, _ := json.Marshal(body)
-	br := bytes.NewBuffer(buf)
+// reconcile compares upstreams of openresty with running proxies
+// missing or stale upstreams are set, unknown upstreams are deleted.
+// If openresty can't list upstreams, all running proxies are set again.
+func (p *RestyProxy) reconcile(ctx context.Context) {
+	current, listErr := p.listUpstreams(ctx)
+	if listErr != nil {
+		logs.Warn("list upstreams fail: %v, set all upstreams", listErr)
+	}
 
-	req, err := http.NewRequest("POST", p.cfg.RestyAdminUrl, br)
-	if err != nil {
-		logs.Error("request %v fail: %v", body, err)
-		return
+	// routes are taken after listing, upstreams deleted between
+	// will not be set again. Reserved routes are taken before running
+	// routes, so a proxy starts in between is in one of them, its
+	// upstream may be set by RunProxy and is kept
+	mgr := plugin.DefaultPluginManager()
+	pending := make(map[string]bool)
+	for _, item := range mgr.Reserved(p.scheme) {
+		pending[item.Domain] = true
 	}
 
-	resp, err := cli.Do(req)
-	if err != nil {
-		logs.Error("request %v fail: %v", body, err)
-		return
+	expected := make(map[string]*AddUpstreamBody)
+	for _, item := range mgr.Routes(p.scheme) {
+		body, err := upstreamOf(item)
+		if err != nil {
+			continue
+		}
+		expected[body.Host] = body
 	}
-	defer resp.Body.Close()
 
-	cnt, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		logs.Error("request %v fail: %v", body, err)
+	for host, body := range expected {
+		if listErr == nil {
+			if c, ok := current[host]; ok && c.IP == body.IP && c.Port == body.Port {
+				continue
+			}
+			logs.Warn("upstream %s://%s drift, set %s:%s", p.scheme, host, body.IP, body.Port)
+		}
+
+		err := p.setUpstream(ctx, body)
+		if err != nil {
+			logs.Error("reconcile upstream %s://%s fail: %v", p.scheme, host, err)
+		}
+	}
+
+	if listErr != nil {
 		return
 	}
-	logs.Info("set upstream %v reply: %s", body, string(cnt))
+
+	for host := range current {
+		if _, ok := expected[host]; ok || pending[host] {
+			continue
+		}
+
+		logs.Warn("upstream %s://%s is not running, delete it", p.scheme, host)
+		err := p.deleteUpstream(ctx, host, p.scheme)
+		if err != nil {
+			logs.Error("reconcile upstream %s://%s fail: %v", p.scheme, host, err)
+		}
+	}
 }
 
-func (p *RestyProxy) sendDeleteReq(host, scheme string) {
-	cli := http.Client{
-		Timeout: time.Second * 10,
+// listUpstreams returns upstreams of the scheme
+// key: host
+func (p *RestyProxy) listUpstreams(ctx context.Context) (map[string]*AddUpstreamBody, error) {
+	cnt, err := p.do(ctx, "GET", p.cfg.RestyAdminUrl, nil)
+	if err != nil {
+		return nil, err
 	}
-	url := fmt.Sprintf("%s?host=%s&scheme=%s", p.cfg.RestyAdminUrl, host, scheme)
-	req, err := http.NewRequest("DELETE", url, nil)
+
+	var list []*AddUpstreamBody
+	err = json.Unmarshal(cnt, &list)
 	if err != nil {
-		logs.Error("delete host %s fail: %v", host, err)
-		return
+		return nil, err
 	}
 
-	resp, err := cli.Do(req)
+	upstreams := make(map[string]*AddUpstreamBody)
+	for _, u := range list {
+		if u.Scheme == p.scheme {
+			upstreams[u.Host] = u
+		}
+	}
+	return upstreams, nil
+}
+
+func (p *RestyProxy) setUpstream(ctx context.Context, body *AddUpstreamBody) error {
+	buf, _ := json.Marshal(body)
+	cnt, err := p.do(ctx, "POST", p.cfg.RestyAdminUrl, buf)
 	if err != nil {
-		logs.Error("delete host %s fail: %v", host, err)
-		return
+		return err
 	}
-	defer resp.Body.Close()
 
-	cnt, err := ioutil.ReadAll(resp.Body)
+	logs.Info("set upstream %v reply: %s", body, string(cnt))
+	return nil
+}
+
+func (p *RestyProxy) deleteUpstream(ctx context.Context, host, scheme string) error {
+	query := url.Values{}
+	query.Set("host", host)
+	query.Set("scheme", scheme)
+	cnt, err := p.do(ctx, "DELETE", p.cfg.RestyAdminUrl+"?"+query.Encode(), nil)
 	if err != nil {
-		logs.Error("delete host %s fail: %v", host, err)
-		return
+		return err
 	}
 
 	logs.Info("delete upstream reply: %s", string(cnt))
+	return nil
+}
+
+// do sends admin api request with retries
+// non 2xx reply is treated as failure, retries stop once
+// ctx is done or the timeout of the operation is exceeded
+func (p *RestyProxy) do(ctx context.Context, method, u string, body []byte) ([]byte, error) {
+	if p.cfg.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(p.cfg.Timeout)*time.Second)
+		defer cancel()
+	}
+
+	var lastErr error
+	backoff := retryBackoff
+	for i := 0; i <= p.cfg.Retries; i++ {
+		if i > 0 {
+			select {
+			case <-time.After(backoff):
+			case <-ctx.Done():
+				return nil, fmt.Errorf("%v, last error: %v", ctx.Err(), lastErr)
+			}
+			backoff *= 2
+		}
+
+		req, err := http.NewRequest(method, u, bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+
+		resp, err := p.cli.Do(req.WithContext(ctx))
+		if err != nil {
+			lastErr = err
+			if ctx.Err() != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		cnt, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			lastErr = err
+			continue
+		}
+
+		if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+			lastErr = fmt.Errorf("%s %s reply %s: %s", method, u, resp.Status, cnt)
+
+			// client errors are not retried
+			if resp.StatusCode >= 400 && resp.StatusCode < 500 {
+				return nil, lastErr
+			}
+			continue
+		}
+		return cnt, nil
+	}
+	return nil, lastErr
+}
+
+func upstreamOf(item *plugin.PluginMeta) (*AddUpstreamBody, error) {
+	vip, port, err := net.SplitHostPort(item.To)
+	if err != nil {
+		return nil, err
+	}
+
+	return &AddUpstreamBody{
+		Scheme: item.Protocol,
+		Host:   item.Domain,
+		IP:     vip,
+		Port:   port,
+	}, nil
 }
@@ -0,0 +1,297 @@
+package restyproxy
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ICKelin/opennotr/opennotrd/plugin"
+)
+
+// adminStub is an in memory resty-upstream admin api
+type adminStub struct {
+	mu        sync.Mutex
+	upstreams map[string]*AddUpstreamBody
+
+	// failures replies 502 for the next n requests
+	failures int
+
+	// noList replies 404 for listing, eg: old resty-upstream
+	noList bool
+}
+
+func newAdminStub() (*adminStub, *httptest.Server) {
+	s := &adminStub{upstreams: make(map[string]*AddUpstreamBody)}
+	return s, httptest.NewServer(s)
+}
+
+func (s *adminStub) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.failures > 0 {
+		s.failures--
+		w.WriteHeader(http.StatusBadGateway)
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		if s.noList {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		list := make([]*AddUpstreamBody, 0)
+		for _, u := range s.upstreams {
+			list = append(list, u)
+		}
+		json.NewEncoder(w).Encode(list)
+
+	case "POST":
+		body := &AddUpstreamBody{}
+		if err := json.NewDecoder(r.Body).Decode(body); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		s.upstreams[body.Scheme+"://"+body.Host] = body
+		fmt.Fprint(w, "ok")
+
+	case "DELETE":
+		q := r.URL.Query()
+		delete(s.upstreams, q.Get("scheme")+"://"+q.Get("host"))
+		fmt.Fprint(w, "ok")
+	}
+}
+
+func (s *adminStub) get(key string) *AddUpstreamBody {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.upstreams[key]
+}
+
+func (s *adminStub) set(f func()) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	f()
+}
+
+func TestRestyProxy(t *testing.T) {
+	stub, srv := newAdminStub()
+	defer srv.Close()
+
+	retryBackoff = 0
+	err := plugin.Setup(map[string]string{
+		"http": fmt.Sprintf(`{"adminUrl": "%s", "retries": 2, "reconcile": -1}`, srv.URL),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mgr := plugin.DefaultPluginManager()
+	item := &plugin.PluginMeta{
+		Protocol: "http",
+		From:     "0.0.0.0:0",
+		To:       "100.64.240.10:8080",
+		Domain:   "a.open.notr.tech",
+	}
+
+	// registered after one retry
+	stub.set(func() { stub.failures = 1 })
+	_, err = mgr.AddProxy(item)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mgr.DelProxy(item)
+
+	if u := stub.get("http://a.open.notr.tech"); u == nil || u.Port != "8080" {
+		t.Fatalf("expected upstream registered, got %v", u)
+	}
+
+	// failure is propagated to AddProxy
+	failed := &plugin.PluginMeta{
+		Protocol: "http",
+		From:     "0.0.0.0:0",
+		To:       "100.64.240.11:8080",
+		Domain:   "b.open.notr.tech",
+	}
+	stub.set(func() { stub.failures = 3 })
+	_, err = mgr.AddProxy(failed)
+	if err == nil {
+		t.Fatal("expected set upstream error")
+	}
+
+	if len(mgr.Routes("http")) != 1 {
+		t.Fatal("expected failed proxy not added")
+	}
+
+	p := &RestyProxy{scheme: "http", cfg: RestyConfig{RestyAdminUrl: srv.URL, Retries: 1}, cli: http.DefaultClient}
+
+	// openresty restarted and stale upstream left
+	stub.set(func() {
+		stub.upstreams = map[string]*AddUpstreamBody{
+			"http://stale.open.notr.tech": {Scheme: "http", Host: "stale.open.notr.tech", IP: "100.64.240.12", Port: "80"},
+			"https://a.open.notr.tech":    {Scheme: "https", Host: "a.open.notr.tech", IP: "100.64.240.10", Port: "443"},
+		}
+	})
+	p.reconcile(context.Background())
+
+	if u := stub.get("http://a.open.notr.tech"); u == nil || u.IP != "100.64.240.10" {
+		t.Fatalf("expected missing upstream repaired, got %v", u)
+	}
+
+	if stub.get("http://stale.open.notr.tech") != nil {
+		t.Fatal("expected stale upstream deleted")
+	}
+
+	if stub.get("https://a.open.notr.tech") == nil {
+		t.Fatal("expected upstream of other scheme kept")
+	}
+
+	// drift is repaired
+	stub.set(func() { stub.upstreams["http://a.open.notr.tech"].Port = "9090" })
+	p.reconcile(context.Background())
+	if u := stub.get("http://a.open.notr.tech"); u.Port != "8080" {
+		t.Fatalf("expected drift repaired, got %v", u)
+	}
+
+	// all upstreams are set if listing is not supported
+	stub.set(func() {
+		stub.noList = true
+		stub.upstreams = make(map[string]*AddUpstreamBody)
+	})
+	p.reconcile(context.Background())
+	if stub.get("http://a.open.notr.tech") == nil {
+		t.Fatal("expected upstream set without listing")
+	}
+
+	mgr.DelProxy(item)
+	if stub.get("http://a.open.notr.tech") != nil {
+		t.Fatal("expected upstream deleted")
+	}
+}
+
+func TestRestyProxyTimeout(t *testing.T) {
+	stub, srv := newAdminStub()
+	defer srv.Close()
+
+	backoff := retryBackoff
+	retryBackoff = time.Millisecond * 200
+	defer func() { retryBackoff = backoff }()
+
+	// 10 retries backoff about 100 seconds
+	stub.set(func() { stub.failures = 100 })
+	p := &RestyProxy{scheme: "http", cfg: RestyConfig{RestyAdminUrl: srv.URL, Retries: 10, Timeout: 1}, cli: http.DefaultClient}
+	body := &AddUpstreamBody{Scheme: "http", Host: "a.open.notr.tech", IP: "100.64.240.10", Port: "8080"}
+
+	begin := time.Now()
+	if err := p.setUpstream(context.Background(), body); err == nil {
+		t.Fatal("expected timeout error")
+	}
+
+	if elapsed := time.Since(begin); elapsed > time.Second*2 {
+		t.Fatalf("expected retries bounded by timeout, took %v", elapsed)
+	}
+
+	// canceled ctx stops retries
+	p.cfg.Timeout = 0
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*300)
+	defer cancel()
+
+	begin = time.Now()
+	if err := p.setUpstream(ctx, body); err == nil {
+		t.Fatal("expected canceled error")
+	}
+
+	if elapsed := time.Since(begin); elapsed > time.Second {
+		t.Fatalf("expected retries stopped by ctx, took %v", elapsed)
+	}
+}
+
+func TestRestyProxyRetries(t *testing.T) {
+	stub, srv := newAdminStub()
+	defer srv.Close()
+
+	retryBackoff = 0
+	body := &AddUpstreamBody{Scheme: "http", Host: "a.open.notr.tech", IP: "100.64.240.10", Port: "8080"}
+	tests := []struct {
+		cfg      string
+		failures int
+		ok       bool
+	}{
+		{`{"adminUrl": "%s", "reconcile": -1}`, 3, true},
+		{`{"adminUrl": "%s", "reconcile": -1}`, 4, false},
+		{`{"adminUrl": "%s", "retries": 0, "reconcile": -1}`, 1, false},
+		{`{"adminUrl": "%s", "retries": 1, "reconcile": -1}`, 1, true},
+	}
+
+	for _, test := range tests {
+		p := &RestyProxy{scheme: "http"}
+		err := p.Setup(context.Background(), json.RawMessage(fmt.Sprintf(test.cfg, srv.URL)))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		stub.set(func() { stub.failures = test.failures })
+		err = p.setUpstream(context.Background(), body)
+		if test.ok != (err == nil) {
+			t.Errorf("%s with %d failures: expected ok %v, got %v", test.cfg, test.failures, test.ok, err)
+		}
+		stub.set(func() { stub.failures = 0 })
+	}
+}
+
+func TestRestyProxyReconcilePending(t *testing.T) {
+	stub, _ := newAdminStub()
+
+	// the upstream is set but RunProxy is not finished
+	posted, release := make(chan struct{}), make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		stub.ServeHTTP(w, r)
+		if r.Method == "POST" {
+			close(posted)
+			<-release
+		}
+	}))
+	defer srv.Close()
+
+	err := plugin.Setup(map[string]string{
+		"http": fmt.Sprintf(`{"adminUrl": "%s", "reconcile": -1}`, srv.URL),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mgr := plugin.DefaultPluginManager()
+	item := &plugin.PluginMeta{
+		Protocol: "http",
+		From:     "0.0.0.0:0",
+		To:       "100.64.240.13:8080",
+		Domain:   "pending.open.notr.tech",
+	}
+
+	done := make(chan error)
+	go func() {
+		_, err := mgr.AddProxy(item)
+		done <- err
+	}()
+	<-posted
+
+	p := &RestyProxy{scheme: "http", cfg: RestyConfig{RestyAdminUrl: srv.URL}, cli: http.DefaultClient}
+	p.reconcile(context.Background())
+	close(release)
+
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	defer mgr.DelProxy(item)
+
+	if stub.get("http://pending.open.notr.tech") == nil {
+		t.Fatal("expected upstream of starting proxy kept")
+	}
+}
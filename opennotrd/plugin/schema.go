@@ -0,0 +1,323 @@
+package plugin
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Configurable is implemented by plugins which declare the schema
+// of their configuration. The configuration is validated and the
+// defaults are filled by the schema before Setup.
+type Configurable interface {
+	Schema() *Schema
+}
+
+// ForwardConfigurable is implemented by plugins which declare the per
+// forward options they accept. Options are passed by the client rawConfig
+// as PluginMeta.Ctx, they are validated and the defaults are filled by
+// the schema before the proxy runs.
+type ForwardConfigurable interface {
+	ForwardSchema() *Schema
+}
+
+// Schema describes a configuration value
+type Schema struct {
+	// Type is one of object, array, map, string, int, number, bool and any
+	Type string `json:"type"`
+
+	// Fields specific fields of object
+	Fields []*Field `json:"fields,omitempty"`
+
+	// Elem specific the schema of array and map elements
+	Elem *Schema `json:"elem,omitempty"`
+
+	// Min and Max specific the range of int and number
+	Min *float64 `json:"min,omitempty"`
+	Max *float64 `json:"max,omitempty"`
+
+	// Enum specific allowed values of string
+	Enum []string `json:"enum,omitempty"`
+}
+
+// Field describes a field of object
+type Field struct {
+	Name     string      `json:"name"`
+	Schema   *Schema     `json:"schema"`
+	Required bool        `json:"required,omitempty"`
+	Default  interface{} `json:"default,omitempty"`
+
+	// fill fills defaults of a missing struct field,
+	// a missing pointer field is kept missing
+	fill bool
+}
+
+// ConfigError lists invalid values of configuration
+// each error is prefixed with the path of the value,
+// eg: plugin.http.errorPages.retryAfter: expect int, got "30s"
+type ConfigError struct {
+	Errors []string
+}
+
+func (e *ConfigError) Error() string {
+	return strings.Join(e.Errors, "; ")
+}
+
+func (e *ConfigError) add(path, format string, args ...interface{}) {
+	e.Errors = append(e.Errors, path+": "+fmt.Sprintf(format, args...))
+}
+
+// SchemaOf returns the schema of a configuration struct.
+// Fields are named by json tags and typed by their go types,
+// non-zero fields of v are the defaults. Constraints are declared
+// by tags and apply to elements of slices and maps, eg:
+// required:"true" requires the field, min:"1" max:"65535"
+// limits int and number, enum:"dns|http" limits string.
+func SchemaOf(v interface{}) *Schema {
+	return schemaOf(reflect.ValueOf(v))
+}
+
+var rawMessageType = reflect.TypeOf(json.RawMessage{})
+
+func schemaOf(v reflect.Value) *Schema {
+	t := v.Type()
+	switch {
+	case t == rawMessageType:
+		return &Schema{Type: "any"}
+	case t.Kind() == reflect.Ptr:
+		if v.IsNil() {
+			return schemaOf(reflect.New(t.Elem()).Elem())
+		}
+		return schemaOf(v.Elem())
+	case t.Kind() == reflect.Struct:
+		s := &Schema{Type: "object"}
+		for i := 0; i < t.NumField(); i++ {
+			if f := fieldOf(t.Field(i), v.Field(i)); f != nil {
+				s.Fields = append(s.Fields, f)
+			}
+		}
+		return s
+	case t.Kind() == reflect.Slice && t.Elem().Kind() == reflect.Uint8:
+		return &Schema{Type: "string"}
+	case t.Kind() == reflect.Slice || t.Kind() == reflect.Array:
+		return &Schema{Type: "array", Elem: schemaOf(reflect.New(t.Elem()).Elem())}
+	case t.Kind() == reflect.Map:
+		return &Schema{Type: "map", Elem: schemaOf(reflect.New(t.Elem()).Elem())}
+	case t.Kind() == reflect.String:
+		return &Schema{Type: "string"}
+	case t.Kind() == reflect.Bool:
+		return &Schema{Type: "bool"}
+	case t.Kind() >= reflect.Int && t.Kind() <= reflect.Uint64:
+		return &Schema{Type: "int"}
+	case t.Kind() == reflect.Float32 || t.Kind() == reflect.Float64:
+		return &Schema{Type: "number"}
+	default:
+		return &Schema{Type: "any"}
+	}
+}
+
+func fieldOf(sf reflect.StructField, v reflect.Value) *Field {
+	name := strings.Split(sf.Tag.Get("json"), ",")[0]
+	if sf.PkgPath != "" || name == "-" {
+		return nil
+	}
+
+	if len(name) <= 0 {
+		name = sf.Name
+	}
+
+	f := &Field{
+		Name:     name,
+		Schema:   schemaOf(v),
+		Required: sf.Tag.Get("required") == "true",
+	}
+
+	if f.Schema.Type == "object" {
+		f.fill = sf.Type.Kind() == reflect.Struct
+	} else if !v.IsZero() {
+		f.Default = v.Interface()
+	}
+
+	// constraints apply to the scalar
+	scalar := f.Schema
+	for scalar.Elem != nil {
+		scalar = scalar.Elem
+	}
+
+	if min, err := strconv.ParseFloat(sf.Tag.Get("min"), 64); err == nil {
+		scalar.Min = &min
+	}
+
+	if max, err := strconv.ParseFloat(sf.Tag.Get("max"), 64); err == nil {
+		scalar.Max = &max
+	}
+
+	if enum := sf.Tag.Get("enum"); len(enum) > 0 {
+		scalar.Enum = strings.Split(enum, "|")
+	}
+	return f
+}
+
+// Apply validates raw configuration and fills the defaults,
+// errors are prefixed with path
+func (s *Schema) Apply(path string, raw json.RawMessage) (json.RawMessage, error) {
+	if len(bytes.TrimSpace(raw)) <= 0 {
+		raw = json.RawMessage(`{}`)
+	}
+
+	var v interface{}
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	dec.UseNumber()
+	err := dec.Decode(&v)
+	if err != nil {
+		return nil, &ConfigError{Errors: []string{path + ": invalid json: " + err.Error()}}
+	}
+
+	e := &ConfigError{}
+	v = s.apply(path, v, e)
+	if len(e.Errors) > 0 {
+		return nil, e
+	}
+	return json.Marshal(v)
+}
+
+func (s *Schema) apply(path string, v interface{}, e *ConfigError) interface{} {
+	switch s.Type {
+	case "object":
+		obj, ok := v.(map[string]interface{})
+		if !ok {
+			e.add(path, "expect object, got %s", describe(v))
+			return v
+		}
+
+		known := make(map[string]bool)
+		for _, f := range s.Fields {
+			known[f.Name] = true
+			fv, ok := obj[f.Name]
+			if !ok || fv == nil {
+				switch {
+				case f.Required:
+					e.add(path+"."+f.Name, "is required")
+				case f.fill:
+					obj[f.Name] = f.Schema.apply(path+"."+f.Name, make(map[string]interface{}), e)
+				case f.Default != nil:
+					obj[f.Name] = f.Default
+				}
+				continue
+			}
+			obj[f.Name] = f.Schema.apply(path+"."+f.Name, fv, e)
+		}
+
+		unknown := make([]string, 0)
+		for name := range obj {
+			if !known[name] {
+				unknown = append(unknown, name)
+			}
+		}
+		sort.Strings(unknown)
+		for _, name := range unknown {
+			e.add(path+"."+name, "unknown field")
+		}
+		return obj
+
+	case "array":
+		list, ok := v.([]interface{})
+		if !ok {
+			e.add(path, "expect array, got %s", describe(v))
+			return v
+		}
+
+		for i := range list {
+			list[i] = s.Elem.apply(fmt.Sprintf("%s[%d]", path, i), list[i], e)
+		}
+		return list
+
+	case "map":
+		obj, ok := v.(map[string]interface{})
+		if !ok {
+			e.add(path, "expect object, got %s", describe(v))
+			return v
+		}
+
+		keys := make([]string, 0, len(obj))
+		for k := range obj {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			obj[k] = s.Elem.apply(path+"."+k, obj[k], e)
+		}
+		return obj
+
+	case "string":
+		str, ok := v.(string)
+		if !ok {
+			e.add(path, "expect string, got %s", describe(v))
+			return v
+		}
+
+		if len(s.Enum) > 0 && !contains(s.Enum, str) {
+			e.add(path, "expect one of %s, got %q", strings.Join(s.Enum, ", "), str)
+		}
+		return v
+
+	case "int", "number":
+		n, ok := v.(json.Number)
+		if !ok {
+			e.add(path, "expect %s, got %s", s.Type, describe(v))
+			return v
+		}
+
+		f, err := n.Float64()
+		if _, ierr := n.Int64(); err != nil || (s.Type == "int" && ierr != nil) {
+			e.add(path, "expect %s, got %s", s.Type, n)
+			return v
+		}
+
+		if s.Min != nil && f < *s.Min {
+			e.add(path, "expect >= %v, got %s", *s.Min, n)
+		}
+
+		if s.Max != nil && f > *s.Max {
+			e.add(path, "expect <= %v, got %s", *s.Max, n)
+		}
+		return v
+
+	case "bool":
+		if _, ok := v.(bool); !ok {
+			e.add(path, "expect bool, got %s", describe(v))
+		}
+		return v
+	}
+	return v
+}
+
+func describe(v interface{}) string {
+	switch v := v.(type) {
+	case nil:
+		return "null"
+	case string:
+		return strconv.Quote(v)
+	case json.Number:
+		return v.String()
+	case bool:
+		return strconv.FormatBool(v)
+	case []interface{}:
+		return "array"
+	default:
+		return "object"
+	}
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,196 @@
+package plugin
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+type testNested struct {
+	Retry int    `json:"retry" min:"1" max:"10"`
+	Mode  string `json:"mode" enum:"fast|slow"`
+}
+
+type testConfig struct {
+	URL     string            `json:"url" required:"true"`
+	Timeout int               `json:"timeout" min:"0"`
+	Ratio   float64           `json:"ratio"`
+	Enable  bool              `json:"enable"`
+	Methods []string          `json:"methods" enum:"dns|http"`
+	Headers map[string]string `json:"headers"`
+	Nested  testNested        `json:"nested"`
+	Opt     *testNested       `json:"opt"`
+	Raw     json.RawMessage   `json:"raw"`
+}
+
+func testSchema() *Schema {
+	return SchemaOf(testConfig{Timeout: 10, Nested: testNested{Retry: 3, Mode: "fast"}})
+}
+
+func TestSchemaApply(t *testing.T) {
+	raw, err := testSchema().Apply("cfg", json.RawMessage(`{"url": "http://127.0.0.1", "methods": ["dns"], "raw": [1]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var cfg testConfig
+	err = json.Unmarshal(raw, &cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expect := testConfig{
+		URL:     "http://127.0.0.1",
+		Timeout: 10,
+		Methods: []string{"dns"},
+		Nested:  testNested{Retry: 3, Mode: "fast"},
+		Raw:     json.RawMessage(`[1]`),
+	}
+	if !reflect.DeepEqual(cfg, expect) {
+		t.Errorf("expect %+v, got %+v", expect, cfg)
+	}
+}
+
+func TestSchemaErrors(t *testing.T) {
+	_, err := testSchema().Apply("cfg", json.RawMessage(`{
+		"timeout": "10s",
+		"ratio": true,
+		"methods": ["dns", "ftp"],
+		"headers": {"a": 1},
+		"nested": {"retry": 11, "mode": "slow"},
+		"opt": {"retry": 1.5},
+		"extra": 1
+	}`))
+
+	ce, ok := err.(*ConfigError)
+	if !ok {
+		t.Fatalf("expect config error, got %v", err)
+	}
+
+	expect := []string{
+		`cfg.url: is required`,
+		`cfg.timeout: expect int, got "10s"`,
+		`cfg.ratio: expect number, got true`,
+		`cfg.methods[1]: expect one of dns, http, got "ftp"`,
+		`cfg.headers.a: expect string, got 1`,
+		`cfg.nested.retry: expect <= 10, got 11`,
+		`cfg.opt.retry: expect int, got 1.5`,
+		`cfg.extra: unknown field`,
+	}
+	if !reflect.DeepEqual(ce.Errors, expect) {
+		t.Errorf("expect\n%s\ngot\n%s", strings.Join(expect, "\n"), strings.Join(ce.Errors, "\n"))
+	}
+
+	_, err = testSchema().Apply("cfg", json.RawMessage(`{"url": }`))
+	if err == nil || !strings.Contains(err.Error(), "cfg: invalid json") {
+		t.Errorf("expect invalid json error, got %v", err)
+	}
+}
+
+type schemaPlugin struct {
+	cfg json.RawMessage
+}
+
+func (p *schemaPlugin) Schema() *Schema {
+	return SchemaOf(testConfig{Timeout: 10})
+}
+
+func (p *schemaPlugin) Setup(ctx context.Context, cfg json.RawMessage) error {
+	p.cfg = cfg
+	return nil
+}
+
+func (p *schemaPlugin) RunProxy(ctx context.Context, item *PluginMeta) (Proxy, error) {
+	return NewProxy(&ProxyTuple{}, nil), nil
+}
+
+func TestCheck(t *testing.T) {
+	p := &schemaPlugin{}
+	RegisterDriverV2("schema_test", "schema", p)
+
+	err := Check(map[string]string{
+		"schema_test": `{"driver": "schema", "timeout": -1}`,
+		"unknown":     `{}`,
+	})
+
+	ce, ok := err.(*ConfigError)
+	if !ok {
+		t.Fatalf("expect config error, got %v", err)
+	}
+
+	expect := []string{
+		`plugin.schema_test.url: is required`,
+		`plugin.schema_test.timeout: expect >= 0, got -1`,
+		`plugin.unknown: protocol unknown not register`,
+	}
+	if !reflect.DeepEqual(ce.Errors, expect) {
+		t.Errorf("expect %q, got %q", expect, ce.Errors)
+	}
+
+	if p.cfg != nil {
+		t.Error("expect plugin not setup by check")
+	}
+
+	// the plugin is setup with defaults
+	err = Setup(map[string]string{"schema_test": `{"driver": "schema", "url": "http://127.0.0.1"}`})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var cfg map[string]interface{}
+	json.Unmarshal(p.cfg, &cfg)
+	if cfg["driver"] != "schema" || cfg["timeout"] != float64(10) {
+		t.Errorf("unexpected configuration %s", p.cfg)
+	}
+}
+
+type optionsPlugin struct {
+	schemaPlugin
+	ctx interface{}
+}
+
+func (p *optionsPlugin) ForwardSchema() *Schema {
+	return SchemaOf(testNested{Retry: 3})
+}
+
+func (p *optionsPlugin) RunProxy(ctx context.Context, item *PluginMeta) (Proxy, error) {
+	p.ctx = item.Ctx
+	return NewProxy(&ProxyTuple{}, nil), nil
+}
+
+func TestForwardOptions(t *testing.T) {
+	p := &optionsPlugin{}
+	RegisterV2("options_test", p)
+
+	mgr := DefaultPluginManager()
+	items := []*PluginMeta{
+		{Protocol: "options_test", From: "0.0.0.0:1", Ctx: `{"mode": "slow"}`},
+		{Protocol: "options_test", From: "0.0.0.0:2", Ctx: `{"mode": "none", "auth": {}}`},
+	}
+
+	results, err := mgr.AddProxies(items, BatchOptions{})
+	if err == nil {
+		t.Fatal("expect error of invalid options")
+	}
+
+	if results[0].Err != nil || results[1].Err == nil || p.ctx != nil {
+		t.Errorf("expect only the second forward fails and nothing runs, got %v %v", results[0].Err, results[1].Err)
+	}
+
+	expect := `rawConfig.mode: expect one of fast, slow, got "none"; rawConfig.auth: unknown field`
+	if results[1].Err.Error() != expect {
+		t.Errorf("expect %s, got %v", expect, results[1].Err)
+	}
+
+	_, err = mgr.AddProxy(items[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mgr.DelProxy(items[0])
+
+	if p.ctx != `{"mode":"slow","retry":3}` {
+		t.Errorf("expect options with defaults, got %v", p.ctx)
+	}
+}
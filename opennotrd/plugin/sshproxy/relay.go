@@ -0,0 +1,113 @@
+package sshproxy
+
+import (
+	"io"
+	"sync"
+
+	"github.com/ICKelin/opennotr/opennotrd/plugin"
+	"golang.org/x/crypto/ssh"
+)
+
+// relay bridges channels and requests between the visitor connection
+// and the sshd connection until one of them is closed.
+// Traffic from the visitor is counted as BytesIn.
+func relay(counter *plugin.BasicProxy,
+	visitor ssh.Conn, visitorChans <-chan ssh.NewChannel, visitorReqs <-chan *ssh.Request,
+	sshd ssh.Conn, sshdChans <-chan ssh.NewChannel, sshdReqs <-chan *ssh.Request) {
+	go forwardRequests(sshd, visitorReqs)
+	go forwardRequests(visitor, sshdReqs)
+
+	// session, direct-tcpip channels from the visitor and
+	// forwarded-tcpip, auth-agent channels from the sshd
+	go forwardChannels(sshd, visitorChans, func(v, s ssh.Channel, vreqs, sreqs <-chan *ssh.Request) {
+		bridge(counter, v, vreqs, s, sreqs)
+	})
+	go forwardChannels(visitor, sshdChans, func(s, v ssh.Channel, sreqs, vreqs <-chan *ssh.Request) {
+		bridge(counter, v, vreqs, s, sreqs)
+	})
+
+	go func() {
+		sshd.Wait()
+		visitor.Close()
+	}()
+	visitor.Wait()
+	sshd.Close()
+}
+
+func forwardRequests(dst ssh.Conn, reqs <-chan *ssh.Request) {
+	for req := range reqs {
+		ok, payload, _ := dst.SendRequest(req.Type, req.WantReply, req.Payload)
+		if req.WantReply {
+			req.Reply(ok, payload)
+		}
+	}
+}
+
+// forwardChannels opens channels of chans on dst,
+// fn is called with the accepted channel and the opened channel
+func forwardChannels(dst ssh.Conn, chans <-chan ssh.NewChannel, fn func(src, dst ssh.Channel, srcReqs, dstReqs <-chan *ssh.Request)) {
+	for nc := range chans {
+		go func(nc ssh.NewChannel) {
+			dch, dreqs, err := dst.OpenChannel(nc.ChannelType(), nc.ExtraData())
+			if err != nil {
+				if oerr, ok := err.(*ssh.OpenChannelError); ok {
+					nc.Reject(oerr.Reason, oerr.Message)
+				} else {
+					nc.Reject(ssh.ConnectionFailed, err.Error())
+				}
+				return
+			}
+
+			sch, sreqs, err := nc.Accept()
+			if err != nil {
+				dch.Close()
+				return
+			}
+
+			fn(sch, dch, sreqs, dreqs)
+		}(nc)
+	}
+}
+
+// bridge copies data and requests between the visitor channel v
+// and the sshd channel s, in both directions
+func bridge(counter *plugin.BasicProxy, v ssh.Channel, vreqs <-chan *ssh.Request, s ssh.Channel, sreqs <-chan *ssh.Request) {
+	wg := &sync.WaitGroup{}
+	wg.Add(1)
+	defer wg.Wait()
+
+	go func() {
+		defer wg.Done()
+		pipe(s, v, vreqs, counter.InWriter)
+	}()
+	pipe(v, s, sreqs, counter.OutWriter)
+}
+
+// pipe copies data, extended data and requests of src to dst,
+// dst is closed after src is closed and the data is copied,
+// so exit-status and the tail of output are not lost
+func pipe(dst, src ssh.Channel, reqs <-chan *ssh.Request, count func(io.Writer) io.Writer) {
+	wg := &sync.WaitGroup{}
+	wg.Add(2)
+
+	go func() {
+		defer wg.Done()
+		io.Copy(count(dst), src)
+		dst.CloseWrite()
+	}()
+
+	go func() {
+		defer wg.Done()
+		io.Copy(count(dst.Stderr()), src.Stderr())
+	}()
+
+	for req := range reqs {
+		ok, _ := dst.SendRequest(req.Type, req.WantReply, req.Payload)
+		if req.WantReply {
+			req.Reply(ok, nil)
+		}
+	}
+
+	wg.Wait()
+	dst.Close()
+}
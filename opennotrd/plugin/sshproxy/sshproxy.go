@@ -0,0 +1,448 @@
+package sshproxy
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ICKelin/opennotr/internal/logs"
+	"github.com/ICKelin/opennotr/opennotrd/plugin"
+	"golang.org/x/crypto/ssh"
+)
+
+var (
+	// default listen address
+	defaultListen = ":2222"
+
+	// default separator of user and client domain
+	defaultSeparator = "+"
+
+	// default timeout for handshake and authentication(seconds)
+	defaultTimeout = 60
+)
+
+func init() {
+	plugin.RegisterV2("ssh", &SSHProxy{})
+}
+
+type config struct {
+	// Listen specific the shared listen address, default :2222
+	Listen string `json:"listen"`
+
+	// HostKey specific the private key file of the gateway,
+	// a key is generated and saved if the file does not exist.
+	// empty means a new key is generated on every start
+	HostKey string `json:"hostKey"`
+
+	// Separator specific the separator of user and client domain
+	// in login names, default +, eg: root+dev.open.notr.tech
+	Separator string `json:"separator"`
+
+	// Timeout specific handshake and authentication timeout in second
+	// default 60 seconds
+	Timeout int `json:"timeout" min:"0"`
+}
+
+// SSHProxy is a ssh gateway, clients share the same port.
+// Logins as user+domain are proxied to the sshd of the client
+// owns domain, password and keyboard-interactive authentication
+// are relayed to the sshd. Other logins use the gateway as a jump
+// host, eg: ssh -J gw@notr.tech:2222 user@domain, the sshd is
+// authenticated by the visitor end to end.
+type SSHProxy struct {
+	cfg     config
+	timeout time.Duration
+	signer  ssh.Signer
+
+	mu sync.RWMutex
+
+	// routes stores running proxies of domains
+	// key: domain
+	routes map[string]*route
+}
+
+type route struct {
+	meta  *plugin.PluginMeta
+	proxy *plugin.BasicProxy
+}
+
+func (p *SSHProxy) Schema() *plugin.Schema {
+	return plugin.SchemaOf(config{Listen: defaultListen, Separator: defaultSeparator, Timeout: defaultTimeout})
+}
+
+// Setup listens the shared address at the first call,
+// the listen address and host key can not be changed by reload
+func (p *SSHProxy) Setup(ctx context.Context, rawMessage json.RawMessage) error {
+	var cfg config
+	err := json.Unmarshal(rawMessage, &cfg)
+	if err != nil {
+		return err
+	}
+
+	if len(cfg.Listen) <= 0 {
+		cfg.Listen = defaultListen
+	}
+
+	if len(cfg.Separator) <= 0 {
+		cfg.Separator = defaultSeparator
+	}
+
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = defaultTimeout
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.routes != nil {
+		if cfg.Listen != p.cfg.Listen {
+			return fmt.Errorf("ssh listen %s can not be changed to %s by reload", p.cfg.Listen, cfg.Listen)
+		}
+
+		if cfg.HostKey != p.cfg.HostKey {
+			return fmt.Errorf("ssh host key %s can not be changed to %s by reload", p.cfg.HostKey, cfg.HostKey)
+		}
+
+		p.cfg = cfg
+		p.timeout = time.Duration(cfg.Timeout) * time.Second
+		return nil
+	}
+
+	signer, err := loadHostKey(cfg.HostKey)
+	if err != nil {
+		return err
+	}
+
+	lis, err := net.Listen("tcp", cfg.Listen)
+	if err != nil {
+		return err
+	}
+
+	p.cfg = cfg
+	p.timeout = time.Duration(cfg.Timeout) * time.Second
+	p.signer = signer
+	p.routes = make(map[string]*route)
+	go p.serve(lis)
+	return nil
+}
+
+// ForwardSchema declares forwards accept no options
+func (p *SSHProxy) ForwardSchema() *plugin.Schema {
+	return plugin.SchemaOf(struct{}{})
+}
+
+func (p *SSHProxy) RunProxy(ctx context.Context, item *plugin.PluginMeta) (plugin.Proxy, error) {
+	if item.Dialer == nil {
+		return nil, fmt.Errorf("no dialer for %s", item.Domain)
+	}
+
+	if len(item.Domain) <= 0 {
+		return nil, fmt.Errorf("domain is required for ssh")
+	}
+
+	domain := strings.ToLower(item.Domain)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if _, ok := p.routes[domain]; ok {
+		return nil, fmt.Errorf("ssh://%s is in used", domain)
+	}
+
+	_, fromPort, _ := net.SplitHostPort(p.cfg.Listen)
+	_, toPort, _ := net.SplitHostPort(item.To)
+
+	r := &route{meta: item}
+	r.proxy = plugin.NewProxy(&plugin.ProxyTuple{
+		Protocol: item.Protocol,
+		FromPort: fromPort,
+		ToPort:   toPort,
+	}, func() error {
+		p.delRoute(domain, r)
+		return nil
+	})
+	p.routes[domain] = r
+	return r.proxy, nil
+}
+
+func (p *SSHProxy) delRoute(domain string, r *route) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.routes[domain] == r {
+		delete(p.routes, domain)
+	}
+}
+
+func (p *SSHProxy) lookup(domain string) *route {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.routes[strings.ToLower(domain)]
+}
+
+func (p *SSHProxy) serve(lis net.Listener) {
+	defer lis.Close()
+	for {
+		conn, err := lis.Accept()
+		if err != nil {
+			logs.Error("accept fail: %v", err)
+			break
+		}
+
+		go p.doProxy(conn)
+	}
+}
+
+func (p *SSHProxy) doProxy(conn net.Conn) {
+	defer conn.Close()
+
+	p.mu.RLock()
+	timeout := p.timeout
+	separator := p.cfg.Separator
+	p.mu.RUnlock()
+
+	l := &login{p: p, conn: conn, separator: separator}
+	defer l.close()
+
+	conn.SetDeadline(time.Now().Add(timeout))
+	sconn, chans, reqs, err := ssh.NewServerConn(conn, l.serverConfig())
+	conn.SetDeadline(time.Time{})
+	if err != nil {
+		logs.Error("ssh handshake with %s fail: %v", conn.RemoteAddr(), err)
+		return
+	}
+	defer sconn.Close()
+
+	if l.upstream == nil {
+		p.serveJump(sconn, chans, reqs, separator)
+		return
+	}
+
+	r := l.route
+	r.proxy.ConnOpen()
+	defer r.proxy.ConnClose()
+	relay(r.proxy, sconn, chans, reqs, l.upstream, l.upstreamChans, l.upstreamReqs)
+}
+
+// login authenticates a visitor, logins as user+domain are
+// authenticated by the sshd of domain
+type login struct {
+	p         *SSHProxy
+	conn      net.Conn
+	separator string
+
+	route         *route
+	upstream      ssh.Conn
+	upstreamChans <-chan ssh.NewChannel
+	upstreamReqs  <-chan *ssh.Request
+}
+
+func (l *login) serverConfig() *ssh.ServerConfig {
+	cfg := &ssh.ServerConfig{
+		ServerVersion: "SSH-2.0-opennotr",
+
+		// logins without domain are jump host sessions,
+		// the target sshd authenticates visitors itself
+		NoClientAuth: true,
+		NoClientAuthCallback: func(meta ssh.ConnMetadata) (*ssh.Permissions, error) {
+			if _, _, ok := l.split(meta.User()); ok {
+				return nil, fmt.Errorf("authentication is required by %s", meta.User())
+			}
+			return nil, nil
+		},
+
+		PasswordCallback: func(meta ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+			return nil, l.dial(meta, ssh.Password(string(password)))
+		},
+
+		KeyboardInteractiveCallback: func(meta ssh.ConnMetadata, challenge ssh.KeyboardInteractiveChallenge) (*ssh.Permissions, error) {
+			return nil, l.dial(meta, ssh.KeyboardInteractive(func(user, instruction string, questions []string, echos []bool) ([]string, error) {
+				return challenge(user, instruction, questions, echos)
+			}))
+		},
+	}
+	cfg.AddHostKey(l.p.signer)
+	return cfg
+}
+
+// split splits login name to user and domain
+func (l *login) split(name string) (string, string, bool) {
+	idx := strings.LastIndex(name, l.separator)
+	if idx <= 0 || idx+len(l.separator) >= len(name) {
+		return "", "", false
+	}
+	return name[:idx], name[idx+len(l.separator):], true
+}
+
+// dial authenticates the visitor by logging in the sshd with auth
+func (l *login) dial(meta ssh.ConnMetadata, auth ssh.AuthMethod) error {
+	user, domain, ok := l.split(meta.User())
+	if !ok {
+		return fmt.Errorf("login name %s without domain", meta.User())
+	}
+
+	r := l.p.lookup(domain)
+	if r == nil {
+		logs.Warn("no route for ssh login %q", meta.User())
+		return fmt.Errorf("no route for %s", domain)
+	}
+
+	item := r.meta
+	stream, err := item.Dialer.Dial(l.conn.RemoteAddr(), item.To)
+	if err != nil {
+		logs.Error("dial %s fail: %v", item.To, err)
+		r.proxy.SetHealth(err)
+		return err
+	}
+	r.proxy.SetHealth(nil)
+
+	// the sshd is reached through the authenticated tunnel
+	// so its host key is not verified
+	conn, chans, reqs, err := ssh.NewClientConn(stream, item.To, &ssh.ClientConfig{
+		User:            user,
+		Auth:            []ssh.AuthMethod{auth},
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	})
+	if err != nil {
+		stream.Close()
+		return err
+	}
+
+	l.close()
+	l.route = r
+	l.upstream = conn
+	l.upstreamChans = chans
+	l.upstreamReqs = reqs
+	return nil
+}
+
+func (l *login) close() {
+	if l.upstream != nil {
+		l.upstream.Close()
+		l.upstream = nil
+	}
+}
+
+// directTCPIP is the extra data of direct-tcpip channel, RFC 4254 7.2
+type directTCPIP struct {
+	Host       string
+	Port       uint32
+	OriginHost string
+	OriginPort uint32
+}
+
+// serveJump serves direct-tcpip channels to the sshd of clients,
+// the host is the client domain, the port is ignored
+func (p *SSHProxy) serveJump(sconn *ssh.ServerConn, chans <-chan ssh.NewChannel, reqs <-chan *ssh.Request, separator string) {
+	go ssh.DiscardRequests(reqs)
+	for nc := range chans {
+		if nc.ChannelType() != "direct-tcpip" {
+			nc.Reject(ssh.Prohibited, "jump host only, login as user"+separator+"domain for a shell")
+			continue
+		}
+
+		go p.jump(sconn, nc)
+	}
+}
+
+func (p *SSHProxy) jump(sconn *ssh.ServerConn, nc ssh.NewChannel) {
+	var msg directTCPIP
+	err := ssh.Unmarshal(nc.ExtraData(), &msg)
+	if err != nil {
+		nc.Reject(ssh.ConnectionFailed, "invalid direct-tcpip request")
+		return
+	}
+
+	r := p.lookup(msg.Host)
+	if r == nil {
+		logs.Warn("no route for ssh jump to %q", msg.Host)
+		nc.Reject(ssh.ConnectionFailed, "no route for "+msg.Host)
+		return
+	}
+
+	item := r.meta
+	stream, err := item.Dialer.Dial(sconn.RemoteAddr(), item.To)
+	if err != nil {
+		logs.Error("dial %s fail: %v", item.To, err)
+		r.proxy.SetHealth(err)
+		nc.Reject(ssh.ConnectionFailed, err.Error())
+		return
+	}
+	defer stream.Close()
+	r.proxy.SetHealth(nil)
+
+	ch, reqs, err := nc.Accept()
+	if err != nil {
+		return
+	}
+	defer ch.Close()
+	go ssh.DiscardRequests(reqs)
+
+	r.proxy.ConnOpen()
+	defer r.proxy.ConnClose()
+
+	wg := &sync.WaitGroup{}
+	wg.Add(1)
+	defer wg.Wait()
+
+	go func() {
+		defer wg.Done()
+		defer stream.Close()
+		buf := make([]byte, 4096)
+		io.CopyBuffer(r.proxy.InWriter(stream), ch, buf)
+	}()
+
+	buf := make([]byte, 4096)
+	io.CopyBuffer(r.proxy.OutWriter(ch), stream, buf)
+	ch.Close()
+}
+
+// loadHostKey loads the host key from file,
+// a new ed25519 key is generated and saved if file does not exist
+func loadHostKey(file string) (ssh.Signer, error) {
+	if len(file) > 0 {
+		content, err := ioutil.ReadFile(file)
+		if err == nil {
+			return ssh.ParsePrivateKey(content)
+		}
+
+		if !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(file) <= 0 {
+		logs.Warn("ssh host key is not configured, visitors see a new host key after restart")
+		return signer, nil
+	}
+
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+
+	err = ioutil.WriteFile(file, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0600)
+	if err != nil {
+		return nil, err
+	}
+	logs.Info("ssh host key %s generated", file)
+	return signer, nil
+}
@@ -0,0 +1,261 @@
+package sshproxy
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ICKelin/opennotr/opennotrd/plugin"
+	"github.com/ICKelin/opennotr/opennotrd/plugin/plugintest"
+	"golang.org/x/crypto/ssh"
+)
+
+// sshd is a stand-in of the sshd of a client, alice logins by password
+// and bob logins by keyboard-interactive. exec replies "$user: $command"
+// and exits with status 3
+type sshd struct {
+	lis net.Listener
+}
+
+func newSSHD(t *testing.T) *sshd {
+	signer, err := loadHostKey("")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := &ssh.ServerConfig{
+		PasswordCallback: func(meta ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+			if meta.User() == "alice" && string(password) == "secret" {
+				return nil, nil
+			}
+			return nil, fmt.Errorf("password rejected for %s", meta.User())
+		},
+		KeyboardInteractiveCallback: func(meta ssh.ConnMetadata, challenge ssh.KeyboardInteractiveChallenge) (*ssh.Permissions, error) {
+			answers, err := challenge(meta.User(), "", []string{"otp: "}, []bool{false})
+			if err != nil {
+				return nil, err
+			}
+
+			if meta.User() == "bob" && len(answers) == 1 && answers[0] == "123456" {
+				return nil, nil
+			}
+			return nil, fmt.Errorf("otp rejected for %s", meta.User())
+		},
+	}
+	cfg.AddHostKey(signer)
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go func() {
+		for {
+			conn, err := lis.Accept()
+			if err != nil {
+				return
+			}
+			go serveSSH(conn, cfg)
+		}
+	}()
+	return &sshd{lis: lis}
+}
+
+func (s *sshd) Close() error {
+	return s.lis.Close()
+}
+
+func serveSSH(conn net.Conn, cfg *ssh.ServerConfig) {
+	defer conn.Close()
+	sconn, chans, reqs, err := ssh.NewServerConn(conn, cfg)
+	if err != nil {
+		return
+	}
+	defer sconn.Close()
+	go ssh.DiscardRequests(reqs)
+
+	for nc := range chans {
+		if nc.ChannelType() != "session" {
+			nc.Reject(ssh.UnknownChannelType, nc.ChannelType())
+			continue
+		}
+
+		ch, reqs, err := nc.Accept()
+		if err != nil {
+			continue
+		}
+
+		go func() {
+			defer ch.Close()
+			for req := range reqs {
+				if req.Type != "exec" {
+					req.Reply(false, nil)
+					continue
+				}
+
+				var msg struct{ Command string }
+				ssh.Unmarshal(req.Payload, &msg)
+				req.Reply(true, nil)
+				fmt.Fprintf(ch, "%s: %s", sconn.User(), msg.Command)
+				ch.SendRequest("exit-status", false, ssh.Marshal(struct{ Status uint32 }{3}))
+				return
+			}
+		}()
+	}
+}
+
+func run(t *testing.T, conn *ssh.Client, command string) string {
+	sess, err := conn.NewSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sess.Close()
+
+	out, err := sess.Output(command)
+	if exit, ok := err.(*ssh.ExitError); !ok || exit.ExitStatus() != 3 {
+		t.Fatalf("expect exit status 3, got %v", err)
+	}
+	return string(out)
+}
+
+func TestSSHGateway(t *testing.T) {
+	tun := plugintest.NewTunnel(t)
+	defer tun.Close()
+
+	backend := newSSHD(t)
+	defer backend.Close()
+
+	dir, err := ioutil.TempDir("", "sshproxy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	addr := plugintest.FreeAddr(t)
+	hostKey := filepath.Join(dir, "host_key")
+	p := &SSHProxy{}
+	ctx := context.Background()
+	err = p.Setup(ctx, json.RawMessage(fmt.Sprintf(`{"listen": "%s", "hostKey": "%s", "timeout": 5}`, addr, hostKey)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the generated host key is saved
+	if _, err := loadHostKey(hostKey); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := p.Setup(ctx, json.RawMessage(fmt.Sprintf(`{"listen": "%s"}`, addr))); err == nil {
+		t.Fatal("expected host key can not be changed error")
+	}
+
+	item := &plugin.PluginMeta{
+		Protocol: "ssh",
+		To:       "100.64.240.10:" + plugintest.Port(t, backend.lis.Addr().String()),
+		Domain:   "dev.open.notr.tech",
+		Dialer:   tun,
+	}
+	proxy, err := p.RunProxy(ctx, item)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := p.RunProxy(ctx, item); err == nil {
+		t.Fatal("expected domain in used error")
+	}
+
+	dial := func(user string, auth ...ssh.AuthMethod) (*ssh.Client, error) {
+		return ssh.Dial("tcp", addr, &ssh.ClientConfig{
+			User:            user,
+			Auth:            auth,
+			HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+			Timeout:         time.Second * 5,
+		})
+	}
+
+	// password is relayed to the sshd
+	cli, err := dial("alice+DEV.open.notr.tech", ssh.Password("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if out := run(t, cli, "hostname"); out != "alice: hostname" {
+		t.Errorf("unexpected output %q", out)
+	}
+	cli.Close()
+
+	if _, err := dial("alice+dev.open.notr.tech", ssh.Password("wrong")); err == nil {
+		t.Error("expected wrong password rejected")
+	}
+
+	if _, err := dial("alice+unknown.open.notr.tech", ssh.Password("secret")); err == nil {
+		t.Error("expected unknown domain rejected")
+	}
+
+	// keyboard-interactive is relayed to the sshd
+	cli, err = dial("bob+dev.open.notr.tech", ssh.KeyboardInteractive(func(user, instruction string, questions []string, echos []bool) ([]string, error) {
+		if len(questions) != 1 || questions[0] != "otp: " {
+			return nil, fmt.Errorf("unexpected questions %q", questions)
+		}
+		return []string{"123456"}, nil
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if out := run(t, cli, "uptime"); out != "bob: uptime" {
+		t.Errorf("unexpected output %q", out)
+	}
+	cli.Close()
+
+	// jump host, the visitor authenticates to the sshd end to end
+	jump, err := dial("jump")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer jump.Close()
+
+	if _, err := jump.NewSession(); err == nil {
+		t.Error("expected session rejected by jump host")
+	}
+
+	if _, err := jump.Dial("tcp", "unknown.open.notr.tech:22"); err == nil {
+		t.Error("expected unknown domain rejected by jump host")
+	}
+
+	stream, err := jump.Dial("tcp", "dev.open.notr.tech:22")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conn, chans, reqs, err := ssh.NewClientConn(stream, "dev.open.notr.tech:22", &ssh.ClientConfig{
+		User:            "alice",
+		Auth:            []ssh.AuthMethod{ssh.Password("secret")},
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cli = ssh.NewClient(conn, chans, reqs)
+	if out := run(t, cli, "whoami"); out != "alice: whoami" {
+		t.Errorf("unexpected output %q", out)
+	}
+	cli.Close()
+
+	stats := proxy.Stats()
+	if stats.TotalConns != 3 || stats.BytesIn <= 0 || stats.BytesOut <= 0 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+
+	// closed proxy removes the route
+	proxy.Close()
+	if _, err := dial("alice+dev.open.notr.tech", ssh.Password("secret")); err == nil {
+		t.Error("expected closed route rejected")
+	}
+}
@@ -1,7 +1,9 @@
 package tcpproxy
 
 import (
+	"context"
 	"encoding/json"
+	"fmt"
 	"io"
 	"net"
 	"sync"
@@ -12,43 +14,58 @@ import (
 )
 
 func init() {
-	plugin.Register("tcp", &TCPProxy{})
+	plugin.RegisterV2("tcp", &TCPProxy{})
 }
 
 type TCPProxy struct{}
 
-func (t *TCPProxy) Setup(config json.RawMessage) error { return nil }
+// Schema declares tcp proxy has no configuration
+func (t *TCPProxy) Schema() *plugin.Schema {
+	return plugin.SchemaOf(struct{}{})
+}
 
-func (t *TCPProxy) StopProxy(item *plugin.PluginMeta) {
-	select {
-	case item.RecycleSignal <- struct{}{}:
-	default:
-	}
+func (t *TCPProxy) Setup(ctx context.Context, config json.RawMessage) error { return nil }
+
+// Validate checks whether the listen address is free
+func (t *TCPProxy) Validate(item *plugin.PluginMeta) error {
+	return plugin.CheckListen("tcp", item.From)
+}
+
+// ForwardSchema declares forwards accept no options
+func (t *TCPProxy) ForwardSchema() *plugin.Schema {
+	return plugin.SchemaOf(struct{}{})
 }
 
 // RunProxy runs a tcp server and proxy to item.To
-// RunProxy may change item.From address to the real listenner address
-func (t *TCPProxy) RunProxy(item *plugin.PluginMeta) (*plugin.ProxyTuple, error) {
+// the server is closed when ctx is done or the proxy is closed
+func (t *TCPProxy) RunProxy(ctx context.Context, item *plugin.PluginMeta) (plugin.Proxy, error) {
 	from, to := item.From, item.To
 	lis, err := net.Listen("tcp", from)
 	if err != nil {
 		return nil, err
 	}
 
-	fin := make(chan struct{})
+	_, fromPort, _ := net.SplitHostPort(lis.Addr().String())
+	_, toPort, _ := net.SplitHostPort(item.To)
+
+	ctx, cancel := context.WithCancel(ctx)
+	proxy := plugin.NewProxy(&plugin.ProxyTuple{
+		Protocol: item.Protocol,
+		FromPort: fromPort,
+		ToPort:   toPort,
+	}, func() error {
+		cancel()
+		return nil
+	})
+
 	go func() {
-		select {
-		case <-item.RecycleSignal:
-			logs.Info("receive recycle signal for %s", from)
-			lis.Close()
-		case <-fin:
-			return
-		}
+		<-ctx.Done()
+		logs.Info("stop tcp proxy %s", from)
+		lis.Close()
 	}()
 
 	go func() {
 		defer lis.Close()
-		defer close(fin)
 
 		sess := &sync.Map{}
 		defer func() {
@@ -63,29 +80,25 @@ func (t *TCPProxy) RunProxy(item *plugin.PluginMeta) (*plugin.ProxyTuple, error)
 		for {
 			conn, err := lis.Accept()
 			if err != nil {
-				logs.Error("accept fail: %v", err)
+				if ctx.Err() == nil {
+					logs.Error("accept fail: %v", err)
+					proxy.SetHealth(fmt.Errorf("listener %s closed: %v", from, err))
+				}
 				break
 			}
 
 			go func() {
 				sess.Store(conn.RemoteAddr().String(), conn)
 				defer sess.Delete(conn.RemoteAddr().String())
-				t.doProxy(conn, to)
+				t.doProxy(conn, to, &proxy.Counter)
 			}()
 		}
 	}()
 
-	_, fromPort, _ := net.SplitHostPort(lis.Addr().String())
-	_, toPort, _ := net.SplitHostPort(item.To)
-
-	return &plugin.ProxyTuple{
-		Protocol: item.Protocol,
-		FromPort: fromPort,
-		ToPort:   toPort,
-	}, nil
+	return proxy, nil
 }
 
-func (t *TCPProxy) doProxy(conn net.Conn, to string) {
+func (t *TCPProxy) doProxy(conn net.Conn, to string, counter *plugin.Counter) {
 	defer conn.Close()
 
 	toconn, err := net.DialTimeout("tcp", to, time.Second*10)
@@ -95,19 +108,22 @@ func (t *TCPProxy) doProxy(conn net.Conn, to string) {
 	}
 	defer toconn.Close()
 
+	counter.ConnOpen()
+	defer counter.ConnClose()
+
 	wg := &sync.WaitGroup{}
 	wg.Add(2)
 
 	go func() {
 		defer wg.Done()
 		buf := make([]byte, 1500)
-		io.CopyBuffer(toconn, conn, buf)
+		io.CopyBuffer(counter.InWriter(toconn), conn, buf)
 	}()
 
 	go func() {
 		defer wg.Done()
 		buf := make([]byte, 1500)
-		io.CopyBuffer(conn, toconn, buf)
+		io.CopyBuffer(counter.OutWriter(conn), toconn, buf)
 	}()
 	wg.Wait()
 }
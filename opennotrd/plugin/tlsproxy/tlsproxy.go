@@ -0,0 +1,267 @@
+// Package tlsproxy forwards tls connections to clients by the SNI
+// of client hello, the tls session is terminated by the client.
+package tlsproxy
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ICKelin/opennotr/internal/logs"
+	"github.com/ICKelin/opennotr/opennotrd/plugin"
+)
+
+var (
+	// default listen address, :443 is the default of https
+	defaultListen = ":8443"
+
+	// default timeout for reading client hello(seconds)
+	defaultTimeout = 10
+
+	errHelloRead = errors.New("client hello read")
+)
+
+func init() {
+	plugin.RegisterV2("tls", &TLSProxy{})
+}
+
+type config struct {
+	// Listen specific the shared listen address, default :8443
+	Listen string `json:"listen"`
+
+	// Timeout specific client hello read timeout in second
+	// default 10 seconds
+	Timeout int `json:"timeout" min:"0"`
+}
+
+// TLSProxy routes tls connections by SNI without decrypting
+// clients share the same port like http clients do
+type TLSProxy struct {
+	cfg     config
+	timeout time.Duration
+
+	mu sync.RWMutex
+
+	// routes stores running proxies of domains
+	// key: domain
+	routes map[string]*route
+}
+
+type route struct {
+	meta  *plugin.PluginMeta
+	proxy *plugin.BasicProxy
+}
+
+func (p *TLSProxy) Schema() *plugin.Schema {
+	return plugin.SchemaOf(config{Listen: defaultListen, Timeout: defaultTimeout})
+}
+
+// Setup listens the shared address at the first call,
+// the listen address can not be changed by reload
+func (p *TLSProxy) Setup(ctx context.Context, rawMessage json.RawMessage) error {
+	var cfg config
+	err := json.Unmarshal(rawMessage, &cfg)
+	if err != nil {
+		return err
+	}
+
+	if len(cfg.Listen) <= 0 {
+		cfg.Listen = defaultListen
+	}
+
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = defaultTimeout
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.routes != nil {
+		if cfg.Listen != p.cfg.Listen {
+			return fmt.Errorf("tls listen %s can not be changed to %s by reload", p.cfg.Listen, cfg.Listen)
+		}
+
+		p.cfg = cfg
+		p.timeout = time.Duration(cfg.Timeout) * time.Second
+		return nil
+	}
+
+	lis, err := net.Listen("tcp", cfg.Listen)
+	if err != nil {
+		return err
+	}
+
+	p.cfg = cfg
+	p.timeout = time.Duration(cfg.Timeout) * time.Second
+	p.routes = make(map[string]*route)
+	go p.serve(lis)
+	return nil
+}
+
+// ForwardSchema declares forwards accept no options
+func (p *TLSProxy) ForwardSchema() *plugin.Schema {
+	return plugin.SchemaOf(struct{}{})
+}
+
+func (p *TLSProxy) RunProxy(ctx context.Context, item *plugin.PluginMeta) (plugin.Proxy, error) {
+	if item.Dialer == nil {
+		return nil, fmt.Errorf("no dialer for %s", item.Domain)
+	}
+
+	if len(item.Domain) <= 0 {
+		return nil, fmt.Errorf("domain is required for tls")
+	}
+
+	domain := strings.ToLower(item.Domain)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if _, ok := p.routes[domain]; ok {
+		return nil, fmt.Errorf("tls://%s is in used", domain)
+	}
+
+	_, fromPort, _ := net.SplitHostPort(p.cfg.Listen)
+	_, toPort, _ := net.SplitHostPort(item.To)
+
+	r := &route{meta: item}
+	r.proxy = plugin.NewProxy(&plugin.ProxyTuple{
+		Protocol: item.Protocol,
+		FromPort: fromPort,
+		ToPort:   toPort,
+	}, func() error {
+		p.delRoute(domain, r)
+		return nil
+	})
+	p.routes[domain] = r
+	return r.proxy, nil
+}
+
+func (p *TLSProxy) delRoute(domain string, r *route) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.routes[domain] == r {
+		delete(p.routes, domain)
+	}
+}
+
+func (p *TLSProxy) lookup(domain string) *route {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.routes[strings.ToLower(domain)]
+}
+
+func (p *TLSProxy) serve(lis net.Listener) {
+	defer lis.Close()
+	for {
+		conn, err := lis.Accept()
+		if err != nil {
+			logs.Error("accept fail: %v", err)
+			break
+		}
+
+		go p.doProxy(conn)
+	}
+}
+
+func (p *TLSProxy) doProxy(conn net.Conn) {
+	defer conn.Close()
+
+	p.mu.RLock()
+	timeout := p.timeout
+	p.mu.RUnlock()
+
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	serverName, hello, err := peekServerName(conn)
+	conn.SetReadDeadline(time.Time{})
+	if err != nil {
+		logs.Error("read client hello from %s fail: %v", conn.RemoteAddr(), err)
+		return
+	}
+
+	r := p.lookup(serverName)
+	if r == nil {
+		logs.Warn("no route for sni %q", serverName)
+		return
+	}
+
+	item := r.meta
+	stream, err := item.Dialer.Dial(conn.RemoteAddr(), item.To)
+	if err != nil {
+		logs.Error("dial %s fail: %v", item.To, err)
+		r.proxy.SetHealth(err)
+		return
+	}
+	defer stream.Close()
+	r.proxy.SetHealth(nil)
+
+	r.proxy.ConnOpen()
+	defer r.proxy.ConnClose()
+
+	// replay the client hello we have read
+	_, err = stream.Write(hello)
+	if err != nil {
+		logs.Error("stream write fail: %v", err)
+		return
+	}
+	r.proxy.AddIn(int64(len(hello)))
+
+	wg := &sync.WaitGroup{}
+	wg.Add(1)
+	defer wg.Wait()
+
+	go func() {
+		defer wg.Done()
+		defer stream.Close()
+		defer conn.Close()
+		buf := make([]byte, 4096)
+		io.CopyBuffer(r.proxy.InWriter(stream), conn, buf)
+	}()
+
+	buf := make([]byte, 4096)
+	io.CopyBuffer(r.proxy.OutWriter(conn), stream, buf)
+}
+
+// peekServerName reads the client hello from conn
+// it returns the SNI and the raw bytes have been read
+func peekServerName(conn net.Conn) (string, []byte, error) {
+	buf := &bytes.Buffer{}
+	serverName := ""
+	hasHello := false
+	err := tls.Server(&readOnlyConn{r: io.TeeReader(conn, buf)}, &tls.Config{
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			serverName = hello.ServerName
+			hasHello = true
+			return nil, errHelloRead
+		},
+	}).Handshake()
+	if !hasHello {
+		return "", nil, err
+	}
+
+	if len(serverName) <= 0 {
+		return "", nil, fmt.Errorf("client hello without sni")
+	}
+	return serverName, buf.Bytes(), nil
+}
+
+// readOnlyConn is used to read client hello only
+// tls.Server writes alert to it and the write is dropped
+type readOnlyConn struct {
+	r io.Reader
+}
+
+func (c *readOnlyConn) Read(p []byte) (int, error)         { return c.r.Read(p) }
+func (c *readOnlyConn) Write(p []byte) (int, error)        { return 0, io.ErrClosedPipe }
+func (c *readOnlyConn) Close() error                       { return nil }
+func (c *readOnlyConn) LocalAddr() net.Addr                { return nil }
+func (c *readOnlyConn) RemoteAddr() net.Addr               { return nil }
+func (c *readOnlyConn) SetDeadline(t time.Time) error      { return nil }
+func (c *readOnlyConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *readOnlyConn) SetWriteDeadline(t time.Time) error { return nil }
@@ -0,0 +1,97 @@
+package tlsproxy
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/ICKelin/opennotr/opennotrd/plugin"
+	"github.com/ICKelin/opennotr/opennotrd/plugin/plugintest"
+)
+
+func TestTLSPassthrough(t *testing.T) {
+	tun := plugintest.NewTunnel(t)
+	defer tun.Close()
+
+	// the backend terminates tls itself
+	backend := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "%s %s", r.TLS.ServerName, r.URL.Path)
+	}))
+	defer backend.Close()
+
+	addr := plugintest.FreeAddr(t)
+	p := &TLSProxy{}
+	ctx := context.Background()
+	err := p.Setup(ctx, json.RawMessage(fmt.Sprintf(`{"listen": "%s"}`, addr)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// reload keeps the listener
+	err = p.Setup(ctx, json.RawMessage(fmt.Sprintf(`{"listen": "%s", "timeout": 5}`, addr)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := p.Setup(ctx, json.RawMessage(`{"listen": ":0"}`)); err == nil {
+		t.Fatal("expected listen can not be changed error")
+	}
+
+	item := &plugin.PluginMeta{
+		Protocol: "tls",
+		To:       "100.64.240.10:" + plugintest.Port(t, backend.URL),
+		Domain:   "mtls.open.notr.tech",
+		Dialer:   tun,
+	}
+	proxy, err := p.RunProxy(ctx, item)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := p.RunProxy(ctx, item); err == nil {
+		t.Fatal("expected domain in used error")
+	}
+
+	cli := &http.Client{
+		Timeout: time.Second * 5,
+		Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+			Dial: func(network, _ string) (net.Conn, error) {
+				return net.Dial(network, addr)
+			},
+		},
+	}
+
+	resp, err := cli.Get("https://mtls.open.notr.tech/passthrough")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "mtls.open.notr.tech /passthrough" {
+		t.Fatalf("unexpected reply %q", body)
+	}
+
+	if _, err := cli.Get("https://unknown.open.notr.tech/"); err == nil {
+		t.Fatal("expected connection closed for unknown sni")
+	}
+
+	cli.Transport.(*http.Transport).CloseIdleConnections()
+	stats := proxy.Stats()
+	if stats.TotalConns != 1 || stats.BytesIn <= 0 || stats.BytesOut <= 0 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+
+	proxy.Close()
+	cli.Transport.(*http.Transport).CloseIdleConnections()
+	if _, err := cli.Get("https://mtls.open.notr.tech/"); err == nil {
+		t.Fatal("expected connection closed after stop")
+	}
+}
@@ -3,6 +3,7 @@ package udpproxy
 import (
 	"context"
 	"encoding/json"
+	"fmt"
 	"net"
 	"sync"
 	"time"
@@ -15,19 +16,23 @@ import (
 var defaultTimeout = 30
 
 func init() {
-	plugin.Register("udp", &UDPProxy{})
+	plugin.RegisterV2("udp", &UDPProxy{})
 }
 
 type config struct {
 	// session timeout(second)
-	SessionTimeout int `json:"sessionTimeout"`
+	SessionTimeout int `json:"sessionTimeout" min:"0"`
 }
 
 type UDPProxy struct {
 	cfg config
 }
 
-func (p *UDPProxy) Setup(rawMessage json.RawMessage) error {
+func (p *UDPProxy) Schema() *plugin.Schema {
+	return plugin.SchemaOf(config{SessionTimeout: defaultTimeout})
+}
+
+func (p *UDPProxy) Setup(ctx context.Context, rawMessage json.RawMessage) error {
 	var cfg config
 	err := json.Unmarshal(rawMessage, &cfg)
 	if err != nil {
@@ -41,14 +46,19 @@ func (p *UDPProxy) Setup(rawMessage json.RawMessage) error {
 	return nil
 }
 
-func (p *UDPProxy) StopProxy(item *plugin.PluginMeta) {
-	select {
-	case item.RecycleSignal <- struct{}{}:
-	default:
-	}
+// ForwardSchema declares forwards accept no options
+func (p *UDPProxy) ForwardSchema() *plugin.Schema {
+	return plugin.SchemaOf(struct{}{})
 }
 
-func (p *UDPProxy) RunProxy(item *plugin.PluginMeta) (*plugin.ProxyTuple, error) {
+// Validate checks whether the listen address is free
+func (p *UDPProxy) Validate(item *plugin.PluginMeta) error {
+	return plugin.CheckListen("udp", item.From)
+}
+
+// RunProxy runs a udp server and proxy to item.To
+// the server is closed when ctx is done or the proxy is closed
+func (p *UDPProxy) RunProxy(ctx context.Context, item *plugin.PluginMeta) (plugin.Proxy, error) {
 	from := item.From
 	laddr, err := net.ResolveUDPAddr("udp", from)
 	if err != nil {
@@ -60,36 +70,32 @@ func (p *UDPProxy) RunProxy(item *plugin.PluginMeta) (*plugin.ProxyTuple, error)
 		return nil, err
 	}
 
-	go p.doProxy(lis, item)
-
 	_, fromPort, _ := net.SplitHostPort(lis.LocalAddr().String())
 	_, toPort, _ := net.SplitHostPort(item.To)
 
-	return &plugin.ProxyTuple{
+	ctx, cancel := context.WithCancel(ctx)
+	proxy := plugin.NewProxy(&plugin.ProxyTuple{
 		Protocol: item.Protocol,
 		FromPort: fromPort,
 		ToPort:   toPort,
-	}, nil
+	}, func() error {
+		cancel()
+		return nil
+	})
+
+	go p.doProxy(ctx, lis, item, p.cfg.SessionTimeout, proxy)
+	return proxy, nil
 }
 
-func (p *UDPProxy) doProxy(lis *net.UDPConn, item *plugin.PluginMeta) {
+func (p *UDPProxy) doProxy(ctx context.Context, lis *net.UDPConn, item *plugin.PluginMeta, timeout int, proxy *plugin.BasicProxy) {
 	defer lis.Close()
 
-	from := item.From
-	ctx, cancel := context.WithCancel(context.Background())
-	defer cancel()
-
-	// receive this signal and close the listener
 	// the listener close will force lis.ReadFromUDP loop break
 	// then close all the client socket and end udpCopy
 	go func() {
-		select {
-		case <-item.RecycleSignal:
-			logs.Info("receive recycle signal for %s", from)
-			lis.Close()
-		case <-ctx.Done():
-			return
-		}
+		<-ctx.Done()
+		logs.Info("stop udp proxy %s", item.From)
+		lis.Close()
 	}()
 
 	// sess store all backend connection
@@ -113,13 +119,19 @@ func (p *UDPProxy) doProxy(lis *net.UDPConn, item *plugin.PluginMeta) {
 	}()
 
 	go func() {
-		timeout := p.cfg.SessionTimeout
 		interval := timeout / 2
 		if interval <= 0 {
 			interval = timeout
 		}
 		tick := time.NewTicker(time.Second * time.Duration(interval))
-		for range tick.C {
+		defer tick.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-tick.C:
+			}
+
 			sessionTimeout.Range(func(k, v interface{}) bool {
 				lastActiveAt, ok := v.(time.Time)
 				if !ok {
@@ -127,7 +139,11 @@ func (p *UDPProxy) doProxy(lis *net.UDPConn, item *plugin.PluginMeta) {
 				}
 
 				if time.Now().Sub(lastActiveAt).Seconds() > float64(timeout) {
+					if conn, ok := sess.Load(k); ok {
+						conn.(*net.UDPConn).Close()
+					}
 					sess.Delete(k)
+					sessionTimeout.Delete(k)
 				}
 				return true
 			})
@@ -138,7 +154,10 @@ func (p *UDPProxy) doProxy(lis *net.UDPConn, item *plugin.PluginMeta) {
 	for {
 		nr, raddr, err := lis.ReadFromUDP(buf)
 		if err != nil {
-			logs.Error("read from udp fail: %v", err)
+			if ctx.Err() == nil {
+				logs.Error("read from udp fail: %v", err)
+				proxy.SetHealth(fmt.Errorf("listener %s closed: %v", item.From, err))
+			}
 			break
 		}
 
@@ -160,7 +179,8 @@ func (p *UDPProxy) doProxy(lis *net.UDPConn, item *plugin.PluginMeta) {
 			sessionTimeout.Store(key, time.Now())
 
 			// read from $to address and write to $from address
-			go p.udpCopy(lis, backendConn, raddr)
+			proxy.ConnOpen()
+			go p.udpCopy(lis, backendConn, raddr, &proxy.Counter)
 		}
 
 		val, ok = sess.Load(key)
@@ -171,11 +191,13 @@ func (p *UDPProxy) doProxy(lis *net.UDPConn, item *plugin.PluginMeta) {
 		sessionTimeout.Store(key, time.Now())
 		// read from $from address and write to $to address
 		val.(*net.UDPConn).Write(buf[:nr])
+		proxy.AddIn(int64(nr))
 	}
 }
 
-func (p *UDPProxy) udpCopy(dst, src *net.UDPConn, toaddr *net.UDPAddr) {
+func (p *UDPProxy) udpCopy(dst, src *net.UDPConn, toaddr *net.UDPAddr, counter *plugin.Counter) {
 	defer src.Close()
+	defer counter.ConnClose()
 	buf := make([]byte, 64*1024)
 	for {
 		nr, _, err := src.ReadFromUDP(buf)
@@ -189,5 +211,6 @@ func (p *UDPProxy) udpCopy(dst, src *net.UDPConn, toaddr *net.UDPAddr) {
 			logs.Error("write to udp fail: %v", err)
 			break
 		}
+		counter.AddOut(int64(nr))
 	}
 }
@@ -0,0 +1,213 @@
+package plugin
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"sync"
+	"sync/atomic"
+)
+
+// IPluginV2 defines context based plugin interface
+// v1 plugins are adapted by FromV1
+type IPluginV2 interface {
+	// Setup calls at the begin of plugin system initialize and
+	// again on configuration reload with the new configuration,
+	// running proxies should keep running after reload
+	Setup(ctx context.Context, cfg json.RawMessage) error
+
+	// RunProxy runs a proxy, it may be called by client's connection established.
+	// ctx is done when the proxy is deleted, the returned proxy is closed too
+	RunProxy(ctx context.Context, item *PluginMeta) (Proxy, error)
+}
+
+// Proxy is a running proxy returned by IPluginV2.RunProxy
+type Proxy interface {
+	// Tuple returns real proxy address
+	Tuple() *ProxyTuple
+
+	// Close stops the proxy, it is safe to call more than once
+	Close() error
+
+	// Stats returns traffic of the proxy
+	Stats() Stats
+
+	// Health returns nil if the proxy works
+	Health() error
+}
+
+// Stats defines traffic of a proxy
+type Stats struct {
+	// Conns specific active connections or sessions
+	Conns int64 `json:"conns"`
+
+	// TotalConns specific connections or sessions since started
+	TotalConns int64 `json:"totalConns"`
+
+	// BytesIn specific bytes from visitors to the client
+	BytesIn int64 `json:"bytesIn"`
+
+	// BytesOut specific bytes from the client to visitors
+	BytesOut int64 `json:"bytesOut"`
+}
+
+// Counter counts traffic of a proxy, it is safe for concurrent use
+type Counter struct {
+	conns      int64
+	totalConns int64
+	bytesIn    int64
+	bytesOut   int64
+}
+
+// ConnOpen counts a new connection
+func (c *Counter) ConnOpen() {
+	atomic.AddInt64(&c.conns, 1)
+	atomic.AddInt64(&c.totalConns, 1)
+}
+
+// ConnClose counts a closed connection
+func (c *Counter) ConnClose() {
+	atomic.AddInt64(&c.conns, -1)
+}
+
+// AddIn counts bytes from visitors to the client
+func (c *Counter) AddIn(n int64) {
+	atomic.AddInt64(&c.bytesIn, n)
+}
+
+// AddOut counts bytes from the client to visitors
+func (c *Counter) AddOut(n int64) {
+	atomic.AddInt64(&c.bytesOut, n)
+}
+
+// InWriter returns a writer counts bytes written to w as BytesIn
+func (c *Counter) InWriter(w io.Writer) io.Writer {
+	return &countWriter{w: w, n: &c.bytesIn}
+}
+
+// OutWriter returns a writer counts bytes written to w as BytesOut
+func (c *Counter) OutWriter(w io.Writer) io.Writer {
+	return &countWriter{w: w, n: &c.bytesOut}
+}
+
+func (c *Counter) Stats() Stats {
+	return Stats{
+		Conns:      atomic.LoadInt64(&c.conns),
+		TotalConns: atomic.LoadInt64(&c.totalConns),
+		BytesIn:    atomic.LoadInt64(&c.bytesIn),
+		BytesOut:   atomic.LoadInt64(&c.bytesOut),
+	}
+}
+
+type countWriter struct {
+	w io.Writer
+	n *int64
+}
+
+func (w *countWriter) Write(b []byte) (int, error) {
+	n, err := w.w.Write(b)
+	atomic.AddInt64(w.n, int64(n))
+	return n, err
+}
+
+// BasicProxy implements Proxy by a close function
+// plugins count traffic by its Counter and report health by SetHealth
+type BasicProxy struct {
+	// Counter is the first field for 64-bit atomic alignment
+	Counter
+
+	tuple *ProxyTuple
+
+	closeOnce sync.Once
+	closeFn   func() error
+	closeErr  error
+
+	mu     sync.Mutex
+	health error
+}
+
+// NewProxy returns a proxy of tuple, close is called once by Close
+// close may be nil
+func NewProxy(tuple *ProxyTuple, close func() error) *BasicProxy {
+	return &BasicProxy{
+		tuple:   tuple,
+		closeFn: close,
+	}
+}
+
+func (p *BasicProxy) Tuple() *ProxyTuple {
+	return p.tuple
+}
+
+func (p *BasicProxy) Close() error {
+	p.closeOnce.Do(func() {
+		if p.closeFn != nil {
+			p.closeErr = p.closeFn()
+		}
+	})
+	return p.closeErr
+}
+
+func (p *BasicProxy) Health() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.health
+}
+
+// SetHealth sets the health error, nil means healthy
+func (p *BasicProxy) SetHealth(err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.health = err
+}
+
+// FromV1 adapts v1 plugin to IPluginV2.
+// Proxies of v1 plugins have no stats and are always healthy,
+// Close calls StopProxy.
+func FromV1(p IPlugin) IPluginV2 {
+	return &v1Adapter{p: p}
+}
+
+type v1Adapter struct {
+	p IPlugin
+}
+
+func (a *v1Adapter) Setup(ctx context.Context, cfg json.RawMessage) error {
+	return a.p.Setup(cfg)
+}
+
+func (a *v1Adapter) RunProxy(ctx context.Context, item *PluginMeta) (Proxy, error) {
+	tuple, err := a.p.RunProxy(item)
+	if err != nil {
+		return nil, err
+	}
+
+	return NewProxy(tuple, func() error {
+		a.p.StopProxy(item)
+		return nil
+	}), nil
+}
+
+// Validate forwards to the v1 plugin if it is a Validator
+func (a *v1Adapter) Validate(item *PluginMeta) error {
+	if v, ok := a.p.(Validator); ok {
+		return v.Validate(item)
+	}
+	return nil
+}
+
+// ForwardSchema forwards to the v1 plugin if it is ForwardConfigurable
+func (a *v1Adapter) ForwardSchema() *Schema {
+	if c, ok := a.p.(ForwardConfigurable); ok {
+		return c.ForwardSchema()
+	}
+	return nil
+}
+
+// Schema forwards to the v1 plugin if it is Configurable
+func (a *v1Adapter) Schema() *Schema {
+	if c, ok := a.p.(Configurable); ok {
+		return c.Schema()
+	}
+	return nil
+}
@@ -2,8 +2,15 @@ package opennotrd
 
 import (
 	// plugin import
+	_ "github.com/ICKelin/opennotr/opennotrd/plugin/caddyproxy"
 	_ "github.com/ICKelin/opennotr/opennotrd/plugin/dummy"
+	_ "github.com/ICKelin/opennotr/opennotrd/plugin/haproxy"
+	_ "github.com/ICKelin/opennotr/opennotrd/plugin/hook"
+	_ "github.com/ICKelin/opennotr/opennotrd/plugin/httpproxy"
+	_ "github.com/ICKelin/opennotr/opennotrd/plugin/nginxproxy"
 	_ "github.com/ICKelin/opennotr/opennotrd/plugin/restyproxy"
+	_ "github.com/ICKelin/opennotr/opennotrd/plugin/sshproxy"
 	_ "github.com/ICKelin/opennotr/opennotrd/plugin/tcpproxy"
+	_ "github.com/ICKelin/opennotr/opennotrd/plugin/tlsproxy"
 	_ "github.com/ICKelin/opennotr/opennotrd/plugin/udpproxy"
 )
@@ -3,19 +3,34 @@ package opennotrd
 import (
 	"flag"
 	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
 
 	"github.com/ICKelin/opennotr/internal/logs"
+	"github.com/ICKelin/opennotr/opennotrd/admin"
+	"github.com/ICKelin/opennotr/opennotrd/certs"
 	"github.com/ICKelin/opennotr/opennotrd/core"
 	"github.com/ICKelin/opennotr/opennotrd/plugin"
+	"github.com/ICKelin/opennotr/opennotrd/plugin/external"
 )
 
 func Run() {
 	confpath := flag.String("conf", "", "config file path")
+	checkConfig := flag.Bool("check-config", false, "validate config file including plugins and exit")
 	flag.Parse()
 
 	cfg, err := core.ParseConfig(*confpath)
 	if err != nil {
 		fmt.Println(err)
+		if *checkConfig {
+			os.Exit(1)
+		}
+		return
+	}
+
+	if *checkConfig {
+		check(cfg)
 		return
 	}
 
@@ -30,6 +45,15 @@ func Run() {
 		return
 	}
 
+	// external plugins register their protocols before setup
+	if len(cfg.ExternalPlugins.Dir) > 0 {
+		err = external.Load(cfg.ExternalPlugins)
+		if err != nil {
+			logs.Error("load external plugins fail: %v", err)
+			return
+		}
+	}
+
 	// setup all plugin base on plugin json configuration
 	err = plugin.Setup(cfg.Plugins)
 	if err != nil {
@@ -37,6 +61,10 @@ func Run() {
 		return
 	}
 
+	// SIGHUP reloads plugin configurations without
+	// restarting running proxies
+	go reloadPlugins(*confpath)
+
 	// initial resolver
 	// currently resolver use coredns and etcd
 	// our resolver just write DOMAIN => VIP record to etcd
@@ -49,6 +77,41 @@ func Run() {
 		}
 	}
 
+	// certificate store serves our own certificates
+	// it takes precedence over acme
+	if len(cfg.CertStoreConfig.Dir) > 0 {
+		store, err := certs.NewStore(cfg.CertStoreConfig)
+		if err != nil {
+			logs.Error("new certificate store fail: %v", err)
+			return
+		}
+		certs.Register(store)
+		go store.Run()
+	}
+
+	// acme obtains certificates for client domains
+	// and wildcard certificates by dns-01 via resolver
+	if cfg.ACMEConfig.Enable {
+		var txt certs.TXTWriter
+		if resolver != nil {
+			txt = resolver
+		}
+
+		m, err := certs.NewACME(cfg.ACMEConfig, txt)
+		if err != nil {
+			logs.Error("new acme fail: %v", err)
+			return
+		}
+		certs.Register(m)
+		go m.Run()
+	}
+
+	if len(cfg.AdminConfig.Listen) > 0 {
+		go func() {
+			logs.Error("admin api exit: %v", admin.ListenAndServe(cfg.AdminConfig))
+		}()
+	}
+
 	// up local tcp,udp service
 	// we use tproxy to route traffic to the tcp port and udp port here.
 	tcpfw := core.NewTCPForward(cfg.TCPForwardConfig)
@@ -69,6 +132,62 @@ func Run() {
 	go udpfw.Serve(lconn)
 
 	// server provides tcp server for opennotr client
-	s := core.NewServer(cfg.ServerConfig, dhcp, resolver)
+	s, err := core.NewServer(cfg.ServerConfig, dhcp, resolver)
+	if err != nil {
+		logs.Error("new server fail: %v", err)
+		return
+	}
 	fmt.Println(s.ListenAndServe())
 }
+
+// check validates cfg without listening any ports and exits 1 if invalid
+func check(cfg *core.Config) {
+	err := validate(cfg)
+	if err == nil {
+		fmt.Println("configuration is ok")
+		return
+	}
+
+	if ce, ok := err.(*plugin.ConfigError); ok {
+		for _, e := range ce.Errors {
+			fmt.Println(e)
+		}
+	} else {
+		fmt.Println(err)
+	}
+	os.Exit(1)
+}
+
+// validate validates cfg, external plugins are started to
+// validate their protocols and stopped before it returns
+func validate(cfg *core.Config) error {
+	if len(cfg.ExternalPlugins.Dir) > 0 {
+		err := external.Load(cfg.ExternalPlugins)
+		defer external.Shutdown()
+		if err != nil {
+			return fmt.Errorf("externalPlugins: %v", err)
+		}
+	}
+	return cfg.Check()
+}
+
+// reloadPlugins setups plugins with the configuration of confpath
+// every time SIGHUP is received
+func reloadPlugins(confpath string) {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGHUP)
+	for range sig {
+		cfg, err := core.ParseConfig(confpath)
+		if err != nil {
+			logs.Error("reload config fail: %v", err)
+			continue
+		}
+
+		err = plugin.Reload(cfg.Plugins)
+		if err != nil {
+			logs.Error("reload plugin fail: %v", err)
+			continue
+		}
+		logs.Info("reload plugin success")
+	}
+}